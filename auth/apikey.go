@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// apiKeyPrefix starts every API key, so keys are easy to tell apart from
+// JWTs and to spot in leaked text.
+const apiKeyPrefix = "ttk_"
+
+// NewAPIKey generates a key for subject. It returns the key to hand out,
+// which is never stored, and the record to store, which only holds its hash.
+func NewAPIKey(subject string, roles []Role, wallets []string) (string, *store.APIKey, error) {
+	id := make([]byte, 8)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+
+	k := &store.APIKey{
+		ID:      hex.EncodeToString(id),
+		Hash:    hashSecret(hex.EncodeToString(secret)),
+		Subject: subject,
+		Roles:   []string{},
+		Wallets: append([]string{}, wallets...),
+	}
+	for _, r := range roles {
+		k.Roles = append(k.Roles, string(r))
+	}
+	return apiKeyPrefix + k.ID + "_" + hex.EncodeToString(secret), k, nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyStore is where APIKeys looks keys up.
+type APIKeyStore interface {
+	GetAPIKey(ctx context.Context, id string) (*store.APIKey, error)
+}
+
+type apiKeys struct {
+	store APIKeyStore
+}
+
+// APIKeys returns an Authenticator accepting the keys made by NewAPIKey and
+// kept in s, until they are revoked.
+func APIKeys(s APIKeyStore) Authenticator {
+	return &apiKeys{store: s}
+}
+
+func (a *apiKeys) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	rest, ok := strings.CutPrefix(token, apiKeyPrefix)
+	if !ok {
+		return nil, errNotMine
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed api key", ErrInvalidCredentials)
+	}
+
+	k, err := a.store.GetAPIKey(ctx, id)
+	if errors.Is(err, store.ErrAPIKeyNotFound) {
+		return nil, fmt.Errorf("%w: unknown api key", ErrInvalidCredentials)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.Hash)) != 1 {
+		return nil, fmt.Errorf("%w: wrong api key secret", ErrInvalidCredentials)
+	}
+	if k.Revoked() {
+		return nil, fmt.Errorf("%w: api key revoked", ErrInvalidCredentials)
+	}
+
+	p := &Principal{Subject: k.Subject, Wallets: append([]string{}, k.Wallets...)}
+	for _, r := range k.Roles {
+		p.Roles = append(p.Roles, Role(r))
+	}
+	return p, nil
+}
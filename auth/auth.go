@@ -0,0 +1,302 @@
+// Package auth identifies who is calling the API and what they may do.
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql/handler/transport"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// Role is what a caller may do. Roles are ranked, each one granting
+// everything the roles before it do.
+type Role string
+
+const (
+	// RoleViewer may read what is not public.
+	RoleViewer Role = "viewer"
+	// RoleUser may act for the wallets it owns.
+	RoleUser Role = "user"
+	// RoleOperator may look after the running service.
+	RoleOperator Role = "operator"
+	// RoleIssuer may register tokens and change their supply.
+	RoleIssuer Role = "issuer"
+	// RoleAdmin may do anything, including listing every wallet.
+	RoleAdmin Role = "admin"
+)
+
+// Roles lists every role, lowest ranked first.
+var Roles = []Role{RoleViewer, RoleUser, RoleOperator, RoleIssuer, RoleAdmin}
+
+// rank returns the position of r in Roles, or -1 for a role the API does
+// not know, which grants nothing.
+func (r Role) rank() int {
+	for i, known := range Roles {
+		if r == known {
+			return i
+		}
+	}
+	return -1
+}
+
+// ParseRole returns the role named s.
+func ParseRole(s string) (Role, error) {
+	r := Role(s)
+	if r.rank() < 0 {
+		return "", fmt.Errorf("unknown role %q", s)
+	}
+	return r, nil
+}
+
+var (
+	// ErrUnauthenticated is returned when a request needs a caller but came
+	// without credentials.
+	ErrUnauthenticated = errors.New("unauthenticated")
+
+	// ErrForbidden is returned when the caller lacks a required role, or is
+	// not authorized for the wallet it acts on.
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrInvalidCredentials is returned by an Authenticator for credentials
+	// it recognizes but does not accept: a wrong secret, a bad signature, an
+	// expired token or a revoked key.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// errNotMine is returned by an Authenticator for credentials of a kind
+	// it does not handle, so the next one can try.
+	errNotMine = errors.New("credentials of another kind")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	Subject string
+	Roles   []Role
+
+	// Wallets are the addresses the caller may move funds out of.
+	Wallets []string
+}
+
+// HasRole reports whether the caller holds role, or a role ranked above
+// it.
+func (p *Principal) HasRole(role Role) bool {
+	if p == nil || role.rank() < 0 {
+		return false
+	}
+	for _, r := range p.Roles {
+		if r.rank() >= role.rank() {
+			return true
+		}
+	}
+	return false
+}
+
+// Owns reports whether the caller may act for the wallet at address, however
+// the address is spelled.
+func (p *Principal) Owns(address string) bool {
+	if p == nil {
+		return false
+	}
+	address = canonicalAddress(address)
+	for _, w := range p.Wallets {
+		if canonicalAddress(w) == address {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalAddress returns s in the lowercase form stores keep addresses in,
+// or s itself if it is not an address.
+func canonicalAddress(s string) string {
+	if a, err := store.ParseAddress(s); err == nil {
+		return a.String()
+	}
+	return s
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the caller of the request, or nil for anonymous
+// requests.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// DeniedError is returned when the caller may not do what it asked. It
+// matches ErrUnauthenticated for anonymous callers and ErrForbidden for
+// everyone else.
+type DeniedError struct {
+	// Role is the role that was required, if any.
+	Role Role
+	// Wallet is the address the caller had to own, if any.
+	Wallet string
+	// Anonymous is set when the request carried no credentials.
+	Anonymous bool
+}
+
+func (e *DeniedError) Error() string {
+	var msg string
+	if e.Anonymous {
+		msg = ErrUnauthenticated.Error()
+	} else {
+		msg = ErrForbidden.Error()
+	}
+	if e.Role != "" {
+		msg += ": requires the " + string(e.Role) + " role"
+	}
+	if e.Wallet != "" {
+		msg += ": requires owning wallet " + e.Wallet
+	}
+	return msg
+}
+
+func (e *DeniedError) Unwrap() error {
+	if e.Anonymous {
+		return ErrUnauthenticated
+	}
+	return ErrForbidden
+}
+
+// RequireRole returns a *DeniedError unless the caller has role.
+func RequireRole(ctx context.Context, role Role) error {
+	p := FromContext(ctx)
+	if !p.HasRole(role) {
+		return &DeniedError{Role: role, Anonymous: p == nil}
+	}
+	return nil
+}
+
+// RequireWallet returns a *DeniedError unless the caller may act for the
+// wallet at address.
+func RequireWallet(ctx context.Context, address string) error {
+	p := FromContext(ctx)
+	if !p.Owns(address) {
+		return &DeniedError{Wallet: address, Anonymous: p == nil}
+	}
+	return nil
+}
+
+// Authenticator identifies the caller presenting a bearer token.
+type Authenticator interface {
+	// Authenticate returns the caller token belongs to. It fails with
+	// ErrInvalidCredentials for a token it will not accept, and with
+	// errNotMine for a token it does not handle at all.
+	Authenticate(ctx context.Context, token string) (*Principal, error)
+}
+
+// Middleware identifies the caller of every request by its bearer token,
+// trying each authenticator in turn. Requests without a token pass through
+// anonymously; requests with a token nobody accepts are refused with 401.
+func Middleware(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := bearerToken(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p, err := authenticate(r.Context(), authenticators, token)
+			if err != nil {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					log.Printf("authentication failed: %v", err)
+				}
+				unauthorized(w)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+		})
+	}
+}
+
+// WebsocketInit identifies the caller of a websocket connection by the bearer
+// token in the Authorization field of its init payload, since browsers cannot
+// set headers on websocket requests. Without one, the caller is whoever
+// Middleware found on the upgrade request; a token nobody accepts closes the
+// connection.
+func WebsocketInit(authenticators ...Authenticator) transport.WebsocketInitFunc {
+	return func(ctx context.Context, payload transport.InitPayload) (context.Context, *transport.InitPayload, error) {
+		token, ok := parseBearer(payload.Authorization())
+		if !ok {
+			return ctx, &payload, nil
+		}
+
+		p, err := authenticate(ctx, authenticators, token)
+		if err != nil {
+			if !errors.Is(err, ErrInvalidCredentials) {
+				log.Printf("authentication failed: %v", err)
+			}
+			return ctx, nil, ErrInvalidCredentials
+		}
+		return WithPrincipal(ctx, p), &payload, nil
+	}
+}
+
+func authenticate(ctx context.Context, authenticators []Authenticator, token string) (*Principal, error) {
+	for _, a := range authenticators {
+		p, err := a.Authenticate(ctx, token)
+		if errors.Is(err, errNotMine) {
+			continue
+		}
+		return p, err
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// unauthorized answers like the GraphQL endpoint would, so clients handle a
+// rejected token the same way as any other error.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"errors": []map[string]any{{
+			"message":    ErrInvalidCredentials.Error(),
+			"extensions": map[string]any{"code": "UNAUTHENTICATED"},
+		}},
+	})
+}
+
+// staticKey accepts a single fixed key.
+type staticKey struct {
+	key       string
+	principal Principal
+}
+
+// StaticKey returns an Authenticator accepting key, and only key, as p.
+func StaticKey(key string, p Principal) Authenticator {
+	return &staticKey{key: key, principal: p}
+}
+
+func (a *staticKey) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.key)) != 1 {
+		return nil, errNotMine
+	}
+	p := a.principal
+	return &p, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	return parseBearer(r.Header.Get("Authorization"))
+}
+
+// parseBearer returns the token of an Authorization value "Bearer <token>".
+func parseBearer(header string) (string, bool) {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
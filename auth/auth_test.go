@@ -0,0 +1,335 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+var hs256Secret = []byte(strings.Repeat("s", minHS256SecretLen))
+
+// addr returns the i-th test address.
+func addr(i int) string {
+	return fmt.Sprintf("0x%040x", i)
+}
+
+// signJWT returns a token of claims signed with alg, using key as the HMAC
+// secret for HS256 and as the private key for EdDSA.
+func signJWT(t *testing.T, alg string, key any, claims map[string]any) string {
+	t.Helper()
+	enc := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal error: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := enc(map[string]string{"alg": alg, "typ": "JWT"}) + "." + enc(claims)
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "EdDSA":
+		sig = ed25519.Sign(key.(ed25519.PrivateKey), []byte(signed))
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWT(t *testing.T) {
+	ctx := context.Background()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	a, err := JWT(JWTConfig{HS256Secret: hs256Secret, EdDSAKey: pub, Audience: "tokentransfer"})
+	if err != nil {
+		t.Fatalf("JWT error: %v", err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	claims := map[string]any{"sub": "alice", "exp": exp, "aud": "tokentransfer", "roles": []string{"issuer"}, "wallets": []string{addr(1)}}
+
+	for _, alg := range []string{"HS256", "EdDSA"} {
+		key := any(hs256Secret)
+		if alg == "EdDSA" {
+			key = priv
+		}
+		p, err := a.Authenticate(ctx, signJWT(t, alg, key, claims))
+		if err != nil {
+			t.Fatalf("%s: Authenticate error: %v", alg, err)
+		}
+		if p.Subject != "alice" || !p.HasRole(RoleIssuer) || !p.Owns(addr(1)) || p.Owns(addr(2)) {
+			t.Errorf("%s: Unexpected principal: %+v", alg, p)
+		}
+	}
+
+	with := func(key string, value any) map[string]any {
+		c := map[string]any{}
+		for k, v := range claims {
+			c[k] = v
+		}
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	rejected := map[string]string{
+		"wrong secret":       signJWT(t, "HS256", []byte(strings.Repeat("x", minHS256SecretLen)), claims),
+		"wrong key":          signJWT(t, "EdDSA", otherPriv, claims),
+		"alg none":           signJWT(t, "none", nil, claims),
+		"public key as HMAC": signJWT(t, "HS256", []byte(pub), claims),
+		"expired":            signJWT(t, "HS256", hs256Secret, with("exp", time.Now().Add(-time.Minute).Unix())),
+		"no exp":             signJWT(t, "HS256", hs256Secret, with("exp", nil)),
+		"no sub":             signJWT(t, "HS256", hs256Secret, with("sub", nil)),
+		"not yet valid":      signJWT(t, "HS256", hs256Secret, with("nbf", time.Now().Add(time.Hour).Unix())),
+		"other audience":     signJWT(t, "HS256", hs256Secret, with("aud", []string{"elsewhere"})),
+		"tampered":           signJWT(t, "HS256", hs256Secret, claims) + "x",
+	}
+	for name, token := range rejected {
+		if _, err := a.Authenticate(ctx, token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: Expected ErrInvalidCredentials, got: %v", name, err)
+		}
+	}
+
+	if _, err := JWT(JWTConfig{HS256Secret: []byte("short")}); err == nil {
+		t.Errorf("Expected a short HS256 secret to be refused")
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewInMemWalletStore()
+	a := APIKeys(s)
+
+	key, k, err := NewAPIKey("alice", []Role{RoleIssuer}, []string{addr(1)})
+	if err != nil {
+		t.Fatalf("NewAPIKey error: %v", err)
+	}
+	if strings.Contains(k.Hash, strings.TrimPrefix(key, apiKeyPrefix+k.ID+"_")) {
+		t.Fatalf("Expected only a hash of the secret to be stored")
+	}
+	if err := s.CreateAPIKey(ctx, k); err != nil {
+		t.Fatalf("CreateAPIKey error: %v", err)
+	}
+
+	p, err := a.Authenticate(ctx, key)
+	if err != nil {
+		t.Fatalf("Authenticate error: %v", err)
+	}
+	if p.Subject != "alice" || !p.HasRole(RoleIssuer) || !p.Owns(addr(1)) {
+		t.Errorf("Unexpected principal: %+v", p)
+	}
+
+	wrong := "0"
+	if strings.HasSuffix(key, wrong) {
+		wrong = "1"
+	}
+	for name, token := range map[string]string{
+		"wrong secret": key[:len(key)-1] + wrong,
+		"unknown id":   apiKeyPrefix + "0000000000000000_" + strings.Repeat("0", 64),
+		"malformed":    apiKeyPrefix + "nosecret",
+	} {
+		if _, err := a.Authenticate(ctx, token); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("%s: Expected ErrInvalidCredentials, got: %v", name, err)
+		}
+	}
+
+	if _, err := s.RevokeAPIKey(ctx, k.ID); err != nil {
+		t.Fatalf("RevokeAPIKey error: %v", err)
+	}
+	if _, err := a.Authenticate(ctx, key); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Revoked key: Expected ErrInvalidCredentials, got: %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var seen *Principal
+	h := Middleware(StaticKey("issuer-key", Principal{Subject: "issuer", Roles: []Role{RoleIssuer}}))(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = FromContext(r.Context())
+		}),
+	)
+	serve := func(header string) int {
+		seen = nil
+		r := httptest.NewRequest(http.MethodPost, "/graphql", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(""); code != http.StatusOK || seen != nil {
+		t.Errorf("No token: Expected an anonymous request, got: %d %+v", code, seen)
+	}
+	if code := serve("Bearer issuer-key"); code != http.StatusOK || !seen.HasRole(RoleIssuer) {
+		t.Errorf("Issuer key: Expected the issuer, got: %d %+v", code, seen)
+	}
+	if code := serve("Bearer wrong"); code != http.StatusUnauthorized || seen != nil {
+		t.Errorf("Unknown token: Expected 401, got: %d %+v", code, seen)
+	}
+
+	ctx := context.Background()
+	if err := RequireWallet(ctx, addr(1)); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("Anonymous: Expected ErrUnauthenticated, got: %v", err)
+	}
+	ctx = WithPrincipal(ctx, &Principal{Subject: "alice", Wallets: []string{addr(1)}})
+	if err := RequireWallet(ctx, addr(1)); err != nil {
+		t.Errorf("Owner: Expected no error, got: %v", err)
+	}
+	var denied *DeniedError
+	if err := RequireWallet(ctx, addr(2)); !errors.Is(err, ErrForbidden) || !errors.As(err, &denied) || denied.Wallet != addr(2) {
+		t.Errorf("Other wallet: Expected ErrForbidden for %s, got: %v", addr(2), err)
+	}
+	ctx = WithPrincipal(ctx, &Principal{Subject: "bob", Wallets: []string{"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"}})
+	if err := RequireWallet(ctx, "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beaed"); err != nil {
+		t.Errorf("Owner in lowercase: Expected no error, got: %v", err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	issuer := &Principal{Subject: "treasury", Roles: []Role{RoleIssuer}}
+	for _, r := range Roles {
+		if want := r != RoleAdmin; issuer.HasRole(r) != want {
+			t.Errorf("Issuer HasRole(%s): Expected %v", r, want)
+		}
+	}
+	if (&Principal{Roles: []Role{"root"}}).HasRole(RoleViewer) {
+		t.Errorf("Expected an unknown role to grant nothing")
+	}
+	if _, err := ParseRole("root"); err == nil {
+		t.Errorf("Expected ParseRole to refuse an unknown role")
+	}
+
+	ctx := context.Background()
+	var denied *DeniedError
+	if err := RequireRole(ctx, RoleViewer); !errors.Is(err, ErrUnauthenticated) || !errors.As(err, &denied) || denied.Role != RoleViewer {
+		t.Errorf("Anonymous: Expected ErrUnauthenticated for viewer, got: %v", err)
+	}
+	ctx = WithPrincipal(ctx, issuer)
+	if err := RequireRole(ctx, RoleUser); err != nil {
+		t.Errorf("Issuer as user: Expected no error, got: %v", err)
+	}
+	if err := RequireRole(ctx, RoleAdmin); !errors.Is(err, ErrForbidden) || !errors.As(err, &denied) || denied.Role != RoleAdmin {
+		t.Errorf("Issuer as admin: Expected ErrForbidden for admin, got: %v", err)
+	}
+}
+
+func TestTransferSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	intent := TransferIntent{
+		Domain: "test",
+		From:   addr(1),
+		Token:  "BTP",
+		Legs:   []store.TransferOp{{To: addr(2), Amount: big.NewInt(5)}, {To: addr(3), Amount: big.NewInt(2)}},
+		Nonce:  7,
+	}
+	sig := SignTransfer(priv, intent)
+	if err := VerifyTransfer(pub, intent, sig); err != nil {
+		t.Fatalf("VerifyTransfer error: %v", err)
+	}
+
+	changed := map[string]func(*TransferIntent){
+		"domain": func(i *TransferIntent) { i.Domain = "other" },
+		"from":   func(i *TransferIntent) { i.From = addr(9) },
+		"token":  func(i *TransferIntent) { i.Token = "USDX" },
+		"nonce":  func(i *TransferIntent) { i.Nonce = 8 },
+		"amount": func(i *TransferIntent) { i.Legs = []store.TransferOp{{To: addr(2), Amount: big.NewInt(50)}, i.Legs[1]} },
+		"legs":   func(i *TransferIntent) { i.Legs = i.Legs[:1] },
+		// Moving bytes between neighbouring fields keeps their
+		// concatenation, but not their encoding.
+		"split": func(i *TransferIntent) { i.Domain, i.From = "test0", intent.From[1:] },
+	}
+	for name, change := range changed {
+		other := intent
+		change(&other)
+		if err := VerifyTransfer(pub, other, sig); !errors.Is(err, store.ErrInvalidSignature) {
+			t.Errorf("Changed %s: Expected ErrInvalidSignature, got: %v", name, err)
+		}
+	}
+	respelled := intent
+	respelled.From = "0x" + strings.ToUpper(intent.From[2:])
+	if err := VerifyTransfer(pub, respelled, sig); err != nil {
+		t.Errorf("Sender in uppercase: Expected no error, got: %v", err)
+	}
+	if err := VerifyTransfer(nil, intent, sig); !errors.Is(err, store.ErrInvalidSignature) {
+		t.Errorf("No key: Expected ErrInvalidSignature, got: %v", err)
+	}
+
+	if _, err := ParseSignature("abcd"); !errors.Is(err, store.ErrInvalidSignature) {
+		t.Errorf("Short signature: Expected ErrInvalidSignature, got: %v", err)
+	}
+	if _, err := ParseWalletKey("zz"); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Malformed key: Expected ErrInvalidArgument, got: %v", err)
+	}
+}
+
+func TestApprovalSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	intent := ApprovalIntent{
+		Domain:  "test",
+		Owner:   addr(1),
+		Spender: addr(2),
+		Token:   "BTP",
+		Amount:  big.NewInt(30),
+		Nonce:   3,
+	}
+	sig := SignApproval(priv, intent)
+	if err := VerifyApproval(pub, intent, sig); err != nil {
+		t.Fatalf("VerifyApproval error: %v", err)
+	}
+
+	changed := map[string]func(*ApprovalIntent){
+		"owner":   func(a *ApprovalIntent) { a.Owner = addr(9) },
+		"spender": func(a *ApprovalIntent) { a.Spender = addr(9) },
+		"amount":  func(a *ApprovalIntent) { a.Amount = big.NewInt(300) },
+		"nonce":   func(a *ApprovalIntent) { a.Nonce = 4 },
+	}
+	for name, change := range changed {
+		other := intent
+		change(&other)
+		if err := VerifyApproval(pub, other, sig); !errors.Is(err, store.ErrInvalidSignature) {
+			t.Errorf("Changed %s: Expected ErrInvalidSignature, got: %v", name, err)
+		}
+	}
+
+	// A signed approval is no signed transfer, even of the same amount to
+	// the same wallet.
+	transfer := TransferIntent{
+		Domain: "test",
+		From:   addr(1),
+		Token:  "BTP",
+		Legs:   []store.TransferOp{{To: addr(2), Amount: big.NewInt(30)}},
+		Nonce:  3,
+	}
+	if err := VerifyTransfer(pub, transfer, sig); !errors.Is(err, store.ErrInvalidSignature) {
+		t.Errorf("Approval as transfer: Expected ErrInvalidSignature, got: %v", err)
+	}
+}
@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// minHS256SecretLen is the shortest HS256 secret accepted, as long as the
+// hash itself; shorter secrets can be brute-forced from a single token.
+const minHS256SecretLen = 32
+
+// JWTConfig says which JSON Web Tokens the API accepts. At least one of
+// HS256Secret and EdDSAKey must be set; a token is only accepted with the
+// algorithm whose key is configured.
+type JWTConfig struct {
+	HS256Secret []byte
+	EdDSAKey    ed25519.PublicKey
+
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+
+	// Leeway allows for clocks drifting apart when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// jwtClaims are the claims the API reads. exp and sub are required.
+//
+//	{"sub": "alice", "exp": 1767225600, "roles": ["issuer"], "wallets": ["0x..."]}
+type jwtClaims struct {
+	Subject   string       `json:"sub"`
+	Issuer    string       `json:"iss"`
+	Audience  jwtAudience  `json:"aud"`
+	ExpiresAt *json.Number `json:"exp"`
+	NotBefore *json.Number `json:"nbf"`
+	Roles     []string     `json:"roles"`
+	Wallets   []string     `json:"wallets"`
+}
+
+// jwtAudience is the aud claim, which is either a string or an array of
+// them.
+type jwtAudience []string
+
+func (a *jwtAudience) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*a = jwtAudience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return errors.New("aud must be a string or an array of strings")
+	}
+	*a = many
+	return nil
+}
+
+type jwtVerifier struct {
+	cfg JWTConfig
+	now func() time.Time
+}
+
+// JWT returns an Authenticator accepting the JSON Web Tokens cfg allows.
+func JWT(cfg JWTConfig) (Authenticator, error) {
+	if cfg.HS256Secret == nil && cfg.EdDSAKey == nil {
+		return nil, errors.New("jwt: no key configured")
+	}
+	if cfg.HS256Secret != nil && len(cfg.HS256Secret) < minHS256SecretLen {
+		return nil, fmt.Errorf("jwt: HS256 secret must be at least %d bytes", minHS256SecretLen)
+	}
+	if cfg.EdDSAKey != nil && len(cfg.EdDSAKey) != ed25519.PublicKeySize {
+		return nil, errors.New("jwt: invalid Ed25519 public key")
+	}
+	return &jwtVerifier{cfg: cfg, now: time.Now}, nil
+}
+
+// ParseEd25519PublicKey reads an Ed25519 public key from PEM, as written by
+// openssl pkey -pubout.
+func ParseEd25519PublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("expected a PEM encoded PUBLIC KEY")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 public key, got %T", key)
+	}
+	return edKey, nil
+}
+
+func (v *jwtVerifier) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errNotMine
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed jwt signature", ErrInvalidCredentials)
+	}
+	if !v.verify(header.Alg, parts[0]+"."+parts[1], sig) {
+		return nil, fmt.Errorf("%w: bad jwt signature", ErrInvalidCredentials)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.check(&claims); err != nil {
+		return nil, err
+	}
+
+	p := &Principal{Subject: claims.Subject, Wallets: claims.Wallets}
+	for _, r := range claims.Roles {
+		p.Roles = append(p.Roles, Role(r))
+	}
+	return p, nil
+}
+
+// verify checks sig with the key configured for alg. The algorithm is only
+// used to pick a key, never to decide how the key is used, so a token cannot
+// have an Ed25519 public key taken for an HMAC secret.
+func (v *jwtVerifier) verify(alg, signed string, sig []byte) bool {
+	switch alg {
+	case "HS256":
+		if v.cfg.HS256Secret == nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, v.cfg.HS256Secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(sig, mac.Sum(nil))
+	case "EdDSA":
+		if v.cfg.EdDSAKey == nil {
+			return false
+		}
+		return ed25519.Verify(v.cfg.EdDSAKey, []byte(signed), sig)
+	default:
+		return false
+	}
+}
+
+func (v *jwtVerifier) check(c *jwtClaims) error {
+	now := v.now()
+	if c.Subject == "" {
+		return fmt.Errorf("%w: jwt has no sub", ErrInvalidCredentials)
+	}
+	if c.ExpiresAt == nil {
+		return fmt.Errorf("%w: jwt has no exp", ErrInvalidCredentials)
+	}
+	exp, err := numericDate(*c.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if !now.Before(exp.Add(v.cfg.Leeway)) {
+		return fmt.Errorf("%w: jwt expired", ErrInvalidCredentials)
+	}
+	if c.NotBefore != nil {
+		nbf, err := numericDate(*c.NotBefore)
+		if err != nil {
+			return err
+		}
+		if now.Add(v.cfg.Leeway).Before(nbf) {
+			return fmt.Errorf("%w: jwt not valid yet", ErrInvalidCredentials)
+		}
+	}
+	if v.cfg.Issuer != "" && c.Issuer != v.cfg.Issuer {
+		return fmt.Errorf("%w: jwt issued by %q", ErrInvalidCredentials, c.Issuer)
+	}
+	if v.cfg.Audience != "" && !containsString(c.Audience, v.cfg.Audience) {
+		return fmt.Errorf("%w: jwt not meant for %q", ErrInvalidCredentials, v.cfg.Audience)
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("%w: malformed jwt", ErrInvalidCredentials)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("%w: malformed jwt: %v", ErrInvalidCredentials, err)
+	}
+	return nil
+}
+
+// maxNumericDate is the last NumericDate accepted, in the year 5138; later
+// dates are more likely mistakes than tokens meant to last that long.
+const maxNumericDate = 1e11
+
+// numericDate converts a NumericDate, seconds since the epoch, to a time.
+func numericDate(n json.Number) (time.Time, error) {
+	f, err := n.Float64()
+	if err != nil || f < 0 || f > maxNumericDate {
+		return time.Time{}, fmt.Errorf("%w: malformed jwt date %q", ErrInvalidCredentials, n)
+	}
+	return time.Unix(int64(f), 0), nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// DefaultSigningDomain is the domain transfers are signed for unless the
+// server is configured with another one.
+const DefaultSigningDomain = "tokentransfer"
+
+// transferMessagePrefix and approvalMessagePrefix start every signed message,
+// so a signature over one can never be taken for a signature over anything
+// else.
+const (
+	transferMessagePrefix = "tokentransfer/transfer/v1"
+	approvalMessagePrefix = "tokentransfer/approve/v1"
+)
+
+// TransferIntent is what the key of a wallet signs to send a transfer.
+type TransferIntent struct {
+	// Domain names the deployment the transfer is meant for, like a chain
+	// id, so it cannot be replayed against another one.
+	Domain string
+	From   string
+	Token  string
+	Legs   []store.TransferOp
+	Nonce  uint64
+}
+
+// Message returns the canonical encoding of t, the bytes that are signed.
+// Strings are written as a 4-byte big-endian length followed by their bytes,
+// addresses in lowercase whatever their spelling in t, amounts as decimal
+// strings and numbers as big-endian integers:
+//
+//	"tokentransfer/transfer/v1" domain from token nonce(8) count(4) (to amount)...
+func (t TransferIntent) Message() []byte {
+	var b []byte
+	b = appendString(b, transferMessagePrefix)
+	b = appendString(b, t.Domain)
+	b = appendString(b, canonicalAddress(t.From))
+	b = appendString(b, t.Token)
+	b = binary.BigEndian.AppendUint64(b, t.Nonce)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(t.Legs)))
+	for _, leg := range t.Legs {
+		b = appendString(b, canonicalAddress(leg.To))
+		b = appendString(b, leg.Amount.String())
+	}
+	return b
+}
+
+// SignTransfer signs t with key.
+func SignTransfer(key ed25519.PrivateKey, t TransferIntent) []byte {
+	return ed25519.Sign(key, t.Message())
+}
+
+// VerifyTransfer returns store.ErrInvalidSignature unless sig is the
+// signature of t by key.
+func VerifyTransfer(key ed25519.PublicKey, t TransferIntent, sig []byte) error {
+	return verify(key, t.Message(), sig, t.From)
+}
+
+// ApprovalIntent is what the key of a wallet signs to let a spender move
+// its funds.
+type ApprovalIntent struct {
+	Domain  string
+	Owner   string
+	Spender string
+	Token   string
+	Amount  *big.Int
+	Nonce   uint64
+}
+
+// Message returns the canonical encoding of a, the bytes that are signed,
+// encoded like those of a transfer:
+//
+//	"tokentransfer/approve/v1" domain owner spender token amount nonce(8)
+func (a ApprovalIntent) Message() []byte {
+	var b []byte
+	b = appendString(b, approvalMessagePrefix)
+	b = appendString(b, a.Domain)
+	b = appendString(b, canonicalAddress(a.Owner))
+	b = appendString(b, canonicalAddress(a.Spender))
+	b = appendString(b, a.Token)
+	b = appendString(b, a.Amount.String())
+	return binary.BigEndian.AppendUint64(b, a.Nonce)
+}
+
+// SignApproval signs a with key.
+func SignApproval(key ed25519.PrivateKey, a ApprovalIntent) []byte {
+	return ed25519.Sign(key, a.Message())
+}
+
+// VerifyApproval returns store.ErrInvalidSignature unless sig is the
+// signature of a by key.
+func VerifyApproval(key ed25519.PublicKey, a ApprovalIntent, sig []byte) error {
+	return verify(key, a.Message(), sig, a.Owner)
+}
+
+// appendString appends s to b as a 4-byte big-endian length followed by its
+// bytes.
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// verify checks that sig is the signature of msg by key, the key of the
+// wallet at address.
+func verify(key ed25519.PublicKey, msg, sig []byte, address string) error {
+	if key == nil {
+		return fmt.Errorf("%w: %s has no key registered", store.ErrInvalidSignature, address)
+	}
+	if !ed25519.Verify(key, msg, sig) {
+		return fmt.Errorf("%w: not signed by the key of %s", store.ErrInvalidSignature, address)
+	}
+	return nil
+}
+
+// ParseWalletKey reads an Ed25519 public key written in hex.
+func ParseWalletKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%w: a wallet key is %d bytes in hex", store.ErrInvalidArgument, ed25519.PublicKeySize)
+	}
+	return key, nil
+}
+
+// ParseSignature reads an Ed25519 signature written in hex.
+func ParseSignature(s string) ([]byte, error) {
+	sig, err := hex.DecodeString(s)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("%w: a signature is %d bytes in hex", store.ErrInvalidSignature, ed25519.SignatureSize)
+	}
+	return sig, nil
+}
+
+// ParseEd25519PrivateKey reads an Ed25519 private key from PEM, as written by
+// openssl genpkey -algorithm ed25519.
+func ParseEd25519PrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("expected a PEM encoded PRIVATE KEY")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an Ed25519 private key, got %T", key)
+	}
+	return edKey, nil
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/graph"
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// apiClient sends GraphQL requests to a running server.
+type apiClient struct {
+	url    string
+	apiKey string
+	http   *http.Client
+}
+
+func newAPIClient(url, apiKey string) *apiClient {
+	return &apiClient{url: url, apiKey: apiKey, http: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// errorsByCode maps the codes the API sets in extensions.code back to the
+// errors they were raised for.
+var errorsByCode = map[string]error{
+	graph.CodeWalletNotFound:        store.ErrWalletNotFound,
+	graph.CodeTokenNotFound:         store.ErrTokenNotFound,
+	graph.CodeInsufficientFunds:     store.ErrInsufficientFunds,
+	graph.CodeInsufficientAllowance: store.ErrInsufficientAllowance,
+	graph.CodeInvalidAmount:         store.ErrInvalidAmount,
+	graph.CodeBadUserInput:          store.ErrInvalidArgument,
+	graph.CodeConflict:              store.ErrConflict,
+	graph.CodeInvalidSignature:      store.ErrInvalidSignature,
+	graph.CodeInvalidNonce:          store.ErrInvalidNonce,
+	graph.CodeInvalidAddress:        store.ErrInvalidAddress,
+	graph.CodeUnknownRecipient:      store.ErrUnknownRecipient,
+	graph.CodeRecipientNotOptedIn:   store.ErrRecipientNotOptedIn,
+	graph.CodeUnauthenticated:       auth.ErrUnauthenticated,
+	graph.CodeForbidden:             auth.ErrForbidden,
+}
+
+// apiError is an error returned by the API. It unwraps to the error its code
+// stands for, if any.
+type apiError struct {
+	Message    string `json:"message"`
+	Extensions struct {
+		Code string `json:"code"`
+	} `json:"extensions"`
+}
+
+func (e *apiError) Error() string {
+	if e.Extensions.Code == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Extensions.Code)
+}
+
+func (e *apiError) Unwrap() error {
+	return errorsByCode[e.Extensions.Code]
+}
+
+// do runs a GraphQL operation and decodes its data into out. Only the first
+// error the API returns is reported.
+func (c *apiClient) do(ctx context.Context, query string, variables map[string]any, out any) error {
+	body, err := json.Marshal(map[string]any{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []*apiError     `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response from %s: %s", c.url, resp.Status)
+	}
+	if len(result.Errors) > 0 {
+		return result.Errors[0]
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+// apiAmount decodes a BigInt, which the API sends as a JSON string.
+type apiAmount struct{ n *big.Int }
+
+func (a *apiAmount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return fmt.Errorf("invalid amount %q", s)
+	}
+	a.n = n
+	return nil
+}
+
+const walletFields = `
+    address
+    balance
+    balances { token { symbol name decimals } balance }
+    createdAt
+    updatedAt
+`
+
+type apiWallet struct {
+	Address  string    `json:"address"`
+	Balance  apiAmount `json:"balance"`
+	Balances []struct {
+		Token   generated.Token `json:"token"`
+		Balance apiAmount       `json:"balance"`
+	} `json:"balances"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (w *apiWallet) wallet() *generated.Wallet {
+	out := &generated.Wallet{
+		Address:   w.Address,
+		Balance:   w.Balance.n,
+		Balances:  []*generated.TokenBalance{},
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+	for _, b := range w.Balances {
+		token := b.Token
+		out.Balances = append(out.Balances, &generated.TokenBalance{Token: &token, Balance: b.Balance.n})
+	}
+	return out
+}
+
+func (c *apiClient) GetWallet(ctx context.Context, address string, asOf *time.Time) (*generated.Wallet, error) {
+	var data struct {
+		Wallet *apiWallet `json:"wallet"`
+	}
+	err := c.do(ctx, `query($address: ID!, $asOf: Time) {
+  wallet(address: $address, asOf: $asOf) {`+walletFields+`}
+}`, map[string]any{"address": address, "asOf": asOf}, &data)
+	if err != nil {
+		return nil, err
+	}
+	if data.Wallet == nil {
+		return nil, store.ErrWalletNotFound
+	}
+	return data.Wallet.wallet(), nil
+}
+
+func (c *apiClient) ListWallets(ctx context.Context, q store.WalletQuery) (*generated.WalletConnection, error) {
+	variables := map[string]any{"first": q.First, "asOf": q.AsOf}
+	if q.After != "" {
+		variables["after"] = q.After
+	}
+	if q.OrderBy.Field != "" {
+		variables["orderBy"] = q.OrderBy
+	}
+	filter := map[string]any{}
+	if q.Filter.MinBalance != nil {
+		filter["minBalance"] = q.Filter.MinBalance.String()
+	}
+	if q.Filter.MaxBalance != nil {
+		filter["maxBalance"] = q.Filter.MaxBalance.String()
+	}
+	if q.Filter.CreatedAfter != nil {
+		filter["createdAfter"] = q.Filter.CreatedAfter
+	}
+	if q.Filter.CreatedBefore != nil {
+		filter["createdBefore"] = q.Filter.CreatedBefore
+	}
+	variables["filter"] = filter
+
+	var data struct {
+		Wallets struct {
+			Edges []struct {
+				Cursor string    `json:"cursor"`
+				Node   apiWallet `json:"node"`
+			} `json:"edges"`
+			PageInfo generated.PageInfo `json:"pageInfo"`
+		} `json:"wallets"`
+	}
+	err := c.do(ctx, `query($first: Int, $after: String, $orderBy: WalletOrder, $filter: WalletFilter, $asOf: Time) {
+  wallets(first: $first, after: $after, orderBy: $orderBy, filter: $filter, asOf: $asOf) {
+    edges { cursor node {`+walletFields+`} }
+    pageInfo { hasNextPage hasPreviousPage startCursor endCursor }
+  }
+}`, variables, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &generated.WalletConnection{Edges: []*generated.WalletEdge{}, PageInfo: &data.Wallets.PageInfo}
+	for _, e := range data.Wallets.Edges {
+		conn.Edges = append(conn.Edges, &generated.WalletEdge{Cursor: e.Cursor, Node: e.Node.wallet()})
+	}
+	return conn, nil
+}
+
+func (c *apiClient) CreateWallet(ctx context.Context, address string) (*generated.Wallet, error) {
+	var data struct {
+		CreateWallet apiWallet `json:"createWallet"`
+	}
+	err := c.do(ctx, `mutation($address: ID!) {
+  createWallet(address: $address) {`+walletFields+`}
+}`, map[string]any{"address": address}, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.CreateWallet.wallet(), nil
+}
+
+func (c *apiClient) Mint(ctx context.Context, token, to string, amount *big.Int) (*big.Int, error) {
+	var data struct {
+		Mint apiAmount `json:"mint"`
+	}
+	err := c.do(ctx, `mutation($to: ID!, $amount: BigInt!, $token: String) {
+  mint(to: $to, amount: $amount, token: $token)
+}`, map[string]any{"to": to, "amount": amount.String(), "token": token}, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Mint.n, nil
+}
+
+func (c *apiClient) Transfer(ctx context.Context, from string, ops []store.TransferOp, opts store.TransferOptions, sig []byte) (*big.Int, error) {
+	if opts.Spender != "" {
+		return nil, errors.New("transfers on behalf of another wallet are not supported")
+	}
+
+	transfers := make([]map[string]any, 0, len(ops))
+	for _, op := range ops {
+		transfers = append(transfers, map[string]any{"to_address": op.To, "amount": op.Amount.String()})
+	}
+	variables := map[string]any{"from": from, "transfers": transfers, "token": opts.Token}
+	if opts.IdempotencyKey != "" {
+		variables["idempotencyKey"] = opts.IdempotencyKey
+	}
+	if opts.Nonce != nil {
+		variables["nonce"] = *opts.Nonce
+	}
+	if sig != nil {
+		variables["signature"] = hex.EncodeToString(sig)
+	}
+
+	var data struct {
+		Transfer apiAmount `json:"transfer"`
+	}
+	err := c.do(ctx, `mutation($from: ID!, $transfers: [TransferInput!]!, $idempotencyKey: String, $token: String, $nonce: Int, $signature: String) {
+  transfer(from_address: $from, transfers: $transfers, idempotencyKey: $idempotencyKey, token: $token, nonce: $nonce, signature: $signature)
+}`, variables, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.Transfer.n, nil
+}
+
+// apiWalletKey is the key of a wallet as the API returns it.
+type apiWalletKey struct {
+	Address   string  `json:"address"`
+	PublicKey *string `json:"publicKey"`
+	Nonce     uint64  `json:"nonce"`
+}
+
+func (k *apiWalletKey) key() (*store.WalletKey, error) {
+	out := &store.WalletKey{Address: k.Address, Nonce: k.Nonce}
+	if k.PublicKey != nil {
+		var err error
+		if out.PublicKey, err = auth.ParseWalletKey(*k.PublicKey); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (c *apiClient) WalletKey(ctx context.Context, address string) (*store.WalletKey, error) {
+	var data struct {
+		Wallet *apiWalletKey `json:"wallet"`
+	}
+	err := c.do(ctx, `query($address: ID!) {
+  wallet(address: $address) { address publicKey nonce }
+}`, map[string]any{"address": address}, &data)
+	if err != nil {
+		return nil, err
+	}
+	if data.Wallet == nil {
+		return nil, store.ErrWalletNotFound
+	}
+	return data.Wallet.key()
+}
+
+func (c *apiClient) RegisterWalletKey(ctx context.Context, address string, key ed25519.PublicKey) (*store.WalletKey, error) {
+	var data struct {
+		RegisterWalletKey apiWalletKey `json:"registerWalletKey"`
+	}
+	err := c.do(ctx, `mutation($address: ID!, $publicKey: String!) {
+  registerWalletKey(address: $address, publicKey: $publicKey) { address publicKey nonce }
+}`, map[string]any{"address": address, "publicKey": hex.EncodeToString(key)}, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.RegisterWalletKey.key()
+}
+
+func (c *apiClient) SetAcceptsTransfers(ctx context.Context, address string, accepts bool) (*generated.Wallet, error) {
+	var data struct {
+		SetAcceptsTransfers apiWallet `json:"setAcceptsTransfers"`
+	}
+	err := c.do(ctx, `mutation($address: ID!, $accepts: Boolean!) {
+  setAcceptsTransfers(address: $address, accepts: $accepts) {`+walletFields+`}
+}`, map[string]any{"address": address, "accepts": accepts}, &data)
+	if err != nil {
+		return nil, err
+	}
+	return data.SetAcceptsTransfers.wallet(), nil
+}
+
+func (c *apiClient) SigningDomain(ctx context.Context) (string, error) {
+	var data struct {
+		SigningDomain string `json:"signingDomain"`
+	}
+	if err := c.do(ctx, `query { signingDomain }`, nil, &data); err != nil {
+		return "", err
+	}
+	return data.SigningDomain, nil
+}
+
+func (c *apiClient) Close() {}
+
+// apiURL completes a server address given without a scheme or path.
+func apiURL(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	addr = strings.TrimSuffix(addr, "/")
+	if !strings.HasSuffix(addr, "/graphql") {
+		addr += "/graphql"
+	}
+	return addr
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/zanpatryk/tokentransferapi/auth"
+)
+
+// listFlag collects every value of a flag given more than once.
+type listFlag []string
+
+func (f *listFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// apikeyCreate issues a key for SUBJECT and prints it. Only its hash is
+// stored, so this is the one chance to see it.
+func apikeyCreate(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "apikey create")
+	var roles, wallets listFlag
+	flags.Var(&roles, "role", "role granted to the key (viewer, user, operator, issuer or admin), may be repeated")
+	flags.Var(&wallets, "wallet", "wallet the key may move funds out of, may be repeated")
+	rest, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	st, err := directStore(s)
+	if err != nil {
+		return err
+	}
+
+	keyRoles := make([]auth.Role, len(roles))
+	for i, r := range roles {
+		if keyRoles[i], err = auth.ParseRole(r); err != nil {
+			return fmt.Errorf("%w: %v", errUsage, err)
+		}
+	}
+	secret, k, err := auth.NewAPIKey(rest[0], keyRoles, wallets)
+	if err != nil {
+		return err
+	}
+	if err := st.CreateAPIKey(ctx, k); err != nil {
+		return err
+	}
+	return s.out.apiKeyCreated(viewAPIKey(k), secret)
+}
+
+func apikeyList(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "apikey list")
+	if _, err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	st, err := directStore(s)
+	if err != nil {
+		return err
+	}
+
+	keys, err := st.ListAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	views := make([]apiKeyView, len(keys))
+	for i, k := range keys {
+		views[i] = viewAPIKey(k)
+	}
+	return s.out.apiKeys(views)
+}
+
+func apikeyRevoke(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "apikey revoke")
+	rest, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	st, err := directStore(s)
+	if err != nil {
+		return err
+	}
+
+	k, err := st.RevokeAPIKey(ctx, rest[0])
+	if err != nil {
+		return err
+	}
+	return s.out.apiKeys([]apiKeyView{viewAPIKey(k)})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// client is what the commands need, either from a store opened directly or
+// from the API. Both report failures with the store's errors, so commands
+// can tell them apart with errors.Is either way.
+type client interface {
+	GetWallet(ctx context.Context, address string, asOf *time.Time) (*generated.Wallet, error)
+	ListWallets(ctx context.Context, q store.WalletQuery) (*generated.WalletConnection, error)
+
+	// CreateWallet creates a wallet holding nothing, returning an existing
+	// wallet unchanged.
+	CreateWallet(ctx context.Context, address string) (*generated.Wallet, error)
+
+	Mint(ctx context.Context, token, to string, amount *big.Int) (*big.Int, error)
+
+	// Transfer sends a transfer, signed with sig when that is not nil. A
+	// signed transfer also carries the key and nonce in opts.
+	Transfer(ctx context.Context, from string, ops []store.TransferOp, opts store.TransferOptions, sig []byte) (*big.Int, error)
+
+	WalletKey(ctx context.Context, address string) (*store.WalletKey, error)
+	RegisterWalletKey(ctx context.Context, address string, key ed25519.PublicKey) (*store.WalletKey, error)
+
+	// SetAcceptsTransfers opts the wallet in to or out of receiving
+	// transfers, returning the wallet.
+	SetAcceptsTransfers(ctx context.Context, address string, accepts bool) (*generated.Wallet, error)
+
+	// SigningDomain returns the domain transfers are signed for.
+	SigningDomain(ctx context.Context) (string, error)
+
+	Close()
+}
+
+// storeClient works on the store directly, bypassing the API and its
+// authorization.
+type storeClient struct {
+	store store.WalletStore
+	close func()
+}
+
+func (c *storeClient) GetWallet(ctx context.Context, address string, asOf *time.Time) (*generated.Wallet, error) {
+	if asOf != nil {
+		return c.store.GetByAddressAsOf(ctx, address, *asOf)
+	}
+	return c.store.GetByAddress(ctx, address)
+}
+
+func (c *storeClient) ListWallets(ctx context.Context, q store.WalletQuery) (*generated.WalletConnection, error) {
+	return c.store.ListWallets(ctx, q)
+}
+
+func (c *storeClient) CreateWallet(ctx context.Context, address string) (*generated.Wallet, error) {
+	return c.store.CreateIfNotExists(ctx, address, new(big.Int))
+}
+
+func (c *storeClient) Mint(ctx context.Context, token, to string, amount *big.Int) (*big.Int, error) {
+	return c.store.Mint(ctx, token, to, amount)
+}
+
+// Transfer leaves the signature out: the store only checks the key a
+// transfer was signed with, which the caller holding the private key is
+// trusted to give.
+func (c *storeClient) Transfer(ctx context.Context, from string, ops []store.TransferOp, opts store.TransferOptions, sig []byte) (*big.Int, error) {
+	return c.store.Transfer(ctx, from, ops, opts)
+}
+
+func (c *storeClient) WalletKey(ctx context.Context, address string) (*store.WalletKey, error) {
+	return c.store.GetWalletKey(ctx, address)
+}
+
+func (c *storeClient) RegisterWalletKey(ctx context.Context, address string, key ed25519.PublicKey) (*store.WalletKey, error) {
+	return c.store.RegisterWalletKey(ctx, address, key)
+}
+
+func (c *storeClient) SetAcceptsTransfers(ctx context.Context, address string, accepts bool) (*generated.Wallet, error) {
+	if err := c.store.SetAcceptsTransfers(ctx, address, accepts); err != nil {
+		return nil, err
+	}
+	return c.store.GetByAddress(ctx, address)
+}
+
+// SigningDomain returns the domain the server would be configured with.
+func (c *storeClient) SigningDomain(ctx context.Context) (string, error) {
+	if domain := os.Getenv("SIGNING_DOMAIN"); domain != "" {
+		return domain, nil
+	}
+	return auth.DefaultSigningDomain, nil
+}
+
+func (c *storeClient) Close() {
+	c.close()
+}
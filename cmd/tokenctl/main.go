@@ -0,0 +1,591 @@
+// Command tokenctl runs wallet operations from the command line, for scripts
+// and for operators who would rather not write GraphQL by hand.
+//
+// Usage:
+//
+//	tokenctl [-api URL] [-api-key KEY] [-o table|json] COMMAND [flags] [args]
+//
+// Commands:
+//
+//	wallet create [-balance N] [-token SYMBOL] ADDRESS
+//	wallet get [-as-of TIME] ADDRESS
+//	wallet list [-first N] [-after CURSOR] [-order FIELD] [-desc] [-min-balance N] [-max-balance N] [-as-of TIME] [-all]
+//	wallet key [-register PUBLIC_KEY_FILE] ADDRESS
+//	transfer [-token SYMBOL] [-key KEY] [-sign-key PRIVATE_KEY_FILE] [-nonce N] FROM TO=AMOUNT...
+//	export [-transfers] [-format jsonl|csv] [-out FILE]
+//	import [-transfers] [-format jsonl|csv] [-in FILE] [-dry-run] [-batch N]
+//	apikey create [-role ROLE]... [-wallet ADDRESS]... SUBJECT
+//	apikey list
+//	apikey revoke ID
+//
+// With -api, or TOKENCTL_API, tokenctl talks to a running server, sending
+// -api-key, or TOKENCTL_API_KEY, as a bearer token. Otherwise it opens the
+// store itself, configured by the same environment variables as the server.
+// export, import and apikey always need the store itself. Flags of a command
+// go before its arguments.
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// Exit codes.
+const (
+	exitOK     = 0
+	exitFailed = 1
+	exitUsage  = 2
+)
+
+const usage = `Usage: tokenctl [-api URL] [-api-key KEY] [-o table|json] COMMAND [flags] [args]
+
+Commands:
+  wallet create [-balance N] [-token SYMBOL] ADDRESS
+  wallet get [-as-of TIME] ADDRESS
+  wallet list [-first N] [-after CURSOR] [-order address|balance|created] [-desc] [-min-balance N] [-max-balance N] [-as-of TIME] [-all]
+  wallet key [-register PUBLIC_KEY_FILE] ADDRESS
+  wallet accept [-off] ADDRESS
+  transfer [-token SYMBOL] [-key KEY] [-sign-key PRIVATE_KEY_FILE] [-nonce N] FROM TO=AMOUNT...
+  export [-transfers] [-format jsonl|csv] [-out FILE]
+  import [-transfers] [-format jsonl|csv] [-in FILE] [-dry-run] [-batch N]
+  apikey create [-role ROLE]... [-wallet ADDRESS]... SUBJECT
+  apikey list
+  apikey revoke ID
+
+Without -api the store is opened directly, configured like the server;
+export, import and apikey always need it.
+Times are RFC 3339, such as 2025-07-01T00:00:00Z.
+Keys are PEM files, as written by openssl genpkey -algorithm ed25519.
+`
+
+// errUsage is returned for malformed command lines.
+var errUsage = errors.New("usage")
+
+func main() {
+	_ = godotenv.Load()
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// session is what a command runs with.
+type session struct {
+	client client
+	out    *printer
+	stdin  io.Reader
+	stderr io.Writer
+}
+
+type command func(ctx context.Context, s *session, args []string) error
+
+var commands = map[string]command{
+	"wallet create": walletCreate,
+	"wallet get":    walletGet,
+	"wallet list":   walletList,
+	"wallet key":    walletKey,
+	"wallet accept": walletAccept,
+	"transfer":      transfer,
+	"export":        export,
+	"import":        importRows,
+	"apikey create": apikeyCreate,
+	"apikey list":   apikeyList,
+	"apikey revoke": apikeyRevoke,
+}
+
+// run is main without the process around it, returning the exit code.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("tokenctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	api := flags.String("api", os.Getenv("TOKENCTL_API"), "URL of the API to talk to instead of opening the store")
+	apiKey := flags.String("api-key", os.Getenv("TOKENCTL_API_KEY"), "bearer token sent to the API")
+	format := flags.String("o", formatTable, "output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return exitUsage
+	}
+	if *format != formatTable && *format != formatJSON {
+		fmt.Fprintf(stderr, "tokenctl: unknown output format %q\n", *format)
+		return exitUsage
+	}
+
+	args = flags.Args()
+	name, cmd := lookupCommand(args)
+	if cmd == nil {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	args = args[len(strings.Fields(name)):]
+
+	s := &session{out: &printer{w: stdout, format: *format}, stdin: stdin, stderr: stderr}
+	if *api != "" {
+		s.client = newAPIClient(apiURL(*api), *apiKey)
+	} else {
+		c, err := openStoreClient(ctx)
+		if err != nil {
+			fmt.Fprintf(stderr, "tokenctl: %v\n", err)
+			return exitFailed
+		}
+		s.client = c
+	}
+	defer s.client.Close()
+
+	if err := cmd(ctx, s, args); err != nil {
+		fmt.Fprintf(stderr, "tokenctl %s: %v\n", name, err)
+		if errors.Is(err, errUsage) {
+			return exitUsage
+		}
+		return exitFailed
+	}
+	return exitOK
+}
+
+// lookupCommand finds the command args start with, of one or two words.
+func lookupCommand(args []string) (string, command) {
+	if len(args) >= 2 {
+		if cmd, ok := commands[args[0]+" "+args[1]]; ok {
+			return args[0] + " " + args[1], cmd
+		}
+	}
+	if len(args) >= 1 {
+		if cmd, ok := commands[args[0]]; ok {
+			return args[0], cmd
+		}
+	}
+	return "", nil
+}
+
+func openStoreClient(ctx context.Context) (*storeClient, error) {
+	cfg, err := store.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	s, closeStore, err := store.Open(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("open %s store: %v", cfg.Backend, err)
+	}
+	return &storeClient{store: s, close: closeStore}, nil
+}
+
+// newFlags returns the flag set of a command, reporting errors as usage
+// errors instead of exiting.
+func newFlags(s *session, name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(s.stderr)
+	return flags
+}
+
+func parseFlags(flags *flag.FlagSet, args []string, want int) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if want >= 0 && flags.NArg() != want {
+		return nil, fmt.Errorf("%w: expected %d arguments, got %d", errUsage, want, flags.NArg())
+	}
+	return flags.Args(), nil
+}
+
+func parseAmount(s string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid amount %q", errUsage, s)
+	}
+	return n, nil
+}
+
+// timeFlag is an optional RFC 3339 time.
+type timeFlag struct{ t *time.Time }
+
+func (f *timeFlag) String() string {
+	if f.t == nil {
+		return ""
+	}
+	return f.t.Format(time.RFC3339Nano)
+}
+
+func (f *timeFlag) Set(s string) error {
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return err
+	}
+	f.t = &t
+	return nil
+}
+
+func walletCreate(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "wallet create")
+	balance := flags.String("balance", "0", "amount minted into the new wallet")
+	token := flags.String("token", store.DefaultToken, "token the balance is minted in")
+	rest, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+	address := rest[0]
+	amount, err := parseAmount(*balance)
+	if err != nil {
+		return err
+	}
+
+	// A starting balance is minted, so it must not land in a wallet that
+	// already exists.
+	if amount.Sign() != 0 {
+		if _, err := s.client.GetWallet(ctx, address, nil); err == nil {
+			return fmt.Errorf("%w: wallet %s already exists", store.ErrConflict, address)
+		} else if !errors.Is(err, store.ErrWalletNotFound) {
+			return err
+		}
+	}
+
+	// Minting creates the wallet, so nothing is left behind if it fails.
+	if amount.Sign() != 0 {
+		if _, err := s.client.Mint(ctx, *token, address, amount); err != nil {
+			return err
+		}
+	} else if _, err := s.client.CreateWallet(ctx, address); err != nil {
+		return err
+	}
+
+	w, err := s.client.GetWallet(ctx, address, nil)
+	if err != nil {
+		return err
+	}
+	return s.out.wallet(viewWallet(w))
+}
+
+func walletGet(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "wallet get")
+	var asOf timeFlag
+	flags.Var(&asOf, "as-of", "show the wallet as it was at this time")
+	rest, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	w, err := s.client.GetWallet(ctx, rest[0], asOf.t)
+	if err != nil {
+		return err
+	}
+	return s.out.wallet(viewWallet(w))
+}
+
+// walletOrderFields are the values of -order.
+var walletOrderFields = map[string]generated.WalletOrderField{
+	"address": generated.WalletOrderFieldAddress,
+	"balance": generated.WalletOrderFieldBalance,
+	"created": generated.WalletOrderFieldCreatedAt,
+}
+
+func walletList(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "wallet list")
+	first := flags.Int("first", 50, "number of wallets per page")
+	after := flags.String("after", "", "cursor to continue after")
+	order := flags.String("order", "address", "sort by address, balance or created")
+	desc := flags.Bool("desc", false, "sort in descending order")
+	minBalance := flags.String("min-balance", "", "only list wallets holding at least this much")
+	maxBalance := flags.String("max-balance", "", "only list wallets holding at most this much")
+	all := flags.Bool("all", false, "list every page")
+	var asOf timeFlag
+	flags.Var(&asOf, "as-of", "list wallets as they were at this time")
+	if _, err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+
+	if *first < 1 || *first > store.MaxWalletsPageSize {
+		return fmt.Errorf("%w: -first must be between 1 and %d", errUsage, store.MaxWalletsPageSize)
+	}
+	field, ok := walletOrderFields[*order]
+	if !ok {
+		return fmt.Errorf("%w: cannot order by %q", errUsage, *order)
+	}
+	q := store.WalletQuery{
+		First:   *first,
+		After:   *after,
+		OrderBy: generated.WalletOrder{Field: field, Direction: generated.OrderDirectionAsc},
+		AsOf:    asOf.t,
+	}
+	if *desc {
+		q.OrderBy.Direction = generated.OrderDirectionDesc
+	}
+	var err error
+	if *minBalance != "" {
+		if q.Filter.MinBalance, err = parseAmount(*minBalance); err != nil {
+			return err
+		}
+	}
+	if *maxBalance != "" {
+		if q.Filter.MaxBalance, err = parseAmount(*maxBalance); err != nil {
+			return err
+		}
+	}
+
+	var ws []walletView
+	next, err := listWallets(ctx, s.client, q, *all, func(w *generated.Wallet) error {
+		ws = append(ws, viewWallet(w))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.out.wallets(ws, next)
+}
+
+// listWallets calls fn with every wallet q selects, following pages if all
+// is set. It returns the cursor to continue from if there is more.
+func listWallets(ctx context.Context, c client, q store.WalletQuery, all bool, fn func(*generated.Wallet) error) (string, error) {
+	for {
+		conn, err := c.ListWallets(ctx, q)
+		if err != nil {
+			return "", err
+		}
+		for _, e := range conn.Edges {
+			if err := fn(e.Node); err != nil {
+				return "", err
+			}
+		}
+
+		if !conn.PageInfo.HasNextPage || conn.PageInfo.EndCursor == nil {
+			return "", nil
+		}
+		if !all {
+			return *conn.PageInfo.EndCursor, nil
+		}
+		q.After = *conn.PageInfo.EndCursor
+	}
+}
+
+func transfer(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "transfer")
+	token := flags.String("token", store.DefaultToken, "token to move")
+	key := flags.String("key", "", "idempotency key, so the transfer can safely be retried")
+	signKey := flags.String("sign-key", "", "PEM file of the Ed25519 private key to sign the transfer with")
+	nonce := flags.Int64("nonce", -1, "nonce of a signed transfer, the wallet's next one if negative")
+	rest, err := parseFlags(flags, args, -1)
+	if err != nil {
+		return err
+	}
+	if len(rest) < 2 {
+		return fmt.Errorf("%w: expected FROM and at least one TO=AMOUNT", errUsage)
+	}
+
+	from := rest[0]
+	var ops []store.TransferOp
+	for _, leg := range rest[1:] {
+		to, amount, ok := strings.Cut(leg, "=")
+		if !ok {
+			return fmt.Errorf("%w: expected TO=AMOUNT, got %q", errUsage, leg)
+		}
+		n, err := parseAmount(amount)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, store.TransferOp{To: to, Amount: n})
+	}
+
+	opts := store.TransferOptions{Token: *token, IdempotencyKey: *key}
+	var sig []byte
+	if *signKey != "" {
+		if sig, err = signTransfer(ctx, s, *signKey, *nonce, from, ops, &opts); err != nil {
+			return err
+		}
+	}
+
+	balance, err := s.client.Transfer(ctx, from, ops, opts, sig)
+	if err != nil {
+		return err
+	}
+	return s.out.transfer(transferResult{From: from, Token: *token, Balance: balance.String()})
+}
+
+// signTransfer signs the transfer of ops out of from with the private key in
+// keyFile, for nonce or the wallet's next nonce, and records the key and
+// nonce in opts.
+func signTransfer(ctx context.Context, s *session, keyFile string, nonce int64, from string, ops []store.TransferOp, opts *store.TransferOptions) ([]byte, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	priv, err := auth.ParseEd25519PrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errUsage, keyFile, err)
+	}
+
+	n := uint64(nonce)
+	if nonce < 0 {
+		k, err := s.client.WalletKey(ctx, from)
+		if err != nil {
+			return nil, err
+		}
+		n = k.Nonce
+	}
+	domain, err := s.client.SigningDomain(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	opts.Nonce = &n
+	opts.SignedWith = priv.Public().(ed25519.PublicKey)
+	return auth.SignTransfer(priv, auth.TransferIntent{
+		Domain: domain,
+		From:   from,
+		Token:  opts.Token,
+		Legs:   ops,
+		Nonce:  n,
+	}), nil
+}
+
+// walletKey prints the key and next nonce of a wallet, registering the
+// public key in -register first.
+func walletKey(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "wallet key")
+	register := flags.String("register", "", "PEM file of the Ed25519 public key to register")
+	rest, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	var k *store.WalletKey
+	if *register != "" {
+		data, err := os.ReadFile(*register)
+		if err != nil {
+			return err
+		}
+		pub, err := auth.ParseEd25519PublicKey(data)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", errUsage, *register, err)
+		}
+		k, err = s.client.RegisterWalletKey(ctx, rest[0], pub)
+		if err != nil {
+			return err
+		}
+	} else if k, err = s.client.WalletKey(ctx, rest[0]); err != nil {
+		return err
+	}
+	return s.out.walletKey(viewWalletKey(k))
+}
+
+// walletAccept opts a wallet in to receiving transfers, which the opt-in
+// recipient policy requires, or out of it with -off.
+func walletAccept(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "wallet accept")
+	off := flags.Bool("off", false, "opt out instead")
+	rest, err := parseFlags(flags, args, 1)
+	if err != nil {
+		return err
+	}
+
+	w, err := s.client.SetAcceptsTransfers(ctx, rest[0], !*off)
+	if err != nil {
+		return err
+	}
+	return s.out.wallet(viewWallet(w))
+}
+
+// export writes every wallet balance, or every transfer, in one of the bulk
+// formats import reads.
+func export(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "export")
+	out := flags.String("out", "-", "file to write to, - for standard output")
+	format := flags.String("format", string(store.FormatJSONL), "file format, jsonl or csv")
+	transfers := flags.Bool("transfers", false, "export transfer history instead of wallets")
+	if _, err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	st, err := directStore(s)
+	if err != nil {
+		return err
+	}
+
+	w := s.out.w
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	what := "wallet balances"
+	var n int
+	if *transfers {
+		what = "transfers"
+		n, err = store.BulkExportTransfers(ctx, st, w, store.BulkFormat(*format))
+	} else {
+		n, err = store.BulkExportWallets(ctx, st, w, store.BulkFormat(*format))
+	}
+	if errors.Is(err, store.ErrInvalidArgument) {
+		return fmt.Errorf("%w: %v", errUsage, err)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(s.stderr, "exported %d %s\n", n, what)
+	return nil
+}
+
+// importRows imports the wallet balances, or transfers, of a file in one of
+// the bulk formats. Rows that cannot be imported are reported, and the rest
+// of the file is imported regardless.
+func importRows(ctx context.Context, s *session, args []string) error {
+	flags := newFlags(s, "import")
+	in := flags.String("in", "-", "file to read, - for standard input")
+	format := flags.String("format", string(store.FormatJSONL), "file format, jsonl or csv")
+	transfers := flags.Bool("transfers", false, "import transfer history instead of wallets")
+	dryRun := flags.Bool("dry-run", false, "check every row and report what would be imported, without importing it")
+	batch := flags.Int("batch", store.DefaultImportBatch, "rows imported per transaction")
+	if _, err := parseFlags(flags, args, 0); err != nil {
+		return err
+	}
+	st, err := directStore(s)
+	if err != nil {
+		return err
+	}
+
+	r := s.stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	opts := store.ImportOptions{Format: store.BulkFormat(*format), DryRun: *dryRun, BatchSize: *batch}
+	var report *store.ImportReport
+	if *transfers {
+		report, err = store.BulkImportTransfers(ctx, st, r, opts)
+	} else {
+		report, err = store.BulkImportWallets(ctx, st, r, opts)
+	}
+	if perr := s.out.importReport(report); perr != nil && err == nil {
+		err = perr
+	}
+	if err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d rows failed", report.Failed, report.Rows)
+	}
+	return nil
+}
+
+// directStore returns the store of a session that opened it directly, for
+// commands the API has no way to carry.
+func directStore(s *session) (store.WalletStore, error) {
+	c, ok := s.client.(*storeClient)
+	if !ok {
+		return nil, fmt.Errorf("%w: need direct access to the store; run without -api", errUsage)
+	}
+	return c.store, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/graph"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+const issuerKey = "issuer-key"
+
+// addr returns the i-th test address.
+func addr(i int) string {
+	return fmt.Sprintf("0x%040x", i)
+}
+
+// useStore points commands run without -api at a durable in-memory store in
+// a fresh directory, so what one command writes the next one reads.
+func useStore(t *testing.T) {
+	t.Helper()
+	t.Setenv("TOKENCTL_API", "")
+	t.Setenv("TOKENCTL_API_KEY", "")
+	t.Setenv("STORE_BACKEND", store.BackendMemory)
+	t.Setenv("MEMORY_DATA_DIR", t.TempDir())
+	t.Setenv("MEMORY_FSYNC", string(store.FsyncNever))
+	t.Setenv("IDEMPOTENCY_WINDOW", "")
+	t.Setenv("RECIPIENT_POLICY", "")
+}
+
+// tokenctl runs a command line, returning its exit code and output.
+func tokenctl(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(context.Background(), args, strings.NewReader(""), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// serve starts the API on top of s, accepting issuerKey and the API keys
+// kept in s.
+func serve(t *testing.T, s store.WalletStore) string {
+	t.Helper()
+	authenticators := []auth.Authenticator{
+		auth.StaticKey(issuerKey, auth.Principal{Subject: "issuer", Roles: []auth.Role{auth.RoleIssuer}}),
+		auth.APIKeys(s),
+	}
+	server := graph.NewServer(&graph.Resolver{Store: s, SigningDomain: auth.DefaultSigningDomain}, authenticators...)
+	srv := httptest.NewServer(auth.Middleware(authenticators...)(server))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestUsage(t *testing.T) {
+	useStore(t)
+
+	for _, args := range [][]string{
+		{},
+		{"wallet"},
+		{"wallet", "burn", addr(1)},
+		{"-o", "xml", "wallet", "get", addr(1)},
+		{"wallet", "get"},
+		{"wallet", "get", addr(1), addr(2)},
+		{"wallet", "get", "-as-of", "yesterday", addr(1)},
+		{"wallet", "create", "-balance", "lots", addr(1)},
+		{"wallet", "list", "-first", "-1"},
+		{"wallet", "list", "-first", "0"},
+		{"wallet", "list", "-first", fmt.Sprint(store.MaxWalletsPageSize + 1)},
+		{"wallet", "list", "-order", "name"},
+		{"wallet", "list", "-min-balance", "1.5"},
+		{"wallet", "list", "extra"},
+		{"transfer", addr(1)},
+		{"transfer", addr(1), addr(2)},
+		{"transfer", addr(1), addr(2) + "=ten"},
+		{"apikey", "create"},
+	} {
+		code, _, stderr := tokenctl(t, args...)
+		if code != exitUsage {
+			t.Errorf("%q: Expected exit code %d, got: %d (%s)", args, exitUsage, code, stderr)
+		}
+	}
+}
+
+func TestDirectStore(t *testing.T) {
+	useStore(t)
+
+	if code, _, stderr := tokenctl(t, "wallet", "create", "-balance", "100", addr(1)); code != exitOK {
+		t.Fatalf("wallet create: Expected exit code 0, got: %d (%s)", code, stderr)
+	}
+	if code, _, _ := tokenctl(t, "wallet", "create", "-balance", "100", addr(1)); code != exitFailed {
+		t.Errorf("Minting into an existing wallet: Expected exit code %d, got: %d", exitFailed, code)
+	}
+
+	code, stdout, stderr := tokenctl(t, "-o", "json", "transfer", addr(1), addr(2)+"=30", addr(3)+"=20")
+	if code != exitOK {
+		t.Fatalf("transfer: Expected exit code 0, got: %d (%s)", code, stderr)
+	}
+	var res transferResult
+	if err := json.Unmarshal([]byte(stdout), &res); err != nil || res.Balance != "50" {
+		t.Errorf("transfer: Expected balance 50, got: %q, %v", stdout, err)
+	}
+
+	code, _, stderr = tokenctl(t, "transfer", addr(1), addr(2)+"=1000")
+	if code != exitFailed || !strings.Contains(stderr, "insufficient funds") {
+		t.Errorf("Overdrawing transfer: Expected exit code %d and insufficient funds, got: %d (%s)", exitFailed, code, stderr)
+	}
+
+	code, stdout, stderr = tokenctl(t, "-o", "json", "wallet", "list", "-first", "2", "-order", "balance", "-desc")
+	if code != exitOK {
+		t.Fatalf("wallet list: Expected exit code 0, got: %d (%s)", code, stderr)
+	}
+	var page struct {
+		Wallets   []walletView `json:"wallets"`
+		EndCursor string       `json:"endCursor"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &page); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+	if len(page.Wallets) != 2 || page.Wallets[0].Balance != "50" || page.Wallets[1].Balance != "30" || page.EndCursor == "" {
+		t.Errorf("wallet list: Expected balances 50 and 30 and a cursor, got: %s", stdout)
+	}
+
+	code, stdout, _ = tokenctl(t, "-o", "json", "wallet", "list", "-first", "2", "-order", "balance", "-desc", "-after", page.EndCursor)
+	if err := json.Unmarshal([]byte(stdout), &page); code != exitOK || err != nil || len(page.Wallets) != 1 || page.Wallets[0].Balance != "20" {
+		t.Errorf("wallet list -after: Expected the wallet holding 20, got: %d %s", code, stdout)
+	}
+
+	if code, _, _ := tokenctl(t, "wallet", "get", addr(9)); code != exitFailed {
+		t.Errorf("wallet get of unknown wallet: Expected exit code %d, got: %d", exitFailed, code)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	useStore(t)
+	ctx := context.Background()
+	s := store.NewInMemWalletStore()
+	url := serve(t, s)
+
+	key, k, err := auth.NewAPIKey("alice", nil, []string{addr(1)})
+	if err != nil {
+		t.Fatalf("NewAPIKey error: %v", err)
+	}
+	if err := s.CreateAPIKey(ctx, k); err != nil {
+		t.Fatalf("CreateAPIKey error: %v", err)
+	}
+
+	if code, _, stderr := tokenctl(t, "-api", url, "-api-key", issuerKey, "wallet", "create", "-balance", "100", addr(1)); code != exitOK {
+		t.Fatalf("wallet create: Expected exit code 0, got: %d (%s)", code, stderr)
+	}
+
+	code, stdout, stderr := tokenctl(t, "-api", url, "-api-key", key, "-o", "json", "transfer", addr(1), addr(2)+"=40")
+	if code != exitOK {
+		t.Fatalf("transfer: Expected exit code 0, got: %d (%s)", code, stderr)
+	}
+	var res transferResult
+	if err := json.Unmarshal([]byte(stdout), &res); err != nil || res.Balance != "60" {
+		t.Errorf("transfer: Expected balance 60, got: %q, %v", stdout, err)
+	}
+
+	// The API's refusals come back as the store's errors.
+	if code, _, stderr := tokenctl(t, "-api", url, "-api-key", key, "transfer", addr(2), addr(1)+"=1"); code != exitFailed || !strings.Contains(stderr, "FORBIDDEN") {
+		t.Errorf("Transfer out of a wallet alice does not own: Expected exit code %d and FORBIDDEN, got: %d (%s)", exitFailed, code, stderr)
+	}
+	c := newAPIClient(apiURL(url), key)
+	if _, err := c.Transfer(ctx, addr(1), []store.TransferOp{{To: addr(2), Amount: big.NewInt(1000)}}, store.TransferOptions{}, nil); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Errorf("Overdrawing transfer: Expected ErrInsufficientFunds, got: %v", err)
+	}
+	if _, err := c.GetWallet(ctx, addr(9), nil); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Unknown wallet: Expected ErrWalletNotFound, got: %v", err)
+	}
+	if _, err := c.ListWallets(ctx, store.WalletQuery{First: 10}); !errors.Is(err, auth.ErrForbidden) {
+		t.Errorf("Listing wallets without the admin role: Expected ErrForbidden, got: %v", err)
+	}
+
+	code, stdout, stderr = tokenctl(t, "-api", strings.TrimPrefix(url, "http://"), "-o", "json", "wallet", "get", addr(2))
+	var w walletView
+	if code != exitOK || json.Unmarshal([]byte(stdout), &w) != nil || w.Balance != "40" {
+		t.Errorf("wallet get: Expected balance 40, got: %d %s (%s)", code, stdout, stderr)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// Output formats.
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// walletView is how wallets are printed and exported. Amounts are strings,
+// as in the API, so no reader loses precision to floating point, and
+// addresses are checksummed whether they came from the API or a store.
+type walletView struct {
+	Address   string        `json:"address"`
+	Balance   string        `json:"balance"`
+	Balances  []balanceView `json:"balances"`
+	CreatedAt time.Time     `json:"createdAt"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+type balanceView struct {
+	Token   string `json:"token"`
+	Balance string `json:"balance"`
+}
+
+func viewWallet(w *generated.Wallet) walletView {
+	v := walletView{
+		Address:   store.ChecksumAddress(w.Address),
+		Balance:   w.Balance.String(),
+		Balances:  []balanceView{},
+		CreatedAt: w.CreatedAt,
+		UpdatedAt: w.UpdatedAt,
+	}
+	for _, b := range w.Balances {
+		v.Balances = append(v.Balances, balanceView{Token: b.Token.Symbol, Balance: b.Balance.String()})
+	}
+	return v
+}
+
+// printer writes command results in the chosen format.
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+func (p *printer) json(v any) error {
+	enc := json.NewEncoder(p.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// table prints rows under header, aligned in columns.
+func (p *printer) table(header []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(p.w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func (p *printer) wallets(ws []walletView, next string) error {
+	if p.format == formatJSON {
+		out := struct {
+			Wallets   []walletView `json:"wallets"`
+			EndCursor string       `json:"endCursor,omitempty"`
+		}{ws, next}
+		return p.json(out)
+	}
+
+	rows := make([][]string, 0, len(ws))
+	for _, w := range ws {
+		balances := make([]string, 0, len(w.Balances))
+		for _, b := range w.Balances {
+			balances = append(balances, b.Token+" "+b.Balance)
+		}
+		rows = append(rows, []string{
+			w.Address, w.Balance, strings.Join(balances, ", "),
+			w.CreatedAt.Format(time.RFC3339), w.UpdatedAt.Format(time.RFC3339),
+		})
+	}
+	if err := p.table([]string{"ADDRESS", "BALANCE", "TOKENS", "CREATED", "UPDATED"}, rows); err != nil {
+		return err
+	}
+	if next != "" {
+		fmt.Fprintf(p.w, "\nMore wallets follow, continue with -after %s\n", next)
+	}
+	return nil
+}
+
+func (p *printer) wallet(w walletView) error {
+	if p.format == formatJSON {
+		return p.json(w)
+	}
+	return p.wallets([]walletView{w}, "")
+}
+
+// walletKeyView is how the key of a wallet is printed.
+type walletKeyView struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"publicKey,omitempty"`
+	Nonce     uint64 `json:"nonce"`
+}
+
+func viewWalletKey(k *store.WalletKey) walletKeyView {
+	v := walletKeyView{Address: store.ChecksumAddress(k.Address), Nonce: k.Nonce}
+	if k.PublicKey != nil {
+		v.PublicKey = hex.EncodeToString(k.PublicKey)
+	}
+	return v
+}
+
+func (p *printer) walletKey(k walletKeyView) error {
+	if p.format == formatJSON {
+		return p.json(k)
+	}
+	return p.table([]string{"ADDRESS", "PUBLIC KEY", "NONCE"}, [][]string{{k.Address, k.PublicKey, strconv.FormatUint(k.Nonce, 10)}})
+}
+
+// transferResult is what transfer prints.
+type transferResult struct {
+	From    string `json:"from"`
+	Token   string `json:"token"`
+	Balance string `json:"balance"`
+}
+
+func (p *printer) transfer(r transferResult) error {
+	if p.format == formatJSON {
+		return p.json(r)
+	}
+	return p.table([]string{"FROM", "TOKEN", "NEW BALANCE"}, [][]string{{r.From, r.Token, r.Balance}})
+}
+
+// importReport prints the rows of an import that were not imported, then a
+// summary. A failed import may have no report.
+func (p *printer) importReport(r *store.ImportReport) error {
+	if r == nil {
+		return nil
+	}
+	if p.format == formatJSON {
+		return p.json(r)
+	}
+
+	if len(r.Problems) > 0 {
+		rows := make([][]string, 0, len(r.Problems))
+		for _, pr := range r.Problems {
+			rows = append(rows, []string{fmt.Sprint(pr.Line), string(pr.Status), pr.Reason})
+		}
+		if err := p.table([]string{"LINE", "STATUS", "REASON"}, rows); err != nil {
+			return err
+		}
+		fmt.Fprintln(p.w)
+	}
+	verb := "imported"
+	if r.DryRun {
+		verb = "would import"
+	}
+	_, err := fmt.Fprintf(p.w, "%d rows: %s %d, skipped %d, failed %d\n", r.Rows, verb, r.Imported, r.Skipped, r.Failed)
+	return err
+}
+
+// apiKeyView is how API keys are printed. The hash is left out: it is of no
+// use to anyone reading it.
+type apiKeyView struct {
+	ID        string     `json:"id"`
+	Subject   string     `json:"subject"`
+	Roles     []string   `json:"roles"`
+	Wallets   []string   `json:"wallets"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+func viewAPIKey(k *store.APIKey) apiKeyView {
+	return apiKeyView{
+		ID:        k.ID,
+		Subject:   k.Subject,
+		Roles:     k.Roles,
+		Wallets:   k.Wallets,
+		CreatedAt: k.CreatedAt,
+		RevokedAt: k.RevokedAt,
+	}
+}
+
+func (p *printer) apiKeys(keys []apiKeyView) error {
+	if p.format == formatJSON {
+		return p.json(struct {
+			Keys []apiKeyView `json:"keys"`
+		}{keys})
+	}
+
+	rows := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		revoked := ""
+		if k.RevokedAt != nil {
+			revoked = k.RevokedAt.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{
+			k.ID, k.Subject, strings.Join(k.Roles, ","), strings.Join(k.Wallets, ","),
+			k.CreatedAt.Format(time.RFC3339), revoked,
+		})
+	}
+	return p.table([]string{"ID", "SUBJECT", "ROLES", "WALLETS", "CREATED", "REVOKED"}, rows)
+}
+
+// apiKeyCreated prints a new key along with its secret, which cannot be
+// shown again.
+func (p *printer) apiKeyCreated(k apiKeyView, secret string) error {
+	if p.format == formatJSON {
+		return p.json(struct {
+			apiKeyView
+			Key string `json:"key"`
+		}{k, secret})
+	}
+	if err := p.apiKeys([]apiKeyView{k}); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(p.w, "\nKey (shown only once): %s\n", secret)
+	return err
+}
@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS transfers;
+CREATE TABLE transfers (
+    id BIGSERIAL PRIMARY KEY,
+    from_address TEXT NOT NULL,
+    to_address TEXT NOT NULL,
+    amount NUMERIC NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('SUCCEEDED', 'REJECTED')),
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+CREATE INDEX transfers_from_address_idx ON transfers (from_address, id);
+CREATE INDEX transfers_to_address_idx ON transfers (to_address, id);
@@ -0,0 +1,11 @@
+ALTER TABLE transfers DROP COLUMN IF EXISTS token;
+
+ALTER TABLE wallets ADD COLUMN balance NUMERIC NOT NULL DEFAULT 0;
+
+UPDATE wallets w
+   SET balance = b.balance
+  FROM balances b
+ WHERE b.address = w.address AND b.token = 'BTP';
+
+DROP TABLE IF EXISTS balances;
+DROP TABLE IF EXISTS tokens;
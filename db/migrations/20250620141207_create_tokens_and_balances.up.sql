@@ -0,0 +1,30 @@
+DROP TABLE IF EXISTS balances;
+DROP TABLE IF EXISTS tokens;
+CREATE TABLE tokens (
+    symbol TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    decimals INTEGER NOT NULL CHECK (decimals >= 0 AND decimals <= 77),
+    total_supply NUMERIC NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+-- Every balance held so far was of the single, unnamed token. It becomes the
+-- default BTP token, and its supply is whatever the wallets hold today.
+INSERT INTO tokens(symbol, name, decimals, total_supply)
+SELECT 'BTP', 'BTP Token', 0, COALESCE(SUM(balance), 0) FROM wallets;
+
+CREATE TABLE balances (
+    address TEXT NOT NULL REFERENCES wallets(address) ON DELETE CASCADE,
+    token TEXT NOT NULL REFERENCES tokens(symbol),
+    balance NUMERIC NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY (address, token)
+);
+
+INSERT INTO balances(address, token, balance, updated_at)
+SELECT address, 'BTP', balance, updated_at FROM wallets;
+
+ALTER TABLE wallets DROP COLUMN balance;
+
+ALTER TABLE transfers ADD COLUMN token TEXT NOT NULL DEFAULT 'BTP';
+ALTER TABLE transfers ALTER COLUMN token DROP DEFAULT;
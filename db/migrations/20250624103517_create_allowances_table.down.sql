@@ -0,0 +1,3 @@
+ALTER TABLE transfers DROP COLUMN IF EXISTS spender;
+
+DROP TABLE IF EXISTS allowances;
@@ -0,0 +1,11 @@
+DROP TABLE IF EXISTS allowances;
+CREATE TABLE allowances (
+    owner TEXT NOT NULL REFERENCES wallets(address) ON DELETE CASCADE,
+    spender TEXT NOT NULL,
+    token TEXT NOT NULL REFERENCES tokens(symbol),
+    amount NUMERIC NOT NULL CHECK (amount >= 0),
+    updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
+    PRIMARY KEY (owner, spender, token)
+);
+
+ALTER TABLE transfers ADD COLUMN spender TEXT;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS balances_token_balance_address_idx;
+DROP INDEX IF EXISTS wallets_created_at_address_idx;
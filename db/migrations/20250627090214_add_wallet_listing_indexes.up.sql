@@ -0,0 +1,2 @@
+CREATE INDEX wallets_created_at_address_idx ON wallets (created_at, address);
+CREATE INDEX balances_token_balance_address_idx ON balances (token, balance, address);
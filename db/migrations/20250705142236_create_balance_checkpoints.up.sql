@@ -0,0 +1,20 @@
+DROP TABLE IF EXISTS balance_checkpoints;
+
+-- A checkpoint is the balance a wallet held of a token from recorded_at until
+-- its next checkpoint. One is written whenever a balance changes, so the
+-- balance at any earlier time is a single index lookup away.
+CREATE TABLE balance_checkpoints (
+    id BIGSERIAL PRIMARY KEY,
+    address TEXT NOT NULL,
+    token TEXT NOT NULL REFERENCES tokens(symbol),
+    balance NUMERIC NOT NULL,
+    recorded_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX balance_checkpoints_address_token_recorded_at_idx
+    ON balance_checkpoints (address, token, recorded_at DESC, id DESC);
+
+-- History from before checkpoints were kept is lost; each balance is known
+-- from its last update on.
+INSERT INTO balance_checkpoints(address, token, balance, recorded_at)
+SELECT address, token, balance, updated_at FROM balances;
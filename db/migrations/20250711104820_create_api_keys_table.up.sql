@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS api_keys;
+
+-- Credentials clients authenticate with. Only the SHA-256 of each key's
+-- secret is kept; the secret itself is shown once, when the key is created.
+CREATE TABLE api_keys (
+    id TEXT PRIMARY KEY,
+    hash TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    roles TEXT[] NOT NULL DEFAULT '{}',
+    wallets TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
@@ -0,0 +1,73 @@
+DROP TABLE IF EXISTS wallet_address_problems;
+
+-- Addresses are kept in lowercase from now on. Wallets that cannot be
+-- lowercased are listed here for an operator to sort out by hand, and left
+-- as they are:
+--   CASE_DUPLICATE  another wallet is the same address spelled differently,
+--                   so merging them would merge their funds
+--   MALFORMED       the address is not 0x and 40 hex digits
+-- canonical is the lowercase address, shared by every CASE_DUPLICATE wallet
+-- of the same address.
+CREATE TABLE wallet_address_problems (
+    address TEXT PRIMARY KEY,
+    canonical TEXT NOT NULL,
+    problem TEXT NOT NULL CHECK (problem IN ('CASE_DUPLICATE', 'MALFORMED')),
+    detected_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now()
+);
+
+INSERT INTO wallet_address_problems(address, canonical, problem)
+SELECT address, lower(address), 'MALFORMED'
+  FROM wallets
+ WHERE address !~ '^0[xX][0-9a-fA-F]{40}$';
+
+INSERT INTO wallet_address_problems(address, canonical, problem)
+SELECT address, lower(address), 'CASE_DUPLICATE'
+  FROM wallets
+ WHERE address ~ '^0[xX][0-9a-fA-F]{40}$'
+   AND lower(address) IN (SELECT lower(address) FROM wallets GROUP BY lower(address) HAVING count(*) > 1);
+
+DO $$
+DECLARE
+    p RECORD;
+BEGIN
+    FOR p IN
+        SELECT canonical, problem, string_agg(address, ', ' ORDER BY address) AS addresses
+          FROM wallet_address_problems
+         GROUP BY canonical, problem
+         ORDER BY canonical
+    LOOP
+        RAISE WARNING 'wallet address %: % (left as it is, see wallet_address_problems)', p.problem, p.addresses;
+    END LOOP;
+END $$;
+
+-- Every other wallet not yet in lowercase is moved to its lowercase address,
+-- along with everything recorded under the old one.
+CREATE TEMPORARY TABLE wallet_address_renames AS
+SELECT address AS old_address, lower(address) AS new_address
+  FROM wallets
+ WHERE address <> lower(address)
+   AND address NOT IN (SELECT address FROM wallet_address_problems);
+
+INSERT INTO wallets(address, created_at, updated_at, public_key, nonce)
+SELECT r.new_address, w.created_at, w.updated_at, w.public_key, w.nonce
+  FROM wallets w JOIN wallet_address_renames r ON r.old_address = w.address;
+
+UPDATE balances b SET address = r.new_address FROM wallet_address_renames r WHERE b.address = r.old_address;
+UPDATE allowances a SET owner = r.new_address FROM wallet_address_renames r WHERE a.owner = r.old_address;
+UPDATE transfers t SET from_address = r.new_address FROM wallet_address_renames r WHERE t.from_address = r.old_address;
+UPDATE transfers t SET to_address = r.new_address FROM wallet_address_renames r WHERE t.to_address = r.old_address;
+UPDATE transfers t SET spender = r.new_address FROM wallet_address_renames r WHERE t.spender = r.old_address;
+UPDATE postings p SET address = r.new_address FROM wallet_address_renames r WHERE p.address = r.old_address;
+UPDATE balance_checkpoints c SET address = r.new_address FROM wallet_address_renames r WHERE c.address = r.old_address;
+
+-- Spenders and senders of idempotency keys need not be wallets, so the new
+-- spelling may already be in use; those rows keep the old one.
+UPDATE allowances a SET spender = r.new_address FROM wallet_address_renames r
+ WHERE a.spender = r.old_address
+   AND NOT EXISTS (SELECT 1 FROM allowances o WHERE o.owner = a.owner AND o.spender = r.new_address AND o.token = a.token);
+UPDATE idempotency_keys k SET from_address = r.new_address FROM wallet_address_renames r
+ WHERE k.from_address = r.old_address
+   AND NOT EXISTS (SELECT 1 FROM idempotency_keys o WHERE o.from_address = r.new_address AND o.key = k.key);
+
+DELETE FROM wallets WHERE address IN (SELECT old_address FROM wallet_address_renames);
+DROP TABLE wallet_address_renames;
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS allowances;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS transfers;
+DROP TABLE IF EXISTS balances;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS wallets;
@@ -0,0 +1,74 @@
+-- SQLite has no arbitrary-precision numbers, so amounts are kept as base-10
+-- TEXT and all arithmetic on them happens in the application. Timestamps are
+-- INTEGER nanoseconds since the Unix epoch.
+
+DROP TABLE IF EXISTS allowances;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS transfers;
+DROP TABLE IF EXISTS balances;
+DROP TABLE IF EXISTS tokens;
+DROP TABLE IF EXISTS wallets;
+
+CREATE TABLE wallets (
+    address TEXT PRIMARY KEY,
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+CREATE TABLE tokens (
+    symbol TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    decimals INTEGER NOT NULL CHECK (decimals >= 0 AND decimals <= 77),
+    total_supply TEXT NOT NULL DEFAULT '0',
+    created_at INTEGER NOT NULL
+);
+
+INSERT INTO tokens(symbol, name, decimals, total_supply, created_at)
+VALUES ('BTP', 'BTP Token', 0, '0', CAST(unixepoch('subsec') * 1000000000 AS INTEGER));
+
+CREATE TABLE balances (
+    address TEXT NOT NULL REFERENCES wallets(address) ON DELETE CASCADE,
+    token TEXT NOT NULL REFERENCES tokens(symbol),
+    balance TEXT NOT NULL DEFAULT '0',
+    -- The balance prefixed with its zero-padded length, so that comparing
+    -- keys as text orders balances numerically.
+    balance_key TEXT GENERATED ALWAYS AS (printf('%03d', length(balance)) || balance) VIRTUAL,
+    updated_at INTEGER NOT NULL,
+    PRIMARY KEY (address, token)
+);
+
+CREATE TABLE transfers (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    from_address TEXT NOT NULL,
+    to_address TEXT NOT NULL,
+    spender TEXT,
+    token TEXT NOT NULL,
+    amount TEXT NOT NULL,
+    status TEXT NOT NULL CHECK (status IN ('SUCCEEDED', 'REJECTED')),
+    error TEXT,
+    created_at INTEGER NOT NULL
+);
+
+CREATE TABLE idempotency_keys (
+    from_address TEXT NOT NULL,
+    key TEXT NOT NULL,
+    fingerprint TEXT NOT NULL,
+    balance TEXT NOT NULL,
+    error TEXT,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (from_address, key)
+);
+
+CREATE TABLE allowances (
+    owner TEXT NOT NULL REFERENCES wallets(address) ON DELETE CASCADE,
+    spender TEXT NOT NULL,
+    token TEXT NOT NULL REFERENCES tokens(symbol),
+    amount TEXT NOT NULL,
+    updated_at INTEGER NOT NULL,
+    PRIMARY KEY (owner, spender, token)
+);
+
+CREATE INDEX transfers_from_address_idx ON transfers (from_address, id);
+CREATE INDEX transfers_to_address_idx ON transfers (to_address, id);
+CREATE INDEX wallets_created_at_address_idx ON wallets (created_at, address);
+CREATE INDEX balances_token_balance_key_address_idx ON balances (token, balance_key, address);
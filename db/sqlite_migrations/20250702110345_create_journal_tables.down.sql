@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS postings;
+DROP TABLE IF EXISTS journal_entries;
@@ -0,0 +1,37 @@
+DROP TABLE IF EXISTS postings;
+DROP TABLE IF EXISTS journal_entries;
+CREATE TABLE journal_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    kind TEXT NOT NULL CHECK (kind IN ('OPENING', 'SEED', 'TRANSFER', 'MINT', 'BURN')),
+    created_at INTEGER NOT NULL
+);
+
+-- A posting credits amount to address, or debits it when it starts with a
+-- minus sign. The postings of an entry sum to zero per token; new tokens are
+-- issued from the '@issuance' account. transfer_id links a posting to its
+-- transfer leg.
+CREATE TABLE postings (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    entry_id INTEGER NOT NULL REFERENCES journal_entries(id) ON DELETE CASCADE,
+    address TEXT NOT NULL,
+    token TEXT NOT NULL REFERENCES tokens(symbol),
+    amount TEXT NOT NULL CHECK (amount NOT IN ('0', '-0')),
+    transfer_id INTEGER REFERENCES transfers(id)
+);
+
+CREATE INDEX postings_entry_id_idx ON postings (entry_id);
+CREATE INDEX postings_address_token_idx ON postings (address, token);
+
+-- Balances held before the journal existed are opened in a single entry,
+-- each issued from the '@issuance' account.
+INSERT INTO journal_entries(kind, created_at)
+SELECT 'OPENING', CAST(unixepoch('subsec') * 1000000000 AS INTEGER)
+ WHERE EXISTS (SELECT 1 FROM balances WHERE balance <> '0');
+
+INSERT INTO postings(entry_id, address, token, amount)
+SELECT e.id, p.address, p.token, p.amount
+  FROM journal_entries e,
+       (SELECT address, token, balance AS amount FROM balances WHERE balance <> '0'
+        UNION ALL
+        SELECT '@issuance', token, '-' || balance FROM balances WHERE balance <> '0') p
+ WHERE e.kind = 'OPENING';
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS genesis;
+
+-- The genesis applied to the store. The single row is written in the
+-- transaction that applies it, so a genesis is applied at most once.
+CREATE TABLE genesis (
+    id INTEGER PRIMARY KEY CHECK (id = 1),
+    checksum TEXT NOT NULL,
+    applied_at INTEGER NOT NULL
+);
@@ -0,0 +1,14 @@
+DROP TABLE IF EXISTS api_keys;
+
+-- Credentials clients authenticate with. Only the SHA-256 of each key's
+-- secret is kept; the secret itself is shown once, when the key is created.
+-- roles and wallets are JSON arrays of strings.
+CREATE TABLE api_keys (
+    id TEXT PRIMARY KEY,
+    hash TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    roles TEXT NOT NULL DEFAULT '[]',
+    wallets TEXT NOT NULL DEFAULT '[]',
+    created_at INTEGER NOT NULL,
+    revoked_at INTEGER
+);
@@ -0,0 +1,2 @@
+ALTER TABLE wallets DROP COLUMN nonce;
+ALTER TABLE wallets DROP COLUMN public_key;
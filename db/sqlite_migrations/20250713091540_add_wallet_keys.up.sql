@@ -0,0 +1,4 @@
+-- The Ed25519 key a wallet signs its transfers with, if it has one, and the
+-- nonce the next transfer carrying one must use.
+ALTER TABLE wallets ADD COLUMN public_key BLOB CHECK (length(public_key) = 32);
+ALTER TABLE wallets ADD COLUMN nonce INTEGER NOT NULL DEFAULT 0 CHECK (nonce >= 0);
@@ -0,0 +1,3 @@
+-- Lowercased addresses are not restored to their old spelling; they name the
+-- same wallets.
+DROP TABLE IF EXISTS wallet_address_problems;
@@ -0,0 +1,70 @@
+DROP TABLE IF EXISTS wallet_address_problems;
+
+-- Addresses are kept in lowercase from now on. Wallets that cannot be
+-- lowercased are listed here for an operator to sort out by hand, and left
+-- as they are:
+--   CASE_DUPLICATE  another wallet is the same address spelled differently,
+--                   so merging them would merge their funds
+--   MALFORMED       the address is not 0x and 40 hex digits
+-- canonical is the lowercase address, shared by every CASE_DUPLICATE wallet
+-- of the same address.
+CREATE TABLE wallet_address_problems (
+    address TEXT PRIMARY KEY,
+    canonical TEXT NOT NULL,
+    problem TEXT NOT NULL CHECK (problem IN ('CASE_DUPLICATE', 'MALFORMED')),
+    detected_at INTEGER NOT NULL
+);
+
+INSERT INTO wallet_address_problems(address, canonical, problem, detected_at)
+SELECT address, lower(address), 'MALFORMED', CAST(unixepoch('subsec') * 1000000000 AS INTEGER)
+  FROM wallets
+ WHERE length(address) <> 42
+    OR lower(substr(address, 1, 2)) <> '0x'
+    OR substr(address, 3) GLOB '*[^0-9a-fA-F]*';
+
+INSERT INTO wallet_address_problems(address, canonical, problem, detected_at)
+SELECT address, lower(address), 'CASE_DUPLICATE', CAST(unixepoch('subsec') * 1000000000 AS INTEGER)
+  FROM wallets
+ WHERE address NOT IN (SELECT address FROM wallet_address_problems)
+   AND lower(address) IN (SELECT lower(address) FROM wallets GROUP BY lower(address) HAVING count(*) > 1);
+
+-- Every other wallet not yet in lowercase is moved to its lowercase address,
+-- along with everything recorded under the old one.
+CREATE TEMPORARY TABLE wallet_address_renames AS
+SELECT address AS old_address, lower(address) AS new_address
+  FROM wallets
+ WHERE address <> lower(address)
+   AND address NOT IN (SELECT address FROM wallet_address_problems);
+
+INSERT INTO wallets(address, created_at, updated_at, public_key, nonce)
+SELECT r.new_address, w.created_at, w.updated_at, w.public_key, w.nonce
+  FROM wallets w JOIN wallet_address_renames r ON r.old_address = w.address;
+
+UPDATE balances SET address = (SELECT new_address FROM wallet_address_renames WHERE old_address = address)
+ WHERE address IN (SELECT old_address FROM wallet_address_renames);
+UPDATE allowances SET owner = (SELECT new_address FROM wallet_address_renames WHERE old_address = owner)
+ WHERE owner IN (SELECT old_address FROM wallet_address_renames);
+UPDATE transfers SET from_address = (SELECT new_address FROM wallet_address_renames WHERE old_address = from_address)
+ WHERE from_address IN (SELECT old_address FROM wallet_address_renames);
+UPDATE transfers SET to_address = (SELECT new_address FROM wallet_address_renames WHERE old_address = to_address)
+ WHERE to_address IN (SELECT old_address FROM wallet_address_renames);
+UPDATE transfers SET spender = (SELECT new_address FROM wallet_address_renames WHERE old_address = spender)
+ WHERE spender IN (SELECT old_address FROM wallet_address_renames);
+UPDATE postings SET address = (SELECT new_address FROM wallet_address_renames WHERE old_address = address)
+ WHERE address IN (SELECT old_address FROM wallet_address_renames);
+UPDATE balance_checkpoints SET address = (SELECT new_address FROM wallet_address_renames WHERE old_address = address)
+ WHERE address IN (SELECT old_address FROM wallet_address_renames);
+
+-- Spenders and senders of idempotency keys need not be wallets, so the new
+-- spelling may already be in use; those rows keep the old one.
+UPDATE allowances SET spender = lower(spender)
+ WHERE spender IN (SELECT old_address FROM wallet_address_renames)
+   AND NOT EXISTS (SELECT 1 FROM allowances o
+                    WHERE o.owner = allowances.owner AND o.spender = lower(allowances.spender) AND o.token = allowances.token);
+UPDATE idempotency_keys SET from_address = lower(from_address)
+ WHERE from_address IN (SELECT old_address FROM wallet_address_renames)
+   AND NOT EXISTS (SELECT 1 FROM idempotency_keys o
+                    WHERE o.from_address = lower(idempotency_keys.from_address) AND o.key = idempotency_keys.key);
+
+DELETE FROM wallets WHERE address IN (SELECT old_address FROM wallet_address_renames);
+DROP TABLE wallet_address_renames;
@@ -0,0 +1,3 @@
+-- Whether the wallet opted in to receiving transfers, which the opt-in
+-- recipient policy requires of every recipient.
+ALTER TABLE wallets ADD COLUMN accepts_transfers INTEGER NOT NULL DEFAULT 0 CHECK (accepts_transfers IN (0, 1));
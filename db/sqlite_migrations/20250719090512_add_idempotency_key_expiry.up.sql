@@ -0,0 +1,5 @@
+-- When each key stops being honoured, fixed by the idempotency window in
+-- force when it was stored, so changing the window only affects keys stored
+-- afterwards. Keys stored before this column existed have none and expire
+-- after the current window.
+ALTER TABLE idempotency_keys ADD COLUMN expires_at INTEGER;
@@ -0,0 +1,83 @@
+package graph
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// Directives implements the access control directives of the schema.
+func Directives() generated.DirectiveRoot {
+	return generated.DirectiveRoot{
+		HasRole:     hasRole,
+		OwnsWallet:  ownsWallet,
+		ViewsWallet: viewsWallet,
+	}
+}
+
+// hasRole resolves the field only for callers holding role.
+func hasRole(ctx context.Context, obj any, next graphql.Resolver, role generated.Role) (any, error) {
+	if err := auth.RequireRole(ctx, authRole(role)); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// ownsWallet resolves the field only for callers owning the wallet named by
+// the field's argument arg.
+func ownsWallet(ctx context.Context, obj any, next graphql.Resolver, arg string) (any, error) {
+	address, ok := graphql.GetFieldContext(ctx).Args[arg].(string)
+	if !ok {
+		return nil, fmt.Errorf("@ownsWallet: field has no %q address argument", arg)
+	}
+	if err := auth.RequireWallet(ctx, address); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// viewsWallet resolves the field for callers owning the wallet named by the
+// field's argument arg or holding role. A null argument stands for every
+// wallet, which takes allWallets instead.
+func viewsWallet(ctx context.Context, obj any, next graphql.Resolver, arg string, role generated.Role, allWallets generated.Role) (any, error) {
+	var address string
+	switch a := graphql.GetFieldContext(ctx).Args[arg].(type) {
+	case string:
+		address = a
+	case *string:
+		if a != nil {
+			address = *a
+		}
+	case nil:
+	default:
+		return nil, fmt.Errorf("@viewsWallet: field has no %q address argument", arg)
+	}
+
+	if address == "" {
+		if err := auth.RequireRole(ctx, authRole(allWallets)); err != nil {
+			return nil, err
+		}
+		return next(ctx)
+	}
+	if auth.FromContext(ctx).Owns(address) {
+		return next(ctx)
+	}
+	if err := auth.RequireRole(ctx, authRole(role)); err != nil {
+		return nil, err
+	}
+	return next(ctx)
+}
+
+// authRole converts a Role of the schema, such as ISSUER, to auth's issuer.
+func authRole(r generated.Role) auth.Role {
+	return auth.Role(strings.ToLower(string(r)))
+}
+
+// schemaRole converts a role of auth to its name in the schema.
+func schemaRole(r auth.Role) generated.Role {
+	return generated.Role(strings.ToUpper(string(r)))
+}
@@ -0,0 +1,101 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/graph/scalars"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// Error codes set in the extensions.code field of errors returned to
+// clients.
+const (
+	CodeWalletNotFound        = "WALLET_NOT_FOUND"
+	CodeTokenNotFound         = "TOKEN_NOT_FOUND"
+	CodeInsufficientFunds     = "INSUFFICIENT_FUNDS"
+	CodeInsufficientAllowance = "INSUFFICIENT_ALLOWANCE"
+	CodeInvalidAmount         = "INVALID_AMOUNT"
+	CodeBadUserInput          = "BAD_USER_INPUT"
+	CodeConflict              = "CONFLICT"
+	CodeInvalidSignature      = "INVALID_SIGNATURE"
+	CodeInvalidNonce          = "INVALID_NONCE"
+	CodeInvalidAddress        = "INVALID_ADDRESS"
+	CodeUnknownRecipient      = "UNKNOWN_RECIPIENT"
+	CodeRecipientNotOptedIn   = "RECIPIENT_NOT_OPTED_IN"
+	CodeUnauthenticated       = "UNAUTHENTICATED"
+	CodeForbidden             = "FORBIDDEN"
+	CodeInternal              = "INTERNAL"
+)
+
+var errorCodes = []struct {
+	err  error
+	code string
+}{
+	{store.ErrWalletNotFound, CodeWalletNotFound},
+	{store.ErrTokenNotFound, CodeTokenNotFound},
+	{store.ErrInsufficientFunds, CodeInsufficientFunds},
+	{store.ErrInsufficientAllowance, CodeInsufficientAllowance},
+	{store.ErrInvalidAmount, CodeInvalidAmount},
+	{store.ErrInvalidArgument, CodeBadUserInput},
+	{scalars.ErrInvalidBigInt, CodeBadUserInput},
+	{store.ErrConflict, CodeConflict},
+	{store.ErrInvalidSignature, CodeInvalidSignature},
+	{store.ErrInvalidNonce, CodeInvalidNonce},
+	{store.ErrInvalidAddress, CodeInvalidAddress},
+	{store.ErrUnknownRecipient, CodeUnknownRecipient},
+	{store.ErrRecipientNotOptedIn, CodeRecipientNotOptedIn},
+	{auth.ErrUnauthenticated, CodeUnauthenticated},
+	{auth.ErrForbidden, CodeForbidden},
+}
+
+// ErrorPresenter sets extensions.code on errors the API knows about. Any
+// other error coming out of a resolver is an internal failure: it is logged
+// and replaced, so database errors never reach clients.
+func ErrorPresenter(ctx context.Context, err error) *gqlerror.Error {
+	gqlErr := graphql.DefaultErrorPresenter(ctx, err)
+
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			if gqlErr.Extensions == nil {
+				gqlErr.Extensions = map[string]any{}
+			}
+			gqlErr.Extensions["code"] = c.code
+			addDenial(gqlErr, err)
+			return gqlErr
+		}
+	}
+
+	// Errors gqlgen raises itself, such as parse and validation errors, wrap
+	// nothing and are safe to show.
+	if gqlErr.Err == nil {
+		return gqlErr
+	}
+
+	log.Printf("internal error at %v: %v", gqlErr.Path, gqlErr.Err)
+	return &gqlerror.Error{
+		Message:    "internal server error",
+		Path:       gqlErr.Path,
+		Locations:  gqlErr.Locations,
+		Extensions: map[string]any{"code": CodeInternal},
+	}
+}
+
+// addDenial tells clients refused by access control what they were missing,
+// in the requiredRole or requiredWallet extension.
+func addDenial(gqlErr *gqlerror.Error, err error) {
+	var denied *auth.DeniedError
+	if !errors.As(err, &denied) {
+		return
+	}
+	if denied.Role != "" {
+		gqlErr.Extensions["requiredRole"] = schemaRole(denied.Role)
+	}
+	if denied.Wallet != "" {
+		gqlErr.Extensions["requiredWallet"] = denied.Wallet
+	}
+}
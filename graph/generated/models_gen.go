@@ -3,23 +3,323 @@
 package generated
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
 	"time"
 )
 
+type BalanceChange struct {
+	Address string   `json:"address"`
+	Token   string   `json:"token"`
+	Balance *big.Int `json:"balance"`
+}
+
 type Mutation struct {
 }
 
+type PageInfo struct {
+	HasNextPage     bool    `json:"hasNextPage"`
+	HasPreviousPage bool    `json:"hasPreviousPage"`
+	StartCursor     *string `json:"startCursor,omitempty"`
+	EndCursor       *string `json:"endCursor,omitempty"`
+}
+
 type Query struct {
 }
 
+type Subscription struct {
+}
+
+type Token struct {
+	Symbol      string    `json:"symbol"`
+	Name        string    `json:"name"`
+	Decimals    int       `json:"decimals"`
+	TotalSupply *big.Int  `json:"totalSupply"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type TokenBalance struct {
+	Token   *Token   `json:"token"`
+	Balance *big.Int `json:"balance"`
+}
+
+type Transfer struct {
+	ID          string         `json:"id"`
+	FromAddress string         `json:"fromAddress"`
+	ToAddress   string         `json:"toAddress"`
+	Spender     *string        `json:"spender,omitempty"`
+	Token       string         `json:"token"`
+	Amount      *big.Int       `json:"amount"`
+	Status      TransferStatus `json:"status"`
+	Error       *string        `json:"error,omitempty"`
+	CreatedAt   time.Time      `json:"createdAt"`
+}
+
 type TransferInput struct {
-	ToAddress string `json:"to_address"`
-	Amount    int    `json:"amount"`
+	ToAddress string   `json:"to_address"`
+	Amount    *big.Int `json:"amount"`
 }
 
 type Wallet struct {
-	Address   string    `json:"address"`
-	Balance   int       `json:"balance"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	Address          string          `json:"address"`
+	Balance          *big.Int        `json:"balance"`
+	Balances         []*TokenBalance `json:"balances"`
+	PublicKey        *string         `json:"publicKey,omitempty"`
+	Nonce            int             `json:"nonce"`
+	AcceptsTransfers bool            `json:"acceptsTransfers"`
+	CreatedAt        time.Time       `json:"createdAt"`
+	UpdatedAt        time.Time       `json:"updatedAt"`
+}
+
+type WalletConnection struct {
+	Edges    []*WalletEdge `json:"edges"`
+	PageInfo *PageInfo     `json:"pageInfo"`
+}
+
+type WalletEdge struct {
+	Cursor string  `json:"cursor"`
+	Node   *Wallet `json:"node"`
+}
+
+type WalletFilter struct {
+	MinBalance    *big.Int   `json:"minBalance,omitempty"`
+	MaxBalance    *big.Int   `json:"maxBalance,omitempty"`
+	CreatedAfter  *time.Time `json:"createdAfter,omitempty"`
+	CreatedBefore *time.Time `json:"createdBefore,omitempty"`
+}
+
+type WalletOrder struct {
+	Field     WalletOrderField `json:"field"`
+	Direction OrderDirection   `json:"direction"`
+}
+
+type OrderDirection string
+
+const (
+	OrderDirectionAsc  OrderDirection = "ASC"
+	OrderDirectionDesc OrderDirection = "DESC"
+)
+
+var AllOrderDirection = []OrderDirection{
+	OrderDirectionAsc,
+	OrderDirectionDesc,
+}
+
+func (e OrderDirection) IsValid() bool {
+	switch e {
+	case OrderDirectionAsc, OrderDirectionDesc:
+		return true
+	}
+	return false
+}
+
+func (e OrderDirection) String() string {
+	return string(e)
+}
+
+func (e *OrderDirection) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = OrderDirection(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid OrderDirection", str)
+	}
+	return nil
+}
+
+func (e OrderDirection) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *OrderDirection) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e OrderDirection) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
+
+type Role string
+
+const (
+	RoleViewer   Role = "VIEWER"
+	RoleUser     Role = "USER"
+	RoleOperator Role = "OPERATOR"
+	RoleIssuer   Role = "ISSUER"
+	RoleAdmin    Role = "ADMIN"
+)
+
+var AllRole = []Role{
+	RoleViewer,
+	RoleUser,
+	RoleOperator,
+	RoleIssuer,
+	RoleAdmin,
+}
+
+func (e Role) IsValid() bool {
+	switch e {
+	case RoleViewer, RoleUser, RoleOperator, RoleIssuer, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+func (e Role) String() string {
+	return string(e)
+}
+
+func (e *Role) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = Role(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid Role", str)
+	}
+	return nil
+}
+
+func (e Role) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *Role) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e Role) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
+
+type TransferStatus string
+
+const (
+	TransferStatusSucceeded TransferStatus = "SUCCEEDED"
+	TransferStatusRejected  TransferStatus = "REJECTED"
+)
+
+var AllTransferStatus = []TransferStatus{
+	TransferStatusSucceeded,
+	TransferStatusRejected,
+}
+
+func (e TransferStatus) IsValid() bool {
+	switch e {
+	case TransferStatusSucceeded, TransferStatusRejected:
+		return true
+	}
+	return false
+}
+
+func (e TransferStatus) String() string {
+	return string(e)
+}
+
+func (e *TransferStatus) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = TransferStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid TransferStatus", str)
+	}
+	return nil
+}
+
+func (e TransferStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *TransferStatus) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e TransferStatus) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
+}
+
+type WalletOrderField string
+
+const (
+	WalletOrderFieldBalance   WalletOrderField = "BALANCE"
+	WalletOrderFieldCreatedAt WalletOrderField = "CREATED_AT"
+	WalletOrderFieldAddress   WalletOrderField = "ADDRESS"
+)
+
+var AllWalletOrderField = []WalletOrderField{
+	WalletOrderFieldBalance,
+	WalletOrderFieldCreatedAt,
+	WalletOrderFieldAddress,
+}
+
+func (e WalletOrderField) IsValid() bool {
+	switch e {
+	case WalletOrderFieldBalance, WalletOrderFieldCreatedAt, WalletOrderFieldAddress:
+		return true
+	}
+	return false
+}
+
+func (e WalletOrderField) String() string {
+	return string(e)
+}
+
+func (e *WalletOrderField) UnmarshalGQL(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = WalletOrderField(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid WalletOrderField", str)
+	}
+	return nil
+}
+
+func (e WalletOrderField) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+func (e *WalletOrderField) UnmarshalJSON(b []byte) error {
+	s, err := strconv.Unquote(string(b))
+	if err != nil {
+		return err
+	}
+	return e.UnmarshalGQL(s)
+}
+
+func (e WalletOrderField) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	e.MarshalGQL(&buf)
+	return buf.Bytes(), nil
 }
@@ -1,7 +1,96 @@
 package graph
 
-import "github.com/zanpatryk/tokentransferapi/store"
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+const (
+	defaultTransfersPageSize = 50
+	maxTransfersPageSize     = 500
+
+	defaultWalletsPageSize = 50
+)
 
 type Resolver struct {
 	Store store.WalletStore
+
+	// SigningDomain is the domain signed transfers must be signed for.
+	SigningDomain string
+}
+
+// derefToken returns the token a request asked for, or the default token
+// when the argument was left out.
+func derefToken(token *string) string {
+	if token == nil || *token == "" {
+		return store.DefaultToken
+	}
+	return *token
+}
+
+// verifyTransfer checks that signature signs the transfer of ops out of from
+// described by opts, with the key registered for from, and marks opts as
+// signed with that key. The store checks again, in the transaction that
+// moves the funds, that the key is still the wallet's and the nonce unused.
+func (r *Resolver) verifyTransfer(ctx context.Context, from string, ops []store.TransferOp, opts *store.TransferOptions, signature string) error {
+	sig, err := auth.ParseSignature(signature)
+	if err != nil {
+		return err
+	}
+	if opts.Nonce == nil {
+		return fmt.Errorf("%w: a signed transfer needs a nonce", store.ErrInvalidNonce)
+	}
+	k, err := r.Store.GetWalletKey(ctx, from)
+	if err != nil {
+		return fmt.Errorf("sender %w", err)
+	}
+
+	intent := auth.TransferIntent{
+		Domain: r.SigningDomain,
+		From:   from,
+		Token:  opts.Token,
+		Legs:   ops,
+		Nonce:  *opts.Nonce,
+	}
+	if err := auth.VerifyTransfer(k.PublicKey, intent, sig); err != nil {
+		return err
+	}
+	opts.SignedWith = k.PublicKey
+	return nil
+}
+
+// verifyApproval checks that signature signs the approval of amount of token
+// by owner to spender, with the key registered for owner, and marks opts as
+// signed with that key. Like a transfer, the store checks the key and nonce
+// again when it saves the allowance.
+func (r *Resolver) verifyApproval(ctx context.Context, owner, spender, token string, amount *big.Int, opts *store.ApproveOptions, signature string) error {
+	sig, err := auth.ParseSignature(signature)
+	if err != nil {
+		return err
+	}
+	if opts.Nonce == nil {
+		return fmt.Errorf("%w: a signed approval needs a nonce", store.ErrInvalidNonce)
+	}
+	k, err := r.Store.GetWalletKey(ctx, owner)
+	if err != nil {
+		return fmt.Errorf("owner %w", err)
+	}
+
+	intent := auth.ApprovalIntent{
+		Domain:  r.SigningDomain,
+		Owner:   owner,
+		Spender: spender,
+		Token:   token,
+		Amount:  amount,
+		Nonce:   *opts.Nonce,
+	}
+	if err := auth.VerifyApproval(k.PublicKey, intent, sig); err != nil {
+		return err
+	}
+	opts.SignedWith = k.PublicKey
+	return nil
 }
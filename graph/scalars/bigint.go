@@ -0,0 +1,58 @@
+package scalars
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// ErrInvalidBigInt is wrapped by every error UnmarshalBigInt returns.
+var ErrInvalidBigInt = errors.New("invalid BigInt")
+
+// MarshalBigInt writes an arbitrary-precision integer as a JSON string, so
+// clients never lose precision to float64 when parsing responses.
+func MarshalBigInt(b *big.Int) graphql.Marshaler {
+	if b == nil {
+		return graphql.Null
+	}
+	return graphql.WriterFunc(func(w io.Writer) {
+		_, _ = io.WriteString(w, strconv.Quote(b.String()))
+	})
+}
+
+// UnmarshalBigInt accepts a base-10 integer given either as a string or as a
+// JSON number without a fractional part.
+func UnmarshalBigInt(v any) (*big.Int, error) {
+	switch v := v.(type) {
+	case string:
+		return parseBigInt(v)
+	case json.Number:
+		return parseBigInt(v.String())
+	case int:
+		return big.NewInt(int64(v)), nil
+	case int64:
+		return big.NewInt(v), nil
+	case float64:
+		f := new(big.Float).SetFloat64(v)
+		if !f.IsInt() {
+			return nil, fmt.Errorf("%w: must be an integer, got %v", ErrInvalidBigInt, v)
+		}
+		i, _ := f.Int(nil)
+		return i, nil
+	default:
+		return nil, fmt.Errorf("%w: must be a string or an integer, got %T", ErrInvalidBigInt, v)
+	}
+}
+
+func parseBigInt(s string) (*big.Int, error) {
+	i, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("%w: must be a base-10 integer, got %q", ErrInvalidBigInt, s)
+	}
+	return i, nil
+}
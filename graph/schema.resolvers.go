@@ -6,41 +6,363 @@ package graph
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
+	"math/big"
+	"time"
 
+	"github.com/zanpatryk/tokentransferapi/auth"
 	"github.com/zanpatryk/tokentransferapi/graph/generated"
 	"github.com/zanpatryk/tokentransferapi/store"
 )
 
+// Address is the resolver for the address field.
+func (r *balanceChangeResolver) Address(ctx context.Context, obj *generated.BalanceChange) (string, error) {
+	return store.ChecksumAddress(obj.Address), nil
+}
+
+// CreateWallet is the resolver for the createWallet field.
+func (r *mutationResolver) CreateWallet(ctx context.Context, address string) (*generated.Wallet, error) {
+	return r.Store.CreateIfNotExists(ctx, address, new(big.Int))
+}
+
 // Transfer is the resolver for the transfer field.
-func (r *mutationResolver) Transfer(ctx context.Context, fromAddress string, transfer generated.TransferInput) (int, error) {
-	op := store.TransferOp{
-		To:     transfer.ToAddress,
-		Amount: transfer.Amount,
+func (r *mutationResolver) Transfer(ctx context.Context, fromAddress string, transfers []*generated.TransferInput, idempotencyKey *string, token *string, nonce *int, signature *string) (*big.Int, error) {
+	ops := make([]store.TransferOp, 0, len(transfers))
+	for _, t := range transfers {
+		// Only from_address is checked for ownership, so no leg may debit
+		// the recipient instead.
+		if t.Amount.Sign() <= 0 {
+			return nil, fmt.Errorf("Transfer failed: %w: amount must be positive", store.ErrInvalidAmount)
+		}
+		ops = append(ops, store.TransferOp{
+			To:     t.ToAddress,
+			Amount: t.Amount,
+		})
+	}
+
+	var opts store.TransferOptions
+	if idempotencyKey != nil {
+		opts.IdempotencyKey = *idempotencyKey
+	}
+	opts.Token = derefToken(token)
+	if nonce != nil {
+		if *nonce < 0 {
+			return nil, fmt.Errorf("Transfer failed: %w: must not be negative", store.ErrInvalidNonce)
+		}
+		n := uint64(*nonce)
+		opts.Nonce = &n
+	}
+	if signature != nil {
+		if err := r.verifyTransfer(ctx, fromAddress, ops, &opts, *signature); err != nil {
+			return nil, fmt.Errorf("Transfer failed: %w", err)
+		}
 	}
 
-	newBalance, err := r.Store.Transfer(ctx, fromAddress, op)
+	newBalance, err := r.Store.Transfer(ctx, fromAddress, ops, opts)
 	if err != nil {
 		return newBalance, fmt.Errorf("Transfer failed: %w", err)
 	}
 	return newBalance, err
 }
 
+// RegisterWalletKey is the resolver for the registerWalletKey field.
+func (r *mutationResolver) RegisterWalletKey(ctx context.Context, address string, publicKey string) (*generated.Wallet, error) {
+	key, err := auth.ParseWalletKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Store.RegisterWalletKey(ctx, address, key); err != nil {
+		return nil, fmt.Errorf("RegisterWalletKey failed: %w", err)
+	}
+	return r.Store.GetByAddress(ctx, address)
+}
+
+// SetAcceptsTransfers is the resolver for the setAcceptsTransfers field.
+func (r *mutationResolver) SetAcceptsTransfers(ctx context.Context, address string, accepts bool) (*generated.Wallet, error) {
+	if err := r.Store.SetAcceptsTransfers(ctx, address, accepts); err != nil {
+		return nil, fmt.Errorf("SetAcceptsTransfers failed: %w", err)
+	}
+	return r.Store.GetByAddress(ctx, address)
+}
+
+// CreateToken is the resolver for the createToken field.
+func (r *mutationResolver) CreateToken(ctx context.Context, symbol string, name string, decimals int) (*generated.Token, error) {
+	return r.Store.CreateToken(ctx, symbol, name, decimals)
+}
+
+// Mint is the resolver for the mint field.
+func (r *mutationResolver) Mint(ctx context.Context, to string, amount *big.Int, token *string) (*big.Int, error) {
+	newBalance, err := r.Store.Mint(ctx, derefToken(token), to, amount)
+	if err != nil {
+		return nil, fmt.Errorf("Mint failed: %w", err)
+	}
+	return newBalance, nil
+}
+
+// Burn is the resolver for the burn field.
+func (r *mutationResolver) Burn(ctx context.Context, from string, amount *big.Int, token *string) (*big.Int, error) {
+	newBalance, err := r.Store.Burn(ctx, derefToken(token), from, amount)
+	if err != nil {
+		return nil, fmt.Errorf("Burn failed: %w", err)
+	}
+	return newBalance, nil
+}
+
+// Approve is the resolver for the approve field.
+func (r *mutationResolver) Approve(ctx context.Context, owner string, spender string, amount *big.Int, token *string, nonce *int, signature *string) (*big.Int, error) {
+	var opts store.ApproveOptions
+	if nonce != nil {
+		if *nonce < 0 {
+			return nil, fmt.Errorf("Approve failed: %w: must not be negative", store.ErrInvalidNonce)
+		}
+		n := uint64(*nonce)
+		opts.Nonce = &n
+	}
+	if signature != nil {
+		if err := r.verifyApproval(ctx, owner, spender, derefToken(token), amount, &opts, *signature); err != nil {
+			return nil, fmt.Errorf("Approve failed: %w", err)
+		}
+	}
+
+	allowance, err := r.Store.Approve(ctx, derefToken(token), owner, spender, amount, opts)
+	if err != nil {
+		return nil, fmt.Errorf("Approve failed: %w", err)
+	}
+	return allowance, nil
+}
+
+// TransferFrom is the resolver for the transferFrom field.
+func (r *mutationResolver) TransferFrom(ctx context.Context, spender string, from string, to string, amount *big.Int, token *string, idempotencyKey *string) (*big.Int, error) {
+	if amount.Sign() <= 0 {
+		return nil, fmt.Errorf("Transfer failed: %w: amount must be positive", store.ErrInvalidAmount)
+	}
+	opts := store.TransferOptions{
+		Token:   derefToken(token),
+		Spender: spender,
+	}
+	if idempotencyKey != nil {
+		opts.IdempotencyKey = *idempotencyKey
+	}
+
+	newBalance, err := r.Store.Transfer(ctx, from, []store.TransferOp{{To: to, Amount: amount}}, opts)
+	if err != nil {
+		return newBalance, fmt.Errorf("Transfer failed: %w", err)
+	}
+	return newBalance, nil
+}
+
 // Wallet is the resolver for the wallet field.
-func (r *queryResolver) Wallet(ctx context.Context, address string) (*generated.Wallet, error) {
+func (r *queryResolver) Wallet(ctx context.Context, address string, asOf *time.Time) (*generated.Wallet, error) {
+	if asOf != nil {
+		return r.Store.GetByAddressAsOf(ctx, address, *asOf)
+	}
 	return r.Store.GetByAddress(ctx, address)
 }
 
 // Wallets is the resolver for the wallets field.
-func (r *queryResolver) Wallets(ctx context.Context) ([]*generated.Wallet, error) {
-	return r.Store.ListAll(ctx)
+func (r *queryResolver) Wallets(ctx context.Context, first *int, after *string, orderBy *generated.WalletOrder, filter *generated.WalletFilter, asOf *time.Time) (*generated.WalletConnection, error) {
+	q := store.WalletQuery{First: defaultWalletsPageSize}
+	if first != nil {
+		q.First = *first
+	}
+	if after != nil {
+		q.After = *after
+	}
+	if orderBy != nil {
+		q.OrderBy = *orderBy
+	}
+	if filter != nil {
+		q.Filter = *filter
+	}
+	q.AsOf = asOf
+
+	return r.Store.ListWallets(ctx, q)
+}
+
+// Transfers is the resolver for the transfers field.
+func (r *queryResolver) Transfers(ctx context.Context, address *string, first *int, after *string) ([]*generated.Transfer, error) {
+	limit := defaultTransfersPageSize
+	if first != nil {
+		if *first <= 0 || *first > maxTransfersPageSize {
+			return nil, fmt.Errorf("%w: first must be between 1 and %d", store.ErrInvalidArgument, maxTransfersPageSize)
+		}
+		limit = *first
+	}
+
+	var addr, cursor string
+	if address != nil {
+		addr = *address
+	}
+	if after != nil {
+		cursor = *after
+	}
+
+	return r.Store.ListTransfers(ctx, addr, limit, cursor)
+}
+
+// Token is the resolver for the token field.
+func (r *queryResolver) Token(ctx context.Context, symbol string) (*generated.Token, error) {
+	return r.Store.GetToken(ctx, symbol)
+}
+
+// Tokens is the resolver for the tokens field.
+func (r *queryResolver) Tokens(ctx context.Context) ([]*generated.Token, error) {
+	return r.Store.ListTokens(ctx)
+}
+
+// TotalSupply is the resolver for the totalSupply field.
+func (r *queryResolver) TotalSupply(ctx context.Context, token *string) (*big.Int, error) {
+	t, err := r.Store.GetToken(ctx, derefToken(token))
+	if err != nil {
+		return nil, err
+	}
+	return t.TotalSupply, nil
+}
+
+// Allowance is the resolver for the allowance field.
+func (r *queryResolver) Allowance(ctx context.Context, owner string, spender string, token *string) (*big.Int, error) {
+	return r.Store.Allowance(ctx, derefToken(token), owner, spender)
 }
 
+// SigningDomain is the resolver for the signingDomain field.
+func (r *queryResolver) SigningDomain(ctx context.Context) (string, error) {
+	return r.Resolver.SigningDomain, nil
+}
+
+// BalanceChanged is the resolver for the balanceChanged field.
+func (r *subscriptionResolver) BalanceChanged(ctx context.Context, address string) (<-chan *generated.BalanceChange, error) {
+	a, err := store.ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	address = a.String()
+
+	events, err := r.Store.Subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *generated.BalanceChange, 1)
+	go func() {
+		defer close(out)
+		for ev := range events {
+			if ev.Balance == nil || ev.Balance.Address != address {
+				continue
+			}
+			select {
+			case out <- ev.Balance:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// TransferCreated is the resolver for the transferCreated field.
+func (r *subscriptionResolver) TransferCreated(ctx context.Context, address *string) (<-chan *generated.Transfer, error) {
+	if address != nil {
+		a, err := store.ParseAddress(*address)
+		if err != nil {
+			return nil, err
+		}
+		canonical := a.String()
+		address = &canonical
+	}
+
+	events, err := r.Store.Subscribe(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan *generated.Transfer, 1)
+	go func() {
+		defer close(out)
+		for ev := range events {
+			t := ev.Transfer
+			if t == nil || (address != nil && t.FromAddress != *address && t.ToAddress != *address) {
+				continue
+			}
+			select {
+			case out <- t:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// FromAddress is the resolver for the fromAddress field.
+func (r *transferResolver) FromAddress(ctx context.Context, obj *generated.Transfer) (string, error) {
+	return store.ChecksumAddress(obj.FromAddress), nil
+}
+
+// ToAddress is the resolver for the toAddress field.
+func (r *transferResolver) ToAddress(ctx context.Context, obj *generated.Transfer) (string, error) {
+	return store.ChecksumAddress(obj.ToAddress), nil
+}
+
+// Spender is the resolver for the spender field.
+func (r *transferResolver) Spender(ctx context.Context, obj *generated.Transfer) (*string, error) {
+	if obj.Spender == nil {
+		return nil, nil
+	}
+	spender := store.ChecksumAddress(*obj.Spender)
+	return &spender, nil
+}
+
+// Address is the resolver for the address field.
+func (r *walletResolver) Address(ctx context.Context, obj *generated.Wallet) (string, error) {
+	return store.ChecksumAddress(obj.Address), nil
+}
+
+// PublicKey is the resolver for the publicKey field.
+func (r *walletResolver) PublicKey(ctx context.Context, obj *generated.Wallet) (*string, error) {
+	k, err := r.Store.GetWalletKey(ctx, obj.Address)
+	if err != nil || k.PublicKey == nil {
+		return nil, err
+	}
+	key := hex.EncodeToString(k.PublicKey)
+	return &key, nil
+}
+
+// Nonce is the resolver for the nonce field.
+func (r *walletResolver) Nonce(ctx context.Context, obj *generated.Wallet) (int, error) {
+	k, err := r.Store.GetWalletKey(ctx, obj.Address)
+	if err != nil {
+		return 0, err
+	}
+	return int(k.Nonce), nil
+}
+
+// AcceptsTransfers is the resolver for the acceptsTransfers field.
+func (r *walletResolver) AcceptsTransfers(ctx context.Context, obj *generated.Wallet) (bool, error) {
+	return r.Store.AcceptsTransfers(ctx, obj.Address)
+}
+
+// BalanceChange returns generated.BalanceChangeResolver implementation.
+func (r *Resolver) BalanceChange() generated.BalanceChangeResolver { return &balanceChangeResolver{r} }
+
 // Mutation returns generated.MutationResolver implementation.
 func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
 
 // Query returns generated.QueryResolver implementation.
 func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 
+// Subscription returns generated.SubscriptionResolver implementation.
+func (r *Resolver) Subscription() generated.SubscriptionResolver { return &subscriptionResolver{r} }
+
+// Transfer returns generated.TransferResolver implementation.
+func (r *Resolver) Transfer() generated.TransferResolver { return &transferResolver{r} }
+
+// Wallet returns generated.WalletResolver implementation.
+func (r *Resolver) Wallet() generated.WalletResolver { return &walletResolver{r} }
+
+type balanceChangeResolver struct{ *Resolver }
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
+type transferResolver struct{ *Resolver }
+type walletResolver struct{ *Resolver }
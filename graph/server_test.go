@@ -0,0 +1,150 @@
+package graph_test
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/client"
+	"github.com/zanpatryk/tokentransferapi/auth"
+	"github.com/zanpatryk/tokentransferapi/graph"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// addr returns the i-th test address.
+func addr(i int) string {
+	return fmt.Sprintf("0x%040x", i)
+}
+
+// newClient serves the API on top of s to the callers admin, viewer and
+// alice, the owner of addr(1).
+func newClient(t *testing.T, s store.WalletStore) *client.Client {
+	t.Helper()
+	authenticators := []auth.Authenticator{
+		auth.StaticKey("admin", auth.Principal{Subject: "admin", Roles: []auth.Role{auth.RoleAdmin}}),
+		auth.StaticKey("viewer", auth.Principal{Subject: "viewer", Roles: []auth.Role{auth.RoleViewer}}),
+		auth.StaticKey("alice", auth.Principal{Subject: "alice", Wallets: []string{addr(1)}}),
+	}
+	server := graph.NewServer(&graph.Resolver{Store: s, SigningDomain: auth.DefaultSigningDomain}, authenticators...)
+	return client.New(auth.Middleware(authenticators...)(server))
+}
+
+// bearer authenticates a request as the caller holding key, or leaves it
+// anonymous if key is empty.
+func bearer(key string) client.Option {
+	return func(bd *client.Request) {
+		if key != "" {
+			bd.HTTP.Header.Set("Authorization", "Bearer "+key)
+		}
+	}
+}
+
+func TestTransfersAccess(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewInMemWalletStore()
+	if _, err := s.CreateIfNotExists(ctx, addr(1), big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{{To: addr(2), Amount: big.NewInt(10)}}, store.TransferOptions{}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	c := newClient(t, s)
+
+	for _, tt := range []struct {
+		caller  string
+		address string
+		allowed bool
+	}{
+		{"", "", false},
+		{"", addr(1), false},
+		{"alice", addr(1), true},
+		{"alice", "0x" + strings.ToUpper(addr(1)[2:]), true},
+		{"alice", addr(2), false},
+		{"alice", "", false},
+		{"viewer", addr(2), true},
+		{"viewer", "", false},
+		{"admin", "", true},
+	} {
+		query := `query { transfers { id } }`
+		if tt.address != "" {
+			query = fmt.Sprintf(`query { transfers(address: %q) { id } }`, tt.address)
+		}
+		var resp struct {
+			Transfers []struct{ ID string }
+		}
+		err := c.Post(query, &resp, bearer(tt.caller))
+		if tt.allowed && (err != nil || len(resp.Transfers) != 1) {
+			t.Errorf("%q listing transfers of %q: Expected one transfer, got: %+v, %v", tt.caller, tt.address, resp.Transfers, err)
+		}
+		if !tt.allowed && err == nil {
+			t.Errorf("%q listing transfers of %q: Expected to be refused", tt.caller, tt.address)
+		}
+	}
+}
+
+func TestSubscriptionAccess(t *testing.T) {
+	ctx := context.Background()
+	s := store.NewInMemWalletStore()
+	if _, err := s.CreateIfNotExists(ctx, addr(1), big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	c := newClient(t, s)
+
+	// receive subscribes and returns the first event, transferring until one
+	// comes through since the subscription starts some time after the
+	// connection is acknowledged.
+	receive := func(query string, payload map[string]any, opts ...client.Option) error {
+		t.Helper()
+		sub := c.WebsocketWithPayload(query, payload, opts...)
+		defer sub.Close()
+
+		done := make(chan error, 1)
+		go func() {
+			var resp map[string]any
+			done <- sub.Next(&resp)
+		}()
+		for deadline := time.After(5 * time.Second); ; {
+			select {
+			case err := <-done:
+				return err
+			case <-deadline:
+				t.Fatalf("%s: No event or error received", query)
+			case <-time.After(50 * time.Millisecond):
+				if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{{To: addr(2), Amount: big.NewInt(1)}}, store.TransferOptions{}); err != nil {
+					t.Fatalf("Transfer error: %v", err)
+				}
+			}
+		}
+	}
+
+	all := `subscription { transferCreated { id } }`
+	mine := fmt.Sprintf(`subscription { balanceChanged(address: %q) { balance } }`, addr(1))
+
+	if err := receive(all, nil); err == nil {
+		t.Errorf("Anonymous subscriber to every transfer: Expected to be refused")
+	}
+	if err := receive(mine, nil); err == nil {
+		t.Errorf("Anonymous subscriber to a wallet: Expected to be refused")
+	}
+	if err := receive(all, map[string]any{"Authorization": "Bearer alice"}); err == nil {
+		t.Errorf("alice subscribing to every transfer: Expected to be refused")
+	}
+
+	if err := receive(mine, map[string]any{"Authorization": "Bearer nobody"}); err == nil {
+		t.Errorf("Subscriber with a token nobody accepts: Expected to be refused")
+	}
+
+	// Callers are identified by the init payload, or by the upgrade request.
+	if err := receive(mine, map[string]any{"Authorization": "Bearer alice"}); err != nil {
+		t.Errorf("alice subscribing to her wallet: Expected an event, got: %v", err)
+	}
+	if err := receive(all, map[string]any{"Authorization": "Bearer admin"}); err != nil {
+		t.Errorf("admin subscribing to every transfer: Expected an event, got: %v", err)
+	}
+	if err := receive(all, nil, bearer("admin")); err != nil {
+		t.Errorf("admin subscribing with a header: Expected an event, got: %v", err)
+	}
+}
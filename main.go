@@ -2,20 +2,16 @@ package main
 
 import (
 	"context"
-	"database/sql"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
-	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/99designs/gqlgen/graphql/playground"
-	"github.com/golang-migrate/migrate/v4"
-	postgresDriver "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
+	"github.com/zanpatryk/tokentransferapi/auth"
 	"github.com/zanpatryk/tokentransferapi/graph"
-	"github.com/zanpatryk/tokentransferapi/graph/generated"
 	"github.com/zanpatryk/tokentransferapi/store"
 )
 
@@ -26,6 +22,9 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Exit(runReconcile(os.Args[2:]))
+	}
 
 	port := os.Getenv("PORT")
 
@@ -33,90 +32,118 @@ func main() {
 		port = "8080"
 	}
 
-	dbUrl := os.Getenv("DATABASE_URL")
-	if dbUrl == "" {
-		log.Fatal("DATABASE_URL is not set !")
+	resolverStore, closeStore, err := openStore(context.Background())
+	if err != nil {
+		log.Fatal(err)
 	}
+	defer closeStore()
 
-	migrationsPath := os.Getenv("MIGRATIONS_PATH")
-	if migrationsPath == "" {
-		log.Fatal("MIGRATIONS_PATH must be set")
+	if path := os.Getenv("GENESIS_FILE"); path != "" {
+		if err := applyGenesis(context.Background(), resolverStore, path); err != nil {
+			log.Fatalf("Failed to apply genesis: %v", err)
+		}
 	}
 
-	sqlDB, errSql := sql.Open("postgres", dbUrl)
-	if errSql != nil {
-		log.Fatalf("could not open sql.DB: %v", errSql)
-
+	signingDomain := os.Getenv("SIGNING_DOMAIN")
+	if signingDomain == "" {
+		signingDomain = auth.DefaultSigningDomain
 	}
-	defer sqlDB.Close()
 
-	driver, err := postgresDriver.WithInstance(sqlDB, &postgresDriver.Config{})
+	authenticators, err := authenticators(resolverStore)
 	if err != nil {
-		log.Fatalf("could not create migrate driver: %v", err)
+		log.Fatal(err)
 	}
+	server := graph.NewServer(&graph.Resolver{Store: resolverStore, SigningDomain: signingDomain}, authenticators...)
 
-	m, err := migrate.NewWithDatabaseInstance(
-		"file://"+migrationsPath,
-		"postgres",
-		driver,
-	)
-	if err != nil {
-		log.Fatalf("failed to initialize migrations: %v", err)
+	http.Handle("/", playground.Handler("BTP Token Playground", "/graphql"))
+	http.Handle("/graphql", auth.Middleware(authenticators...)(server))
+
+	if interval := os.Getenv("RECONCILE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			log.Fatalf("invalid RECONCILE_INTERVAL %q", interval)
+		}
+		go reconcileEvery(context.Background(), resolverStore, d)
 	}
 
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		log.Fatalf("migration failed: %v", err)
-	}
-	log.Println("Database migrations applied")
+	log.Printf("Server started at http://localhost:%s/ (Playground)", port)
+	log.Fatal(http.ListenAndServe(":"+port, nil))
+}
 
-	pool, err := pgxpool.New(context.Background(), dbUrl)
+// openStore opens the backend selected by STORE_BACKEND with the settings
+// taken from the environment.
+func openStore(ctx context.Context) (store.WalletStore, func(), error) {
+	cfg, err := store.ConfigFromEnv()
 	if err != nil {
-		log.Fatalf("failed to connect to Postgres pool: %v", err)
+		return nil, nil, err
 	}
-	defer pool.Close()
-
-	resolverStore := store.NewPostgresWalletStore(pool)
-
-	_, errAddr1 := resolverStore.CreateIfNotExists(
-		context.Background(),
-		"0x0000000000000000000000000000000000000000",
-		1000,
-	)
 
-	if errAddr1 != nil {
-		log.Fatalf("Failed to set initial wallet: %v", errAddr1)
+	s, closeStore, err := store.Open(ctx, cfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s store: %v", cfg.Backend, err)
 	}
+	log.Printf("Using %s store", cfg.Backend)
+	return s, closeStore, nil
+}
 
-	_, errAddr2 := resolverStore.CreateIfNotExists(
-		context.Background(),
-		"0x0000000000000000000000000000000000000001",
-		1000,
-	)
+// authenticators returns the ways callers can identify themselves: API keys
+// kept in the store, plus the issuer key and JSON Web Tokens when they are
+// configured.
+func authenticators(s store.WalletStore) ([]auth.Authenticator, error) {
+	var as []auth.Authenticator
 
-	if errAddr2 != nil {
-		log.Fatalf("Failed to set initial wallet: %v", errAddr2)
+	if key := os.Getenv("ISSUER_API_KEY"); key != "" {
+		as = append(as, auth.StaticKey(key, auth.Principal{Subject: "issuer", Roles: []auth.Role{auth.RoleIssuer}}))
 	}
 
-	_, errAddr3 := resolverStore.CreateIfNotExists(
-		context.Background(),
-		"0x0000000000000000000000000000000000000002",
-		1000,
-	)
+	as = append(as, auth.APIKeys(s))
 
-	if errAddr3 != nil {
-		log.Fatalf("Failed to set initial wallet: %v", errAddr3)
+	cfg := auth.JWTConfig{
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Audience: os.Getenv("JWT_AUDIENCE"),
+		Leeway:   time.Minute,
 	}
+	if secret := os.Getenv("JWT_HS256_SECRET"); secret != "" {
+		cfg.HS256Secret = []byte(secret)
+	}
+	if path := os.Getenv("JWT_ED25519_PUBLIC_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read JWT_ED25519_PUBLIC_KEY_FILE: %v", err)
+		}
+		if cfg.EdDSAKey, err = auth.ParseEd25519PublicKey(data); err != nil {
+			return nil, fmt.Errorf("invalid JWT_ED25519_PUBLIC_KEY_FILE %s: %v", path, err)
+		}
+	}
+	if cfg.HS256Secret != nil || cfg.EdDSAKey != nil {
+		jwt, err := auth.JWT(cfg)
+		if err != nil {
+			return nil, err
+		}
+		as = append(as, jwt)
+	}
+	return as, nil
+}
 
-	server := handler.NewDefaultServer(
-		generated.NewExecutableSchema(
-			generated.Config{Resolvers: &graph.Resolver{Store: resolverStore}},
-		),
-	)
-
-	http.Handle("/", playground.Handler("BTP Token Playground", "/graphql"))
-
-	http.Handle("/graphql", server)
+// applyGenesis seeds the store from the genesis file at path, unless it was
+// seeded before. A file that changed since is ignored with a warning.
+func applyGenesis(ctx context.Context, s store.WalletStore, path string) error {
+	g, err := store.LoadGenesis(path)
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Server started at http://localhost:%s/ (Playground)", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	rec, applied, err := s.ApplyGenesis(ctx, g)
+	if err != nil {
+		return err
+	}
+	if applied {
+		log.Printf("Applied genesis %s (%s): %d tokens, %d wallets", path, g.Checksum, len(g.Tokens), len(g.Wallets))
+		return nil
+	}
+	if rec.Checksum != g.Checksum {
+		log.Printf("WARNING: %s has changed since genesis was applied at %s (%s, now %s); the changes are ignored",
+			path, rec.AppliedAt.Format(time.RFC3339), rec.Checksum, g.Checksum)
+	}
+	return nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// Exit codes of the reconcile subcommand.
+const (
+	reconcileOK          = 0
+	reconcileFailed      = 1
+	reconcileCouldNotRun = 2
+)
+
+// runReconcile checks the store against its invariants once, writes the
+// report as JSON and returns the exit code: reconcileFailed if anything is
+// off, reconcileCouldNotRun if the check itself failed.
+func runReconcile(args []string) int {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	out := flags.String("out", "-", "file to write the JSON report to, - for standard output")
+	timeout := flags.Duration("timeout", 5*time.Minute, "give up after this long")
+	if err := flags.Parse(args); err != nil {
+		return reconcileCouldNotRun
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	s, closeStore, err := openStore(ctx)
+	if err != nil {
+		log.Print(err)
+		return reconcileCouldNotRun
+	}
+	defer closeStore()
+
+	report, err := store.Reconcile(ctx, s)
+	if err != nil {
+		log.Printf("reconcile: %v", err)
+		return reconcileCouldNotRun
+	}
+
+	if err := writeReport(*out, report); err != nil {
+		log.Printf("reconcile: write report: %v", err)
+		return reconcileCouldNotRun
+	}
+	if !report.OK {
+		log.Printf("reconcile: %d discrepancies, %d unbalanced journal entries",
+			len(report.Discrepancies), len(report.UnbalancedEntries))
+		return reconcileFailed
+	}
+	return reconcileOK
+}
+
+func writeReport(path string, report *store.ReconcileReport) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// reconcileEvery checks the store every interval until ctx is done, logging
+// the report of every check that finds a problem.
+func reconcileEvery(ctx context.Context, s store.WalletStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := store.Reconcile(ctx, s)
+		if err != nil {
+			log.Printf("reconcile: %v", err)
+			continue
+		}
+		if report.OK {
+			log.Printf("reconcile: %d accounts consistent", report.Accounts)
+			continue
+		}
+
+		raw, _ := json.Marshal(report)
+		log.Printf("reconcile: %d discrepancies, %d unbalanced journal entries: %s",
+			len(report.Discrepancies), len(report.UnbalancedEntries), raw)
+	}
+}
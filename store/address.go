@@ -0,0 +1,119 @@
+package store
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// AddressLength is the length of an address in bytes.
+const AddressLength = 20
+
+// Address is a wallet address in the form stores keep it: 0x followed by 40
+// lowercase hex digits.
+type Address string
+
+// ParseAddress reads a 20-byte address written as 0x and 40 hex digits; the
+// prefix may also be written 0X, as some wallets written before addresses
+// were checked are. Digits in one case are taken as they are; mixed case must
+// be the EIP-55 checksum of the address, so a mistyped letter is caught
+// rather than silently naming another wallet.
+func ParseAddress(s string) (Address, error) {
+	digits, ok := strings.CutPrefix(s, "0x")
+	if !ok {
+		digits, ok = strings.CutPrefix(s, "0X")
+	}
+	if !ok || len(digits) != 2*AddressLength {
+		return "", fmt.Errorf("%w: %q must be 0x and %d hex digits", ErrInvalidAddress, s, 2*AddressLength)
+	}
+	if _, err := hex.DecodeString(digits); err != nil {
+		return "", fmt.Errorf("%w: %q must be 0x and %d hex digits", ErrInvalidAddress, s, 2*AddressLength)
+	}
+
+	a := Address("0x" + strings.ToLower(digits))
+	lower, upper := digits == strings.ToLower(digits), digits == strings.ToUpper(digits)
+	if !lower && !upper && "0x"+digits != a.Checksummed() {
+		return "", fmt.Errorf("%w: %q has a bad checksum", ErrInvalidAddress, s)
+	}
+	return a, nil
+}
+
+// String returns a in lowercase.
+func (a Address) String() string {
+	return string(a)
+}
+
+// Checksummed returns a in its EIP-55 form, where a letter is uppercase when
+// the matching nibble of the Keccak-256 hash of the lowercase hex is 8 or
+// more.
+func (a Address) Checksummed() string {
+	digits := []byte(strings.TrimPrefix(string(a), "0x"))
+	h := sha3.NewLegacyKeccak256()
+	h.Write(digits)
+	hash := h.Sum(nil)
+
+	for i, c := range digits {
+		nibble := hash[i/2] >> 4
+		if i%2 == 1 {
+			nibble = hash[i/2] & 0x0f
+		}
+		if c >= 'a' && c <= 'f' && nibble >= 8 {
+			digits[i] = c - 'a' + 'A'
+		}
+	}
+	return "0x" + string(digits)
+}
+
+// ChecksumAddress renders the stored address s in its EIP-55 form. Anything
+// that is not an address, such as a wallet written before addresses were
+// checked, is returned as it is.
+func ChecksumAddress(s string) string {
+	a, err := ParseAddress(s)
+	if err != nil {
+		return s
+	}
+	return a.Checksummed()
+}
+
+// canonicalAddress validates s and returns it in lowercase, the form every
+// store keys wallets by.
+func canonicalAddress(s string) (string, error) {
+	a, err := ParseAddress(s)
+	return string(a), err
+}
+
+// canonicalAddresses replaces each of addrs with its canonical form.
+func canonicalAddresses(addrs ...*string) error {
+	for _, addr := range addrs {
+		a, err := canonicalAddress(*addr)
+		if err != nil {
+			return err
+		}
+		*addr = a
+	}
+	return nil
+}
+
+// canonicalTransfer returns the addresses of a transfer in canonical form,
+// copying ops rather than changing the caller's legs.
+func canonicalTransfer(from string, ops []TransferOp, opts TransferOptions) (string, []TransferOp, TransferOptions, error) {
+	from, err := canonicalAddress(from)
+	if err != nil {
+		return "", nil, opts, err
+	}
+	if opts.Spender != "" {
+		if opts.Spender, err = canonicalAddress(opts.Spender); err != nil {
+			return "", nil, opts, err
+		}
+	}
+	legs := make([]TransferOp, len(ops))
+	for i, op := range ops {
+		if op.To, err = canonicalAddress(op.To); err != nil {
+			return "", nil, opts, err
+		}
+		legs[i] = op
+	}
+	return from, legs, opts, nil
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"fmt"
+	"math/big"
+)
+
+var errNegativeAllowance = fmt.Errorf("%w: allowance must not be negative", ErrInvalidAmount)
+
+// allowanceKey identifies how much of token spender may move out of owner's
+// wallet.
+type allowanceKey struct {
+	owner   string
+	spender string
+	token   string
+}
+
+// transferTotal returns how much a transfer moves out of the sender, which is
+// also how much of the sender's allowance a transfer made by a spender uses
+// up. Every leg must have a positive amount: a transfer only ever debits its
+// sender, the one wallet whose owner authorized it.
+func transferTotal(ops []TransferOp) (*big.Int, error) {
+	if len(ops) == 0 {
+		return nil, errNoTransfers
+	}
+	total := new(big.Int)
+	for _, op := range ops {
+		if op.Amount == nil || op.Amount.Sign() <= 0 {
+			return nil, errNonPositiveAmount
+		}
+		total.Add(total, op.Amount)
+	}
+	return total, nil
+}
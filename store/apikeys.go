@@ -0,0 +1,77 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// APIKey is a credential clients authenticate with. Only a hash of its secret
+// is stored, so the secret cannot be read back out of the store.
+type APIKey struct {
+	ID string `json:"id"`
+
+	// Hash is the SHA-256 of the key's secret, in hex.
+	Hash string `json:"hash"`
+
+	// Subject names who the key was issued to.
+	Subject string `json:"subject"`
+
+	// Roles are granted to whoever presents the key.
+	Roles []string `json:"roles"`
+
+	// Wallets are the addresses the key may move funds out of.
+	Wallets []string `json:"wallets"`
+
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Revoked reports whether k may no longer be used.
+func (k *APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+var (
+	apiKeyIDPattern   = regexp.MustCompile(`^[0-9a-z]{1,64}$`)
+	apiKeyHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// validateAPIKey checks k and puts its wallets in canonical form.
+func validateAPIKey(k *APIKey) error {
+	if !apiKeyIDPattern.MatchString(k.ID) {
+		return fmt.Errorf("%w: api key id %q must be 1-64 lowercase letters or digits", ErrInvalidArgument, k.ID)
+	}
+	if !apiKeyHashPattern.MatchString(k.Hash) {
+		return fmt.Errorf("%w: api key hash must be a hex SHA-256", ErrInvalidArgument)
+	}
+	if k.Subject == "" {
+		return fmt.Errorf("%w: api key subject is required", ErrInvalidArgument)
+	}
+	for i := range k.Wallets {
+		if err := canonicalAddresses(&k.Wallets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func errUnknownAPIKey(id string) error {
+	return fmt.Errorf("%w: %q", ErrAPIKeyNotFound, id)
+}
+
+func errAPIKeyExists(id string) error {
+	return fmt.Errorf("%w: api key %q already exists", ErrConflict, id)
+}
+
+// copyAPIKey returns a copy of k that shares nothing with it.
+func copyAPIKey(k *APIKey) *APIKey {
+	cp := *k
+	cp.Roles = append([]string{}, k.Roles...)
+	cp.Wallets = append([]string{}, k.Wallets...)
+	if k.RevokedAt != nil {
+		at := *k.RevokedAt
+		cp.RevokedAt = &at
+	}
+	return &cp
+}
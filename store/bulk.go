@@ -0,0 +1,546 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// BulkFormat is a file format of bulk imports and exports.
+type BulkFormat string
+
+const (
+	// FormatCSV has a header row naming the columns, in any order.
+	FormatCSV BulkFormat = "csv"
+
+	// FormatJSONL has one JSON object per line. Amounts may be numbers or
+	// strings, and are exported as strings.
+	FormatJSONL BulkFormat = "jsonl"
+)
+
+// DefaultImportBatch is how many rows are imported per transaction unless
+// ImportOptions says otherwise.
+const DefaultImportBatch = 1000
+
+// Columns of the bulk formats, which are the keys of JSONL objects too.
+var (
+	walletColumns   = []string{"address", "token", "balance"}
+	transferColumns = []string{"id", "from", "to", "spender", "token", "amount", "status", "error", "createdAt"}
+)
+
+// WalletRow is one balance of a wallet, as imported and exported in bulk.
+type WalletRow struct {
+	Address string
+	Token   string
+	Balance *big.Int
+}
+
+// RowStatus is what became of an imported row.
+type RowStatus string
+
+const (
+	RowImported RowStatus = "IMPORTED"
+
+	// RowSkipped rows were valid but had nothing left to import, such as a
+	// balance the wallet already holds.
+	RowSkipped RowStatus = "SKIPPED"
+
+	RowFailed RowStatus = "FAILED"
+)
+
+// RowResult is what became of an imported row, and why if it was not
+// imported.
+type RowResult struct {
+	Status RowStatus
+	Reason string
+}
+
+func rowFailed(err error) RowResult {
+	return RowResult{Status: RowFailed, Reason: err.Error()}
+}
+
+func rowSkipped(format string, args ...any) RowResult {
+	return RowResult{Status: RowSkipped, Reason: fmt.Sprintf(format, args...)}
+}
+
+// walletRowResult decides what importing row does, given whether its token
+// is registered, whether its wallet exists and how much of the token the
+// wallet holds. Every store decides through it, so they all agree.
+func walletRowResult(row WalletRow, tokenKnown, walletExists bool, held *big.Int) RowResult {
+	switch {
+	case !tokenKnown:
+		return rowFailed(errUnknownToken(row.Token))
+	case held.Sign() != 0:
+		return rowSkipped("wallet already holds %s %s", held, row.Token)
+	case walletExists && row.Balance.Sign() == 0:
+		return rowSkipped("wallet already exists")
+	}
+	return RowResult{Status: RowImported}
+}
+
+// ImportOptions tune BulkImportWallets and BulkImportTransfers.
+type ImportOptions struct {
+	Format BulkFormat
+
+	// DryRun validates every row against the store and reports what
+	// importing it would do, without writing anything.
+	DryRun bool
+
+	// BatchSize is how many rows are imported per transaction,
+	// DefaultImportBatch if zero. A failing batch fails the import, but rows
+	// of earlier batches stay imported.
+	BatchSize int
+}
+
+// ImportReport sums up a bulk import. Problems lists every row that was not
+// imported, in file order.
+type ImportReport struct {
+	DryRun   bool         `json:"dryRun"`
+	Rows     int          `json:"rows"`
+	Imported int          `json:"imported"`
+	Skipped  int          `json:"skipped"`
+	Failed   int          `json:"failed"`
+	Problems []RowProblem `json:"problems"`
+}
+
+// RowProblem is a row that was skipped or failed. Line is the line of the
+// file the row starts on.
+type RowProblem struct {
+	Line   int       `json:"line"`
+	Status RowStatus `json:"status"`
+	Reason string    `json:"reason"`
+}
+
+func (r *ImportReport) add(line int, res RowResult) {
+	r.Rows++
+	switch res.Status {
+	case RowImported:
+		r.Imported++
+		return
+	case RowSkipped:
+		r.Skipped++
+	default:
+		r.Failed++
+	}
+	r.Problems = append(r.Problems, RowProblem{Line: line, Status: res.Status, Reason: res.Reason})
+}
+
+// sortProblems puts problems back in file order, since rows that fail to
+// parse are reported before the batch they were read with.
+func (r *ImportReport) sortProblems() {
+	sort.SliceStable(r.Problems, func(i, j int) bool { return r.Problems[i].Line < r.Problems[j].Line })
+}
+
+// BulkImportWallets reads wallet rows from r and imports them into s batch
+// by batch. A row that cannot be parsed, or that the store rejects, is
+// reported and the import carries on with the next one. The error is only
+// set when the import as a whole could not go on.
+func BulkImportWallets(ctx context.Context, s WalletStore, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: opts.DryRun, Problems: []RowProblem{}}
+
+	// Every balance may only be given once, or which one counts would depend
+	// on how rows fall into batches.
+	seen := make(map[[2]string]int)
+
+	b := newImportBatch(opts, report, func(rows []WalletRow) ([]RowResult, error) {
+		return s.ImportWallets(ctx, rows, opts.DryRun)
+	})
+	err := readRows(r, opts.Format, walletColumns, func(line int, rec map[string]string, err error) error {
+		if err != nil {
+			report.add(line, rowFailed(err))
+			return nil
+		}
+		row, err := parseWalletRow(rec)
+		if err != nil {
+			report.add(line, rowFailed(err))
+			return nil
+		}
+		key := [2]string{row.Address, row.Token}
+		if first, ok := seen[key]; ok {
+			report.add(line, rowFailed(fmt.Errorf("%w: balance of %s in %s is already given on line %d",
+				ErrInvalidArgument, row.Token, row.Address, first)))
+			return nil
+		}
+		seen[key] = line
+		return b.add(line, row)
+	})
+	if err == nil {
+		err = b.flush()
+	}
+	report.sortProblems()
+	return report, err
+}
+
+// BulkImportTransfers reads transfer rows from r and records them in s as
+// transfer history. Funds do not move: balances are imported on their own.
+// The id column is ignored, since imported transfers get new ids.
+func BulkImportTransfers(ctx context.Context, s WalletStore, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	report := &ImportReport{DryRun: opts.DryRun, Problems: []RowProblem{}}
+
+	b := newImportBatch(opts, report, func(rows []*generated.Transfer) ([]RowResult, error) {
+		return s.ImportTransfers(ctx, rows, opts.DryRun)
+	})
+	err := readRows(r, opts.Format, transferColumns, func(line int, rec map[string]string, err error) error {
+		if err != nil {
+			report.add(line, rowFailed(err))
+			return nil
+		}
+		t, err := parseTransferRow(rec)
+		if err != nil {
+			report.add(line, rowFailed(err))
+			return nil
+		}
+		return b.add(line, t)
+	})
+	if err == nil {
+		err = b.flush()
+	}
+	report.sortProblems()
+	return report, err
+}
+
+// importBatch collects parsed rows and hands them to the store once there
+// are enough of them.
+type importBatch[T any] struct {
+	size    int
+	report  *ImportReport
+	lines   []int
+	rows    []T
+	process func([]T) ([]RowResult, error)
+}
+
+func newImportBatch[T any](opts ImportOptions, report *ImportReport, process func([]T) ([]RowResult, error)) *importBatch[T] {
+	size := opts.BatchSize
+	if size <= 0 {
+		size = DefaultImportBatch
+	}
+	return &importBatch[T]{size: size, report: report, process: process}
+}
+
+func (b *importBatch[T]) add(line int, row T) error {
+	b.lines = append(b.lines, line)
+	b.rows = append(b.rows, row)
+	if len(b.rows) < b.size {
+		return nil
+	}
+	return b.flush()
+}
+
+func (b *importBatch[T]) flush() error {
+	if len(b.rows) == 0 {
+		return nil
+	}
+	results, err := b.process(b.rows)
+	if err != nil {
+		return fmt.Errorf("import rows from line %d: %w", b.lines[0], err)
+	}
+	for i, res := range results {
+		b.report.add(b.lines[i], res)
+	}
+	b.lines, b.rows = nil, nil
+	return nil
+}
+
+// readRows calls fn with every row of r as a map from column to value,
+// along with the line the row starts on. A row that cannot be read is passed
+// with the reason instead. Only errors reading r itself, or returned by fn,
+// stop the reading.
+func readRows(r io.Reader, format BulkFormat, columns []string, fn func(line int, rec map[string]string, err error) error) error {
+	switch format {
+	case FormatCSV:
+		return readCSVRows(r, columns, fn)
+	case FormatJSONL:
+		return readJSONLRows(r, columns, fn)
+	default:
+		return fmt.Errorf("%w: unknown format %q", ErrInvalidArgument, format)
+	}
+}
+
+func readCSVRows(r io.Reader, columns []string, fn func(int, map[string]string, error) error) error {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w: read header: %v", ErrInvalidArgument, err)
+	}
+	header = append([]string(nil), header...)
+	for _, name := range header {
+		if !contains(columns, name) {
+			return fmt.Errorf("%w: unknown column %q, expected some of: %s",
+				ErrInvalidArgument, name, strings.Join(columns, ", "))
+		}
+	}
+
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if err := fn(parseErr.StartLine, nil, fmt.Errorf("%w: %v", ErrInvalidArgument, parseErr.Err)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		line, _ := cr.FieldPos(0)
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			row[name] = rec[i]
+		}
+		if err := fn(line, row, nil); err != nil {
+			return err
+		}
+	}
+}
+
+func readJSONLRows(r io.Reader, columns []string, fn func(int, map[string]string, error) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		row, err := decodeJSONLRow(sc.Bytes(), columns)
+		if err := fn(line, row, err); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// decodeJSONLRow turns an object of strings and numbers into a row. null
+// counts as empty.
+func decodeJSONLRow(data []byte, columns []string) (map[string]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var obj map[string]any
+	if err := dec.Decode(&obj); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+
+	row := make(map[string]string, len(obj))
+	for key, v := range obj {
+		if !contains(columns, key) {
+			return nil, fmt.Errorf("%w: unknown field %q", ErrInvalidArgument, key)
+		}
+		switch v := v.(type) {
+		case nil:
+		case string:
+			row[key] = v
+		case json.Number:
+			row[key] = v.String()
+		default:
+			return nil, fmt.Errorf("%w: field %q must be a string or a number", ErrInvalidArgument, key)
+		}
+	}
+	return row, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func parseWalletRow(rec map[string]string) (WalletRow, error) {
+	row := WalletRow{Address: rec["address"], Token: tokenOrDefault(rec["token"])}
+	if row.Address == "" {
+		return row, fmt.Errorf("%w: address is required", ErrInvalidArgument)
+	}
+	if err := canonicalAddresses(&row.Address); err != nil {
+		return row, err
+	}
+	n, ok := new(big.Int).SetString(rec["balance"], 10)
+	if !ok || n.Sign() < 0 {
+		return row, fmt.Errorf("%w: balance %q must be a whole number of at least zero", ErrInvalidAmount, rec["balance"])
+	}
+	row.Balance = n
+	return row, nil
+}
+
+func parseTransferRow(rec map[string]string) (*generated.Transfer, error) {
+	t := &generated.Transfer{
+		FromAddress: rec["from"],
+		ToAddress:   rec["to"],
+		Token:       tokenOrDefault(rec["token"]),
+		Status:      generated.TransferStatus(rec["status"]),
+	}
+	if t.FromAddress == "" || t.ToAddress == "" {
+		return nil, fmt.Errorf("%w: from and to are required", ErrInvalidArgument)
+	}
+	if err := canonicalAddresses(&t.FromAddress, &t.ToAddress); err != nil {
+		return nil, err
+	}
+	if spender := rec["spender"]; spender != "" {
+		if err := canonicalAddresses(&spender); err != nil {
+			return nil, err
+		}
+		t.Spender = &spender
+	}
+
+	n, ok := new(big.Int).SetString(rec["amount"], 10)
+	if !ok {
+		return nil, fmt.Errorf("%w: amount %q must be a whole number", ErrInvalidAmount, rec["amount"])
+	}
+	t.Amount = n
+
+	if !t.Status.IsValid() {
+		return nil, fmt.Errorf("%w: status %q must be one of %v", ErrInvalidArgument, rec["status"], generated.AllTransferStatus)
+	}
+	if reason := rec["error"]; reason != "" {
+		t.Error = &reason
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, rec["createdAt"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: createdAt %q must be an RFC 3339 time", ErrInvalidArgument, rec["createdAt"])
+	}
+	t.CreatedAt = createdAt.UTC()
+	return t, nil
+}
+
+// BulkExportWallets writes a row for every balance held in s to w, ordered
+// by address and token, and returns how many rows it wrote. A wallet that
+// holds nothing gets a single row of zero of the default token, so
+// importing the file recreates it.
+func BulkExportWallets(ctx context.Context, s WalletStore, w io.Writer, format BulkFormat) (int, error) {
+	rw, err := newRowWriter(w, format, walletColumns)
+	if err != nil {
+		return 0, err
+	}
+	err = s.ExportWallets(ctx, func(row WalletRow) error {
+		return rw.write(map[string]string{
+			"address": row.Address,
+			"token":   row.Token,
+			"balance": row.Balance.String(),
+		})
+	})
+	if err != nil {
+		return rw.rows, err
+	}
+	return rw.rows, rw.flush()
+}
+
+// BulkExportTransfers writes every transfer recorded in s to w, oldest
+// first, and returns how many it wrote.
+func BulkExportTransfers(ctx context.Context, s WalletStore, w io.Writer, format BulkFormat) (int, error) {
+	rw, err := newRowWriter(w, format, transferColumns)
+	if err != nil {
+		return 0, err
+	}
+	err = s.ExportTransfers(ctx, func(t *generated.Transfer) error {
+		rec := map[string]string{
+			"id":        t.ID,
+			"from":      t.FromAddress,
+			"to":        t.ToAddress,
+			"token":     t.Token,
+			"amount":    t.Amount.String(),
+			"status":    string(t.Status),
+			"createdAt": t.CreatedAt.UTC().Format(time.RFC3339Nano),
+		}
+		if t.Spender != nil {
+			rec["spender"] = *t.Spender
+		}
+		if t.Error != nil {
+			rec["error"] = *t.Error
+		}
+		return rw.write(rec)
+	})
+	if err != nil {
+		return rw.rows, err
+	}
+	return rw.rows, rw.flush()
+}
+
+// rowWriter writes rows in one of the bulk formats. JSONL leaves out empty
+// values.
+type rowWriter struct {
+	format  BulkFormat
+	columns []string
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	rows    int
+}
+
+func newRowWriter(w io.Writer, format BulkFormat, columns []string) (*rowWriter, error) {
+	rw := &rowWriter{format: format, columns: columns, buf: bufio.NewWriter(w)}
+	switch format {
+	case FormatCSV:
+		rw.csv = csv.NewWriter(rw.buf)
+		if err := rw.csv.Write(columns); err != nil {
+			return nil, err
+		}
+	case FormatJSONL:
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidArgument, format)
+	}
+	return rw, nil
+}
+
+func (rw *rowWriter) write(rec map[string]string) error {
+	rw.rows++
+	if rw.csv != nil {
+		fields := make([]string, len(rw.columns))
+		for i, name := range rw.columns {
+			fields[i] = rec[name]
+		}
+		return rw.csv.Write(fields)
+	}
+
+	// Built by hand to keep the columns in order.
+	line := []byte{'{'}
+	for _, name := range rw.columns {
+		v, ok := rec[name]
+		if !ok || v == "" {
+			continue
+		}
+		if len(line) > 1 {
+			line = append(line, ',')
+		}
+		line = strconv.AppendQuote(line, name)
+		line = append(line, ':')
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		line = append(line, value...)
+	}
+	line = append(line, '}', '\n')
+	_, err := rw.buf.Write(line)
+	return err
+}
+
+func (rw *rowWriter) flush() error {
+	if rw.csv != nil {
+		rw.csv.Flush()
+		if err := rw.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return rw.buf.Flush()
+}
@@ -0,0 +1,14 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/zanpatryk/tokentransferapi/store"
+	"github.com/zanpatryk/tokentransferapi/store/storetest"
+)
+
+func TestPostgresConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, opts ...store.Option) store.WalletStore {
+		return store.NewTestPostgresStore(t, opts...)
+	})
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors returned by every WalletStore. They are usually wrapped with more
+// detail, so compare them with errors.Is. Any other error is an internal
+// failure of the backend.
+var (
+	ErrWalletNotFound        = errors.New("wallet not found")
+	ErrTokenNotFound         = errors.New("token not found")
+	ErrInsufficientFunds     = errors.New("insufficient funds")
+	ErrInsufficientAllowance = errors.New("insufficient allowance")
+	ErrInvalidAmount         = errors.New("invalid amount")
+	ErrInvalidArgument       = errors.New("invalid argument")
+	ErrConflict              = errors.New("conflict")
+	ErrAPIKeyNotFound        = errors.New("api key not found")
+	ErrInvalidSignature      = errors.New("invalid signature")
+	ErrInvalidNonce          = errors.New("invalid nonce")
+	ErrInvalidAddress        = errors.New("invalid address")
+	ErrUnknownRecipient      = errors.New("unknown recipient")
+	ErrRecipientNotOptedIn   = errors.New("recipient has not opted in to transfers")
+)
+
+// errInsufficientFundsOnRecipient rejected transfers that pulled funds back
+// from a recipient, from before every leg had to be positive. Only the ledger
+// and idempotency keys still hold it.
+var errInsufficientFundsOnRecipient = fmt.Errorf("%w on recipient", ErrInsufficientFunds)
+
+// rejectionErrors are the errors a transfer can be rejected with. Their
+// messages are the reasons recorded in the ledger and for idempotency keys.
+var rejectionErrors = []error{
+	ErrInsufficientFunds,
+	errInsufficientFundsOnRecipient,
+	ErrInsufficientAllowance,
+}
+
+// rejectionError turns a recorded rejection reason back into its error.
+// Reasons are matched case-insensitively since older ledger entries were
+// written capitalised.
+func rejectionError(reason string) error {
+	for _, err := range rejectionErrors {
+		if strings.EqualFold(err.Error(), reason) {
+			return err
+		}
+	}
+	return errors.New(reason)
+}
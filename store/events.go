@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// Event is a change to the wallets, published once it has been committed.
+// Exactly one of the fields is set.
+type Event struct {
+	Transfer *generated.Transfer      `json:"transfer,omitempty"`
+	Balance  *generated.BalanceChange `json:"balance,omitempty"`
+}
+
+// subscriberBuffer is how many events a subscriber may fall behind by before
+// it starts missing them.
+const subscriberBuffer = 64
+
+// eventBus fans events out to the subscribers of a single process.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[chan Event]struct{})}
+}
+
+// subscribe returns a channel receiving every event published from now on.
+// It is closed once ctx is done.
+func (b *eventBus) subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, subscriberBuffer)
+
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.subs, ch)
+		close(ch)
+		b.mu.Unlock()
+	}()
+	return ch
+}
+
+// publish hands ev to every subscriber without blocking. A subscriber whose
+// buffer is full misses the event rather than stalling the writer.
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func balanceChanged(address, token string, balance *big.Int) Event {
+	return Event{Balance: &generated.BalanceChange{
+		Address: address,
+		Token:   token,
+		Balance: new(big.Int).Set(balance),
+	}}
+}
+
+func transferCreated(t *generated.Transfer) Event {
+	cp := *t
+	cp.Amount = new(big.Int).Set(t.Amount)
+	return Event{Transfer: &cp}
+}
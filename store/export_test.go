@@ -0,0 +1,10 @@
+package store
+
+import "testing"
+
+// NewTestPostgresStore empties the test database and returns a store on it,
+// for tests outside the package.
+func NewTestPostgresStore(t *testing.T, opts ...Option) *PostgresWalletStore {
+	resetWallets(t)
+	return NewPostgresWalletStore(dbPool, opts...)
+}
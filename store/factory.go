@@ -0,0 +1,244 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	postgresDriver "github.com/golang-migrate/migrate/v4/database/postgres"
+	sqliteDriver "github.com/golang-migrate/migrate/v4/database/sqlite"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jackc/pgx/v5/pgxpool"
+	_ "modernc.org/sqlite"
+)
+
+// Names of the built-in backends.
+const (
+	BackendMemory   = "memory"
+	BackendPostgres = "postgres"
+	BackendSQLite   = "sqlite"
+)
+
+// DefaultBackend is used when Config.Backend is empty.
+const DefaultBackend = BackendPostgres
+
+// Config selects a backend and holds everything needed to open it. Backends
+// ignore the fields they have no use for.
+type Config struct {
+	Backend string
+
+	// DatabaseURL is the connection string of database-backed stores. For
+	// SQLite it is the path of the database file.
+	DatabaseURL string
+
+	// MigrationsPath is the directory holding the backend's SQL migrations,
+	// which are applied when the store is opened.
+	MigrationsPath string
+
+	// DataDir, if set, makes the memory backend durable: it keeps a
+	// write-ahead log and snapshots there and restores them when opened.
+	DataDir string
+
+	// Fsync is when the durable memory backend syncs its log to disk,
+	// FsyncAlways if empty.
+	Fsync FsyncPolicy
+
+	Options []Option
+}
+
+// ConfigFromEnv reads the Config shared by every program opening the store
+// from the environment: STORE_BACKEND, DATABASE_URL, MIGRATIONS_PATH,
+// MEMORY_DATA_DIR, MEMORY_FSYNC, IDEMPOTENCY_WINDOW and RECIPIENT_POLICY.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		Backend:        os.Getenv("STORE_BACKEND"),
+		DatabaseURL:    os.Getenv("DATABASE_URL"),
+		MigrationsPath: os.Getenv("MIGRATIONS_PATH"),
+		DataDir:        os.Getenv("MEMORY_DATA_DIR"),
+		Fsync:          FsyncPolicy(os.Getenv("MEMORY_FSYNC")),
+	}
+	if cfg.Backend == "" {
+		cfg.Backend = DefaultBackend
+	}
+
+	if window := os.Getenv("IDEMPOTENCY_WINDOW"); window != "" {
+		d, err := time.ParseDuration(window)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid IDEMPOTENCY_WINDOW %q: %v", window, err)
+		}
+		cfg.Options = append(cfg.Options, WithIdempotencyWindow(d))
+	}
+	if name := os.Getenv("RECIPIENT_POLICY"); name != "" {
+		p, err := ParseRecipientPolicy(name)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid RECIPIENT_POLICY: %v", err)
+		}
+		cfg.Options = append(cfg.Options, WithRecipientPolicy(p))
+	}
+	return cfg, nil
+}
+
+// Opener opens a backend. The returned function releases whatever the store
+// holds on to and must be called once the store is no longer used.
+type Opener func(ctx context.Context, cfg Config) (WalletStore, func(), error)
+
+var backends = map[string]Opener{
+	BackendMemory:   openMemory,
+	BackendPostgres: openPostgres,
+	BackendSQLite:   openSQLite,
+}
+
+// Register makes a backend available to Open under name. It is meant to be
+// called from init functions and panics if name is already taken.
+func Register(name string, open Opener) {
+	if _, exists := backends[name]; exists {
+		panic(fmt.Sprintf("store: backend %q registered twice", name))
+	}
+	backends[name] = open
+}
+
+// Backends returns the names of every available backend, sorted.
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the backend named by cfg.Backend, DefaultBackend if empty.
+func Open(ctx context.Context, cfg Config) (WalletStore, func(), error) {
+	name := cfg.Backend
+	if name == "" {
+		name = DefaultBackend
+	}
+	open, ok := backends[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown store backend %q, expected one of: %s", name, strings.Join(Backends(), ", "))
+	}
+	return open(ctx, cfg)
+}
+
+func openMemory(ctx context.Context, cfg Config) (WalletStore, func(), error) {
+	if cfg.DataDir == "" {
+		return NewInMemWalletStore(cfg.Options...), func() {}, nil
+	}
+
+	s, err := OpenDurableInMemWalletStore(DurabilityConfig{Dir: cfg.DataDir, Fsync: cfg.Fsync}, cfg.Options...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, func() { s.Close() }, nil
+}
+
+func openPostgres(ctx context.Context, cfg Config) (WalletStore, func(), error) {
+	if cfg.DatabaseURL == "" {
+		return nil, nil, errors.New("the postgres backend needs a database URL")
+	}
+	if cfg.MigrationsPath == "" {
+		return nil, nil, errors.New("the postgres backend needs a migrations path")
+	}
+
+	if err := migratePostgres(cfg.DatabaseURL, cfg.MigrationsPath); err != nil {
+		return nil, nil, err
+	}
+
+	pool, err := pgxpool.New(ctx, cfg.DatabaseURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to Postgres pool: %w", err)
+	}
+	s := NewPostgresWalletStore(pool, cfg.Options...)
+	return s, func() {
+		s.Close()
+		pool.Close()
+	}, nil
+}
+
+// migratePostgres brings the database up to the latest migration.
+func migratePostgres(databaseURL, migrationsPath string) error {
+	sqlDB, err := sql.Open("postgres", databaseURL)
+	if err != nil {
+		return fmt.Errorf("could not open sql.DB: %w", err)
+	}
+	defer sqlDB.Close()
+
+	driver, err := postgresDriver.WithInstance(sqlDB, &postgresDriver.Config{})
+	if err != nil {
+		return fmt.Errorf("could not create migrate driver: %w", err)
+	}
+
+	m, err := migrate.NewWithDatabaseInstance("file://"+migrationsPath, "postgres", driver)
+	if err != nil {
+		return fmt.Errorf("failed to initialize migrations: %w", err)
+	}
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	return nil
+}
+
+func openSQLite(ctx context.Context, cfg Config) (WalletStore, func(), error) {
+	if cfg.DatabaseURL == "" {
+		return nil, nil, errors.New("the sqlite backend needs a database file")
+	}
+	if cfg.MigrationsPath == "" {
+		return nil, nil, errors.New("the sqlite backend needs a migrations path")
+	}
+
+	db, err := sql.Open("sqlite", sqliteDSN(cfg.DatabaseURL))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open SQLite database: %w", err)
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("could not open SQLite database: %w", err)
+	}
+
+	if err := migrateSQLite(db, cfg.MigrationsPath); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return NewSQLiteWalletStore(db, cfg.Options...), func() { db.Close() }, nil
+}
+
+// sqliteDSN adds the connection settings the SQLite store relies on to the
+// database file path: write transactions take the write lock as soon as they
+// begin, writers wait for the lock instead of failing, readers never block
+// the writer, and foreign keys are enforced.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_txlock=immediate" +
+		"&_pragma=busy_timeout(10000)" +
+		"&_pragma=journal_mode(WAL)" +
+		"&_pragma=foreign_keys(1)"
+}
+
+// migrateSQLite brings the database up to the latest migration. It leaves db
+// open.
+func migrateSQLite(db *sql.DB, migrationsPath string) error {
+	driver, err := sqliteDriver.WithInstance(db, &sqliteDriver.Config{})
+	if err != nil {
+		return fmt.Errorf("could not create migrate driver: %w", err)
+	}
+
+	m, err := migrate.NewWithDatabaseInstance("file://"+migrationsPath, "sqlite", driver)
+	if err != nil {
+		return fmt.Errorf("failed to initialize migrations: %w", err)
+	}
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+	"gopkg.in/yaml.v3"
+)
+
+// Genesis is the initial state of a store: the tokens to register and the
+// wallets to create with their balances. A store applies at most one genesis
+// in its lifetime.
+type Genesis struct {
+	Tokens  []GenesisToken
+	Wallets []GenesisWallet
+
+	// Checksum identifies the file the genesis was read from, so a store can
+	// tell whether that file changed after it was applied.
+	Checksum string
+}
+
+// GenesisToken is a token a genesis registers. The default token always
+// exists; listing it, or any other token already registered, is allowed as
+// long as the name and decimals match.
+type GenesisToken struct {
+	Symbol   string `json:"symbol" yaml:"symbol"`
+	Name     string `json:"name" yaml:"name"`
+	Decimals int    `json:"decimals" yaml:"decimals"`
+}
+
+// GenesisWallet is a wallet a genesis creates, with its balances sorted by
+// token. A wallet that already exists is left as it is.
+type GenesisWallet struct {
+	Address  string
+	Balances []GenesisBalance
+}
+
+type GenesisBalance struct {
+	Token  string
+	Amount *big.Int
+}
+
+// GenesisRecord is the genesis a store has applied.
+type GenesisRecord struct {
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+// genesisFile is the layout of a genesis file:
+//
+//	tokens:
+//	  - symbol: USDX
+//	    name: USD Example
+//	    decimals: 6
+//	wallets:
+//	  - address: "0x0000000000000000000000000000000000000001"
+//	    balances:
+//	      BTP: 1000
+//	      USDX: "2500000"
+type genesisFile struct {
+	Tokens  []GenesisToken `json:"tokens" yaml:"tokens"`
+	Wallets []struct {
+		Address  string                   `json:"address" yaml:"address"`
+		Balances map[string]genesisAmount `json:"balances" yaml:"balances"`
+	} `json:"wallets" yaml:"wallets"`
+}
+
+// genesisAmount is an amount written either as a number or as a string of
+// digits, since numbers beyond 2^53 do not survive every JSON tool.
+type genesisAmount string
+
+func (a *genesisAmount) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("amount must be a number or a string, got %s", data)
+		}
+		s = n.String()
+	}
+	*a = genesisAmount(s)
+	return nil
+}
+
+func (a *genesisAmount) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: amount must be a number or a string", node.Line)
+	}
+	*a = genesisAmount(node.Value)
+	return nil
+}
+
+// LoadGenesis reads the genesis file at path, YAML if its name ends in .yaml
+// or .yml and JSON otherwise.
+func LoadGenesis(path string) (*Genesis, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f genesisFile
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(&f)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: genesis file %s: %v", ErrInvalidArgument, path, err)
+	}
+
+	g, err := f.genesis()
+	if err != nil {
+		return nil, fmt.Errorf("genesis file %s: %w", path, err)
+	}
+	sum := sha256.Sum256(data)
+	g.Checksum = "sha256:" + hex.EncodeToString(sum[:])
+	return g, nil
+}
+
+// genesis validates f and converts it into a Genesis.
+func (f *genesisFile) genesis() (*Genesis, error) {
+	g := &Genesis{Tokens: f.Tokens}
+
+	symbols := make(map[string]bool)
+	for _, t := range f.Tokens {
+		if err := validateToken(t.Symbol, t.Name, t.Decimals); err != nil {
+			return nil, err
+		}
+		if symbols[t.Symbol] {
+			return nil, fmt.Errorf("%w: token %q is listed twice", ErrInvalidArgument, t.Symbol)
+		}
+		symbols[t.Symbol] = true
+	}
+
+	addresses := make(map[string]bool)
+	for _, fw := range f.Wallets {
+		if fw.Address == "" {
+			return nil, fmt.Errorf("%w: wallet address is required", ErrInvalidArgument)
+		}
+		address, err := canonicalAddress(fw.Address)
+		if err != nil {
+			return nil, err
+		}
+		if addresses[address] {
+			return nil, fmt.Errorf("%w: wallet %s is listed twice", ErrInvalidArgument, fw.Address)
+		}
+		addresses[address] = true
+
+		w := GenesisWallet{Address: address}
+		for token, amount := range fw.Balances {
+			n, ok := new(big.Int).SetString(string(amount), 10)
+			if !ok || n.Sign() < 0 {
+				return nil, fmt.Errorf("%w: balance %q of %s in wallet %s must be a whole number of at least zero",
+					ErrInvalidAmount, amount, token, fw.Address)
+			}
+			if n.Sign() != 0 {
+				w.Balances = append(w.Balances, GenesisBalance{Token: token, Amount: n})
+			}
+		}
+		sort.Slice(w.Balances, func(i, j int) bool { return w.Balances[i].Token < w.Balances[j].Token })
+		g.Wallets = append(g.Wallets, w)
+	}
+	return g, nil
+}
+
+// postings returns the journal postings that issue the balances of w.
+func (w GenesisWallet) postings() []posting {
+	var postings []posting
+	for _, b := range w.Balances {
+		postings = append(postings, issuancePostings(w.Address, b.Token, b.Amount)...)
+	}
+	return postings
+}
+
+// checkGenesisToken returns ErrConflict unless existing, a registered token,
+// is the token t describes.
+func checkGenesisToken(t GenesisToken, existing *generated.Token) error {
+	if existing.Name != t.Name || existing.Decimals != t.Decimals {
+		return fmt.Errorf("%w: token %q already exists as %q with %d decimals",
+			ErrConflict, t.Symbol, existing.Name, existing.Decimals)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+)
+
+var errIdempotencyKeyReused = fmt.Errorf("%w: idempotency key was already used for a different transfer", ErrConflict)
+
+// idempotentResult is the remembered outcome of a transfer made with an
+// idempotency key. An empty reason means the transfer succeeded.
+type idempotentResult struct {
+	fingerprint string
+	balance     *big.Int
+	reason      string
+}
+
+// replay returns the stored outcome for a retried request, or an error when
+// the key is being reused for a transfer with different legs.
+func (r *idempotentResult) replay(fingerprint string) (*big.Int, error) {
+	if r.fingerprint != fingerprint {
+		return nil, errIdempotencyKeyReused
+	}
+	balance := new(big.Int).Set(r.balance)
+	if r.reason != "" {
+		return balance, rejectionError(r.reason)
+	}
+	return balance, nil
+}
+
+// transferFingerprint identifies the token, spender and legs of a transfer so
+// a replayed idempotency key can be matched against the request it was first
+// used for.
+func transferFingerprint(token string, ops []TransferOp, opts TransferOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", token)
+	if opts.Spender != "" {
+		fmt.Fprintf(h, "spender:%s\n", opts.Spender)
+	}
+	for _, op := range ops {
+		fmt.Fprintf(h, "%s:%s\n", op.To, op.Amount)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,152 @@
+package store
+
+import (
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Problems found with the address of a wallet that could not be moved to its
+// lowercase form.
+const (
+	// AddressCaseDuplicate is a wallet whose address is another wallet's
+	// spelled differently, so moving it would merge their funds.
+	AddressCaseDuplicate = "CASE_DUPLICATE"
+
+	// AddressMalformed is a wallet whose address is not 0x and 40 hex
+	// digits.
+	AddressMalformed = "MALFORMED"
+)
+
+// AddressProblem is a wallet the durable in-memory store left at the address
+// its log recorded, the counterpart of a row of the wallet_address_problems
+// table of the SQL backends.
+type AddressProblem struct {
+	Address string `json:"address"`
+
+	// Canonical is the lowercase address, shared by every
+	// AddressCaseDuplicate wallet of the same address.
+	Canonical  string    `json:"canonical"`
+	Problem    string    `json:"problem"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+var wellFormedAddress = regexp.MustCompile(`^0[xX][0-9a-fA-F]{40}$`)
+
+// AddressProblems returns the wallets whose addresses could not be moved to
+// their lowercase form, sorted by address.
+func (s *InMemWalletStore) AddressProblems() []AddressProblem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]AddressProblem(nil), s.addressProblems...)
+}
+
+// canonicalizeWallets moves wallets restored from before addresses were
+// checked to their lowercase address, along with everything recorded under
+// the old one, the way the lowercase_wallet_addresses migration does for the
+// SQL backends. Wallets that cannot be moved are left as they are and added
+// to s.addressProblems, with a warning logged for each. It reports whether
+// anything changed; callers must hold s.mu or have the store to themselves.
+func (s *InMemWalletStore) canonicalizeWallets(now time.Time) bool {
+	known := make(map[string]bool)
+	for _, p := range s.addressProblems {
+		known[p.Address] = true
+	}
+
+	spellings := make(map[string][]string)
+	for address := range s.wallets {
+		if wellFormedAddress.MatchString(address) {
+			canonical := strings.ToLower(address)
+			spellings[canonical] = append(spellings[canonical], address)
+		}
+	}
+
+	var found []AddressProblem
+	renames := make(map[string]string)
+	for address := range s.wallets {
+		canonical := strings.ToLower(address)
+		switch {
+		case !wellFormedAddress.MatchString(address):
+			found = append(found, AddressProblem{Address: address, Canonical: canonical, Problem: AddressMalformed, DetectedAt: now})
+		case len(spellings[canonical]) > 1:
+			found = append(found, AddressProblem{Address: address, Canonical: canonical, Problem: AddressCaseDuplicate, DetectedAt: now})
+		case address != canonical:
+			renames[address] = canonical
+		}
+	}
+
+	changed := len(renames) > 0
+	sort.Slice(found, func(i, j int) bool { return found[i].Address < found[j].Address })
+	for _, p := range found {
+		if known[p.Address] {
+			continue
+		}
+		log.Printf("WARNING: wallet address %s: %s (left as it is, see AddressProblems)", p.Problem, p.Address)
+		s.addressProblems = append(s.addressProblems, p)
+		changed = true
+	}
+	sort.Slice(s.addressProblems, func(i, j int) bool { return s.addressProblems[i].Address < s.addressProblems[j].Address })
+
+	if len(renames) > 0 {
+		s.renameWallets(renames)
+	}
+	return changed
+}
+
+// renameWallets moves each wallet keyed in renames to the address it maps to.
+func (s *InMemWalletStore) renameWallets(renames map[string]string) {
+	rename := func(address string) string {
+		if to, ok := renames[address]; ok {
+			return to
+		}
+		return address
+	}
+
+	for from, to := range renames {
+		w := s.wallets[from]
+		delete(s.wallets, from)
+		w.address = to
+		s.wallets[to] = w
+	}
+
+	for _, t := range s.transfers {
+		t.FromAddress = rename(t.FromAddress)
+		t.ToAddress = rename(t.ToAddress)
+		if t.Spender != nil {
+			spender := rename(*t.Spender)
+			t.Spender = &spender
+		}
+	}
+	for _, e := range s.journal {
+		for i := range e.postings {
+			e.postings[i].address = rename(e.postings[i].address)
+		}
+	}
+
+	// Owners are wallets, and so moved along with them. Spenders and senders
+	// of idempotency keys need not be, so the new spelling may already be in
+	// use; those keep the old one.
+	for k, amount := range s.allowances {
+		if owner := rename(k.owner); owner != k.owner {
+			delete(s.allowances, k)
+			k.owner = owner
+			s.allowances[k] = amount
+		}
+	}
+	for k, amount := range s.allowances {
+		moved := allowanceKey{k.owner, rename(k.spender), k.token}
+		if _, taken := s.allowances[moved]; moved != k && !taken {
+			delete(s.allowances, k)
+			s.allowances[moved] = amount
+		}
+	}
+	for k, r := range s.idempotency {
+		moved := idempotencyKey{rename(k.from), k.key}
+		if _, taken := s.idempotency[moved]; moved != k && !taken {
+			delete(s.idempotency, k)
+			s.idempotency[moved] = r
+		}
+	}
+}
@@ -0,0 +1,691 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// FsyncPolicy says when a durable in-memory store forces its write-ahead log
+// to disk.
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs every write before it returns, so nothing that
+	// succeeded is ever lost.
+	FsyncAlways FsyncPolicy = "always"
+
+	// FsyncInterval syncs in the background once per interval, so a crash of
+	// the machine loses at most that much of the latest writes.
+	FsyncInterval FsyncPolicy = "interval"
+
+	// FsyncNever leaves flushing to the operating system. Writes survive the
+	// process crashing, but not the machine.
+	FsyncNever FsyncPolicy = "never"
+)
+
+// Defaults for the zero fields of DurabilityConfig.
+const (
+	DefaultFsyncInterval = time.Second
+	DefaultSnapshotEvery = 10000
+)
+
+// DurabilityConfig says where and how a durable in-memory store keeps its
+// data.
+type DurabilityConfig struct {
+	// Dir holds the write-ahead log and the latest snapshot. It is created
+	// if it does not exist.
+	Dir string
+
+	// Fsync is FsyncAlways if empty.
+	Fsync FsyncPolicy
+
+	// FsyncInterval is how often FsyncInterval syncs, DefaultFsyncInterval
+	// if zero.
+	FsyncInterval time.Duration
+
+	// SnapshotEvery is how many logged writes are followed by a snapshot,
+	// after which the log starts over. DefaultSnapshotEvery if zero.
+	SnapshotEvery int
+}
+
+const (
+	walFile      = "wal.log"
+	snapshotFile = "snapshot.json"
+	lockFile     = "lock"
+)
+
+var errStoreClosed = errors.New("store is closed")
+
+// ErrDataDirLocked is returned when opening a data directory that another
+// durable store, in this process or another, already has open.
+var ErrDataDirLocked = errors.New("data directory is in use")
+
+// OpenDurableInMemWalletStore returns an in-memory store that logs every
+// write to cfg.Dir before applying it, and restores whatever the directory
+// already holds: the latest snapshot, then the writes logged after it.
+//
+// Only one store may have a directory open at a time; opening one that is in
+// use fails with ErrDataDirLocked. Close must be called once the store is no
+// longer used, which releases the directory.
+func OpenDurableInMemWalletStore(cfg DurabilityConfig, opts ...Option) (_ *InMemWalletStore, err error) {
+	switch cfg.Fsync {
+	case "":
+		cfg.Fsync = FsyncAlways
+	case FsyncAlways, FsyncInterval, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q, expected one of: %s, %s, %s", cfg.Fsync, FsyncAlways, FsyncInterval, FsyncNever)
+	}
+	if cfg.FsyncInterval <= 0 {
+		cfg.FsyncInterval = DefaultFsyncInterval
+	}
+	if cfg.SnapshotEvery <= 0 {
+		cfg.SnapshotEvery = DefaultSnapshotEvery
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data directory: %w", err)
+	}
+
+	lock, err := lockDataDir(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.Close()
+		}
+	}()
+
+	s := NewInMemWalletStore(opts...)
+
+	seq, err := s.restoreSnapshot(filepath.Join(cfg.Dir, snapshotFile))
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(cfg.Dir, walFile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open write-ahead log: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	w := &walLog{cfg: cfg, file: f, lock: lock, seq: seq}
+	if err := s.replay(w); err != nil {
+		return nil, err
+	}
+	s.wal = w
+
+	// Wallets logged before addresses were checked are moved to their
+	// lowercase address once restored. Writes logged afterwards were made
+	// against the old addresses, so this cannot happen any earlier, and the
+	// result is saved as a snapshot right away, replacing those writes.
+	canonicalized := s.canonicalizeWallets(time.Now().UTC())
+
+	// A new store starts with a snapshot, so that the state it was created
+	// with, such as when the default token came to be, is kept as well.
+	if _, err := os.Stat(filepath.Join(cfg.Dir, snapshotFile)); canonicalized || errors.Is(err, os.ErrNotExist) {
+		if err := s.writeSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Fsync == FsyncInterval {
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+// walLog is the write-ahead log of a durable in-memory store. Apart from the
+// fields set up when the store is opened, it is guarded by the store's mu.
+type walLog struct {
+	cfg  DurabilityConfig
+	file *os.File
+
+	// lock holds the lock on the data directory until the store is closed.
+	lock *os.File
+
+	// seq is the sequence number of the last logged write, and pending the
+	// number of writes logged since the last snapshot.
+	seq     uint64
+	pending int
+
+	// syncErr is the first background sync failure. Once set, every write
+	// fails with it, since the log can no longer be trusted to be on disk.
+	syncErr error
+	closed  bool
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+type walOp string
+
+const (
+	walCreateWallet walOp = "createWallet"
+	walTransfer     walOp = "transfer"
+	walCreateToken  walOp = "createToken"
+	walMint         walOp = "mint"
+	walBurn         walOp = "burn"
+	walApprove      walOp = "approve"
+	walGenesis      walOp = "genesis"
+
+	walImportWallets   walOp = "importWallets"
+	walImportTransfers walOp = "importTransfers"
+
+	walCreateAPIKey walOp = "createAPIKey"
+	walRevokeAPIKey walOp = "revokeAPIKey"
+
+	walRegisterWalletKey   walOp = "registerWalletKey"
+	walSetAcceptsTransfers walOp = "setAcceptsTransfers"
+)
+
+// walRecord is a single logged write. Writes are deterministic given the
+// state they are applied to and At, so replaying the records in order
+// rebuilds the store exactly, rejected transfers included.
+type walRecord struct {
+	Seq      uint64          `json:"seq"`
+	Op       walOp           `json:"op"`
+	At       time.Time       `json:"at"`
+	Address  string          `json:"address,omitempty"`
+	Token    string          `json:"token,omitempty"`
+	Amount   *big.Int        `json:"amount,omitempty"`
+	Legs     []TransferOp    `json:"legs,omitempty"`
+	Options  TransferOptions `json:"options"`
+	Spender  string          `json:"spender,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Decimals int             `json:"decimals,omitempty"`
+	Genesis  *Genesis        `json:"genesis,omitempty"`
+
+	WalletRows []WalletRow           `json:"walletRows,omitempty"`
+	Transfers  []*generated.Transfer `json:"transfers,omitempty"`
+
+	APIKey *APIKey `json:"apiKey,omitempty"`
+	KeyID  string  `json:"keyId,omitempty"`
+
+	PublicKey ed25519.PublicKey `json:"publicKey,omitempty"`
+	Accepts   bool              `json:"accepts,omitempty"`
+
+	// Approval holds the signature and nonce of an approval. Approvals
+	// logged before they could be signed have none and replay unchecked.
+	Approval *ApproveOptions `json:"approval,omitempty"`
+
+	// RecipientPolicy is the policy a transfer was checked under, so
+	// replaying it after the policy changed still has the same outcome.
+	// Transfers logged before policies existed have none, which is
+	// RecipientAutoCreate.
+	RecipientPolicy RecipientPolicy `json:"recipientPolicy,omitempty"`
+
+	// IdempotencyWindow is how long the outcome of a transfer was to be
+	// remembered under its idempotency key, so replaying it after the window
+	// changed keeps the key for as long as it was kept the first time.
+	// Transfers logged before it was recorded have none and get the current
+	// window.
+	IdempotencyWindow *time.Duration `json:"idempotencyWindow,omitempty"`
+}
+
+// log appends rec to the write-ahead log before the write it describes is
+// applied, taking a snapshot first when one is due. It does nothing for a
+// store that is not durable; callers must hold s.mu.
+func (s *InMemWalletStore) log(rec walRecord) error {
+	w := s.wal
+	if w == nil {
+		return nil
+	}
+	if w.closed {
+		return errStoreClosed
+	}
+	if w.syncErr != nil {
+		return w.syncErr
+	}
+
+	// Every write logged so far has been applied, so the snapshot taken
+	// here covers all of them.
+	if w.pending >= w.cfg.SnapshotEvery {
+		if err := s.writeSnapshot(); err != nil {
+			return err
+		}
+	}
+
+	rec.Seq = w.seq + 1
+	line, err := encodeWALRecord(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(line); err != nil {
+		return fmt.Errorf("append to write-ahead log: %w", err)
+	}
+	if w.cfg.Fsync == FsyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("sync write-ahead log: %w", err)
+		}
+	}
+
+	w.seq = rec.Seq
+	w.pending++
+	return nil
+}
+
+// encodeWALRecord returns rec as one line of the log: the CRC-32 of the
+// JSON, in hex, then the JSON itself.
+func encodeWALRecord(rec walRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("encode write-ahead log record: %w", err)
+	}
+	return fmt.Appendf(nil, "%08x %s\n", crc32.ChecksumIEEE(data), data), nil
+}
+
+func decodeWALRecord(line []byte) (walRecord, bool) {
+	var rec walRecord
+	sum, data, ok := bytes.Cut(bytes.TrimSuffix(line, []byte("\n")), []byte(" "))
+	if !ok || string(sum) != fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)) {
+		return rec, false
+	}
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+// replay applies every record of w logged after the snapshot that was
+// restored. An incomplete last record, left by a crash in the middle of an
+// append, is cut off; damage anywhere else is an error.
+func (s *InMemWalletStore) replay(w *walLog) error {
+	r := bufio.NewReader(w.file)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				return w.file.Truncate(offset)
+			}
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read write-ahead log: %w", err)
+		}
+
+		rec, ok := decodeWALRecord(line)
+		if !ok {
+			if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+				return w.file.Truncate(offset)
+			}
+			return fmt.Errorf("write-ahead log is corrupt at byte %d", offset)
+		}
+		offset += int64(len(line))
+
+		// Records up to the snapshot are only left over when a crash hit
+		// between writing the snapshot and emptying the log.
+		if rec.Seq <= w.seq {
+			continue
+		}
+		if rec.Seq != w.seq+1 {
+			return fmt.Errorf("write-ahead log skips from write %d to %d", w.seq, rec.Seq)
+		}
+		if err := s.apply(rec); err != nil {
+			return err
+		}
+		w.seq = rec.Seq
+		w.pending++
+	}
+}
+
+// apply repeats a logged write. It fails with whatever error the write
+// failed with the first time, which is of no interest here, so only an
+// unknown record is an error.
+func (s *InMemWalletStore) apply(rec walRecord) error {
+	switch rec.Op {
+	case walCreateWallet:
+		if _, exists := s.wallets[rec.Address]; !exists {
+			s.createWallet(rec.Address, rec.Amount, rec.At)
+		}
+	case walTransfer:
+		window := s.opts.idempotencyWindow
+		if rec.IdempotencyWindow != nil {
+			window = *rec.IdempotencyWindow
+		}
+		_, _ = s.transfer(rec.Address, rec.Legs, rec.Options, rec.RecipientPolicy, window, rec.At)
+	case walCreateToken:
+		if _, exists := s.tokens[rec.Token]; !exists {
+			s.createToken(rec.Token, rec.Name, rec.Decimals, rec.At)
+		}
+	case walMint:
+		_, _ = s.mint(rec.Token, rec.Address, rec.Amount, rec.At)
+	case walBurn:
+		_, _ = s.burn(rec.Token, rec.Address, rec.Amount, rec.At)
+	case walApprove:
+		_, _ = s.approve(rec.Token, rec.Address, rec.Spender, rec.Amount, rec.Approval)
+	case walGenesis:
+		if s.genesis == nil {
+			s.applyGenesis(rec.Genesis, rec.At)
+		}
+	case walImportWallets:
+		s.importWallets(rec.WalletRows, rec.At, false)
+	case walImportTransfers:
+		s.importTransfers(rec.Transfers, false)
+	case walCreateAPIKey:
+		if _, exists := s.apiKeys[rec.APIKey.ID]; !exists {
+			s.apiKeys[rec.APIKey.ID] = rec.APIKey
+		}
+	case walRevokeAPIKey:
+		if k, ok := s.apiKeys[rec.KeyID]; ok && k.RevokedAt == nil {
+			at := rec.At
+			k.RevokedAt = &at
+		}
+	case walRegisterWalletKey:
+		if w, ok := s.wallets[rec.Address]; ok && w.publicKey == nil {
+			w.publicKey = rec.PublicKey
+		}
+	case walSetAcceptsTransfers:
+		if w, ok := s.wallets[rec.Address]; ok {
+			w.accepts = rec.Accepts
+		}
+	default:
+		return fmt.Errorf("write-ahead log record %d has unknown operation %q", rec.Seq, rec.Op)
+	}
+	return nil
+}
+
+// inMemSnapshot is the whole state of an in-memory store after the write
+// numbered Seq.
+type inMemSnapshot struct {
+	Seq         uint64                     `json:"seq"`
+	Wallets     []snapshotWallet           `json:"wallets"`
+	Tokens      []*generated.Token         `json:"tokens"`
+	Transfers   []*generated.Transfer      `json:"transfers"`
+	Idempotency []snapshotIdempotentResult `json:"idempotency"`
+	Allowances  []snapshotAllowance        `json:"allowances"`
+	Journal     []snapshotEntry            `json:"journal"`
+	Genesis     *GenesisRecord             `json:"genesis,omitempty"`
+	APIKeys     []*APIKey                  `json:"apiKeys,omitempty"`
+
+	AddressProblems []AddressProblem `json:"addressProblems,omitempty"`
+}
+
+type snapshotWallet struct {
+	Address   string              `json:"address"`
+	Balances  map[string]*big.Int `json:"balances"`
+	PublicKey ed25519.PublicKey   `json:"publicKey,omitempty"`
+	Nonce     uint64              `json:"nonce,omitempty"`
+	Accepts   bool                `json:"accepts,omitempty"`
+	CreatedAt time.Time           `json:"createdAt"`
+	UpdatedAt time.Time           `json:"updatedAt"`
+}
+
+type snapshotIdempotentResult struct {
+	From        string    `json:"from"`
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Balance     *big.Int  `json:"balance"`
+	Reason      string    `json:"reason,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+
+	// ExpiresAt is missing from snapshots taken before it was kept, whose
+	// keys expire after the current window.
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type snapshotEntry struct {
+	Kind      JournalEntryKind  `json:"kind"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Postings  []snapshotPosting `json:"postings"`
+}
+
+type snapshotPosting struct {
+	Address    string   `json:"address"`
+	Token      string   `json:"token"`
+	Amount     *big.Int `json:"amount"`
+	TransferID string   `json:"transferId,omitempty"`
+}
+
+type snapshotAllowance struct {
+	Owner   string   `json:"owner"`
+	Spender string   `json:"spender"`
+	Token   string   `json:"token"`
+	Amount  *big.Int `json:"amount"`
+}
+
+// writeSnapshot saves the current state and empties the log, whose writes
+// the snapshot now covers; callers must hold s.mu.
+func (s *InMemWalletStore) writeSnapshot() error {
+	w := s.wal
+	snap := inMemSnapshot{
+		Seq:       w.seq,
+		Transfers: s.transfers,
+		Genesis:   s.genesis,
+	}
+	for _, wallet := range s.wallets {
+		snap.Wallets = append(snap.Wallets, snapshotWallet{
+			Address:   wallet.address,
+			Balances:  wallet.balances,
+			PublicKey: wallet.publicKey,
+			Nonce:     wallet.nonce,
+			Accepts:   wallet.accepts,
+			CreatedAt: wallet.createdAt,
+			UpdatedAt: wallet.updatedAt,
+		})
+	}
+	for _, t := range s.tokens {
+		snap.Tokens = append(snap.Tokens, t)
+	}
+	for _, k := range s.apiKeys {
+		snap.APIKeys = append(snap.APIKeys, k)
+	}
+	snap.AddressProblems = s.addressProblems
+	for k, r := range s.idempotency {
+		snap.Idempotency = append(snap.Idempotency, snapshotIdempotentResult{
+			From:        k.from,
+			Key:         k.key,
+			Fingerprint: r.fingerprint,
+			Balance:     r.balance,
+			Reason:      r.reason,
+			CreatedAt:   r.createdAt,
+			ExpiresAt:   r.expiresAt,
+		})
+	}
+	for k, amount := range s.allowances {
+		snap.Allowances = append(snap.Allowances, snapshotAllowance{
+			Owner: k.owner, Spender: k.spender, Token: k.token, Amount: amount,
+		})
+	}
+
+	for _, e := range s.journal {
+		entry := snapshotEntry{Kind: e.kind, CreatedAt: e.createdAt}
+		for _, p := range e.postings {
+			entry.Postings = append(entry.Postings, snapshotPosting{
+				Address: p.address, Token: p.token, Amount: p.amount, TransferID: p.transferID,
+			})
+		}
+		snap.Journal = append(snap.Journal, entry)
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("encode snapshot: %w", err)
+	}
+
+	// The snapshot replaces the old one atomically and is always synced,
+	// whatever the fsync policy, since the log is emptied right after.
+	path := filepath.Join(w.cfg.Dir, snapshotFile)
+	if err := writeFileSynced(path+".tmp", data); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+	if err := syncDir(w.cfg.Dir); err != nil {
+		return fmt.Errorf("write snapshot: %w", err)
+	}
+
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("empty write-ahead log: %w", err)
+	}
+	w.pending = 0
+	return nil
+}
+
+// restoreSnapshot loads the snapshot at path into the empty store s and
+// returns the number of the last write it covers, 0 if there is none.
+func (s *InMemWalletStore) restoreSnapshot(path string) (uint64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read snapshot: %w", err)
+	}
+
+	var snap inMemSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return 0, fmt.Errorf("decode snapshot: %w", err)
+	}
+
+	for _, w := range snap.Wallets {
+		if w.Balances == nil {
+			w.Balances = make(map[string]*big.Int)
+		}
+		s.wallets[w.Address] = &inMemWallet{
+			address:   w.Address,
+			balances:  w.Balances,
+			publicKey: w.PublicKey,
+			nonce:     w.Nonce,
+			accepts:   w.Accepts,
+			createdAt: w.CreatedAt,
+			updatedAt: w.UpdatedAt,
+		}
+	}
+	for _, t := range snap.Tokens {
+		s.tokens[t.Symbol] = t
+	}
+	s.transfers = snap.Transfers
+	s.genesis = snap.Genesis
+	s.addressProblems = snap.AddressProblems
+	for _, k := range snap.APIKeys {
+		s.apiKeys[k.ID] = k
+	}
+	for _, r := range snap.Idempotency {
+		if r.ExpiresAt.IsZero() {
+			r.ExpiresAt = r.CreatedAt.Add(s.opts.idempotencyWindow)
+		}
+		s.idempotency[idempotencyKey{r.From, r.Key}] = &inMemIdempotentResult{
+			idempotentResult: idempotentResult{
+				fingerprint: r.Fingerprint,
+				balance:     r.Balance,
+				reason:      r.Reason,
+			},
+			createdAt: r.CreatedAt,
+			expiresAt: r.ExpiresAt,
+		}
+	}
+	for _, a := range snap.Allowances {
+		s.allowances[allowanceKey{a.Owner, a.Spender, a.Token}] = a.Amount
+	}
+	for _, e := range snap.Journal {
+		entry := &inMemEntry{kind: e.Kind, createdAt: e.CreatedAt}
+		for _, p := range e.Postings {
+			entry.postings = append(entry.postings, posting{
+				address: p.Address, token: p.Token, amount: p.Amount, transferID: p.TransferID,
+			})
+		}
+		s.journal = append(s.journal, entry)
+	}
+	return snap.Seq, nil
+}
+
+func writeFileSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename inside dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// syncPeriodically syncs the log once per interval until the store is
+// closed.
+func (s *InMemWalletStore) syncPeriodically() {
+	w := s.wal
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.cfg.FsyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if !w.closed && w.syncErr == nil {
+				if err := w.file.Sync(); err != nil {
+					w.syncErr = fmt.Errorf("sync write-ahead log: %w", err)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// Close syncs and closes the write-ahead log of a durable store, after which
+// every write fails. It does nothing for a store that is not durable.
+func (s *InMemWalletStore) Close() error {
+	w := s.wal
+	if w == nil {
+		return nil
+	}
+	if w.stop != nil {
+		w.stopOnce.Do(func() { close(w.stop) })
+		<-w.done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.lock.Close()
+	if err := w.file.Sync(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("sync write-ahead log: %w", err)
+	}
+	return w.file.Close()
+}
@@ -0,0 +1,79 @@
+package store
+
+import (
+	"math/big"
+	"time"
+)
+
+// IssuanceAccount is the journal account new tokens are issued from and
+// burned tokens return to. Its balance of a token is always the negative of
+// the token's total supply, which keeps the journal summing to zero.
+const IssuanceAccount = "@issuance"
+
+// JournalEntryKind says what produced a journal entry.
+type JournalEntryKind string
+
+const (
+	// EntryOpening carries the balances wallets already held when the
+	// journal was introduced.
+	EntryOpening  JournalEntryKind = "OPENING"
+	EntrySeed     JournalEntryKind = "SEED"
+	EntryTransfer JournalEntryKind = "TRANSFER"
+	EntryMint     JournalEntryKind = "MINT"
+	EntryBurn     JournalEntryKind = "BURN"
+)
+
+// UnbalancedEntry is a journal entry whose postings of a token do not sum to
+// zero, as reported by CheckJournal.
+type UnbalancedEntry struct {
+	EntryID   string           `json:"entryId"`
+	Kind      JournalEntryKind `json:"kind"`
+	Token     string           `json:"token"`
+	Sum       *big.Int         `json:"sum"`
+	CreatedAt time.Time        `json:"createdAt"`
+}
+
+// posting is one side of a journal entry: amount is credited to address,
+// or debited from it when negative. transferID is the transfer leg the
+// posting belongs to, empty for entries that are not transfers.
+type posting struct {
+	address    string
+	token      string
+	amount     *big.Int
+	transferID string
+}
+
+// transferPostings returns the debit and credit of a single transfer leg.
+func transferPostings(from, token string, op TransferOp, transferID string) []posting {
+	return []posting{
+		{address: from, token: token, amount: new(big.Int).Neg(op.Amount), transferID: transferID},
+		{address: op.To, token: token, amount: new(big.Int).Set(op.Amount), transferID: transferID},
+	}
+}
+
+// issuancePostings returns the postings that issue amount of token to
+// address, or take it back out of circulation when amount is negative.
+func issuancePostings(address, token string, amount *big.Int) []posting {
+	return []posting{
+		{address: IssuanceAccount, token: token, amount: new(big.Int).Neg(amount)},
+		{address: address, token: token, amount: new(big.Int).Set(amount)},
+	}
+}
+
+// unbalancedTokens sums postings per token and returns the tokens whose
+// postings do not cancel out, with their sums.
+func unbalancedTokens(postings []posting) map[string]*big.Int {
+	sums := make(map[string]*big.Int)
+	for _, p := range postings {
+		if sums[p.token] == nil {
+			sums[p.token] = new(big.Int)
+		}
+		sums[p.token].Add(sums[p.token], p.amount)
+	}
+	for token, sum := range sums {
+		if sum.Sign() == 0 {
+			delete(sums, token)
+		}
+	}
+	return sums
+}
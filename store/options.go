@@ -0,0 +1,34 @@
+package store
+
+import "time"
+
+// DefaultIdempotencyWindow is how long a transfer outcome stays replayable
+// under its idempotency key unless WithIdempotencyWindow says otherwise.
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// Option tweaks the behaviour shared by every WalletStore implementation.
+type Option func(*options)
+
+type options struct {
+	idempotencyWindow time.Duration
+	recipientPolicy   RecipientPolicy
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		idempotencyWindow: DefaultIdempotencyWindow,
+		recipientPolicy:   RecipientAutoCreate,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithIdempotencyWindow sets how long a transfer made with an idempotency key
+// is remembered. Replays after the window has passed move funds again.
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(o *options) {
+		o.idempotencyWindow = window
+	}
+}
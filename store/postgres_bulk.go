@@ -0,0 +1,333 @@
+package store
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// Bulk imports COPY their rows into a temporary table first, so every
+// check and write that follows is a single statement over all of them.
+
+func (s *PostgresWalletStore) ImportWallets(ctx context.Context, rows []WalletRow, dryRun bool) ([]RowResult, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+        CREATE TEMP TABLE bulk_wallets (
+            ord INT PRIMARY KEY,
+            address TEXT NOT NULL,
+            token TEXT NOT NULL,
+            balance TEXT NOT NULL
+        ) ON COMMIT DROP
+    `); err != nil {
+		return nil, err
+	}
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"bulk_wallets"},
+		[]string{"ord", "address", "token", "balance"},
+		pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+			return []any{i, rows[i].Address, rows[i].Token, rows[i].Balance.String()}, nil
+		}),
+	); err != nil {
+		return nil, fmt.Errorf("copy wallet rows: %w", err)
+	}
+
+	// Wallets are locked in address order, as Transfer locks them.
+	if _, err := tx.Exec(ctx, `
+        SELECT pg_advisory_xact_lock(hashtext(address)::bigint)
+          FROM (SELECT DISTINCT address FROM bulk_wallets ORDER BY address) a
+    `); err != nil {
+		return nil, err
+	}
+
+	results := make([]RowResult, len(rows))
+	var imported []int32
+	pgRows, err := tx.Query(ctx, `
+        SELECT b.ord,
+               t.symbol IS NOT NULL,
+               w.address IS NOT NULL,
+               COALESCE(bal.balance, 0)::text
+          FROM bulk_wallets b
+          LEFT JOIN tokens t ON t.symbol = b.token
+          LEFT JOIN wallets w ON w.address = b.address
+          LEFT JOIN balances bal ON bal.address = b.address AND bal.token = b.token
+    `)
+	if err != nil {
+		return nil, err
+	}
+	for pgRows.Next() {
+		var ord int32
+		var known, exists bool
+		var held string
+		if err := pgRows.Scan(&ord, &known, &exists, &held); err != nil {
+			pgRows.Close()
+			return nil, err
+		}
+		n, err := parseNumeric(held)
+		if err != nil {
+			pgRows.Close()
+			return nil, err
+		}
+		results[ord] = walletRowResult(rows[ord], known, exists, n)
+		if results[ord].Status == RowImported {
+			imported = append(imported, ord)
+		}
+	}
+	pgRows.Close()
+	if err := pgRows.Err(); err != nil {
+		return nil, err
+	}
+	if dryRun || len(imported) == 0 {
+		return results, nil
+	}
+
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM bulk_wallets WHERE ord <> ALL($1::int[])`, imported,
+	); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO wallets(address, created_at, updated_at)
+        SELECT DISTINCT address, $1::timestamptz, $1::timestamptz FROM bulk_wallets
+        ON CONFLICT (address)
+          DO UPDATE SET updated_at = EXCLUDED.updated_at
+    `, now); err != nil {
+		return nil, fmt.Errorf("insert wallets: %w", err)
+	}
+
+	// Rows of zero only create their wallet; the rest credit a balance the
+	// wallet did not hold before.
+	if _, err := tx.Exec(ctx,
+		`DELETE FROM bulk_wallets WHERE balance::numeric = 0`,
+	); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO balances(address, token, balance, updated_at)
+        SELECT address, token, balance::numeric, $1 FROM bulk_wallets
+        ON CONFLICT (address, token)
+          DO UPDATE SET balance = balances.balance + EXCLUDED.balance,
+                        updated_at = EXCLUDED.updated_at
+    `, now); err != nil {
+		return nil, fmt.Errorf("credit balances: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO balance_checkpoints(address, token, balance, recorded_at)
+        SELECT address, token, balance::numeric, $1 FROM bulk_wallets
+    `, now); err != nil {
+		return nil, fmt.Errorf("record balance checkpoints: %w", err)
+	}
+	if _, err := tx.Exec(ctx, `
+        UPDATE tokens t
+           SET total_supply = t.total_supply + b.amount
+          FROM (SELECT token, SUM(balance::numeric) AS amount FROM bulk_wallets GROUP BY token) b
+         WHERE t.symbol = b.token
+    `); err != nil {
+		return nil, fmt.Errorf("update total supply: %w", err)
+	}
+
+	var postings []posting
+	var events []Event
+	for _, i := range imported {
+		row := rows[i]
+		if row.Balance.Sign() == 0 {
+			continue
+		}
+		postings = append(postings, issuancePostings(row.Address, row.Token, row.Balance)...)
+		events = append(events, balanceChanged(row.Address, row.Token, row.Balance))
+	}
+	if len(postings) > 0 {
+		if err := insertJournalEntry(ctx, tx, EntrySeed, postings, now); err != nil {
+			return nil, err
+		}
+		if err := notifyAll(ctx, tx, events); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *PostgresWalletStore) ImportTransfers(ctx context.Context, rows []*generated.Transfer, dryRun bool) ([]RowResult, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `
+        CREATE TEMP TABLE bulk_transfers (
+            ord INT PRIMARY KEY,
+            from_address TEXT NOT NULL,
+            to_address TEXT NOT NULL,
+            spender TEXT,
+            token TEXT NOT NULL,
+            amount TEXT NOT NULL,
+            status TEXT NOT NULL,
+            error TEXT,
+            created_at TIMESTAMPTZ NOT NULL
+        ) ON COMMIT DROP
+    `); err != nil {
+		return nil, err
+	}
+	if _, err := tx.CopyFrom(ctx, pgx.Identifier{"bulk_transfers"},
+		[]string{"ord", "from_address", "to_address", "spender", "token", "amount", "status", "error", "created_at"},
+		pgx.CopyFromSlice(len(rows), func(i int) ([]any, error) {
+			t := rows[i]
+			return []any{i, t.FromAddress, t.ToAddress, t.Spender, t.Token, t.Amount.String(), string(t.Status), t.Error, t.CreatedAt}, nil
+		}),
+	); err != nil {
+		return nil, fmt.Errorf("copy transfer rows: %w", err)
+	}
+
+	results := make([]RowResult, len(rows))
+	for i := range results {
+		results[i] = RowResult{Status: RowImported}
+	}
+	pgRows, err := tx.Query(ctx, `
+        SELECT b.ord
+          FROM bulk_transfers b
+         WHERE NOT EXISTS (SELECT 1 FROM tokens t WHERE t.symbol = b.token)
+    `)
+	if err != nil {
+		return nil, err
+	}
+	unknown, err := pgx.CollectRows(pgRows, pgx.RowTo[int32])
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range unknown {
+		results[i] = rowFailed(errUnknownToken(rows[i].Token))
+	}
+	if dryRun || len(unknown) == len(rows) {
+		return results, nil
+	}
+
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO transfers(from_address, to_address, spender, token, amount, status, error, created_at)
+        SELECT from_address, to_address, spender, token, amount::numeric, status, error, created_at
+          FROM bulk_transfers b
+         WHERE EXISTS (SELECT 1 FROM tokens t WHERE t.symbol = b.token)
+         ORDER BY ord
+    `); err != nil {
+		return nil, fmt.Errorf("record transfers: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *PostgresWalletStore) ExportWallets(ctx context.Context, fn func(WalletRow) error) error {
+	return s.copyOut(ctx, `
+        SELECT w.address, b.token, b.balance::text
+          FROM wallets w
+          JOIN balances b ON b.address = w.address AND b.balance <> 0
+        UNION ALL
+        SELECT w.address, '`+DefaultToken+`', '0'
+          FROM wallets w
+         WHERE NOT EXISTS (SELECT 1 FROM balances b WHERE b.address = w.address AND b.balance <> 0)
+         ORDER BY 1, 2
+    `, func(rec []string) error {
+		balance, err := parseNumeric(rec[2])
+		if err != nil {
+			return err
+		}
+		return fn(WalletRow{Address: rec[0], Token: rec[1], Balance: balance})
+	})
+}
+
+func (s *PostgresWalletStore) ExportTransfers(ctx context.Context, fn func(*generated.Transfer) error) error {
+	return s.copyOut(ctx, `
+        SELECT id, from_address, to_address, spender, token, amount::text, status, error,
+               to_char(created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"')
+          FROM transfers
+         ORDER BY id
+    `, func(rec []string) error {
+		amount, err := parseNumeric(rec[5])
+		if err != nil {
+			return err
+		}
+		createdAt, err := time.Parse(time.RFC3339Nano, rec[8])
+		if err != nil {
+			return err
+		}
+		return fn(&generated.Transfer{
+			ID:          rec[0],
+			FromAddress: rec[1],
+			ToAddress:   rec[2],
+			Spender:     csvNullable(rec[3]),
+			Token:       rec[4],
+			Amount:      amount,
+			Status:      generated.TransferStatus(rec[6]),
+			Error:       csvNullable(rec[7]),
+			CreatedAt:   createdAt,
+		})
+	})
+}
+
+// csvNull is how copyOut has Postgres write NULL, a value no column of an
+// export can hold.
+const csvNull = `\N`
+
+func csvNullable(s string) *string {
+	if s == csvNull {
+		return nil
+	}
+	return &s
+}
+
+// copyOut streams the result of query through COPY and calls fn with each
+// record. Every column must be text.
+func (s *PostgresWalletStore) copyOut(ctx context.Context, query string, fn func([]string) error) error {
+	conn, err := s.db.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	pr, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		_, err := conn.Conn().PgConn().CopyTo(ctx, pw,
+			`COPY (`+query+`) TO STDOUT WITH (FORMAT csv, NULL '`+csvNull+`')`)
+		pw.CloseWithError(err)
+		copied <- err
+	}()
+
+	r := csv.NewReader(pr)
+	r.ReuseRecord = true
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = fn(rec)
+		}
+		if err != nil {
+			// Closing the pipe makes CopyTo give up, so the connection is
+			// free again once it returns.
+			pr.CloseWithError(err)
+			<-copied
+			return err
+		}
+	}
+	return <-copied
+}
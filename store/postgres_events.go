@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// eventsChannel is the LISTEN/NOTIFY channel every instance sharing the
+// database publishes its events on.
+const eventsChannel = "wallet_events"
+
+// listenRetryDelay is how long the listener waits before reconnecting after
+// losing its connection.
+const listenRetryDelay = time.Second
+
+// notify queues ev on tx. Postgres only delivers it once tx commits and drops
+// it if tx rolls back, so subscribers never see uncommitted changes.
+func notify(ctx context.Context, tx pgx.Tx, ev Event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `SELECT pg_notify($1, $2)`, eventsChannel, string(payload)); err != nil {
+		return fmt.Errorf("notify event: %w", err)
+	}
+	return nil
+}
+
+// notifyAll queues evs on tx in a single round trip, as notify does.
+func notifyAll(ctx context.Context, tx pgx.Tx, evs []Event) error {
+	payloads := make([]string, len(evs))
+	for i, ev := range evs {
+		payload, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		payloads[i] = string(payload)
+	}
+	if _, err := tx.Exec(ctx,
+		`SELECT pg_notify($1, p) FROM unnest($2::text[]) AS p`, eventsChannel, payloads,
+	); err != nil {
+		return fmt.Errorf("notify events: %w", err)
+	}
+	return nil
+}
+
+// pgListener is the connection that forwards notifications to the
+// subscribers of a PostgresWalletStore, from the first Subscribe until Close.
+type pgListener struct {
+	mu     sync.Mutex
+	closed bool
+
+	// cancel stops the listener and done is closed once it has stopped;
+	// both are nil until it starts.
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Subscribe starts listening for events on the first call, and returns once
+// the store is listening, so no event committed after it returns is missed.
+// Events committed by this instance reach subscribers the same way as those
+// of other instances, through the database.
+func (s *PostgresWalletStore) Subscribe(ctx context.Context) (<-chan Event, error) {
+	if err := s.startListening(ctx); err != nil {
+		return nil, err
+	}
+	return s.events.subscribe(ctx), nil
+}
+
+// Close stops listening for events, after which Subscribe fails. The pool is
+// left open, since the store does not own it.
+func (s *PostgresWalletStore) Close() {
+	l := &s.listen
+	l.mu.Lock()
+	l.closed = true
+	cancel, done := l.cancel, l.done
+	l.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+}
+
+// startListening connects the listener unless it already runs. The first
+// LISTEN is made here rather than in the background, so a failure to listen
+// is returned to the subscriber.
+func (s *PostgresWalletStore) startListening(ctx context.Context) error {
+	l := &s.listen
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return errStoreClosed
+	}
+	if l.done != nil {
+		return nil
+	}
+
+	conn, err := s.connectListener(ctx)
+	if err != nil {
+		return fmt.Errorf("listen for events: %w", err)
+	}
+	listenCtx, cancel := context.WithCancel(context.Background())
+	l.cancel, l.done = cancel, make(chan struct{})
+	go s.listenForEvents(listenCtx, conn, l.done)
+	return nil
+}
+
+// listenForEvents forwards notifications received on conn to the local
+// subscribers until ctx is done, then closes done. Whenever the connection is
+// lost it reconnects; events sent while reconnecting are missed.
+func (s *PostgresWalletStore) listenForEvents(ctx context.Context, conn *pgx.Conn, done chan struct{}) {
+	defer close(done)
+	for {
+		if conn != nil {
+			_ = s.receiveEvents(ctx, conn)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+		conn, _ = s.connectListener(ctx)
+	}
+}
+
+// connectListener opens a dedicated connection listening for events, since
+// one taken from the pool would keep receiving notifications after being
+// handed back.
+func (s *PostgresWalletStore) connectListener(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.ConnectConfig(ctx, s.db.Config().ConnConfig)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Exec(ctx, "LISTEN "+eventsChannel); err != nil {
+		conn.Close(context.Background())
+		return nil, err
+	}
+	return conn, nil
+}
+
+// receiveEvents publishes the notifications arriving on conn until it fails
+// or ctx is done, and closes it.
+func (s *PostgresWalletStore) receiveEvents(ctx context.Context, conn *pgx.Conn) error {
+	defer conn.Close(context.Background())
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		var ev Event
+		if err := json.Unmarshal([]byte(n.Payload), &ev); err != nil {
+			continue
+		}
+		s.events.publish(ev)
+	}
+}
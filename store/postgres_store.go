@@ -2,40 +2,83 @@ package store
 
 import (
 	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
-	"sort"
+	"math/big"
 	"strconv"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/zanpatryk/tokentransferapi/graph/generated"
 )
 
 type PostgresWalletStore struct {
-	db *pgxpool.Pool
+	db     *pgxpool.Pool
+	opts   options
+	events *eventBus
+	listen pgListener
 }
 
-func NewPostgresWalletStore(db *pgxpool.Pool) *PostgresWalletStore {
-	return &PostgresWalletStore{db: db}
+func NewPostgresWalletStore(db *pgxpool.Pool, opts ...Option) *PostgresWalletStore {
+	return &PostgresWalletStore{db: db, opts: newOptions(opts), events: newEventBus()}
+}
+
+// pgQuerier is satisfied by both the pool and an open transaction.
+type pgQuerier interface {
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
 }
 
 func (s *PostgresWalletStore) GetByAddress(ctx context.Context, addr string) (*generated.Wallet, error) {
+	addr, err := canonicalAddress(addr)
+	if err != nil {
+		return nil, err
+	}
 	w := &generated.Wallet{}
 	row := s.db.QueryRow(ctx,
-		`SELECT address, balance, created_at, updated_at
+		`SELECT address, created_at, updated_at
 	FROM wallets WHERE address=$1`, addr)
-	var balanceStr string
 
-	if err := row.Scan(&w.Address, &balanceStr, &w.CreatedAt, &w.UpdatedAt); err != nil {
+	if err := row.Scan(&w.Address, &w.CreatedAt, &w.UpdatedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrWalletNotFound
+		}
+		return nil, err
+	}
+
+	if err := loadBalances(ctx, s.db, []*generated.Wallet{w}); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *PostgresWalletStore) GetByAddressAsOf(ctx context.Context, addr string, asOf time.Time) (*generated.Wallet, error) {
+	addr, err := canonicalAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &generated.Wallet{}
+	err = s.db.QueryRow(ctx, `
+        SELECT address, created_at FROM wallets WHERE address = $1 AND created_at <= $2
+    `, addr, asOf).Scan(&w.Address, &w.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadBalancesAsOf(ctx, s.db, []*generated.Wallet{w}, asOf); err != nil {
 		return nil, err
 	}
-	w.Balance, _ = strconv.Atoi(balanceStr)
 	return w, nil
 }
 
 func (s *PostgresWalletStore) ListAll(ctx context.Context) ([]*generated.Wallet, error) {
 	rows, err := s.db.Query(ctx,
-		`SELECT address, balance, created_at, updated_at FROM wallets`)
+		`SELECT address, created_at, updated_at FROM wallets`)
 	if err != nil {
 		return nil, err
 	}
@@ -44,142 +87,1549 @@ func (s *PostgresWalletStore) ListAll(ctx context.Context) ([]*generated.Wallet,
 	var result []*generated.Wallet
 	for rows.Next() {
 		w := &generated.Wallet{}
-		var balanceStr string
-		if err := rows.Scan(&w.Address, &balanceStr, &w.CreatedAt, &w.UpdatedAt); err != nil {
+		if err := rows.Scan(&w.Address, &w.CreatedAt, &w.UpdatedAt); err != nil {
 			return nil, err
 		}
-		w.Balance, _ = strconv.Atoi(balanceStr)
 		result = append(result, w)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := loadBalances(ctx, s.db, result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
 
-func (s *PostgresWalletStore) CreateIfNotExists(ctx context.Context, addr string, initialBalance int) (*generated.Wallet, error) {
+// walletOrderColumns holds the SQL expression wallets are sorted by for
+// each order field. A wallet without a balance row has a balance of zero.
+var walletOrderColumns = map[generated.WalletOrderField]string{
+	generated.WalletOrderFieldBalance:   "COALESCE(b.balance, 0)",
+	generated.WalletOrderFieldCreatedAt: "w.created_at",
+	generated.WalletOrderFieldAddress:   "w.address",
+}
+
+func (s *PostgresWalletStore) ListWallets(ctx context.Context, q WalletQuery) (*generated.WalletConnection, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	field := q.orderField()
+	after, err := decodeWalletCursor(q.After, field)
+	if err != nil {
+		return nil, err
+	}
+
+	column, ok := walletOrderColumns[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot order wallets by %s", ErrInvalidArgument, field)
+	}
+	dir, cmp := "ASC", ">"
+	if q.descending() {
+		dir, cmp = "DESC", "<"
+	}
+
+	var minBalance, maxBalance *string
+	if q.Filter.MinBalance != nil {
+		v := q.Filter.MinBalance.String()
+		minBalance = &v
+	}
+	if q.Filter.MaxBalance != nil {
+		v := q.Filter.MaxBalance.String()
+		maxBalance = &v
+	}
+
+	args := []any{DefaultToken, minBalance, maxBalance, q.Filter.CreatedAfter, q.Filter.CreatedBefore, q.First + 1, q.AsOf}
+
+	// Listing as of a time takes each wallet's balance from its last
+	// checkpoint by then instead of the current balance.
+	balances := "balances b ON b.address = w.address AND b.token = $1"
+	if q.AsOf != nil {
+		balances = `LATERAL (
+            SELECT c.balance
+              FROM balance_checkpoints c
+             WHERE c.address = w.address AND c.token = $1 AND c.recorded_at <= $7::timestamptz
+             ORDER BY c.recorded_at DESC, c.id DESC
+             LIMIT 1
+          ) b ON TRUE`
+	}
+
+	// Keyset pagination: continue right after the (sort value, address) pair
+	// of the cursor instead of skipping rows with OFFSET.
+	keyset := "TRUE"
+	if after != nil {
+		switch field {
+		case generated.WalletOrderFieldBalance:
+			keyset = fmt.Sprintf("(%s, w.address) %s ($8::numeric, $9::text)", column, cmp)
+			args = append(args, after.balance.String(), after.address)
+		case generated.WalletOrderFieldCreatedAt:
+			keyset = fmt.Sprintf("(%s, w.address) %s ($8::timestamptz, $9::text)", column, cmp)
+			args = append(args, after.createdAt, after.address)
+		default:
+			keyset = fmt.Sprintf("w.address %s $8::text", cmp)
+			args = append(args, after.address)
+		}
+	}
+
+	// The page and its balances are read from one snapshot, so the cursors
+	// match the order the page was selected in.
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, fmt.Sprintf(`
+        SELECT w.address, w.created_at, w.updated_at
+          FROM wallets w
+          LEFT JOIN %s
+         WHERE ($2::numeric IS NULL OR COALESCE(b.balance, 0) >= $2::numeric)
+           AND ($3::numeric IS NULL OR COALESCE(b.balance, 0) <= $3::numeric)
+           AND ($4::timestamptz IS NULL OR w.created_at > $4::timestamptz)
+           AND ($5::timestamptz IS NULL OR w.created_at < $5::timestamptz)
+           AND ($7::timestamptz IS NULL OR w.created_at <= $7::timestamptz)
+           AND %s
+         ORDER BY %s %s, w.address %s
+         LIMIT $6
+    `, balances, keyset, column, dir, dir), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ws := []*generated.Wallet{}
+	for rows.Next() {
+		w := &generated.Wallet{}
+		if err := rows.Scan(&w.Address, &w.CreatedAt, &w.UpdatedAt); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if q.AsOf != nil {
+		err = loadBalancesAsOf(ctx, tx, ws, *q.AsOf)
+	} else {
+		err = loadBalances(ctx, tx, ws)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return walletConnection(ws, q), nil
+}
+
+// loadBalances fills Balance and Balances of every wallet in ws.
+func loadBalances(ctx context.Context, q pgQuerier, ws []*generated.Wallet) error {
+	byAddr := make(map[string]*generated.Wallet, len(ws))
+	addrs := make([]string, 0, len(ws))
+	for _, w := range ws {
+		w.Balance = new(big.Int)
+		w.Balances = []*generated.TokenBalance{}
+		byAddr[w.Address] = w
+		addrs = append(addrs, w.Address)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	rows, err := q.Query(ctx, `
+        SELECT b.address, b.balance::text,
+               t.symbol, t.name, t.decimals, t.total_supply::text, t.created_at
+          FROM balances b
+          JOIN tokens t ON t.symbol = b.token
+         WHERE b.address = ANY($1::text[])
+         ORDER BY b.address, t.symbol
+    `, addrs)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var addr, balance, supply string
+		t := &generated.Token{}
+		if err := rows.Scan(&addr, &balance, &t.Symbol, &t.Name, &t.Decimals, &supply, &t.CreatedAt); err != nil {
+			return err
+		}
+		tb := &generated.TokenBalance{Token: t}
+		if tb.Balance, err = parseNumeric(balance); err != nil {
+			return err
+		}
+		if t.TotalSupply, err = parseNumeric(supply); err != nil {
+			return err
+		}
+
+		w := byAddr[addr]
+		w.Balances = append(w.Balances, tb)
+		if t.Symbol == DefaultToken {
+			w.Balance = tb.Balance
+		}
+	}
+	return rows.Err()
+}
+
+// loadBalancesAsOf fills Balance and Balances of every wallet in ws with the
+// balances it held at asOf, and sets UpdatedAt to the last change by then.
+// Every token a wallet ever held has a row in balances, and its balance at
+// asOf is the last checkpoint recorded by then.
+func loadBalancesAsOf(ctx context.Context, q pgQuerier, ws []*generated.Wallet, asOf time.Time) error {
+	byAddr := make(map[string]*generated.Wallet, len(ws))
+	addrs := make([]string, 0, len(ws))
+	for _, w := range ws {
+		w.Balance = new(big.Int)
+		w.Balances = []*generated.TokenBalance{}
+		w.UpdatedAt = w.CreatedAt
+		byAddr[w.Address] = w
+		addrs = append(addrs, w.Address)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	rows, err := q.Query(ctx, `
+        SELECT b.address, c.balance::text, c.recorded_at,
+               t.symbol, t.name, t.decimals, t.total_supply::text, t.created_at
+          FROM balances b
+          JOIN tokens t ON t.symbol = b.token
+          CROSS JOIN LATERAL (
+                SELECT balance, recorded_at
+                  FROM balance_checkpoints
+                 WHERE address = b.address AND token = b.token AND recorded_at <= $2
+                 ORDER BY recorded_at DESC, id DESC
+                 LIMIT 1
+          ) c
+         WHERE b.address = ANY($1::text[])
+         ORDER BY b.address, t.symbol
+    `, addrs, asOf)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var addr, balance, supply string
+		var recordedAt time.Time
+		t := &generated.Token{}
+		if err := rows.Scan(&addr, &balance, &recordedAt, &t.Symbol, &t.Name, &t.Decimals, &supply, &t.CreatedAt); err != nil {
+			return err
+		}
+		tb := &generated.TokenBalance{Token: t}
+		if tb.Balance, err = parseNumeric(balance); err != nil {
+			return err
+		}
+		if t.TotalSupply, err = parseNumeric(supply); err != nil {
+			return err
+		}
+
+		w := byAddr[addr]
+		w.Balances = append(w.Balances, tb)
+		if t.Symbol == DefaultToken {
+			w.Balance = tb.Balance
+		}
+		if recordedAt.After(w.UpdatedAt) {
+			w.UpdatedAt = recordedAt
+		}
+	}
+	return rows.Err()
+}
+
+func (s *PostgresWalletStore) CreateIfNotExists(ctx context.Context, addr string, initialBalance *big.Int) (*generated.Wallet, error) {
+	addr, err := canonicalAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
 
-	if _, err := s.db.Exec(ctx, `
-        INSERT INTO wallets(address, balance, created_at, updated_at)
-        VALUES ($1, $2, now(), now())
+	// The wallet and its seed are stamped with the same time, taken from the
+	// same clock as every other write, so the wallet exists at every instant
+	// its balance history covers.
+	now := time.Now().UTC()
+	res, err := tx.Exec(ctx, `
+        INSERT INTO wallets(address, created_at, updated_at)
+        VALUES ($1, $2, $2)
         ON CONFLICT (address) DO NOTHING
-    `, addr, initialBalance); err != nil {
+    `, addr, now)
+	if err != nil {
 		return nil, fmt.Errorf("insert wallet: %w", err)
 	}
 
+	// Only a freshly created wallet is seeded, and the seed counts towards
+	// the supply of the default token.
+	if res.RowsAffected() == 1 && initialBalance.Sign() != 0 {
+		if _, err := tx.Exec(ctx, `
+            INSERT INTO balances(address, token, balance, updated_at)
+            VALUES ($1, $2, $3::numeric, $4)
+        `, addr, DefaultToken, initialBalance.String(), now); err != nil {
+			return nil, fmt.Errorf("seed wallet: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, `
+            UPDATE tokens SET total_supply = total_supply + $2::numeric WHERE symbol = $1
+        `, DefaultToken, initialBalance.String()); err != nil {
+			return nil, fmt.Errorf("update total supply: %w", err)
+		}
+
+		if err := insertJournalEntry(ctx, tx, EntrySeed, issuancePostings(addr, DefaultToken, initialBalance), now); err != nil {
+			return nil, err
+		}
+
+		if err := insertCheckpoint(ctx, tx, addr, DefaultToken, initialBalance, now); err != nil {
+			return nil, err
+		}
+		if err := notify(ctx, tx, balanceChanged(addr, DefaultToken, initialBalance)); err != nil {
+			return nil, err
+		}
+	}
+
 	w := &generated.Wallet{}
-	if err := s.db.QueryRow(ctx, `
-        SELECT address, balance, created_at, updated_at
+	if err := tx.QueryRow(ctx, `
+        SELECT address, created_at, updated_at
           FROM wallets
          WHERE address = $1
-    `, addr).Scan(&w.Address, &w.Balance, &w.CreatedAt, &w.UpdatedAt); err != nil {
+    `, addr).Scan(&w.Address, &w.CreatedAt, &w.UpdatedAt); err != nil {
 		return nil, fmt.Errorf("fetch wallet: %w", err)
 	}
 
+	if err := loadBalances(ctx, tx, []*generated.Wallet{w}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
 	return w, nil
 }
 
-func (s *PostgresWalletStore) Transfer(ctx context.Context, from string, op TransferOp) (int, error) {
+func (s *PostgresWalletStore) Transfer(ctx context.Context, from string, ops []TransferOp, opts TransferOptions) (*big.Int, error) {
+	from, ops, opts, err := canonicalTransfer(from, ops, opts)
+	if err != nil {
+		return nil, err
+	}
+	total, err := transferTotal(ops)
+	if err != nil {
+		return nil, err
+	}
+	token := tokenOrDefault(opts.Token)
+
+	var spent *big.Int
+	if opts.Spender != "" {
+		spent = total
+	}
+
 	tx, err := s.db.Begin(ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	defer tx.Rollback(ctx)
 
-	addrs := []string{from, op.To}
-	sort.Strings(addrs)
+	if _, err := getToken(ctx, tx, token); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	// The idempotency key is locked before any wallet so concurrent retries
+	// of the same request queue up behind the first one.
+	if opts.IdempotencyKey != "" {
+		if _, err := tx.Exec(ctx,
+			`SELECT pg_advisory_xact_lock(hashtext('idempotency:' || $1::text || ':' || $2::text)::bigint)`,
+			from, opts.IdempotencyKey,
+		); err != nil {
+			return nil, err
+		}
+
+		prev, err := s.loadIdempotentResult(ctx, tx, from, opts.IdempotencyKey, now)
+		if err != nil {
+			return nil, err
+		}
+		if prev != nil {
+			return prev.replay(transferFingerprint(token, ops, opts))
+		}
+	}
 
-	for _, addr := range addrs {
+	// The sender's lock also guards its allowances, which Approve only
+	// changes while holding the same lock.
+	for _, addr := range lockOrder(from, ops) {
 		if _, err := tx.Exec(ctx,
 			`SELECT pg_advisory_xact_lock(hashtext($1)::bigint)`, addr,
 		); err != nil {
-			return 0, err
+			return nil, err
 		}
 	}
 
-	now := time.Now().UTC()
-	amount := op.Amount
+	key, err := getWalletKey(ctx, tx, from)
+	if errors.Is(err, ErrWalletNotFound) {
+		return nil, fmt.Errorf("sender %w", ErrWalletNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransferKey(key.PublicKey, key.Nonce, opts); err != nil {
+		return nil, err
+	}
+	err = checkRecipients(s.opts.recipientPolicy, ops, func(address string) (recipientState, error) {
+		return getRecipient(ctx, tx, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The nonce is used up outside the savepoint, so a rejected transfer
+	// cannot be replayed once the sender can afford it.
+	if opts.Nonce != nil {
+		if _, err := tx.Exec(ctx, `UPDATE wallets SET nonce = nonce + 1 WHERE address = $1`, from); err != nil {
+			return nil, err
+		}
+	}
 
-	if amount >= 0 {
-		res, err := tx.Exec(ctx,
-			`UPDATE wallets
-               SET balance = balance - $1, updated_at = $2
-             WHERE address = $3 AND balance >= $1`,
-			amount, now, from,
-		)
+	// Legs run inside a savepoint so a rejected leg undoes the ones before it
+	// while the rejection itself still gets recorded in the outer transaction.
+	legs, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
 
+	if spent != nil {
+		rejection, err := spendAllowance(ctx, legs, from, opts.Spender, token, spent, now)
 		if err != nil {
-			return 0, err
+			return nil, err
+		}
+		if rejection != nil {
+			if err := legs.Rollback(ctx); err != nil {
+				return nil, err
+			}
+			return s.rejectTransfer(ctx, tx, from, token, ops, opts, now, rejection)
 		}
+	}
 
-		if res.RowsAffected() == 0 {
-			if err := tx.Commit(ctx); err != nil {
-				return 0, err
+	for _, op := range ops {
+		rejection, err := applyTransferLeg(ctx, legs, from, token, op, now)
+		if err != nil {
+			return nil, err
+		}
+		if rejection != nil {
+			if err := legs.Rollback(ctx); err != nil {
+				return nil, err
 			}
+			return s.rejectTransfer(ctx, tx, from, token, ops, opts, now, rejection)
+		}
+	}
 
-			var bal int
-			_ = tx.QueryRow(ctx,
-				`SELECT balance FROM wallets WHERE address = $1`, from,
-			).Scan(&bal)
+	if err := legs.Commit(ctx); err != nil {
+		return nil, err
+	}
 
-			return bal, fmt.Errorf("Insufficient funds")
+	var postings []posting
+	for _, op := range ops {
+		id, err := insertTransfer(ctx, tx, from, token, op, opts, generated.TransferStatusSucceeded, nil, now)
+		if err != nil {
+			return nil, err
 		}
+		postings = append(postings, transferPostings(from, token, op, id)...)
+	}
+	if err := insertJournalEntry(ctx, tx, EntryTransfer, postings, now); err != nil {
+		return nil, err
+	}
 
-		if _, err := tx.Exec(ctx,
-			`INSERT INTO wallets(address, balance, created_at, updated_at)
-                 VALUES($1, $2, now(), now())
-             ON CONFLICT (address)
-               DO UPDATE SET balance = wallets.balance + EXCLUDED.balance,
-                             updated_at = now()`,
-			op.To, amount,
-		); err != nil {
-			return 0, err
+	for _, addr := range lockOrder(from, ops) {
+		bal, err := balanceOf(ctx, tx, addr, token)
+		if err != nil {
+			return nil, err
 		}
-	} else {
+		if err := insertCheckpoint(ctx, tx, addr, token, bal, now); err != nil {
+			return nil, err
+		}
+		if err := notify(ctx, tx, balanceChanged(addr, token, bal)); err != nil {
+			return nil, err
+		}
+	}
+
+	finalBal, err := balanceOf(ctx, tx, from, token)
+	if err != nil {
+		return nil, err
+	}
 
-		absAmt := -amount
+	if err := s.saveIdempotentResult(ctx, tx, from, token, ops, opts, finalBal, nil, now); err != nil {
+		return nil, err
+	}
 
-		res, err := tx.Exec(ctx,
-			`UPDATE wallets
-               SET balance = balance - $1, updated_at = $2
-             WHERE address = $3 AND balance >= $1`,
-			absAmt, now, op.To,
-		)
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			return 0, err
-		}
+	return finalBal, nil
+}
 
-		if res.RowsAffected() == 0 {
-			if err := tx.Commit(ctx); err != nil {
-				return 0, err
-			}
+// applyTransferLeg moves a single op between from and op.To. A non-nil
+// rejection means the leg was rejected and nothing was changed by it.
+func applyTransferLeg(ctx context.Context, tx pgx.Tx, from, token string, op TransferOp, now time.Time) (rejection error, err error) {
+	debited, credited, amount := from, op.To, op.Amount
 
-			var bal int
-			_ = tx.QueryRow(ctx,
-				`SELECT balance FROM wallets WHERE address = $1`, from,
-			).Scan(&bal)
-			return bal, fmt.Errorf("Insufficient funds on recipient")
-		}
+	res, err := tx.Exec(ctx,
+		`UPDATE balances
+           SET balance = balance - $1::numeric, updated_at = $2
+         WHERE address = $3 AND token = $4 AND balance >= $1::numeric`,
+		amount.String(), now, debited, token,
+	)
 
-		if _, err := tx.Exec(ctx,
-			`UPDATE wallets
-			   SET balance = balance + $1, updated_at = $2
-			WHERE address = $3`,
-			absAmt, now, from,
-		); err != nil {
-			return 0, nil
+	if err != nil {
+		return nil, err
+	}
+
+	if res.RowsAffected() == 0 {
+		return ErrInsufficientFunds, nil
+	}
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO wallets(address, created_at, updated_at)
+             VALUES($1, $2, $2)
+         ON CONFLICT (address)
+           DO UPDATE SET updated_at = EXCLUDED.updated_at`,
+		credited, now,
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE wallets SET updated_at = $2 WHERE address = $1`,
+		debited, now,
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO balances(address, token, balance, updated_at)
+             VALUES($1, $2, $3::numeric, $4)
+         ON CONFLICT (address, token)
+           DO UPDATE SET balance = balances.balance + EXCLUDED.balance,
+                         updated_at = EXCLUDED.updated_at`,
+		credited, token, amount.String(), now,
+	); err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// spendAllowance deducts amount from the allowance spender holds on owner's
+// token. A non-nil rejection means the allowance was too small and nothing was
+// changed.
+func spendAllowance(ctx context.Context, tx pgx.Tx, owner, spender, token string, amount *big.Int, now time.Time) (rejection error, err error) {
+	res, err := tx.Exec(ctx,
+		`UPDATE allowances
+           SET amount = amount - $1::numeric, updated_at = $2
+         WHERE owner = $3 AND spender = $4 AND token = $5 AND amount >= $1::numeric`,
+		amount.String(), now, owner, spender, token,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrInsufficientAllowance, nil
+	}
+	return nil, nil
+}
+
+// rejectTransfer records every op as rejected with the given reason and
+// commits, so the ledger keeps failed attempts even though no balance was
+// touched.
+func (s *PostgresWalletStore) rejectTransfer(ctx context.Context, tx pgx.Tx, from, token string, ops []TransferOp, opts TransferOptions, now time.Time, rejection error) (*big.Int, error) {
+	reason := rejection.Error()
+	for _, op := range ops {
+		if _, err := insertTransfer(ctx, tx, from, token, op, opts, generated.TransferStatusRejected, &reason, now); err != nil {
+			return nil, err
 		}
+	}
 
+	bal, err := balanceOf(ctx, tx, from, token)
+	if err != nil {
+		return nil, err
 	}
 
-	var finalBal int
-	if err := tx.QueryRow(ctx,
-		`SELECT balance FROM wallets WHERE address = $1`, from,
-	).Scan(&finalBal); err != nil {
-		return 0, err
+	if err := s.saveIdempotentResult(ctx, tx, from, token, ops, opts, bal, &reason, now); err != nil {
+		return nil, err
 	}
 
 	if err := tx.Commit(ctx); err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return finalBal, nil
+	return bal, rejection
+}
+
+// loadIdempotentResult returns the outcome remembered for key, or nil when
+// the key is unknown or has expired. Keys stored without an expiry expire
+// after the current idempotency window.
+func (s *PostgresWalletStore) loadIdempotentResult(ctx context.Context, tx pgx.Tx, from, key string, now time.Time) (*idempotentResult, error) {
+	r := &idempotentResult{}
+	var balance string
+	var reason *string
+	err := tx.QueryRow(ctx, `
+        SELECT fingerprint, balance::text, error
+          FROM idempotency_keys
+         WHERE from_address = $1 AND key = $2
+           AND COALESCE(expires_at > $3, created_at > $4)
+    `, from, key, now, now.Add(-s.opts.idempotencyWindow)).Scan(&r.fingerprint, &balance, &reason)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load idempotency key: %w", err)
+	}
+	if r.balance, err = parseNumeric(balance); err != nil {
+		return nil, err
+	}
+	if reason != nil {
+		r.reason = *reason
+	}
+	return r, nil
+}
+
+// saveIdempotentResult remembers the outcome of a transfer under its
+// idempotency key until the idempotency window has passed, replacing an
+// expired entry for the same key.
+func (s *PostgresWalletStore) saveIdempotentResult(ctx context.Context, tx pgx.Tx, from, token string, ops []TransferOp, opts TransferOptions, balance *big.Int, reason *string, now time.Time) error {
+	if opts.IdempotencyKey == "" {
+		return nil
+	}
+	_, err := tx.Exec(ctx, `
+        INSERT INTO idempotency_keys(from_address, key, fingerprint, balance, error, created_at, expires_at)
+             VALUES ($1, $2, $3, $4::numeric, $5, $6, $7)
+        ON CONFLICT (from_address, key)
+          DO UPDATE SET fingerprint = EXCLUDED.fingerprint,
+                        balance = EXCLUDED.balance,
+                        error = EXCLUDED.error,
+                        created_at = EXCLUDED.created_at,
+                        expires_at = EXCLUDED.expires_at
+    `, from, opts.IdempotencyKey, transferFingerprint(token, ops, opts), balance.String(), reason, now, now.Add(s.opts.idempotencyWindow))
+	if err != nil {
+		return fmt.Errorf("save idempotency key: %w", err)
+	}
+	return nil
+}
+
+// parseNumeric converts the text form of a NUMERIC column into a big.Int.
+// Amounts are always whole token units, so a fractional value is an error.
+func parseNumeric(s string) (*big.Int, error) {
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid token amount %q", s)
+	}
+	return n, nil
+}
+
+// balanceOf reads the current balance of addr in token inside tx. A wallet
+// that never held the token has a balance of zero.
+func balanceOf(ctx context.Context, tx pgx.Tx, addr, token string) (*big.Int, error) {
+	var balance string
+	if err := tx.QueryRow(ctx,
+		`SELECT COALESCE(
+                (SELECT balance FROM balances WHERE address = $1 AND token = $2), 0
+            )::text`, addr, token,
+	).Scan(&balance); err != nil {
+		return nil, err
+	}
+	return parseNumeric(balance)
+}
+
+// insertTransfer records a single leg of a transfer, announces it and
+// returns its id.
+func insertTransfer(ctx context.Context, tx pgx.Tx, from, token string, op TransferOp, opts TransferOptions, status generated.TransferStatus, reason *string, now time.Time) (string, error) {
+	var spender *string
+	if opts.Spender != "" {
+		spender = &opts.Spender
+	}
+	var id int64
+	err := tx.QueryRow(ctx,
+		`INSERT INTO transfers(from_address, to_address, spender, token, amount, status, error, created_at)
+             VALUES ($1, $2, $3, $4, $5::numeric, $6, $7, $8)
+         RETURNING id`,
+		from, op.To, spender, token, op.Amount.String(), string(status), reason, now,
+	).Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("record transfer: %w", err)
+	}
+
+	t := &generated.Transfer{
+		ID:          strconv.FormatInt(id, 10),
+		FromAddress: from,
+		ToAddress:   op.To,
+		Spender:     spender,
+		Token:       token,
+		Amount:      op.Amount,
+		Status:      status,
+		Error:       reason,
+		CreatedAt:   now,
+	}
+	return t.ID, notify(ctx, tx, transferCreated(t))
+}
+
+// insertCheckpoint records that addr holds balance of token from now on.
+func insertCheckpoint(ctx context.Context, tx pgx.Tx, addr, token string, balance *big.Int, now time.Time) error {
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO balance_checkpoints(address, token, balance, recorded_at)
+        VALUES ($1, $2, $3::numeric, $4)
+    `, addr, token, balance.String(), now); err != nil {
+		return fmt.Errorf("record balance checkpoint: %w", err)
+	}
+	return nil
+}
+
+// insertJournalEntry records postings as a single journal entry, leaving out
+// postings of zero.
+func insertJournalEntry(ctx context.Context, tx pgx.Tx, kind JournalEntryKind, postings []posting, now time.Time) error {
+	var entryID int64
+	if err := tx.QueryRow(ctx,
+		`INSERT INTO journal_entries(kind, created_at) VALUES ($1, $2) RETURNING id`,
+		string(kind), now,
+	).Scan(&entryID); err != nil {
+		return fmt.Errorf("record journal entry: %w", err)
+	}
+
+	var addrs, tokens, amounts, transferIDs []string
+	for _, p := range postings {
+		if p.amount.Sign() == 0 {
+			continue
+		}
+		addrs = append(addrs, p.address)
+		tokens = append(tokens, p.token)
+		amounts = append(amounts, p.amount.String())
+		transferIDs = append(transferIDs, p.transferID)
+	}
+
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO postings(entry_id, address, token, amount, transfer_id)
+        SELECT $1, p.address, p.token, p.amount::numeric, NULLIF(p.transfer_id, '')::bigint
+          FROM unnest($2::text[], $3::text[], $4::text[], $5::text[])
+            AS p(address, token, amount, transfer_id)
+    `, entryID, addrs, tokens, amounts, transferIDs); err != nil {
+		return fmt.Errorf("record postings: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresWalletStore) ListTransfers(ctx context.Context, address string, first int, after string) ([]*generated.Transfer, error) {
+	if address != "" {
+		var err error
+		if address, err = canonicalAddress(address); err != nil {
+			return nil, err
+		}
+	}
+	cursor, err := parseTransferCursor(after)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(ctx, `
+        SELECT id, from_address, to_address, spender, token, amount::text, status, error, created_at
+          FROM transfers
+         WHERE ($1::text = '' OR from_address = $1::text OR to_address = $1::text)
+           AND ($2::bigint = 0 OR id < $2::bigint)
+         ORDER BY id DESC
+         LIMIT $3
+    `, address, cursor, first)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*generated.Transfer{}
+	for rows.Next() {
+		t := &generated.Transfer{}
+		var id int64
+		var amount, status string
+		if err := rows.Scan(&id, &t.FromAddress, &t.ToAddress, &t.Spender, &t.Token, &amount, &status, &t.Error, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if t.Amount, err = parseNumeric(amount); err != nil {
+			return nil, err
+		}
+		t.ID = strconv.FormatInt(id, 10)
+		t.Status = generated.TransferStatus(status)
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresWalletStore) GetToken(ctx context.Context, symbol string) (*generated.Token, error) {
+	return getToken(ctx, s.db, symbol)
+}
+
+func getToken(ctx context.Context, q pgQuerier, symbol string) (*generated.Token, error) {
+	t := &generated.Token{}
+	var supply string
+	err := q.QueryRow(ctx, `
+        SELECT symbol, name, decimals, total_supply::text, created_at
+          FROM tokens
+         WHERE symbol = $1
+    `, symbol).Scan(&t.Symbol, &t.Name, &t.Decimals, &supply, &t.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errUnknownToken(symbol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.TotalSupply, err = parseNumeric(supply); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *PostgresWalletStore) ListTokens(ctx context.Context) ([]*generated.Token, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT symbol, name, decimals, total_supply::text, created_at
+          FROM tokens
+         ORDER BY symbol
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*generated.Token{}
+	for rows.Next() {
+		t := &generated.Token{}
+		var supply string
+		if err := rows.Scan(&t.Symbol, &t.Name, &t.Decimals, &supply, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if t.TotalSupply, err = parseNumeric(supply); err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (s *PostgresWalletStore) CreateToken(ctx context.Context, symbol, name string, decimals int) (*generated.Token, error) {
+	if err := validateToken(symbol, name, decimals); err != nil {
+		return nil, err
+	}
+
+	res, err := s.db.Exec(ctx, `
+        INSERT INTO tokens(symbol, name, decimals, total_supply, created_at)
+        VALUES ($1, $2, $3, 0, $4)
+        ON CONFLICT (symbol) DO NOTHING
+    `, symbol, name, decimals, time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("insert token: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return nil, errTokenExists(symbol)
+	}
+
+	return s.GetToken(ctx, symbol)
+}
+
+func (s *PostgresWalletStore) Mint(ctx context.Context, token, to string, amount *big.Int) (*big.Int, error) {
+	to, err := canonicalAddress(to)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Sign() <= 0 {
+		return nil, errNonPositiveAmount
+	}
+	token = tokenOrDefault(token)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		`SELECT pg_advisory_xact_lock(hashtext($1)::bigint)`, to,
+	); err != nil {
+		return nil, err
+	}
+
+	res, err := tx.Exec(ctx,
+		`UPDATE tokens SET total_supply = total_supply + $2::numeric WHERE symbol = $1`,
+		token, amount.String(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("update total supply: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return nil, errUnknownToken(token)
+	}
+
+	now := time.Now().UTC()
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO wallets(address, created_at, updated_at)
+             VALUES($1, $2, $2)
+         ON CONFLICT (address)
+           DO UPDATE SET updated_at = EXCLUDED.updated_at`,
+		to, now,
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO balances(address, token, balance, updated_at)
+             VALUES($1, $2, $3::numeric, $4)
+         ON CONFLICT (address, token)
+           DO UPDATE SET balance = balances.balance + EXCLUDED.balance,
+                         updated_at = EXCLUDED.updated_at`,
+		to, token, amount.String(), now,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := insertJournalEntry(ctx, tx, EntryMint, issuancePostings(to, token, amount), now); err != nil {
+		return nil, err
+	}
+
+	bal, err := balanceOf(ctx, tx, to, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertCheckpoint(ctx, tx, to, token, bal, now); err != nil {
+		return nil, err
+	}
+	if err := notify(ctx, tx, balanceChanged(to, token, bal)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return bal, nil
+}
+
+func (s *PostgresWalletStore) Burn(ctx context.Context, token, from string, amount *big.Int) (*big.Int, error) {
+	from, err := canonicalAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Sign() <= 0 {
+		return nil, errNonPositiveAmount
+	}
+	token = tokenOrDefault(token)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx,
+		`SELECT pg_advisory_xact_lock(hashtext($1)::bigint)`, from,
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := getToken(ctx, tx, token); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	res, err := tx.Exec(ctx,
+		`UPDATE balances
+           SET balance = balance - $1::numeric, updated_at = $2
+         WHERE address = $3 AND token = $4 AND balance >= $1::numeric`,
+		amount.String(), now, from, token,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if res.RowsAffected() == 0 {
+		return nil, ErrInsufficientFunds
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE wallets SET updated_at = $2 WHERE address = $1`, from, now,
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(ctx,
+		`UPDATE tokens SET total_supply = total_supply - $2::numeric WHERE symbol = $1`,
+		token, amount.String(),
+	); err != nil {
+		return nil, fmt.Errorf("update total supply: %w", err)
+	}
+
+	if err := insertJournalEntry(ctx, tx, EntryBurn, issuancePostings(from, token, new(big.Int).Neg(amount)), now); err != nil {
+		return nil, err
+	}
+
+	bal, err := balanceOf(ctx, tx, from, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := insertCheckpoint(ctx, tx, from, token, bal, now); err != nil {
+		return nil, err
+	}
+	if err := notify(ctx, tx, balanceChanged(from, token, bal)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return bal, nil
+}
+
+func (s *PostgresWalletStore) Approve(ctx context.Context, token, owner, spender string, amount *big.Int, opts ApproveOptions) (*big.Int, error) {
+	if err := canonicalAddresses(&owner, &spender); err != nil {
+		return nil, err
+	}
+	if amount.Sign() < 0 {
+		return nil, errNegativeAllowance
+	}
+	token = tokenOrDefault(token)
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Same lock as Transfer takes for the owner, so an allowance never changes
+	// under a transfer that is spending it.
+	if _, err := tx.Exec(ctx,
+		`SELECT pg_advisory_xact_lock(hashtext($1)::bigint)`, owner,
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := getToken(ctx, tx, token); err != nil {
+		return nil, err
+	}
+
+	key, err := getWalletKey(ctx, tx, owner)
+	if errors.Is(err, ErrWalletNotFound) {
+		return nil, fmt.Errorf("owner %w", ErrWalletNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkApproveKey(key.PublicKey, key.Nonce, opts); err != nil {
+		return nil, err
+	}
+	if opts.Nonce != nil {
+		if _, err := tx.Exec(ctx, `UPDATE wallets SET nonce = nonce + 1 WHERE address = $1`, owner); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.Exec(ctx,
+		`INSERT INTO allowances(owner, spender, token, amount, updated_at)
+             VALUES ($1, $2, $3, $4::numeric, $5)
+         ON CONFLICT (owner, spender, token)
+           DO UPDATE SET amount = EXCLUDED.amount,
+                         updated_at = EXCLUDED.updated_at`,
+		owner, spender, token, amount.String(), time.Now().UTC(),
+	); err != nil {
+		return nil, fmt.Errorf("save allowance: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return new(big.Int).Set(amount), nil
+}
+
+func (s *PostgresWalletStore) Allowance(ctx context.Context, token, owner, spender string) (*big.Int, error) {
+	if err := canonicalAddresses(&owner, &spender); err != nil {
+		return nil, err
+	}
+	token = tokenOrDefault(token)
+
+	if _, err := getToken(ctx, s.db, token); err != nil {
+		return nil, err
+	}
+
+	var amount string
+	if err := s.db.QueryRow(ctx,
+		`SELECT COALESCE(
+                (SELECT amount FROM allowances WHERE owner = $1 AND spender = $2 AND token = $3), 0
+            )::text`, owner, spender, token,
+	).Scan(&amount); err != nil {
+		return nil, err
+	}
+	return parseNumeric(amount)
+}
+
+func (s *PostgresWalletStore) CheckJournal(ctx context.Context) ([]UnbalancedEntry, error) {
+	rows, err := s.db.Query(ctx, `
+        SELECT e.id, e.kind, p.token, SUM(p.amount)::text, e.created_at
+          FROM postings p
+          JOIN journal_entries e ON e.id = p.entry_id
+         GROUP BY e.id, p.token
+        HAVING SUM(p.amount) <> 0
+         ORDER BY e.id, p.token
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []UnbalancedEntry{}
+	for rows.Next() {
+		var u UnbalancedEntry
+		var id int64
+		var kind, sum string
+		if err := rows.Scan(&id, &kind, &u.Token, &sum, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		if u.Sum, err = parseNumeric(sum); err != nil {
+			return nil, err
+		}
+		u.EntryID = strconv.FormatInt(id, 10)
+		u.Kind = JournalEntryKind(kind)
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresWalletStore) RebuildBalances(ctx context.Context) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Writers update balances and supplies in place, so locking both tables
+	// against writes waits for every transfer in flight and holds off new
+	// ones until the projection has been rebuilt. Reads go on.
+	if _, err := tx.Exec(ctx, `LOCK TABLE balances, tokens IN EXCLUSIVE MODE`); err != nil {
+		return err
+	}
+
+	// Balances that change are checkpointed like any other change, so the
+	// history shows when they were corrected.
+	now := time.Now().UTC()
+	if _, err := tx.Exec(ctx, `
+        WITH changed AS (
+            UPDATE balances b
+               SET balance = s.balance, updated_at = $1
+              FROM (SELECT c.address, c.token, COALESCE(SUM(p.amount), 0) AS balance
+                      FROM balances c
+                      LEFT JOIN postings p ON p.address = c.address AND p.token = c.token
+                     GROUP BY c.address, c.token) s
+             WHERE s.address = b.address AND s.token = b.token AND s.balance <> b.balance
+            RETURNING b.address, b.token, b.balance
+        )
+        INSERT INTO balance_checkpoints(address, token, balance, recorded_at)
+        SELECT address, token, balance, $1 FROM changed
+    `, now); err != nil {
+		return fmt.Errorf("rebuild balances: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+        WITH added AS (
+            INSERT INTO balances(address, token, balance, updated_at)
+            SELECT address, token, SUM(amount), $2::timestamptz
+              FROM postings
+             WHERE address <> $1
+             GROUP BY address, token
+            ON CONFLICT (address, token) DO NOTHING
+            RETURNING address, token, balance
+        )
+        INSERT INTO balance_checkpoints(address, token, balance, recorded_at)
+        SELECT address, token, balance, $2 FROM added
+    `, IssuanceAccount, now); err != nil {
+		return fmt.Errorf("rebuild balances: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, `
+        UPDATE tokens t
+           SET total_supply = -COALESCE(
+                (SELECT SUM(amount) FROM postings WHERE address = $1 AND token = t.symbol), 0)
+    `, IssuanceAccount); err != nil {
+		return fmt.Errorf("rebuild total supply: %w", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresWalletStore) LedgerState(ctx context.Context) (*LedgerState, error) {
+	// Balances, supplies and postings are read from one snapshot, so
+	// transfers committed in between cannot show up as discrepancies.
+	tx, err := s.db.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	state := &LedgerState{Supplies: make(map[string]*big.Int)}
+
+	if state.Balances, err = queryAccountBalances(ctx, tx,
+		`SELECT address, token, balance::text FROM balances`); err != nil {
+		return nil, fmt.Errorf("read balances: %w", err)
+	}
+	if state.Journal, err = queryAccountBalances(ctx, tx,
+		`SELECT address, token, SUM(amount)::text FROM postings GROUP BY address, token`); err != nil {
+		return nil, fmt.Errorf("read postings: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, `SELECT symbol, total_supply::text FROM tokens`)
+	if err != nil {
+		return nil, fmt.Errorf("read tokens: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var symbol, supply string
+		if err := rows.Scan(&symbol, &supply); err != nil {
+			return nil, err
+		}
+		if state.Supplies[symbol], err = parseNumeric(supply); err != nil {
+			return nil, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// queryAccountBalances runs a query selecting an address, a token and an
+// amount as text.
+func queryAccountBalances(ctx context.Context, q pgQuerier, sql string) ([]AccountBalance, error) {
+	rows, err := q.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AccountBalance
+	for rows.Next() {
+		var b AccountBalance
+		var amount string
+		if err := rows.Scan(&b.Address, &b.Token, &amount); err != nil {
+			return nil, err
+		}
+		if b.Balance, err = parseNumeric(amount); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+func (s *PostgresWalletStore) ApplyGenesis(ctx context.Context, g *Genesis) (*GenesisRecord, bool, error) {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+
+	// A concurrent genesis waits here for this one to commit, and then finds
+	// the row taken.
+	res, err := tx.Exec(ctx, `
+        INSERT INTO genesis(checksum, applied_at)
+        VALUES ($1, $2)
+        ON CONFLICT (id) DO NOTHING
+    `, g.Checksum, now)
+	if err != nil {
+		return nil, false, fmt.Errorf("record genesis: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		rec := &GenesisRecord{}
+		if err := tx.QueryRow(ctx,
+			`SELECT checksum, applied_at FROM genesis`,
+		).Scan(&rec.Checksum, &rec.AppliedAt); err != nil {
+			return nil, false, fmt.Errorf("fetch genesis: %w", err)
+		}
+		return rec, false, nil
+	}
+
+	for _, t := range g.Tokens {
+		res, err := tx.Exec(ctx, `
+            INSERT INTO tokens(symbol, name, decimals, total_supply, created_at)
+            VALUES ($1, $2, $3, 0, $4)
+            ON CONFLICT (symbol) DO NOTHING
+        `, t.Symbol, t.Name, t.Decimals, now)
+		if err != nil {
+			return nil, false, fmt.Errorf("insert token: %w", err)
+		}
+		if res.RowsAffected() == 0 {
+			existing, err := getToken(ctx, tx, t.Symbol)
+			if err != nil {
+				return nil, false, err
+			}
+			if err := checkGenesisToken(t, existing); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	for _, w := range g.Wallets {
+		res, err := tx.Exec(ctx, `
+            INSERT INTO wallets(address, created_at, updated_at)
+            VALUES ($1, $2, $2)
+            ON CONFLICT (address) DO NOTHING
+        `, w.Address, now)
+		if err != nil {
+			return nil, false, fmt.Errorf("insert wallet: %w", err)
+		}
+		if res.RowsAffected() == 0 {
+			continue
+		}
+
+		for _, b := range w.Balances {
+			res, err := tx.Exec(ctx,
+				`UPDATE tokens SET total_supply = total_supply + $2::numeric WHERE symbol = $1`,
+				b.Token, b.Amount.String(),
+			)
+			if err != nil {
+				return nil, false, fmt.Errorf("update total supply: %w", err)
+			}
+			if res.RowsAffected() == 0 {
+				return nil, false, errUnknownToken(b.Token)
+			}
+
+			if _, err := tx.Exec(ctx, `
+                INSERT INTO balances(address, token, balance, updated_at)
+                VALUES ($1, $2, $3::numeric, $4)
+            `, w.Address, b.Token, b.Amount.String(), now); err != nil {
+				return nil, false, fmt.Errorf("seed wallet: %w", err)
+			}
+			if err := insertCheckpoint(ctx, tx, w.Address, b.Token, b.Amount, now); err != nil {
+				return nil, false, err
+			}
+			if err := notify(ctx, tx, balanceChanged(w.Address, b.Token, b.Amount)); err != nil {
+				return nil, false, err
+			}
+		}
+
+		if len(w.Balances) > 0 {
+			if err := insertJournalEntry(ctx, tx, EntrySeed, w.postings(), now); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, false, err
+	}
+	return &GenesisRecord{Checksum: g.Checksum, AppliedAt: now}, true, nil
+}
+
+func (s *PostgresWalletStore) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	if err := validateAPIKey(k); err != nil {
+		return err
+	}
+
+	// Postgres keeps microseconds, so k gets the time it will be read back
+	// with.
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	res, err := s.db.Exec(ctx, `
+        INSERT INTO api_keys(id, hash, subject, roles, wallets, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+        ON CONFLICT (id) DO NOTHING
+    `, k.ID, k.Hash, k.Subject, nonNilStrings(k.Roles), nonNilStrings(k.Wallets), now)
+	if err != nil {
+		return fmt.Errorf("insert api key: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return errAPIKeyExists(k.ID)
+	}
+	k.CreatedAt, k.RevokedAt = now, nil
+	return nil
+}
+
+const apiKeyColumns = `id, hash, subject, roles, wallets, created_at, revoked_at`
+
+func scanAPIKey(row pgx.Row) (*APIKey, error) {
+	k := &APIKey{}
+	if err := row.Scan(&k.ID, &k.Hash, &k.Subject, &k.Roles, &k.Wallets, &k.CreatedAt, &k.RevokedAt); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *PostgresWalletStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	k, err := scanAPIKey(s.db.QueryRow(ctx,
+		`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = $1`, id,
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errUnknownAPIKey(id)
+	}
+	return k, err
+}
+
+func (s *PostgresWalletStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	rows, err := s.db.Query(ctx,
+		`SELECT `+apiKeyColumns+` FROM api_keys ORDER BY created_at, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *PostgresWalletStore) RevokeAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	k, err := scanAPIKey(s.db.QueryRow(ctx, `
+        UPDATE api_keys SET revoked_at = COALESCE(revoked_at, $2)
+         WHERE id = $1
+     RETURNING `+apiKeyColumns,
+		id, time.Now().UTC(),
+	))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errUnknownAPIKey(id)
+	}
+	return k, err
+}
+
+// nonNilStrings returns ss, or an empty slice for nil, which pgx would
+// otherwise send as NULL.
+func nonNilStrings(ss []string) []string {
+	if ss == nil {
+		return []string{}
+	}
+	return ss
+}
+
+func (s *PostgresWalletStore) RegisterWalletKey(ctx context.Context, address string, key ed25519.PublicKey) (*WalletKey, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateWalletKey(key); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Transfers read the key under the same lock, so none is signed with a
+	// key that is replaced halfway through.
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1)::bigint)`, address); err != nil {
+		return nil, err
+	}
+
+	k, err := getWalletKey(ctx, tx, address)
+	if err != nil {
+		return nil, err
+	}
+	if k.PublicKey != nil && !k.PublicKey.Equal(key) {
+		return nil, errWalletKeyExists(address)
+	}
+	if k.PublicKey == nil {
+		if _, err := tx.Exec(ctx,
+			`UPDATE wallets SET public_key = $2 WHERE address = $1`, address, []byte(key),
+		); err != nil {
+			return nil, err
+		}
+		k.PublicKey = key
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *PostgresWalletStore) GetWalletKey(ctx context.Context, address string) (*WalletKey, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return getWalletKey(ctx, s.db, address)
+}
+
+func (s *PostgresWalletStore) SetAcceptsTransfers(ctx context.Context, address string, accepts bool) error {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Transfers check their recipients under the same lock, so none lands
+	// in a wallet that opted out halfway through.
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1)::bigint)`, address); err != nil {
+		return err
+	}
+	res, err := tx.Exec(ctx, `UPDATE wallets SET accepts_transfers = $2 WHERE address = $1`, address, accepts)
+	if err != nil {
+		return err
+	}
+	if res.RowsAffected() == 0 {
+		return ErrWalletNotFound
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresWalletStore) AcceptsTransfers(ctx context.Context, address string) (bool, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return false, err
+	}
+	r, err := getRecipient(ctx, s.db, address)
+	if err != nil {
+		return false, err
+	}
+	if !r.exists {
+		return false, ErrWalletNotFound
+	}
+	return r.accepts, nil
+}
+
+// getRecipient reads whether the wallet at address exists and accepts
+// transfers.
+func getRecipient(ctx context.Context, q pgQuerier, address string) (recipientState, error) {
+	var accepts bool
+	err := q.QueryRow(ctx,
+		`SELECT accepts_transfers FROM wallets WHERE address = $1`, address,
+	).Scan(&accepts)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return recipientState{}, nil
+	}
+	if err != nil {
+		return recipientState{}, err
+	}
+	return recipientState{exists: true, accepts: accepts}, nil
+}
+
+// getWalletKey reads the key and next nonce of the wallet at address.
+func getWalletKey(ctx context.Context, q pgQuerier, address string) (*WalletKey, error) {
+	k := &WalletKey{Address: address}
+	var key []byte
+	var nonce int64
+	err := q.QueryRow(ctx,
+		`SELECT public_key, nonce FROM wallets WHERE address = $1`, address,
+	).Scan(&key, &nonce)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		k.PublicKey = ed25519.PublicKey(key)
+	}
+	k.Nonce = uint64(nonce)
+	return k, nil
 }
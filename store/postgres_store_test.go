@@ -3,8 +3,10 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
 	"sync"
 	"testing"
@@ -16,6 +18,7 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
 )
 
 var testStore *PostgresWalletStore
@@ -66,14 +69,18 @@ func TestMain(m *testing.M) {
 
 	code := m.Run()
 
-	_, _ = pool.Exec(context.Background(), "DROP TABLE IF EXISTS wallets; DROP TABLE IF EXISTS schema_migrations;")
+	_, _ = pool.Exec(context.Background(), "DROP TABLE IF EXISTS api_keys; DROP TABLE IF EXISTS genesis; DROP TABLE IF EXISTS balance_checkpoints; DROP TABLE IF EXISTS postings; DROP TABLE IF EXISTS journal_entries; DROP TABLE IF EXISTS allowances; DROP TABLE IF EXISTS balances; DROP TABLE IF EXISTS tokens; DROP TABLE IF EXISTS wallets; DROP TABLE IF EXISTS transfers; DROP TABLE IF EXISTS idempotency_keys; DROP TABLE IF EXISTS schema_migrations;")
 	pool.Close()
 	os.Exit(code)
 
 }
 
 func resetWallets(t *testing.T) {
-	_, err := dbPool.Exec(context.Background(), "TRUNCATE wallets;")
+	_, err := dbPool.Exec(context.Background(), `
+        TRUNCATE wallets, balances, balance_checkpoints, allowances, postings, journal_entries, transfers, idempotency_keys, genesis, api_keys;
+        DELETE FROM tokens WHERE symbol <> 'BTP';
+        UPDATE tokens SET total_supply = 0;
+    `)
 	if err != nil {
 		t.Fatalf("Failed to reset wallets table: %v", err)
 	}
@@ -84,23 +91,23 @@ func TestCreateAndGet(t *testing.T) {
 
 	ctx := context.Background()
 
-	w, err := testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", 10)
+	w, err := testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(10))
 
 	if err != nil {
 		t.Fatalf("CreateIfNotExists error: %v", err)
 	}
 
-	if w.Balance != 10 {
+	if w.Balance.String() != "10" {
 		t.Errorf("Expected balance does not match. Expected 10, got: %v", w.Balance)
 	}
 
-	w2, err := testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", 999)
+	w2, err := testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(999))
 
 	if err != nil {
 		t.Fatalf("CreateIfNotExists, second call, error: %v", err)
 	}
 
-	if w2.Balance != 10 {
+	if w2.Balance.String() != "10" {
 		t.Errorf("Expected balance does not match. Expected 10, got: %v", w2.Balance)
 	}
 
@@ -110,7 +117,7 @@ func TestCreateAndGet(t *testing.T) {
 		t.Fatalf("GetByAddress error: %v", err)
 	}
 
-	if got.Balance != 10 {
+	if got.Balance.String() != "10" {
 		t.Errorf("GetByAddress: Expected balance does not match. Expected 10, got: %v", got.Balance)
 	}
 
@@ -125,23 +132,62 @@ func TestCreateAndGet(t *testing.T) {
 	}
 }
 
+// A seeded wallet, its seed and the transfers after it are stamped from one
+// clock, so none of its history comes before the wallet itself.
+func TestCreateTimestamps(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+	alice, bob := "0x0000000000000000000000000000000000000001", "0x0000000000000000000000000000000000000002"
+
+	w, err := testStore.CreateIfNotExists(ctx, alice, big.NewInt(10))
+	if err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if _, err := testStore.Transfer(ctx, alice, []TransferOp{{To: bob, Amount: big.NewInt(4)}}, TransferOptions{}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	var seeded, earliest time.Time
+	if err := dbPool.QueryRow(ctx, `
+        SELECT MIN(recorded_at) FILTER (WHERE balance = 10), MIN(recorded_at)
+          FROM balance_checkpoints
+         WHERE address = $1
+    `, alice).Scan(&seeded, &earliest); err != nil {
+		t.Fatalf("Query checkpoints error: %v", err)
+	}
+	if !seeded.Equal(w.CreatedAt) || earliest.Before(w.CreatedAt) {
+		t.Errorf("Expected the seed checkpoint at %v and nothing before it, got: %v and %v", w.CreatedAt, seeded, earliest)
+	}
+
+	var transferred time.Time
+	if err := dbPool.QueryRow(ctx,
+		`SELECT created_at FROM transfers WHERE from_address = $1`, alice,
+	).Scan(&transferred); err != nil {
+		t.Fatalf("Query transfers error: %v", err)
+	}
+	if transferred.Before(w.CreatedAt) {
+		t.Errorf("Expected the transfer after the wallet was created at %v, got: %v", w.CreatedAt, transferred)
+	}
+}
+
 func TestTransferSuccess(t *testing.T) {
 	resetWallets(t)
 
 	ctx := context.Background()
 
-	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000000", 10)
-	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", 10)
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000000", big.NewInt(10))
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(10))
 
-	newBalance, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", TransferOp{
-		To: "0x0000000000000000000000000000000000000000", Amount: 10,
-	})
+	newBalance, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000000", Amount: big.NewInt(10),
+	}}, TransferOptions{})
 
 	if err != nil {
 		t.Fatalf("Transfer error: %v", err)
 	}
 
-	if newBalance != 0 {
+	if newBalance.String() != "0" {
 		t.Errorf("Transfer: Expected sender balance 0, got: %v", newBalance)
 	}
 
@@ -150,27 +196,695 @@ func TestTransferSuccess(t *testing.T) {
 		t.Fatalf("Get address error: %v", err)
 	}
 
-	if addr.Balance != 20 {
+	if addr.Balance.String() != "20" {
 		t.Fatalf("Post-transfer address balance: expected 20, got: %v", addr.Balance)
 	}
 }
 
+func TestTransferBeyondInt64(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	// 1,000,000 tokens with 18 decimals, well past what fits in an int64.
+	supply, _ := new(big.Int).SetString("1000000000000000000000000", 10)
+	amount, _ := new(big.Int).SetString("250000000000000000000001", 10)
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", supply)
+
+	newBalance, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: amount,
+	}}, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	if newBalance.String() != "749999999999999999999999" {
+		t.Errorf("Transfer: Expected sender balance 749999999999999999999999, got: %v", newBalance)
+	}
+
+	recipient, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000002")
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+
+	if recipient.Balance.Cmp(amount) != 0 {
+		t.Errorf("Post-transfer recipient balance: expected %v, got: %v", amount, recipient.Balance)
+	}
+}
+
 func TestTransferInsufficientFunds(t *testing.T) {
 	resetWallets(t)
 
 	ctx := context.Background()
 
-	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000000", 10)
-	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", 10)
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000000", big.NewInt(10))
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(10))
 
-	_, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", TransferOp{
-		To: "0x0000000000000000000000000000000000000000", Amount: 20,
-	})
+	_, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000000", Amount: big.NewInt(20),
+	}}, TransferOptions{})
 	if err == nil {
 		t.Fatalf("Expected error: Insuficient Funds, got nil")
 	}
 }
 
+func TestTransferMultipleRecipients(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(100))
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000002", big.NewInt(0))
+
+	newBalance, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{
+		{To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(25)},
+		{To: "0x0000000000000000000000000000000000000003", Amount: big.NewInt(50)},
+	}, TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	if newBalance.String() != "25" {
+		t.Errorf("Transfer: Expected sender balance 25, got: %v", newBalance)
+	}
+
+	for addr, expected := range map[string]string{
+		"0x0000000000000000000000000000000000000002": "25",
+		"0x0000000000000000000000000000000000000003": "50",
+	} {
+		w, err := testStore.GetByAddress(ctx, addr)
+		if err != nil {
+			t.Fatalf("GetByAddress %s error: %v", addr, err)
+		}
+		if w.Balance.String() != expected {
+			t.Errorf("Post-transfer balance of %s: expected %v, got: %v", addr, expected, w.Balance)
+		}
+	}
+}
+
+func TestTransferMultipleRecipientsAllOrNothing(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(100))
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000002", big.NewInt(0))
+
+	_, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{
+		{To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(60)},
+		{To: "0x0000000000000000000000000000000000000003", Amount: big.NewInt(60)},
+	}, TransferOptions{})
+	if err == nil {
+		t.Fatalf("Expected error: Insufficient Funds, got nil")
+	}
+
+	sender, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000001")
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+	if sender.Balance.String() != "100" {
+		t.Errorf("Sender balance after rejected transfer: expected 100, got: %v", sender.Balance)
+	}
+
+	recipient, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000002")
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+	if recipient.Balance.String() != "0" {
+		t.Errorf("First recipient balance after rejected transfer: expected 0, got: %v", recipient.Balance)
+	}
+
+	if _, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000003"); err == nil {
+		t.Errorf("Expected second recipient not to be created by a rejected transfer")
+	}
+
+	ledger, err := testStore.ListTransfers(ctx, "", 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+	if len(ledger) != 2 {
+		t.Fatalf("ListTransfers: expected both legs recorded, got: %v", len(ledger))
+	}
+	for _, tr := range ledger {
+		if tr.Status != generated.TransferStatusRejected {
+			t.Errorf("Expected leg %v to be rejected, got: %v", tr.ID, tr.Status)
+		}
+	}
+}
+
+// An idempotency key is kept for the window in force when it was used, even
+// when the store is later run with another window.
+func TestTransferIdempotencyWindow(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+	alice, bob := "0x0000000000000000000000000000000000000001", "0x0000000000000000000000000000000000000002"
+	ops := []TransferOp{{To: bob, Amount: big.NewInt(10)}}
+	long := TransferOptions{IdempotencyKey: "long"}
+	short := TransferOptions{IdempotencyKey: "short"}
+
+	hour := NewPostgresWalletStore(dbPool, WithIdempotencyWindow(time.Hour))
+	if _, err := hour.CreateIfNotExists(ctx, alice, big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if _, err := hour.Transfer(ctx, alice, ops, long); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	if _, err := NewPostgresWalletStore(dbPool, WithIdempotencyWindow(time.Nanosecond)).Transfer(ctx, alice, ops, short); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	if bal, err := hour.Transfer(ctx, alice, ops, long); err != nil || bal.String() != "90" {
+		t.Errorf("Expected the key used under the longer window to be replayed with balance 90, got: %v, %v", bal, err)
+	}
+	if bal, err := hour.Transfer(ctx, alice, ops, short); err != nil || bal.String() != "70" {
+		t.Errorf("Expected the key used under the shorter window to have expired, got: %v, %v", bal, err)
+	}
+}
+
+func TestTransferIdempotencyKey(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000000", big.NewInt(10))
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(10))
+
+	ops := []TransferOp{{To: "0x0000000000000000000000000000000000000000", Amount: big.NewInt(4)}}
+	opts := TransferOptions{IdempotencyKey: "payout-1"}
+
+	first, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", ops, opts)
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	replay, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", ops, opts)
+	if err != nil {
+		t.Fatalf("Replayed transfer error: %v", err)
+	}
+
+	if first.String() != "6" || replay.Cmp(first) != 0 {
+		t.Errorf("Replayed transfer: expected balance 6 twice, got: %v and %v", first, replay)
+	}
+
+	recipient, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000000")
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+
+	if recipient.Balance.String() != "14" {
+		t.Errorf("Recipient balance after replay: expected 14, got: %v", recipient.Balance)
+	}
+
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000000", Amount: big.NewInt(5),
+	}}, opts); err == nil {
+		t.Errorf("Expected error when reusing an idempotency key for a different transfer, got nil")
+	}
+
+	rejected := TransferOptions{IdempotencyKey: "payout-2"}
+	tooMuch := []TransferOp{{To: "0x0000000000000000000000000000000000000000", Amount: big.NewInt(100)}}
+
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", tooMuch, rejected); err == nil {
+		t.Fatalf("Expected error: Insufficient Funds, got nil")
+	}
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000002", big.NewInt(1000))
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000002", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000001", Amount: big.NewInt(500),
+	}}, TransferOptions{}); err != nil {
+		t.Fatalf("Top-up transfer error: %v", err)
+	}
+
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", tooMuch, rejected); err == nil {
+		t.Errorf("Expected replay of a rejected transfer to return the original error, got nil")
+	}
+}
+
+func TestTransferOtherToken(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	if _, err := testStore.CreateToken(ctx, "USDX", "USD Example", 6); err != nil {
+		t.Fatalf("CreateToken error: %v", err)
+	}
+
+	if _, err := testStore.CreateToken(ctx, "USDX", "USD Example", 6); err == nil {
+		t.Errorf("Expected error when registering USDX twice, got nil")
+	}
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(10))
+
+	if _, err := dbPool.Exec(ctx, `
+        INSERT INTO balances(address, token, balance) VALUES ($1, 'USDX', 5000000)
+    `, "0x0000000000000000000000000000000000000001"); err != nil {
+		t.Fatalf("Seeding USDX balance failed: %v", err)
+	}
+
+	newBalance, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(1500000),
+	}}, TransferOptions{Token: "USDX"})
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	if newBalance.String() != "3500000" {
+		t.Errorf("Transfer: Expected sender USDX balance 3500000, got: %v", newBalance)
+	}
+
+	sender, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000001")
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+
+	if sender.Balance.String() != "10" {
+		t.Errorf("Default token balance should be untouched. Expected 10, got: %v", sender.Balance)
+	}
+
+	if len(sender.Balances) != 2 || sender.Balances[0].Token.Symbol != "BTP" || sender.Balances[1].Token.Symbol != "USDX" {
+		t.Fatalf("Expected BTP and USDX balances, got: %v", sender.Balances)
+	}
+
+	if sender.Balances[1].Token.Decimals != 6 || sender.Balances[1].Balance.String() != "3500000" {
+		t.Errorf("Unexpected USDX balance: %+v", sender.Balances[1])
+	}
+
+	recipient, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000002")
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+
+	if recipient.Balance.Sign() != 0 || len(recipient.Balances) != 1 || recipient.Balances[0].Balance.String() != "1500000" {
+		t.Errorf("Expected recipient to hold only 1500000 USDX, got: %v / %v", recipient.Balance, recipient.Balances)
+	}
+
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(1),
+	}}, TransferOptions{Token: "NOPE"}); err == nil {
+		t.Errorf("Expected error for an unknown token, got nil")
+	}
+}
+
+func TestMintAndBurn(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(100))
+
+	newBalance, err := testStore.Mint(ctx, "", "0x0000000000000000000000000000000000000002", big.NewInt(50))
+	if err != nil {
+		t.Fatalf("Mint error: %v", err)
+	}
+
+	if newBalance.String() != "50" {
+		t.Errorf("Mint: Expected balance 50, got: %v", newBalance)
+	}
+
+	newBalance, err = testStore.Burn(ctx, "", "0x0000000000000000000000000000000000000001", big.NewInt(30))
+	if err != nil {
+		t.Fatalf("Burn error: %v", err)
+	}
+
+	if newBalance.String() != "70" {
+		t.Errorf("Burn: Expected balance 70, got: %v", newBalance)
+	}
+
+	if _, err := testStore.Burn(ctx, "", "0x0000000000000000000000000000000000000002", big.NewInt(51)); err == nil {
+		t.Errorf("Expected error when burning more than the balance, got nil")
+	}
+
+	if _, err := testStore.Mint(ctx, "", "0x0000000000000000000000000000000000000002", big.NewInt(0)); err == nil {
+		t.Errorf("Expected error when minting zero, got nil")
+	}
+
+	if _, err := testStore.Mint(ctx, "NOPE", "0x0000000000000000000000000000000000000002", big.NewInt(1)); err == nil {
+		t.Errorf("Expected error when minting an unknown token, got nil")
+	}
+
+	token, err := testStore.GetToken(ctx, DefaultToken)
+	if err != nil {
+		t.Fatalf("GetToken error: %v", err)
+	}
+
+	if token.TotalSupply.String() != "120" {
+		t.Errorf("Expected total supply 120, got: %v", token.TotalSupply)
+	}
+
+	var sum string
+	if err := dbPool.QueryRow(ctx, `SELECT COALESCE(SUM(balance), 0)::text FROM balances WHERE token = $1`, DefaultToken).Scan(&sum); err != nil {
+		t.Fatalf("Summing balances failed: %v", err)
+	}
+
+	if sum != token.TotalSupply.String() {
+		t.Errorf("Total supply %v does not match sum of balances %s", token.TotalSupply, sum)
+	}
+}
+
+func TestTransferFromAllowance(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	owner := "0x0000000000000000000000000000000000000001"
+	spender := "0x0000000000000000000000000000000000000002"
+	merchant := "0x0000000000000000000000000000000000000003"
+
+	_, _ = testStore.CreateIfNotExists(ctx, owner, big.NewInt(100))
+
+	if _, err := testStore.Approve(ctx, "", "0x00000000000000000000000000000000000000ff", spender, big.NewInt(10), ApproveOptions{}); err == nil {
+		t.Errorf("Expected error when approving from an unknown owner, got nil")
+	}
+
+	if _, err := testStore.Approve(ctx, "", owner, spender, big.NewInt(-1), ApproveOptions{}); err == nil {
+		t.Errorf("Expected error when approving a negative amount, got nil")
+	}
+
+	if _, err := testStore.Approve(ctx, "", owner, spender, big.NewInt(40), ApproveOptions{}); err != nil {
+		t.Fatalf("Approve error: %v", err)
+	}
+
+	newBalance, err := testStore.Transfer(ctx, owner, []TransferOp{{
+		To: merchant, Amount: big.NewInt(30),
+	}}, TransferOptions{Spender: spender})
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	if newBalance.String() != "70" {
+		t.Errorf("Transfer: Expected owner balance 70, got: %v", newBalance)
+	}
+
+	allowance, err := testStore.Allowance(ctx, "", owner, spender)
+	if err != nil {
+		t.Fatalf("Allowance error: %v", err)
+	}
+
+	if allowance.String() != "10" {
+		t.Errorf("Expected remaining allowance 10, got: %v", allowance)
+	}
+
+	if _, err := testStore.Transfer(ctx, owner, []TransferOp{{
+		To: merchant, Amount: big.NewInt(11),
+	}}, TransferOptions{Spender: spender}); err == nil {
+		t.Errorf("Expected error when spending more than the allowance, got nil")
+	}
+
+	if _, err := testStore.Transfer(ctx, owner, []TransferOp{{
+		To: merchant, Amount: big.NewInt(-5),
+	}}, TransferOptions{Spender: spender}); err == nil {
+		t.Errorf("Expected error when a spender pulls funds back, got nil")
+	}
+
+	// An allowance larger than the balance still cannot overdraw the owner,
+	// and the failed transfer must not consume the allowance.
+	if _, err := testStore.Approve(ctx, "", owner, spender, big.NewInt(500), ApproveOptions{}); err != nil {
+		t.Fatalf("Approve error: %v", err)
+	}
+
+	if _, err := testStore.Transfer(ctx, owner, []TransferOp{{
+		To: merchant, Amount: big.NewInt(71),
+	}}, TransferOptions{Spender: spender}); err == nil {
+		t.Errorf("Expected error when spending more than the owner's balance, got nil")
+	}
+
+	allowance, err = testStore.Allowance(ctx, "", owner, spender)
+	if err != nil {
+		t.Fatalf("Allowance error: %v", err)
+	}
+
+	if allowance.String() != "500" {
+		t.Errorf("Rejected transfer should keep the allowance at 500, got: %v", allowance)
+	}
+
+	transfers, err := testStore.ListTransfers(ctx, merchant, 1, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+
+	if len(transfers) != 1 || transfers[0].Spender == nil || *transfers[0].Spender != spender {
+		t.Errorf("Expected the ledger to record the spender, got: %+v", transfers)
+	}
+}
+
+func TestSubscribeEvents(t *testing.T) {
+	resetWallets(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(100))
+
+	events, err := testStore.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Subscribe error: %v", err)
+	}
+
+	// Subscribe returns once the store is listening, so the first transfer
+	// made afterwards is already delivered.
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(1),
+	}}, TransferOptions{}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	var got Event
+	select {
+	case got = <-events:
+	case <-ctx.Done():
+		t.Fatalf("No event received: %v", ctx.Err())
+	}
+
+	if got.Transfer == nil || got.Transfer.ToAddress != "0x0000000000000000000000000000000000000002" {
+		t.Fatalf("Expected a transfer event first, got: %+v", got)
+	}
+
+	// A transfer is followed by the new balances of both wallets.
+	balances := map[string]string{}
+	for len(balances) < 2 {
+		select {
+		case ev := <-events:
+			if ev.Balance != nil && ev.Balance.Token == DefaultToken {
+				balances[ev.Balance.Address] = ev.Balance.Balance.String()
+			}
+		case <-ctx.Done():
+			t.Fatalf("Missing balance events, got: %v", balances)
+		}
+	}
+
+	sender, err := testStore.GetByAddress(ctx, "0x0000000000000000000000000000000000000001")
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+
+	if balances["0x0000000000000000000000000000000000000001"] != sender.Balance.String() {
+		t.Errorf("Expected sender balance event %v, got: %v", sender.Balance, balances)
+	}
+}
+
+func TestSubscribeAfterClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	s := NewPostgresWalletStore(dbPool)
+	if _, err := s.Subscribe(ctx); err != nil {
+		t.Fatalf("Subscribe error: %v", err)
+	}
+
+	// Close waits for the listener to stop, and later subscriptions fail
+	// instead of starting it again.
+	s.Close()
+	if _, err := s.Subscribe(ctx); err == nil {
+		t.Errorf("Expected Subscribe on a closed store to fail")
+	}
+	s.Close()
+}
+
+func TestListWalletsPagination(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	balances := []int64{30, 10, 50, 10, 40}
+	for i, b := range balances {
+		addr := fmt.Sprintf("0x000000000000000000000000000000000000000%d", i)
+		if _, err := testStore.CreateIfNotExists(ctx, addr, big.NewInt(b)); err != nil {
+			t.Fatalf("CreateIfNotExists error: %v", err)
+		}
+	}
+
+	q := WalletQuery{
+		First:   2,
+		OrderBy: generated.WalletOrder{Field: generated.WalletOrderFieldBalance, Direction: generated.OrderDirectionDesc},
+		Filter:  generated.WalletFilter{MinBalance: big.NewInt(20)},
+	}
+
+	var got []string
+	for {
+		page, err := testStore.ListWallets(ctx, q)
+		if err != nil {
+			t.Fatalf("ListWallets error: %v", err)
+		}
+		for _, e := range page.Edges {
+			got = append(got, e.Node.Balance.String())
+		}
+		if !page.PageInfo.HasNextPage {
+			break
+		}
+		q.After = *page.PageInfo.EndCursor
+	}
+
+	if fmt.Sprint(got) != "[50 40 30]" {
+		t.Errorf("Expected balances [50 40 30] across pages, got: %v", got)
+	}
+
+	// Equal balances are ordered by address, so paging through them neither
+	// skips nor repeats a wallet.
+	q = WalletQuery{
+		First:   1,
+		OrderBy: generated.WalletOrder{Field: generated.WalletOrderFieldBalance, Direction: generated.OrderDirectionAsc},
+		Filter:  generated.WalletFilter{MaxBalance: big.NewInt(10)},
+	}
+
+	got = nil
+	for {
+		page, err := testStore.ListWallets(ctx, q)
+		if err != nil {
+			t.Fatalf("ListWallets error: %v", err)
+		}
+		for _, e := range page.Edges {
+			got = append(got, e.Node.Address)
+		}
+		if !page.PageInfo.HasNextPage {
+			break
+		}
+		q.After = *page.PageInfo.EndCursor
+	}
+
+	if fmt.Sprint(got) != "[0x0000000000000000000000000000000000000001 0x0000000000000000000000000000000000000003]" {
+		t.Errorf("Unexpected wallets with balance 10: %v", got)
+	}
+
+	if _, err := testStore.ListWallets(ctx, WalletQuery{First: 1, After: q.After}); err == nil {
+		t.Errorf("Expected error when using a balance cursor to order by address, got nil")
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(10))
+
+	if _, err := testStore.GetByAddress(ctx, "0x00000000000000000000000000000000000000ff"); !errors.Is(err, ErrWalletNotFound) {
+		t.Errorf("GetByAddress: Expected ErrWalletNotFound, got: %v", err)
+	}
+
+	_, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(11),
+	}}, TransferOptions{IdempotencyKey: "typed-errors"})
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Transfer: Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	// A replayed rejection keeps its type.
+	_, err = testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(11),
+	}}, TransferOptions{IdempotencyKey: "typed-errors"})
+	if !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("Replayed transfer: Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	_, err = testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(1),
+	}}, TransferOptions{IdempotencyKey: "typed-errors"})
+	if !errors.Is(err, ErrConflict) {
+		t.Errorf("Reused idempotency key: Expected ErrConflict, got: %v", err)
+	}
+
+	_, err = testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(1),
+	}}, TransferOptions{Token: "NOPE"})
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("Transfer: Expected ErrTokenNotFound, got: %v", err)
+	}
+
+	if _, err := testStore.Mint(ctx, "", "0x0000000000000000000000000000000000000001", big.NewInt(-1)); !errors.Is(err, ErrInvalidAmount) {
+		t.Errorf("Mint: Expected ErrInvalidAmount, got: %v", err)
+	}
+
+	if _, err := testStore.CreateToken(ctx, DefaultToken, "Duplicate", 0); !errors.Is(err, ErrConflict) {
+		t.Errorf("CreateToken: Expected ErrConflict, got: %v", err)
+	}
+
+	if _, err := testStore.ListTransfers(ctx, "", 10, "not-a-cursor"); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("ListTransfers: Expected ErrInvalidArgument, got: %v", err)
+	}
+}
+
+func TestTransferLedger(t *testing.T) {
+	resetWallets(t)
+
+	ctx := context.Background()
+
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000000", big.NewInt(10))
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(10))
+	_, _ = testStore.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000002", big.NewInt(10))
+
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000001", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000000", Amount: big.NewInt(4),
+	}}, TransferOptions{}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	if _, err := testStore.Transfer(ctx, "0x0000000000000000000000000000000000000002", []TransferOp{{
+		To: "0x0000000000000000000000000000000000000000", Amount: big.NewInt(50),
+	}}, TransferOptions{}); err == nil {
+		t.Fatalf("Expected error: Insufficient Funds, got nil")
+	}
+
+	all, err := testStore.ListTransfers(ctx, "", 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+
+	if len(all) != 2 {
+		t.Fatalf("ListTransfers: expected 2 transfers, got: %v", len(all))
+	}
+
+	rejected, succeeded := all[0], all[1]
+
+	if rejected.Status != generated.TransferStatusRejected || rejected.Error == nil {
+		t.Errorf("Expected newest transfer to be rejected with a reason, got: %+v", rejected)
+	}
+
+	if succeeded.Status != generated.TransferStatusSucceeded || succeeded.Amount.String() != "4" ||
+		succeeded.FromAddress != "0x0000000000000000000000000000000000000001" {
+		t.Errorf("Expected oldest transfer to be the successful one, got: %+v", succeeded)
+	}
+
+	page, err := testStore.ListTransfers(ctx, "0x0000000000000000000000000000000000000001", 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers by address error: %v", err)
+	}
+
+	if len(page) != 1 || page[0].ID != succeeded.ID {
+		t.Errorf("ListTransfers by address: expected only transfer %v, got: %v", succeeded.ID, page)
+	}
+
+	next, err := testStore.ListTransfers(ctx, "", 1, rejected.ID)
+	if err != nil {
+		t.Fatalf("ListTransfers after cursor error: %v", err)
+	}
+
+	if len(next) != 1 || next[0].ID != succeeded.ID {
+		t.Errorf("ListTransfers after %v: expected transfer %v, got: %v", rejected.ID, succeeded.ID, next)
+	}
+}
+
 func TestTransferRaceConditions(t *testing.T) {
 	resetWallets(t)
 	ctx := context.Background()
@@ -183,7 +897,7 @@ func TestTransferRaceConditions(t *testing.T) {
 	}
 
 	for _, addr := range append([]string{recipient}, senders...) {
-		if _, err := testStore.CreateIfNotExists(ctx, addr, 10); err != nil {
+		if _, err := testStore.CreateIfNotExists(ctx, addr, big.NewInt(10)); err != nil {
 			t.Fatalf("seeding %s failed: %v", addr, err)
 		}
 	}
@@ -191,44 +905,56 @@ func TestTransferRaceConditions(t *testing.T) {
 	type job struct {
 		from   string
 		to     string
-		amount int
+		amount int64
 	}
 
+	// The recipient also sends, so some transfers lock the same wallets in
+	// opposite directions.
 	jobs := []job{
-		{from: senders[0], to: recipient, amount: -4},
-		{from: senders[1], to: recipient, amount: -7},
+		{from: senders[0], to: recipient, amount: 4},
+		{from: senders[1], to: recipient, amount: 7},
 		{from: senders[2], to: recipient, amount: 1},
+		{from: recipient, to: senders[0], amount: 3},
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(len(senders))
+	wg.Add(len(jobs))
 
 	for _, j := range jobs {
 		go func(j job) {
 			defer wg.Done()
-			op := TransferOp{To: j.to, Amount: j.amount}
-			newBal, err := testStore.Transfer(ctx, j.from, op)
-			if err != nil {
+			ops := []TransferOp{{To: j.to, Amount: big.NewInt(j.amount)}}
+			if _, err := testStore.Transfer(ctx, j.from, ops, TransferOptions{}); err != nil {
 				t.Errorf("Transfer from %s failed: %v", j.from, err)
-				return
-			}
-
-			expected := 10 - j.amount
-			if newBal != expected {
-				t.Errorf("Transfer from %s: expected newBal %d, got %d", j.from, expected, newBal)
 			}
 		}(j)
 	}
 
 	wg.Wait()
 
-	time.Sleep(50 * time.Microsecond)
+	want := map[string]int64{
+		recipient:  19,
+		senders[0]: 9,
+		senders[1]: 3,
+		senders[2]: 9,
+	}
+	sum := new(big.Int)
+	for addr, balance := range want {
+		w, err := testStore.GetByAddress(ctx, addr)
+		if err != nil {
+			t.Fatalf("GetByAddress(%s) failed: %v", addr, err)
+		}
+		if w.Balance.Cmp(big.NewInt(balance)) != 0 {
+			t.Errorf("Expected %s to hold %d, got: %v", addr, balance, w.Balance)
+		}
+		sum.Add(sum, w.Balance)
+	}
 
-	got0, err := testStore.GetByAddress(ctx, recipient)
+	tok, err := testStore.GetToken(ctx, DefaultToken)
 	if err != nil {
-		t.Fatalf("GetByAddress for recipient failed: %v", err)
+		t.Fatalf("GetToken error: %v", err)
+	}
+	if tok.TotalSupply.Cmp(sum) != 0 {
+		t.Errorf("Expected the total supply to equal the sum of balances %v, got: %v", sum, tok.TotalSupply)
 	}
-
-	fmt.Printf("Balance after transactions: %v", got0.Balance)
-
 }
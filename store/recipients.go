@@ -0,0 +1,80 @@
+package store
+
+import "fmt"
+
+// RecipientPolicy decides which wallets a transfer may send funds to.
+type RecipientPolicy string
+
+const (
+	// RecipientAutoCreate creates a recipient that does not exist yet, as
+	// every store always did. It is the default.
+	RecipientAutoCreate RecipientPolicy = "auto-create"
+
+	// RecipientMustExist only sends to wallets that already exist, so a
+	// mistyped address fails instead of burning the funds into a new wallet
+	// nobody controls.
+	RecipientMustExist RecipientPolicy = "must-exist"
+
+	// RecipientOptIn only sends to existing wallets that opted in to
+	// receiving transfers with SetAcceptsTransfers.
+	RecipientOptIn RecipientPolicy = "opt-in"
+)
+
+// RecipientPolicies lists every policy.
+var RecipientPolicies = []RecipientPolicy{RecipientAutoCreate, RecipientMustExist, RecipientOptIn}
+
+// ParseRecipientPolicy reads the name of a policy, such as must-exist.
+func ParseRecipientPolicy(s string) (RecipientPolicy, error) {
+	for _, p := range RecipientPolicies {
+		if string(p) == s {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%w: unknown recipient policy %q, expected one of %v", ErrInvalidArgument, s, RecipientPolicies)
+}
+
+// WithRecipientPolicy sets which wallets transfers may send funds to,
+// RecipientAutoCreate unless set. Mints are not affected: an issuer may
+// still mint to a wallet that does not exist yet.
+func WithRecipientPolicy(p RecipientPolicy) Option {
+	return func(o *options) {
+		o.recipientPolicy = p
+	}
+}
+
+// recipientState is what a store knows of a transfer recipient.
+type recipientState struct {
+	exists bool
+
+	// accepts is whether the wallet opted in to receiving transfers.
+	accepts bool
+}
+
+// checkRecipients decides whether a transfer may credit the recipients of
+// ops under policy, looking each one up with lookup. Every store calls it in
+// the transaction that moves the funds, before the sender's nonce is used
+// up, so a refused transfer changes nothing.
+func checkRecipients(policy RecipientPolicy, ops []TransferOp, lookup func(address string) (recipientState, error)) error {
+	if policy == "" || policy == RecipientAutoCreate {
+		return nil
+	}
+	checked := make(map[string]bool)
+	for _, op := range ops {
+		if checked[op.To] {
+			continue
+		}
+		checked[op.To] = true
+
+		r, err := lookup(op.To)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !r.exists:
+			return fmt.Errorf("%w: %s", ErrUnknownRecipient, op.To)
+		case policy == RecipientOptIn && !r.accepts:
+			return fmt.Errorf("%w: %s", ErrRecipientNotOptedIn, op.To)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AccountBalance is the balance of one token held by one account.
+type AccountBalance struct {
+	Address string
+	Token   string
+	Balance *big.Int
+}
+
+// LedgerState is everything reconciliation compares, read from a single
+// consistent view of the store.
+type LedgerState struct {
+	// Balances are the balances wallets hold, as kept by the store.
+	Balances []AccountBalance
+
+	// Supplies maps each registered token to its total supply.
+	Supplies map[string]*big.Int
+
+	// Journal sums the postings of every account, IssuanceAccount included,
+	// per token.
+	Journal []AccountBalance
+}
+
+// DiscrepancyKind names the invariant a Discrepancy breaks.
+type DiscrepancyKind string
+
+const (
+	// DiscrepancyNegativeBalance is a wallet holding less than nothing.
+	DiscrepancyNegativeBalance DiscrepancyKind = "NEGATIVE_BALANCE"
+
+	// DiscrepancyLedgerMismatch is a wallet balance that differs from the
+	// sum of the wallet's postings.
+	DiscrepancyLedgerMismatch DiscrepancyKind = "LEDGER_MISMATCH"
+
+	// DiscrepancySupplyMismatch is a token whose balances do not add up to
+	// its total supply.
+	DiscrepancySupplyMismatch DiscrepancyKind = "SUPPLY_MISMATCH"
+
+	// DiscrepancyIssuanceMismatch is a token whose total supply differs from
+	// the amount the journal says was issued.
+	DiscrepancyIssuanceMismatch DiscrepancyKind = "ISSUANCE_MISMATCH"
+)
+
+// Discrepancy is a single broken invariant. Address is empty for those that
+// concern a token as a whole.
+type Discrepancy struct {
+	Kind     DiscrepancyKind `json:"kind"`
+	Address  string          `json:"address,omitempty"`
+	Token    string          `json:"token"`
+	Expected *big.Int        `json:"expected"`
+	Actual   *big.Int        `json:"actual"`
+}
+
+// TokenTotals sums up a token as seen by reconciliation.
+type TokenTotals struct {
+	Token       string   `json:"token"`
+	TotalSupply *big.Int `json:"totalSupply"`
+	BalanceSum  *big.Int `json:"balanceSum"`
+	Issued      *big.Int `json:"issued"`
+}
+
+// ReconcileReport is the outcome of Reconcile. The store is consistent when
+// OK is set, which is when there are neither discrepancies nor unbalanced
+// journal entries.
+type ReconcileReport struct {
+	OK                bool              `json:"ok"`
+	CheckedAt         time.Time         `json:"checkedAt"`
+	Accounts          int               `json:"accounts"`
+	Tokens            []TokenTotals     `json:"tokens"`
+	Discrepancies     []Discrepancy     `json:"discrepancies"`
+	UnbalancedEntries []UnbalancedEntry `json:"unbalancedEntries"`
+}
+
+// Reconcile checks the invariants every store must keep:
+//
+//   - no wallet holds a negative balance,
+//   - every balance equals the sum of its postings in the journal,
+//   - the balances of every token add up to its total supply,
+//   - the total supply equals the amount the journal says was issued, and
+//   - every journal entry sums to zero.
+func Reconcile(ctx context.Context, s WalletStore) (*ReconcileReport, error) {
+	state, err := s.LedgerState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	unbalanced, err := s.CheckJournal(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := compareLedger(state)
+	report.UnbalancedEntries = append(report.UnbalancedEntries, unbalanced...)
+	report.OK = report.OK && len(unbalanced) == 0
+	return report, nil
+}
+
+// compareLedger checks state against every invariant but the balance of
+// individual journal entries, which Reconcile adds.
+func compareLedger(state *LedgerState) *ReconcileReport {
+	report := &ReconcileReport{
+		CheckedAt:         time.Now().UTC(),
+		Tokens:            []TokenTotals{},
+		Discrepancies:     []Discrepancy{},
+		UnbalancedEntries: []UnbalancedEntry{},
+	}
+
+	type account struct{ address, token string }
+	balances := make(map[account]*big.Int)
+	journal := make(map[account]*big.Int)
+	totals := make(map[string]*TokenTotals)
+
+	total := func(token string) *TokenTotals {
+		if totals[token] == nil {
+			totals[token] = &TokenTotals{Token: token, BalanceSum: new(big.Int), Issued: new(big.Int)}
+		}
+		return totals[token]
+	}
+
+	for token, supply := range state.Supplies {
+		total(token).TotalSupply = supply
+	}
+	for _, b := range state.Balances {
+		balances[account{b.Address, b.Token}] = b.Balance
+		t := total(b.Token)
+		t.BalanceSum.Add(t.BalanceSum, b.Balance)
+
+		if b.Balance.Sign() < 0 {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind: DiscrepancyNegativeBalance, Address: b.Address, Token: b.Token,
+				Expected: new(big.Int), Actual: b.Balance,
+			})
+		}
+	}
+	for _, b := range state.Journal {
+		if b.Address == IssuanceAccount {
+			t := total(b.Token)
+			t.Issued.Sub(t.Issued, b.Balance)
+			continue
+		}
+		journal[account{b.Address, b.Token}] = b.Balance
+	}
+
+	// An account missing on either side holds nothing there.
+	accounts := make(map[account]bool)
+	for a := range balances {
+		accounts[a] = true
+	}
+	for a := range journal {
+		accounts[a] = true
+	}
+	report.Accounts = len(accounts)
+	for a := range accounts {
+		held, posted := balances[a], journal[a]
+		if held == nil {
+			held = new(big.Int)
+		}
+		if posted == nil {
+			posted = new(big.Int)
+		}
+		if held.Cmp(posted) != 0 {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind: DiscrepancyLedgerMismatch, Address: a.address, Token: a.token,
+				Expected: posted, Actual: held,
+			})
+		}
+	}
+
+	for _, t := range totals {
+		if t.TotalSupply == nil {
+			// Balances or postings of a token that is not registered.
+			t.TotalSupply = new(big.Int)
+		}
+		if t.BalanceSum.Cmp(t.TotalSupply) != 0 {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind: DiscrepancySupplyMismatch, Token: t.Token,
+				Expected: t.BalanceSum, Actual: t.TotalSupply,
+			})
+		}
+		if t.Issued.Cmp(t.TotalSupply) != 0 {
+			report.Discrepancies = append(report.Discrepancies, Discrepancy{
+				Kind: DiscrepancyIssuanceMismatch, Token: t.Token,
+				Expected: t.Issued, Actual: t.TotalSupply,
+			})
+		}
+		report.Tokens = append(report.Tokens, *t)
+	}
+
+	sort.Slice(report.Tokens, func(i, j int) bool { return report.Tokens[i].Token < report.Tokens[j].Token })
+	sort.Slice(report.Discrepancies, func(i, j int) bool {
+		a, b := report.Discrepancies[i], report.Discrepancies[j]
+		if c := strings.Compare(a.Address, b.Address); c != 0 {
+			return c < 0
+		}
+		if c := strings.Compare(a.Token, b.Token); c != 0 {
+			return c < 0
+		}
+		return a.Kind < b.Kind
+	})
+
+	report.OK = len(report.Discrepancies) == 0
+	return report
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// errDryRun rolls back the transaction of a dry run once its results are in.
+var errDryRun = errors.New("dry run")
+
+func (s *SQLiteWalletStore) ImportWallets(ctx context.Context, rows []WalletRow, dryRun bool) ([]RowResult, error) {
+	results := make([]RowResult, len(rows))
+	err := s.write(ctx, func(tx *sqliteTx) error {
+		now := time.Now().UTC()
+
+		var postings []posting
+		supply := make(map[string]*big.Int)
+		created := make(map[string]bool)
+		for i, row := range rows {
+			_, err := getSQLiteToken(ctx, tx, row.Token)
+			if err != nil && !errors.Is(err, ErrTokenNotFound) {
+				return err
+			}
+			known := err == nil
+			exists, err := tx.walletExists(ctx, row.Address)
+			if err != nil {
+				return err
+			}
+			held, err := tx.balance(ctx, row.Address, row.Token)
+			if err != nil {
+				return err
+			}
+			// Rows are checked against the store as it was before the batch,
+			// whatever their order.
+			exists = exists && !created[row.Address]
+			results[i] = walletRowResult(row, known, exists, held)
+			if results[i].Status != RowImported {
+				continue
+			}
+			if !exists {
+				created[row.Address] = true
+			}
+			if dryRun {
+				continue
+			}
+
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO wallets(address, created_at, updated_at)
+                     VALUES (?1, ?2, ?2)
+                 ON CONFLICT (address)
+                   DO UPDATE SET updated_at = excluded.updated_at`,
+				row.Address, now.UnixNano(),
+			); err != nil {
+				return fmt.Errorf("insert wallet: %w", err)
+			}
+			if row.Balance.Sign() == 0 {
+				continue
+			}
+			if err := tx.setBalance(ctx, row.Address, row.Token, row.Balance, now); err != nil {
+				return fmt.Errorf("credit balance: %w", err)
+			}
+			if supply[row.Token] == nil {
+				supply[row.Token] = new(big.Int)
+			}
+			supply[row.Token].Add(supply[row.Token], row.Balance)
+			postings = append(postings, issuancePostings(row.Address, row.Token, row.Balance)...)
+			tx.notify(balanceChanged(row.Address, row.Token, row.Balance))
+		}
+		if dryRun {
+			return errDryRun
+		}
+
+		for token, amount := range supply {
+			if err := tx.addSupply(ctx, token, amount); err != nil {
+				return err
+			}
+		}
+		if len(postings) > 0 {
+			return tx.insertJournalEntry(ctx, EntrySeed, postings, now)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *SQLiteWalletStore) ImportTransfers(ctx context.Context, rows []*generated.Transfer, dryRun bool) ([]RowResult, error) {
+	results := make([]RowResult, len(rows))
+	err := s.write(ctx, func(tx *sqliteTx) error {
+		for i, t := range rows {
+			if _, err := getSQLiteToken(ctx, tx, t.Token); errors.Is(err, ErrTokenNotFound) {
+				results[i] = rowFailed(errUnknownToken(t.Token))
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			results[i] = RowResult{Status: RowImported}
+			if dryRun {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx,
+				`INSERT INTO transfers(from_address, to_address, spender, token, amount, status, error, created_at)
+                     VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`,
+				t.FromAddress, t.ToAddress, t.Spender, t.Token, t.Amount.String(), string(t.Status), t.Error, t.CreatedAt.UnixNano(),
+			); err != nil {
+				return fmt.Errorf("record transfer: %w", err)
+			}
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *SQLiteWalletStore) ExportWallets(ctx context.Context, fn func(WalletRow) error) error {
+	// A single query reads a consistent snapshot, however long fn takes.
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT address, token, balance
+          FROM balances
+         WHERE balance <> '0'
+        UNION ALL
+        SELECT w.address, ?1, '0'
+          FROM wallets w
+         WHERE NOT EXISTS (SELECT 1 FROM balances b WHERE b.address = w.address AND b.balance <> '0')
+         ORDER BY 1, 2
+    `, DefaultToken)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var row WalletRow
+		if err := rows.Scan(&row.Address, &row.Token, sqliteAmount{&row.Balance}); err != nil {
+			return err
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteWalletStore) ExportTransfers(ctx context.Context, fn func(*generated.Transfer) error) error {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, from_address, to_address, spender, token, amount, status, error, created_at
+          FROM transfers
+         ORDER BY id
+    `)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		t := &generated.Transfer{}
+		var id int64
+		var status string
+		if err := rows.Scan(&id, &t.FromAddress, &t.ToAddress, &t.Spender, &t.Token,
+			sqliteAmount{&t.Amount}, &status, &t.Error, sqliteTime{&t.CreatedAt}); err != nil {
+			return err
+		}
+		t.ID = strconv.FormatInt(id, 10)
+		t.Status = generated.TransferStatus(status)
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,1687 @@
+package store
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// SQLiteWalletStore keeps wallets in a single SQLite database file, for
+// single-node deployments that do not want to run Postgres.
+//
+// SQLite allows one writer at a time, and every write transaction takes the
+// database write lock when it begins, so transfers are serializable without
+// the per-wallet locks PostgresWalletStore needs.
+type SQLiteWalletStore struct {
+	db     *sql.DB
+	opts   options
+	events *eventBus
+
+	// mu serialises the writers of this process, so their events are
+	// published in commit order.
+	mu sync.Mutex
+}
+
+// NewSQLiteWalletStore returns a store on db, which must have been opened
+// with sqliteDSN and migrated.
+func NewSQLiteWalletStore(db *sql.DB, opts ...Option) *SQLiteWalletStore {
+	return &SQLiteWalletStore{db: db, opts: newOptions(opts), events: newEventBus()}
+}
+
+// sqliteQuerier is satisfied by the database and by an open transaction.
+type sqliteQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqliteTx is a write transaction. Events queued on it are published once it
+// has been committed.
+type sqliteTx struct {
+	*sql.Tx
+	events []Event
+}
+
+func (tx *sqliteTx) notify(ev Event) {
+	tx.events = append(tx.events, ev)
+}
+
+// write runs fn in a transaction holding the database write lock and commits
+// it unless fn fails.
+func (s *SQLiteWalletStore) write(ctx context.Context, fn func(tx *sqliteTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sqlTx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	tx := &sqliteTx{Tx: sqlTx}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, ev := range tx.events {
+		s.events.publish(ev)
+	}
+	return nil
+}
+
+// sqliteTime scans an INTEGER column of Unix nanoseconds.
+type sqliteTime struct{ t *time.Time }
+
+func (s sqliteTime) Scan(v any) error {
+	n, ok := v.(int64)
+	if !ok {
+		return fmt.Errorf("invalid timestamp %v", v)
+	}
+	*s.t = time.Unix(0, n).UTC()
+	return nil
+}
+
+// sqliteAmount scans a TEXT column holding a token amount.
+type sqliteAmount struct{ n **big.Int }
+
+func (s sqliteAmount) Scan(v any) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("invalid token amount %v", v)
+	}
+	n, err := parseNumeric(str)
+	if err != nil {
+		return err
+	}
+	*s.n = n
+	return nil
+}
+
+// sortableAmount is the balance_key of a balance of n, which must not be
+// negative.
+func sortableAmount(n *big.Int) string {
+	s := n.String()
+	return fmt.Sprintf("%03d%s", len(s), s)
+}
+
+func (s *SQLiteWalletStore) GetByAddress(ctx context.Context, addr string) (*generated.Wallet, error) {
+	addr, err := canonicalAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &generated.Wallet{}
+	err = s.db.QueryRowContext(ctx,
+		`SELECT address, created_at, updated_at FROM wallets WHERE address = ?1`, addr,
+	).Scan(&w.Address, sqliteTime{&w.CreatedAt}, sqliteTime{&w.UpdatedAt})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadSQLiteBalances(ctx, s.db, []*generated.Wallet{w}); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *SQLiteWalletStore) GetByAddressAsOf(ctx context.Context, addr string, asOf time.Time) (*generated.Wallet, error) {
+	addr, err := canonicalAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &generated.Wallet{}
+	err = s.db.QueryRowContext(ctx,
+		`SELECT address, created_at FROM wallets WHERE address = ?1 AND created_at <= ?2`, addr, asOf.UnixNano(),
+	).Scan(&w.Address, sqliteTime{&w.CreatedAt})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := loadSQLiteBalancesAsOf(ctx, s.db, []*generated.Wallet{w}, asOf); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *SQLiteWalletStore) ListAll(ctx context.Context) ([]*generated.Wallet, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT address, created_at, updated_at FROM wallets`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*generated.Wallet
+	for rows.Next() {
+		w := &generated.Wallet{}
+		if err := rows.Scan(&w.Address, sqliteTime{&w.CreatedAt}, sqliteTime{&w.UpdatedAt}); err != nil {
+			return nil, err
+		}
+		result = append(result, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := loadSQLiteBalances(ctx, s.db, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// sqliteWalletOrderColumns holds the SQL expression wallets are sorted by for
+// each order field. A wallet without a balance row has a balance of zero,
+// whose key is '0010'.
+var sqliteWalletOrderColumns = map[generated.WalletOrderField]string{
+	generated.WalletOrderFieldBalance:   "COALESCE(b.balance_key, '0010')",
+	generated.WalletOrderFieldCreatedAt: "w.created_at",
+	generated.WalletOrderFieldAddress:   "w.address",
+}
+
+func (s *SQLiteWalletStore) ListWallets(ctx context.Context, q WalletQuery) (*generated.WalletConnection, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	field := q.orderField()
+	after, err := decodeWalletCursor(q.After, field)
+	if err != nil {
+		return nil, err
+	}
+
+	column, ok := sqliteWalletOrderColumns[field]
+	if !ok {
+		return nil, fmt.Errorf("%w: cannot order wallets by %s", ErrInvalidArgument, field)
+	}
+	dir, cmp := "ASC", ">"
+	if q.descending() {
+		dir, cmp = "DESC", "<"
+	}
+
+	// Balances are never negative, so a negative lower bound lets every
+	// wallet through and a negative upper bound none.
+	var minBalance, maxBalance *string
+	if q.Filter.MinBalance != nil && q.Filter.MinBalance.Sign() > 0 {
+		v := sortableAmount(q.Filter.MinBalance)
+		minBalance = &v
+	}
+	if q.Filter.MaxBalance != nil {
+		if q.Filter.MaxBalance.Sign() < 0 {
+			return walletConnection(nil, q), nil
+		}
+		v := sortableAmount(q.Filter.MaxBalance)
+		maxBalance = &v
+	}
+
+	var createdAfter, createdBefore *int64
+	if q.Filter.CreatedAfter != nil {
+		v := q.Filter.CreatedAfter.UnixNano()
+		createdAfter = &v
+	}
+	if q.Filter.CreatedBefore != nil {
+		v := q.Filter.CreatedBefore.UnixNano()
+		createdBefore = &v
+	}
+
+	var asOf *int64
+	if q.AsOf != nil {
+		v := q.AsOf.UnixNano()
+		asOf = &v
+	}
+
+	args := []any{DefaultToken, minBalance, maxBalance, createdAfter, createdBefore, q.First + 1, asOf}
+
+	// Listing as of a time takes each wallet's balance from its last
+	// checkpoint by then instead of the current balance.
+	balances := "balances b ON b.address = w.address AND b.token = ?1"
+	if q.AsOf != nil {
+		balances = `balance_checkpoints b ON b.id = (
+            SELECT c.id
+              FROM balance_checkpoints c
+             WHERE c.address = w.address AND c.token = ?1 AND c.recorded_at <= ?7
+             ORDER BY c.recorded_at DESC, c.id DESC
+             LIMIT 1
+          )`
+	}
+
+	keyset := "TRUE"
+	if after != nil {
+		switch field {
+		case generated.WalletOrderFieldBalance:
+			keyset = fmt.Sprintf("(%s, w.address) %s (?8, ?9)", column, cmp)
+			args = append(args, sortableAmount(after.balance), after.address)
+		case generated.WalletOrderFieldCreatedAt:
+			keyset = fmt.Sprintf("(%s, w.address) %s (?8, ?9)", column, cmp)
+			args = append(args, after.createdAt.UnixNano(), after.address)
+		default:
+			keyset = fmt.Sprintf("w.address %s ?8", cmp)
+			args = append(args, after.address)
+		}
+	}
+
+	// The page and its balances are read from one snapshot, so the cursors
+	// match the order the page was selected in.
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+        SELECT w.address, w.created_at, w.updated_at
+          FROM wallets w
+          LEFT JOIN %s
+         WHERE (?2 IS NULL OR COALESCE(b.balance_key, '0010') >= ?2)
+           AND (?3 IS NULL OR COALESCE(b.balance_key, '0010') <= ?3)
+           AND (?4 IS NULL OR w.created_at > ?4)
+           AND (?5 IS NULL OR w.created_at < ?5)
+           AND (?7 IS NULL OR w.created_at <= ?7)
+           AND %s
+         ORDER BY %s %s, w.address %s
+         LIMIT ?6
+    `, balances, keyset, column, dir, dir), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ws := []*generated.Wallet{}
+	for rows.Next() {
+		w := &generated.Wallet{}
+		if err := rows.Scan(&w.Address, sqliteTime{&w.CreatedAt}, sqliteTime{&w.UpdatedAt}); err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if q.AsOf != nil {
+		err = loadSQLiteBalancesAsOf(ctx, tx, ws, *q.AsOf)
+	} else {
+		err = loadSQLiteBalances(ctx, tx, ws)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return walletConnection(ws, q), nil
+}
+
+// loadSQLiteBalances fills Balance and Balances of every wallet in ws.
+func loadSQLiteBalances(ctx context.Context, q sqliteQuerier, ws []*generated.Wallet) error {
+	byAddr := make(map[string]*generated.Wallet, len(ws))
+	addrs := make([]string, 0, len(ws))
+	for _, w := range ws {
+		w.Balance = new(big.Int)
+		w.Balances = []*generated.TokenBalance{}
+		byAddr[w.Address] = w
+		addrs = append(addrs, w.Address)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	// The addresses go in as one JSON array rather than one parameter each,
+	// which SQLite limits the number of.
+	list, err := json.Marshal(addrs)
+	if err != nil {
+		return err
+	}
+
+	rows, err := q.QueryContext(ctx, `
+        SELECT b.address, b.balance,
+               t.symbol, t.name, t.decimals, t.total_supply, t.created_at
+          FROM balances b
+          JOIN tokens t ON t.symbol = b.token
+         WHERE b.address IN (SELECT value FROM json_each(?1))
+         ORDER BY b.address, t.symbol
+    `, string(list))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var addr string
+		t := &generated.Token{}
+		tb := &generated.TokenBalance{Token: t}
+		if err := rows.Scan(&addr, sqliteAmount{&tb.Balance},
+			&t.Symbol, &t.Name, &t.Decimals, sqliteAmount{&t.TotalSupply}, sqliteTime{&t.CreatedAt}); err != nil {
+			return err
+		}
+
+		w := byAddr[addr]
+		w.Balances = append(w.Balances, tb)
+		if t.Symbol == DefaultToken {
+			w.Balance = tb.Balance
+		}
+	}
+	return rows.Err()
+}
+
+// loadSQLiteBalancesAsOf fills Balance and Balances of every wallet in ws
+// with the balances it held at asOf, and sets UpdatedAt to the last change by
+// then. Every token a wallet ever held has a row in balances, and its balance
+// at asOf is the last checkpoint recorded by then.
+func loadSQLiteBalancesAsOf(ctx context.Context, q sqliteQuerier, ws []*generated.Wallet, asOf time.Time) error {
+	byAddr := make(map[string]*generated.Wallet, len(ws))
+	addrs := make([]string, 0, len(ws))
+	for _, w := range ws {
+		w.Balance = new(big.Int)
+		w.Balances = []*generated.TokenBalance{}
+		w.UpdatedAt = w.CreatedAt
+		byAddr[w.Address] = w
+		addrs = append(addrs, w.Address)
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	list, err := json.Marshal(addrs)
+	if err != nil {
+		return err
+	}
+
+	rows, err := q.QueryContext(ctx, `
+        SELECT b.address, c.balance, c.recorded_at,
+               t.symbol, t.name, t.decimals, t.total_supply, t.created_at
+          FROM balances b
+          JOIN tokens t ON t.symbol = b.token
+          JOIN balance_checkpoints c ON c.id = (
+                SELECT id
+                  FROM balance_checkpoints
+                 WHERE address = b.address AND token = b.token AND recorded_at <= ?2
+                 ORDER BY recorded_at DESC, id DESC
+                 LIMIT 1
+          )
+         WHERE b.address IN (SELECT value FROM json_each(?1))
+         ORDER BY b.address, t.symbol
+    `, string(list), asOf.UnixNano())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var addr string
+		var recordedAt time.Time
+		t := &generated.Token{}
+		tb := &generated.TokenBalance{Token: t}
+		if err := rows.Scan(&addr, sqliteAmount{&tb.Balance}, sqliteTime{&recordedAt},
+			&t.Symbol, &t.Name, &t.Decimals, sqliteAmount{&t.TotalSupply}, sqliteTime{&t.CreatedAt}); err != nil {
+			return err
+		}
+
+		w := byAddr[addr]
+		w.Balances = append(w.Balances, tb)
+		if t.Symbol == DefaultToken {
+			w.Balance = tb.Balance
+		}
+		if recordedAt.After(w.UpdatedAt) {
+			w.UpdatedAt = recordedAt
+		}
+	}
+	return rows.Err()
+}
+
+func (s *SQLiteWalletStore) CreateIfNotExists(ctx context.Context, addr string, initialBalance *big.Int) (*generated.Wallet, error) {
+	addr, err := canonicalAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	w := &generated.Wallet{}
+	err = s.write(ctx, func(tx *sqliteTx) error {
+		now := time.Now().UTC()
+
+		res, err := tx.ExecContext(ctx, `
+            INSERT INTO wallets(address, created_at, updated_at)
+            VALUES (?1, ?2, ?2)
+            ON CONFLICT (address) DO NOTHING
+        `, addr, now.UnixNano())
+		if err != nil {
+			return fmt.Errorf("insert wallet: %w", err)
+		}
+		created, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		// Only a freshly created wallet is seeded, and the seed counts towards
+		// the supply of the default token.
+		if created == 1 && initialBalance.Sign() != 0 {
+			if err := tx.setBalance(ctx, addr, DefaultToken, initialBalance, now); err != nil {
+				return fmt.Errorf("seed wallet: %w", err)
+			}
+			if err := tx.addSupply(ctx, DefaultToken, initialBalance); err != nil {
+				return err
+			}
+			if err := tx.insertJournalEntry(ctx, EntrySeed, issuancePostings(addr, DefaultToken, initialBalance), now); err != nil {
+				return err
+			}
+			tx.notify(balanceChanged(addr, DefaultToken, initialBalance))
+		}
+
+		if err := tx.QueryRowContext(ctx,
+			`SELECT address, created_at, updated_at FROM wallets WHERE address = ?1`, addr,
+		).Scan(&w.Address, sqliteTime{&w.CreatedAt}, sqliteTime{&w.UpdatedAt}); err != nil {
+			return fmt.Errorf("fetch wallet: %w", err)
+		}
+		return loadSQLiteBalances(ctx, tx, []*generated.Wallet{w})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *SQLiteWalletStore) Transfer(ctx context.Context, from string, ops []TransferOp, opts TransferOptions) (*big.Int, error) {
+	from, ops, opts, err := canonicalTransfer(from, ops, opts)
+	if err != nil {
+		return nil, err
+	}
+	total, err := transferTotal(ops)
+	if err != nil {
+		return nil, err
+	}
+	token := tokenOrDefault(opts.Token)
+
+	var spent *big.Int
+	if opts.Spender != "" {
+		spent = total
+	}
+
+	// A rejected or replayed transfer still commits, so its outcome is kept
+	// apart from the error of the transaction itself.
+	var balance *big.Int
+	var rejection error
+
+	err = s.write(ctx, func(tx *sqliteTx) error {
+		if _, err := getSQLiteToken(ctx, tx, token); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		if opts.IdempotencyKey != "" {
+			prev, err := s.loadIdempotentResult(ctx, tx, from, opts.IdempotencyKey, now)
+			if err != nil {
+				return err
+			}
+			if prev != nil {
+				balance, rejection = prev.replay(transferFingerprint(token, ops, opts))
+				return nil
+			}
+		}
+
+		key, err := getSQLiteWalletKey(ctx, tx, from)
+		if errors.Is(err, ErrWalletNotFound) {
+			return fmt.Errorf("sender %w", ErrWalletNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkTransferKey(key.PublicKey, key.Nonce, opts); err != nil {
+			return err
+		}
+		err = checkRecipients(s.opts.recipientPolicy, ops, func(address string) (recipientState, error) {
+			return getSQLiteRecipient(ctx, tx, address)
+		})
+		if err != nil {
+			return err
+		}
+		// The nonce is used up outside the savepoint, so a rejected transfer
+		// cannot be replayed once the sender can afford it.
+		if opts.Nonce != nil {
+			if _, err := tx.ExecContext(ctx, `UPDATE wallets SET nonce = nonce + 1 WHERE address = ?1`, from); err != nil {
+				return err
+			}
+		}
+
+		// Legs run inside a savepoint so a rejected leg undoes the ones before
+		// it while the rejection itself still gets recorded.
+		if _, err := tx.ExecContext(ctx, `SAVEPOINT legs`); err != nil {
+			return err
+		}
+
+		if spent != nil {
+			if rejection, err = tx.spendAllowance(ctx, from, opts.Spender, token, spent, now); err != nil {
+				return err
+			}
+		}
+		for _, op := range ops {
+			if rejection != nil {
+				break
+			}
+			if rejection, err = tx.applyTransferLeg(ctx, from, token, op, now); err != nil {
+				return err
+			}
+		}
+
+		status := generated.TransferStatusSucceeded
+		var reason *string
+		if rejection != nil {
+			if _, err := tx.ExecContext(ctx, `ROLLBACK TO legs`); err != nil {
+				return err
+			}
+			status = generated.TransferStatusRejected
+			r := rejection.Error()
+			reason = &r
+		}
+		if _, err := tx.ExecContext(ctx, `RELEASE legs`); err != nil {
+			return err
+		}
+
+		var postings []posting
+		for _, op := range ops {
+			id, err := tx.insertTransfer(ctx, from, token, op, opts, status, reason, now)
+			if err != nil {
+				return err
+			}
+			postings = append(postings, transferPostings(from, token, op, id)...)
+		}
+
+		if rejection == nil {
+			if err := tx.insertJournalEntry(ctx, EntryTransfer, postings, now); err != nil {
+				return err
+			}
+			for _, addr := range lockOrder(from, ops) {
+				bal, err := tx.balance(ctx, addr, token)
+				if err != nil {
+					return err
+				}
+				tx.notify(balanceChanged(addr, token, bal))
+			}
+		}
+
+		if balance, err = tx.balance(ctx, from, token); err != nil {
+			return err
+		}
+		return tx.saveIdempotentResult(ctx, from, token, ops, opts, balance, reason, now, now.Add(s.opts.idempotencyWindow))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return balance, rejection
+}
+
+// applyTransferLeg moves a single op between from and op.To. A non-nil
+// rejection means the leg was rejected and nothing was changed by it.
+func (tx *sqliteTx) applyTransferLeg(ctx context.Context, from, token string, op TransferOp, now time.Time) (rejection error, err error) {
+	debited, credited, amount := from, op.To, op.Amount
+
+	// Like the conditional UPDATE of the Postgres store, a wallet that never
+	// held the token cannot be debited, not even by zero.
+	held, ok, err := tx.heldBalance(ctx, debited, token)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || held.Cmp(amount) < 0 {
+		return ErrInsufficientFunds, nil
+	}
+
+	if err := tx.setBalance(ctx, debited, token, new(big.Int).Sub(held, amount), now); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO wallets(address, created_at, updated_at)
+             VALUES (?1, ?2, ?2)
+         ON CONFLICT (address)
+           DO UPDATE SET updated_at = excluded.updated_at`,
+		credited, now.UnixNano(),
+	); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE wallets SET updated_at = ?2 WHERE address = ?1`, debited, now.UnixNano(),
+	); err != nil {
+		return nil, err
+	}
+
+	bal, err := tx.balance(ctx, credited, token)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.setBalance(ctx, credited, token, bal.Add(bal, amount), now); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// spendAllowance deducts amount from the allowance spender holds on owner's
+// token. A non-nil rejection means the allowance was too small and nothing was
+// changed.
+func (tx *sqliteTx) spendAllowance(ctx context.Context, owner, spender, token string, amount *big.Int, now time.Time) (rejection error, err error) {
+	allowance, err := sqliteAllowance(ctx, tx, owner, spender, token)
+	if err != nil {
+		return nil, err
+	}
+	if allowance.Cmp(amount) < 0 {
+		return ErrInsufficientAllowance, nil
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE allowances SET amount = ?1, updated_at = ?2
+         WHERE owner = ?3 AND spender = ?4 AND token = ?5`,
+		allowance.Sub(allowance, amount).String(), now.UnixNano(), owner, spender, token,
+	); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// loadIdempotentResult returns the outcome remembered for key, or nil when
+// the key is unknown or older than the idempotency window.
+func (s *SQLiteWalletStore) loadIdempotentResult(ctx context.Context, tx *sqliteTx, from, key string, now time.Time) (*idempotentResult, error) {
+	r := &idempotentResult{}
+	var reason *string
+	err := tx.QueryRowContext(ctx, `
+        SELECT fingerprint, balance, error
+          FROM idempotency_keys
+         WHERE from_address = ?1 AND key = ?2
+           AND COALESCE(expires_at > ?3, created_at > ?4)
+    `, from, key, now.UnixNano(), now.Add(-s.opts.idempotencyWindow).UnixNano(),
+	).Scan(&r.fingerprint, sqliteAmount{&r.balance}, &reason)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load idempotency key: %w", err)
+	}
+	if reason != nil {
+		r.reason = *reason
+	}
+	return r, nil
+}
+
+// saveIdempotentResult remembers the outcome of a transfer under its
+// idempotency key, replacing an expired entry for the same key.
+func (tx *sqliteTx) saveIdempotentResult(ctx context.Context, from, token string, ops []TransferOp, opts TransferOptions, balance *big.Int, reason *string, now, expiresAt time.Time) error {
+	if opts.IdempotencyKey == "" {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `
+        INSERT INTO idempotency_keys(from_address, key, fingerprint, balance, error, created_at, expires_at)
+             VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)
+        ON CONFLICT (from_address, key)
+          DO UPDATE SET fingerprint = excluded.fingerprint,
+                        balance = excluded.balance,
+                        error = excluded.error,
+                        created_at = excluded.created_at,
+                        expires_at = excluded.expires_at
+    `, from, opts.IdempotencyKey, transferFingerprint(token, ops, opts), balance.String(), reason, now.UnixNano(), expiresAt.UnixNano())
+	if err != nil {
+		return fmt.Errorf("save idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (tx *sqliteTx) walletExists(ctx context.Context, addr string) (bool, error) {
+	var exists bool
+	err := tx.QueryRowContext(ctx,
+		`SELECT EXISTS (SELECT 1 FROM wallets WHERE address = ?1)`, addr,
+	).Scan(&exists)
+	return exists, err
+}
+
+// heldBalance reads the balance of addr in token. ok is false when the
+// wallet never held the token.
+func (tx *sqliteTx) heldBalance(ctx context.Context, addr, token string) (balance *big.Int, ok bool, err error) {
+	err = tx.QueryRowContext(ctx,
+		`SELECT balance FROM balances WHERE address = ?1 AND token = ?2`, addr, token,
+	).Scan(sqliteAmount{&balance})
+	if errors.Is(err, sql.ErrNoRows) {
+		return new(big.Int), false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return balance, true, nil
+}
+
+// balance reads the current balance of addr in token. A wallet that never
+// held the token has a balance of zero.
+func (tx *sqliteTx) balance(ctx context.Context, addr, token string) (*big.Int, error) {
+	balance, _, err := tx.heldBalance(ctx, addr, token)
+	return balance, err
+}
+
+// setBalance stores the balance of addr in token and checkpoints it, so the
+// balance can be looked up as of any later time.
+func (tx *sqliteTx) setBalance(ctx context.Context, addr, token string, balance *big.Int, now time.Time) error {
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO balances(address, token, balance, updated_at)
+             VALUES (?1, ?2, ?3, ?4)
+         ON CONFLICT (address, token)
+           DO UPDATE SET balance = excluded.balance,
+                         updated_at = excluded.updated_at`,
+		addr, token, balance.String(), now.UnixNano(),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO balance_checkpoints(address, token, balance, recorded_at) VALUES (?1, ?2, ?3, ?4)`,
+		addr, token, balance.String(), now.UnixNano(),
+	); err != nil {
+		return fmt.Errorf("record balance checkpoint: %w", err)
+	}
+	return nil
+}
+
+// addSupply changes the total supply of token by delta.
+func (tx *sqliteTx) addSupply(ctx context.Context, token string, delta *big.Int) error {
+	t, err := getSQLiteToken(ctx, tx, token)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE tokens SET total_supply = ?2 WHERE symbol = ?1`,
+		token, t.TotalSupply.Add(t.TotalSupply, delta).String(),
+	); err != nil {
+		return fmt.Errorf("update total supply: %w", err)
+	}
+	return nil
+}
+
+// insertTransfer records a single leg of a transfer, announces it and
+// returns its id.
+func (tx *sqliteTx) insertTransfer(ctx context.Context, from, token string, op TransferOp, opts TransferOptions, status generated.TransferStatus, reason *string, now time.Time) (string, error) {
+	var spender *string
+	if opts.Spender != "" {
+		spender = &opts.Spender
+	}
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO transfers(from_address, to_address, spender, token, amount, status, error, created_at)
+             VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`,
+		from, op.To, spender, token, op.Amount.String(), string(status), reason, now.UnixNano(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("record transfer: %w", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return "", fmt.Errorf("record transfer: %w", err)
+	}
+
+	t := &generated.Transfer{
+		ID:          strconv.FormatInt(id, 10),
+		FromAddress: from,
+		ToAddress:   op.To,
+		Spender:     spender,
+		Token:       token,
+		Amount:      op.Amount,
+		Status:      status,
+		Error:       reason,
+		CreatedAt:   now,
+	}
+	tx.notify(transferCreated(t))
+	return t.ID, nil
+}
+
+// insertJournalEntry records postings as a single journal entry, leaving out
+// postings of zero.
+func (tx *sqliteTx) insertJournalEntry(ctx context.Context, kind JournalEntryKind, postings []posting, now time.Time) error {
+	res, err := tx.ExecContext(ctx,
+		`INSERT INTO journal_entries(kind, created_at) VALUES (?1, ?2)`, string(kind), now.UnixNano(),
+	)
+	if err != nil {
+		return fmt.Errorf("record journal entry: %w", err)
+	}
+	entryID, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("record journal entry: %w", err)
+	}
+
+	for _, p := range postings {
+		if p.amount.Sign() == 0 {
+			continue
+		}
+		var transferID *string
+		if p.transferID != "" {
+			transferID = &p.transferID
+		}
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO postings(entry_id, address, token, amount, transfer_id)
+                 VALUES (?1, ?2, ?3, ?4, ?5)`,
+			entryID, p.address, p.token, p.amount.String(), transferID,
+		); err != nil {
+			return fmt.Errorf("record postings: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLiteWalletStore) ListTransfers(ctx context.Context, address string, first int, after string) ([]*generated.Transfer, error) {
+	if address != "" {
+		var err error
+		if address, err = canonicalAddress(address); err != nil {
+			return nil, err
+		}
+	}
+	cursor, err := parseTransferCursor(after)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT id, from_address, to_address, spender, token, amount, status, error, created_at
+          FROM transfers
+         WHERE (?1 = '' OR from_address = ?1 OR to_address = ?1)
+           AND (?2 = 0 OR id < ?2)
+         ORDER BY id DESC
+         LIMIT ?3
+    `, address, cursor, first)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*generated.Transfer{}
+	for rows.Next() {
+		t := &generated.Transfer{}
+		var id int64
+		var status string
+		if err := rows.Scan(&id, &t.FromAddress, &t.ToAddress, &t.Spender, &t.Token,
+			sqliteAmount{&t.Amount}, &status, &t.Error, sqliteTime{&t.CreatedAt}); err != nil {
+			return nil, err
+		}
+		t.ID = strconv.FormatInt(id, 10)
+		t.Status = generated.TransferStatus(status)
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteWalletStore) GetToken(ctx context.Context, symbol string) (*generated.Token, error) {
+	return getSQLiteToken(ctx, s.db, symbol)
+}
+
+func getSQLiteToken(ctx context.Context, q sqliteQuerier, symbol string) (*generated.Token, error) {
+	t := &generated.Token{}
+	err := q.QueryRowContext(ctx, `
+        SELECT symbol, name, decimals, total_supply, created_at
+          FROM tokens
+         WHERE symbol = ?1
+    `, symbol).Scan(&t.Symbol, &t.Name, &t.Decimals, sqliteAmount{&t.TotalSupply}, sqliteTime{&t.CreatedAt})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUnknownToken(symbol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SQLiteWalletStore) ListTokens(ctx context.Context) ([]*generated.Token, error) {
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT symbol, name, decimals, total_supply, created_at
+          FROM tokens
+         ORDER BY symbol
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []*generated.Token{}
+	for rows.Next() {
+		t := &generated.Token{}
+		if err := rows.Scan(&t.Symbol, &t.Name, &t.Decimals, sqliteAmount{&t.TotalSupply}, sqliteTime{&t.CreatedAt}); err != nil {
+			return nil, err
+		}
+		result = append(result, t)
+	}
+	return result, rows.Err()
+}
+
+func (s *SQLiteWalletStore) CreateToken(ctx context.Context, symbol, name string, decimals int) (*generated.Token, error) {
+	if err := validateToken(symbol, name, decimals); err != nil {
+		return nil, err
+	}
+
+	var t *generated.Token
+	err := s.write(ctx, func(tx *sqliteTx) error {
+		res, err := tx.ExecContext(ctx, `
+            INSERT INTO tokens(symbol, name, decimals, total_supply, created_at)
+            VALUES (?1, ?2, ?3, '0', ?4)
+            ON CONFLICT (symbol) DO NOTHING
+        `, symbol, name, decimals, time.Now().UTC().UnixNano())
+		if err != nil {
+			return fmt.Errorf("insert token: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errTokenExists(symbol)
+		}
+
+		t, err = getSQLiteToken(ctx, tx, symbol)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (s *SQLiteWalletStore) Mint(ctx context.Context, token, to string, amount *big.Int) (*big.Int, error) {
+	to, err := canonicalAddress(to)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Sign() <= 0 {
+		return nil, errNonPositiveAmount
+	}
+	token = tokenOrDefault(token)
+
+	var bal *big.Int
+	err = s.write(ctx, func(tx *sqliteTx) error {
+		if err := tx.addSupply(ctx, token, amount); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO wallets(address, created_at, updated_at)
+                 VALUES (?1, ?2, ?2)
+             ON CONFLICT (address)
+               DO UPDATE SET updated_at = excluded.updated_at`,
+			to, now.UnixNano(),
+		); err != nil {
+			return err
+		}
+
+		var err error
+		if bal, err = tx.balance(ctx, to, token); err != nil {
+			return err
+		}
+		bal.Add(bal, amount)
+		if err := tx.setBalance(ctx, to, token, bal, now); err != nil {
+			return err
+		}
+
+		if err := tx.insertJournalEntry(ctx, EntryMint, issuancePostings(to, token, amount), now); err != nil {
+			return err
+		}
+
+		tx.notify(balanceChanged(to, token, bal))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bal, nil
+}
+
+func (s *SQLiteWalletStore) Burn(ctx context.Context, token, from string, amount *big.Int) (*big.Int, error) {
+	from, err := canonicalAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Sign() <= 0 {
+		return nil, errNonPositiveAmount
+	}
+	token = tokenOrDefault(token)
+
+	var bal *big.Int
+	err = s.write(ctx, func(tx *sqliteTx) error {
+		if _, err := getSQLiteToken(ctx, tx, token); err != nil {
+			return err
+		}
+
+		held, ok, err := tx.heldBalance(ctx, from, token)
+		if err != nil {
+			return err
+		}
+		if !ok || held.Cmp(amount) < 0 {
+			return ErrInsufficientFunds
+		}
+
+		now := time.Now().UTC()
+
+		bal = held.Sub(held, amount)
+		if err := tx.setBalance(ctx, from, token, bal, now); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE wallets SET updated_at = ?2 WHERE address = ?1`, from, now.UnixNano(),
+		); err != nil {
+			return err
+		}
+
+		if err := tx.addSupply(ctx, token, new(big.Int).Neg(amount)); err != nil {
+			return err
+		}
+
+		if err := tx.insertJournalEntry(ctx, EntryBurn, issuancePostings(from, token, new(big.Int).Neg(amount)), now); err != nil {
+			return err
+		}
+
+		tx.notify(balanceChanged(from, token, bal))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bal, nil
+}
+
+func (s *SQLiteWalletStore) Approve(ctx context.Context, token, owner, spender string, amount *big.Int, opts ApproveOptions) (*big.Int, error) {
+	if err := canonicalAddresses(&owner, &spender); err != nil {
+		return nil, err
+	}
+	if amount.Sign() < 0 {
+		return nil, errNegativeAllowance
+	}
+	token = tokenOrDefault(token)
+
+	err := s.write(ctx, func(tx *sqliteTx) error {
+		if _, err := getSQLiteToken(ctx, tx, token); err != nil {
+			return err
+		}
+
+		key, err := getSQLiteWalletKey(ctx, tx, owner)
+		if errors.Is(err, ErrWalletNotFound) {
+			return fmt.Errorf("owner %w", ErrWalletNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkApproveKey(key.PublicKey, key.Nonce, opts); err != nil {
+			return err
+		}
+		if opts.Nonce != nil {
+			if _, err := tx.ExecContext(ctx, `UPDATE wallets SET nonce = nonce + 1 WHERE address = ?1`, owner); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO allowances(owner, spender, token, amount, updated_at)
+                 VALUES (?1, ?2, ?3, ?4, ?5)
+             ON CONFLICT (owner, spender, token)
+               DO UPDATE SET amount = excluded.amount,
+                             updated_at = excluded.updated_at`,
+			owner, spender, token, amount.String(), time.Now().UTC().UnixNano(),
+		); err != nil {
+			return fmt.Errorf("save allowance: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Set(amount), nil
+}
+
+func (s *SQLiteWalletStore) Allowance(ctx context.Context, token, owner, spender string) (*big.Int, error) {
+	if err := canonicalAddresses(&owner, &spender); err != nil {
+		return nil, err
+	}
+	token = tokenOrDefault(token)
+
+	if _, err := getSQLiteToken(ctx, s.db, token); err != nil {
+		return nil, err
+	}
+	return sqliteAllowance(ctx, s.db, owner, spender, token)
+}
+
+// sqliteAllowance reads what spender may still transfer out of owner's
+// wallet, zero if nothing was ever approved.
+func sqliteAllowance(ctx context.Context, q sqliteQuerier, owner, spender, token string) (*big.Int, error) {
+	var amount *big.Int
+	err := q.QueryRowContext(ctx,
+		`SELECT amount FROM allowances WHERE owner = ?1 AND spender = ?2 AND token = ?3`,
+		owner, spender, token,
+	).Scan(sqliteAmount{&amount})
+	if errors.Is(err, sql.ErrNoRows) {
+		return new(big.Int), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return amount, nil
+}
+
+// Subscribe streams the events of this process only: SQLite has no way to
+// hear about writes made by other processes sharing the database file.
+func (s *SQLiteWalletStore) Subscribe(ctx context.Context) (<-chan Event, error) {
+	return s.events.subscribe(ctx), nil
+}
+
+func (s *SQLiteWalletStore) CheckJournal(ctx context.Context) ([]UnbalancedEntry, error) {
+	// SQLite cannot add up amounts of arbitrary size, so entries are summed
+	// here, one at a time.
+	rows, err := s.db.QueryContext(ctx, `
+        SELECT e.id, e.kind, e.created_at, p.address, p.token, p.amount
+          FROM journal_entries e
+          JOIN postings p ON p.entry_id = e.id
+         ORDER BY e.id
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []UnbalancedEntry{}
+	var entry UnbalancedEntry
+	var postings []posting
+
+	flush := func() {
+		sums := unbalancedTokens(postings)
+		tokens := make([]string, 0, len(sums))
+		for token := range sums {
+			tokens = append(tokens, token)
+		}
+		sort.Strings(tokens)
+		for _, token := range tokens {
+			u := entry
+			u.Token, u.Sum = token, sums[token]
+			out = append(out, u)
+		}
+		postings = postings[:0]
+	}
+
+	for rows.Next() {
+		var id int64
+		var kind string
+		var createdAt time.Time
+		var p posting
+		if err := rows.Scan(&id, &kind, sqliteTime{&createdAt}, &p.address, &p.token, sqliteAmount{&p.amount}); err != nil {
+			return nil, err
+		}
+		if entryID := strconv.FormatInt(id, 10); entryID != entry.EntryID {
+			flush()
+			entry = UnbalancedEntry{EntryID: entryID, Kind: JournalEntryKind(kind), CreatedAt: createdAt}
+		}
+		postings = append(postings, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	flush()
+	return out, nil
+}
+
+func (s *SQLiteWalletStore) RebuildBalances(ctx context.Context) error {
+	return s.write(ctx, func(tx *sqliteTx) error {
+		rows, err := tx.QueryContext(ctx, `SELECT address, token, amount FROM postings`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		type account struct{ address, token string }
+		sums := make(map[account]*big.Int)
+		for rows.Next() {
+			var a account
+			var amount *big.Int
+			if err := rows.Scan(&a.address, &a.token, sqliteAmount{&amount}); err != nil {
+				return err
+			}
+			if sums[a] == nil {
+				sums[a] = new(big.Int)
+			}
+			sums[a].Add(sums[a], amount)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Balances nothing was ever posted to are rebuilt as zero.
+		held, err := tx.QueryContext(ctx, `SELECT address, token FROM balances`)
+		if err != nil {
+			return err
+		}
+		defer held.Close()
+		for held.Next() {
+			var a account
+			if err := held.Scan(&a.address, &a.token); err != nil {
+				return err
+			}
+			if sums[a] == nil {
+				sums[a] = new(big.Int)
+			}
+		}
+		if err := held.Err(); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `UPDATE tokens SET total_supply = '0'`); err != nil {
+			return fmt.Errorf("rebuild total supply: %w", err)
+		}
+
+		now := time.Now().UTC()
+		for a, sum := range sums {
+			if a.address == IssuanceAccount {
+				if _, err := tx.ExecContext(ctx,
+					`UPDATE tokens SET total_supply = ?2 WHERE symbol = ?1`, a.token, new(big.Int).Neg(sum).String(),
+				); err != nil {
+					return fmt.Errorf("rebuild total supply: %w", err)
+				}
+				continue
+			}
+			// Only balances that change are written, so the history shows
+			// when they were corrected.
+			bal, ok, err := tx.heldBalance(ctx, a.address, a.token)
+			if err != nil {
+				return err
+			}
+			if ok && bal.Cmp(sum) == 0 {
+				continue
+			}
+			if err := tx.setBalance(ctx, a.address, a.token, sum, now); err != nil {
+				return fmt.Errorf("rebuild balances: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteWalletStore) LedgerState(ctx context.Context) (*LedgerState, error) {
+	// A read transaction sees a single snapshot of the database, so
+	// transfers committed in between cannot show up as discrepancies.
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	state := &LedgerState{Supplies: make(map[string]*big.Int)}
+
+	if state.Balances, err = querySQLiteAccountBalances(ctx, tx,
+		`SELECT address, token, balance FROM balances`); err != nil {
+		return nil, fmt.Errorf("read balances: %w", err)
+	}
+
+	// SQLite cannot add up amounts of arbitrary size, so postings are
+	// summed here.
+	postings, err := querySQLiteAccountBalances(ctx, tx, `SELECT address, token, amount FROM postings`)
+	if err != nil {
+		return nil, fmt.Errorf("read postings: %w", err)
+	}
+	type account struct{ address, token string }
+	sums := make(map[account]*big.Int)
+	for _, p := range postings {
+		a := account{p.Address, p.Token}
+		if sums[a] == nil {
+			sums[a] = new(big.Int)
+		}
+		sums[a].Add(sums[a], p.Balance)
+	}
+	for a, sum := range sums {
+		state.Journal = append(state.Journal, AccountBalance{Address: a.address, Token: a.token, Balance: sum})
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT symbol, total_supply FROM tokens`)
+	if err != nil {
+		return nil, fmt.Errorf("read tokens: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var symbol string
+		var supply *big.Int
+		if err := rows.Scan(&symbol, sqliteAmount{&supply}); err != nil {
+			return nil, err
+		}
+		state.Supplies[symbol] = supply
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// querySQLiteAccountBalances runs a query selecting an address, a token and
+// an amount.
+func querySQLiteAccountBalances(ctx context.Context, q sqliteQuerier, query string) ([]AccountBalance, error) {
+	rows, err := q.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []AccountBalance
+	for rows.Next() {
+		var b AccountBalance
+		if err := rows.Scan(&b.Address, &b.Token, sqliteAmount{&b.Balance}); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteWalletStore) ApplyGenesis(ctx context.Context, g *Genesis) (*GenesisRecord, bool, error) {
+	rec := &GenesisRecord{}
+	applied := false
+	err := s.write(ctx, func(tx *sqliteTx) error {
+		now := time.Now().UTC()
+
+		res, err := tx.ExecContext(ctx, `
+            INSERT INTO genesis(id, checksum, applied_at)
+            VALUES (1, ?1, ?2)
+            ON CONFLICT (id) DO NOTHING
+        `, g.Checksum, now.UnixNano())
+		if err != nil {
+			return fmt.Errorf("record genesis: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			if err := tx.QueryRowContext(ctx,
+				`SELECT checksum, applied_at FROM genesis`,
+			).Scan(&rec.Checksum, sqliteTime{&rec.AppliedAt}); err != nil {
+				return fmt.Errorf("fetch genesis: %w", err)
+			}
+			return nil
+		}
+
+		for _, t := range g.Tokens {
+			res, err := tx.ExecContext(ctx, `
+                INSERT INTO tokens(symbol, name, decimals, total_supply, created_at)
+                VALUES (?1, ?2, ?3, '0', ?4)
+                ON CONFLICT (symbol) DO NOTHING
+            `, t.Symbol, t.Name, t.Decimals, now.UnixNano())
+			if err != nil {
+				return fmt.Errorf("insert token: %w", err)
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				existing, err := getSQLiteToken(ctx, tx, t.Symbol)
+				if err != nil {
+					return err
+				}
+				if err := checkGenesisToken(t, existing); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, w := range g.Wallets {
+			res, err := tx.ExecContext(ctx, `
+                INSERT INTO wallets(address, created_at, updated_at)
+                VALUES (?1, ?2, ?2)
+                ON CONFLICT (address) DO NOTHING
+            `, w.Address, now.UnixNano())
+			if err != nil {
+				return fmt.Errorf("insert wallet: %w", err)
+			}
+			if n, err := res.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				continue
+			}
+
+			for _, b := range w.Balances {
+				if err := tx.addSupply(ctx, b.Token, b.Amount); err != nil {
+					return err
+				}
+				if err := tx.setBalance(ctx, w.Address, b.Token, b.Amount, now); err != nil {
+					return fmt.Errorf("seed wallet: %w", err)
+				}
+				tx.notify(balanceChanged(w.Address, b.Token, b.Amount))
+			}
+			if len(w.Balances) > 0 {
+				if err := tx.insertJournalEntry(ctx, EntrySeed, w.postings(), now); err != nil {
+					return err
+				}
+			}
+		}
+
+		rec.Checksum, rec.AppliedAt, applied = g.Checksum, now, true
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return rec, applied, nil
+}
+
+func (s *SQLiteWalletStore) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	if err := validateAPIKey(k); err != nil {
+		return err
+	}
+	roles, err := json.Marshal(nonNilStrings(k.Roles))
+	if err != nil {
+		return err
+	}
+	wallets, err := json.Marshal(nonNilStrings(k.Wallets))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	err = s.write(ctx, func(tx *sqliteTx) error {
+		res, err := tx.ExecContext(ctx, `
+            INSERT INTO api_keys(id, hash, subject, roles, wallets, created_at)
+            VALUES (?1, ?2, ?3, ?4, ?5, ?6)
+            ON CONFLICT (id) DO NOTHING
+        `, k.ID, k.Hash, k.Subject, string(roles), string(wallets), now.UnixNano())
+		if err != nil {
+			return fmt.Errorf("insert api key: %w", err)
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return errAPIKeyExists(k.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	k.CreatedAt, k.RevokedAt = now, nil
+	return nil
+}
+
+const sqliteAPIKeyColumns = `id, hash, subject, roles, wallets, created_at, revoked_at`
+
+func scanSQLiteAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	k := &APIKey{}
+	var roles, wallets string
+	var revokedAt sql.NullInt64
+	if err := row.Scan(&k.ID, &k.Hash, &k.Subject, &roles, &wallets, sqliteTime{&k.CreatedAt}, &revokedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(roles), &k.Roles); err != nil {
+		return nil, fmt.Errorf("decode roles of api key %q: %w", k.ID, err)
+	}
+	if err := json.Unmarshal([]byte(wallets), &k.Wallets); err != nil {
+		return nil, fmt.Errorf("decode wallets of api key %q: %w", k.ID, err)
+	}
+	if revokedAt.Valid {
+		at := time.Unix(0, revokedAt.Int64).UTC()
+		k.RevokedAt = &at
+	}
+	return k, nil
+}
+
+func (s *SQLiteWalletStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	k, err := scanSQLiteAPIKey(s.db.QueryRowContext(ctx,
+		`SELECT `+sqliteAPIKeyColumns+` FROM api_keys WHERE id = ?1`, id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errUnknownAPIKey(id)
+	}
+	return k, err
+}
+
+func (s *SQLiteWalletStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT `+sqliteAPIKeyColumns+` FROM api_keys ORDER BY created_at, id`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		k, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *SQLiteWalletStore) RevokeAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	var k *APIKey
+	err := s.write(ctx, func(tx *sqliteTx) error {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE api_keys SET revoked_at = COALESCE(revoked_at, ?2) WHERE id = ?1`,
+			id, time.Now().UTC().UnixNano(),
+		); err != nil {
+			return fmt.Errorf("revoke api key: %w", err)
+		}
+
+		var err error
+		k, err = scanSQLiteAPIKey(tx.QueryRowContext(ctx,
+			`SELECT `+sqliteAPIKeyColumns+` FROM api_keys WHERE id = ?1`, id,
+		))
+		if errors.Is(err, sql.ErrNoRows) {
+			return errUnknownAPIKey(id)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *SQLiteWalletStore) RegisterWalletKey(ctx context.Context, address string, key ed25519.PublicKey) (*WalletKey, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateWalletKey(key); err != nil {
+		return nil, err
+	}
+
+	var k *WalletKey
+	err = s.write(ctx, func(tx *sqliteTx) error {
+		var err error
+		if k, err = getSQLiteWalletKey(ctx, tx, address); err != nil {
+			return err
+		}
+		if k.PublicKey != nil && !k.PublicKey.Equal(key) {
+			return errWalletKeyExists(address)
+		}
+		if k.PublicKey == nil {
+			if _, err := tx.ExecContext(ctx,
+				`UPDATE wallets SET public_key = ?2 WHERE address = ?1`, address, []byte(key),
+			); err != nil {
+				return err
+			}
+			k.PublicKey = key
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (s *SQLiteWalletStore) GetWalletKey(ctx context.Context, address string) (*WalletKey, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	return getSQLiteWalletKey(ctx, s.db, address)
+}
+
+func (s *SQLiteWalletStore) SetAcceptsTransfers(ctx context.Context, address string, accepts bool) error {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return err
+	}
+	return s.write(ctx, func(tx *sqliteTx) error {
+		res, err := tx.ExecContext(ctx,
+			`UPDATE wallets SET accepts_transfers = ?2 WHERE address = ?1`, address, accepts,
+		)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrWalletNotFound
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteWalletStore) AcceptsTransfers(ctx context.Context, address string) (bool, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return false, err
+	}
+	r, err := getSQLiteRecipient(ctx, s.db, address)
+	if err != nil {
+		return false, err
+	}
+	if !r.exists {
+		return false, ErrWalletNotFound
+	}
+	return r.accepts, nil
+}
+
+// getSQLiteRecipient reads whether the wallet at address exists and accepts
+// transfers.
+func getSQLiteRecipient(ctx context.Context, q sqliteQuerier, address string) (recipientState, error) {
+	var accepts bool
+	err := q.QueryRowContext(ctx,
+		`SELECT accepts_transfers FROM wallets WHERE address = ?1`, address,
+	).Scan(&accepts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return recipientState{}, nil
+	}
+	if err != nil {
+		return recipientState{}, err
+	}
+	return recipientState{exists: true, accepts: accepts}, nil
+}
+
+// getSQLiteWalletKey reads the key and next nonce of the wallet at address.
+func getSQLiteWalletKey(ctx context.Context, q sqliteQuerier, address string) (*WalletKey, error) {
+	k := &WalletKey{Address: address}
+	var key []byte
+	var nonce int64
+	err := q.QueryRowContext(ctx,
+		`SELECT public_key, nonce FROM wallets WHERE address = ?1`, address,
+	).Scan(&key, &nonce)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrWalletNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		k.PublicKey = ed25519.PublicKey(key)
+	}
+	k.Nonce = uint64(nonce)
+	return k, nil
+}
@@ -0,0 +1,422 @@
+package storetest_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+	"github.com/zanpatryk/tokentransferapi/store"
+	"github.com/zanpatryk/tokentransferapi/store/storetest"
+)
+
+func TestInMemConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, opts ...store.Option) store.WalletStore {
+		return store.NewInMemWalletStore(opts...)
+	})
+}
+
+func TestDurableInMemConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, opts ...store.Option) store.WalletStore {
+		return openDurable(t, t.TempDir(), 5, opts...)
+	})
+}
+
+func openDurable(t *testing.T, dir string, snapshotEvery int, opts ...store.Option) *store.InMemWalletStore {
+	t.Helper()
+	s, err := store.OpenDurableInMemWalletStore(store.DurabilityConfig{
+		Dir:           dir,
+		Fsync:         store.FsyncNever,
+		SnapshotEvery: snapshotEvery,
+	}, opts...)
+	if err != nil {
+		t.Fatalf("OpenDurableInMemWalletStore error: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// dump returns everything a store holds in a form that can be compared.
+func dump(t *testing.T, s store.WalletStore) string {
+	t.Helper()
+	ctx := context.Background()
+
+	wallets, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatalf("ListAll error: %v", err)
+	}
+	sort.Slice(wallets, func(i, j int) bool { return wallets[i].Address < wallets[j].Address })
+
+	transfers, err := s.ListTransfers(ctx, "", 1000, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+	tokens, err := s.ListTokens(ctx)
+	if err != nil {
+		t.Fatalf("ListTokens error: %v", err)
+	}
+
+	keys, err := s.ListAPIKeys(ctx)
+	if err != nil {
+		t.Fatalf("ListAPIKeys error: %v", err)
+	}
+
+	out, err := json.Marshal(map[string]any{"wallets": wallets, "transfers": transfers, "tokens": tokens, "apiKeys": keys})
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+	return string(out)
+}
+
+func TestDurableInMemRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	alice, bob, carol := "0x0000000000000000000000000000000000000001", "0x0000000000000000000000000000000000000002", "0x0000000000000000000000000000000000000003"
+
+	s := openDurable(t, dir, 4)
+
+	if _, err := s.CreateIfNotExists(ctx, alice, big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	genesis := &store.Genesis{
+		Tokens:   []store.GenesisToken{{Symbol: "EURX", Name: "EUR Example", Decimals: 2}},
+		Wallets:  []store.GenesisWallet{{Address: "0x0000000000000000000000000000000000000005", Balances: []store.GenesisBalance{{Token: "EURX", Amount: big.NewInt(40)}}}},
+		Checksum: "sha256:test",
+	}
+	if _, _, err := s.ApplyGenesis(ctx, genesis); err != nil {
+		t.Fatalf("ApplyGenesis error: %v", err)
+	}
+	if _, err := s.ImportWallets(ctx, []store.WalletRow{
+		{Address: "0x0000000000000000000000000000000000000006", Token: "EURX", Balance: big.NewInt(15)},
+		{Address: "0x0000000000000000000000000000000000000007", Token: store.DefaultToken, Balance: new(big.Int)},
+	}, false); err != nil {
+		t.Fatalf("ImportWallets error: %v", err)
+	}
+	if _, err := s.ImportTransfers(ctx, []*generated.Transfer{{
+		FromAddress: "0x0000000000000000000000000000000000000006", ToAddress: "0x0000000000000000000000000000000000000007", Token: "EURX", Amount: big.NewInt(3),
+		Status: generated.TransferStatusSucceeded, CreatedAt: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}}, false); err != nil {
+		t.Fatalf("ImportTransfers error: %v", err)
+	}
+	if err := s.CreateAPIKey(ctx, &store.APIKey{ID: "k1", Hash: strings.Repeat("0", 64), Subject: "alice", Wallets: []string{alice}}); err != nil {
+		t.Fatalf("CreateAPIKey error: %v", err)
+	}
+	if err := s.CreateAPIKey(ctx, &store.APIKey{ID: "k2", Hash: strings.Repeat("1", 64), Subject: "bob"}); err != nil {
+		t.Fatalf("CreateAPIKey error: %v", err)
+	}
+	if _, err := s.RevokeAPIKey(ctx, "k2"); err != nil {
+		t.Fatalf("RevokeAPIKey error: %v", err)
+	}
+	if _, err := s.CreateToken(ctx, "USDX", "USD Example", 6); err != nil {
+		t.Fatalf("CreateToken error: %v", err)
+	}
+	if _, err := s.Mint(ctx, "USDX", bob, big.NewInt(500)); err != nil {
+		t.Fatalf("Mint error: %v", err)
+	}
+	if _, err := s.Burn(ctx, "USDX", bob, big.NewInt(20)); err != nil {
+		t.Fatalf("Burn error: %v", err)
+	}
+	bobKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	if _, err := s.RegisterWalletKey(ctx, bob, bobKey); err != nil {
+		t.Fatalf("RegisterWalletKey error: %v", err)
+	}
+	nonce := uint64(0)
+	signed := store.TransferOptions{Token: "USDX", SignedWith: bobKey, Nonce: &nonce}
+	if _, err := s.Transfer(ctx, bob, []store.TransferOp{{To: carol, Amount: big.NewInt(7)}}, signed); err != nil {
+		t.Fatalf("Signed transfer error: %v", err)
+	}
+	if _, err := s.Approve(ctx, "", alice, carol, big.NewInt(30), store.ApproveOptions{}); err != nil {
+		t.Fatalf("Approve error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, alice, []store.TransferOp{{To: bob, Amount: big.NewInt(10)}},
+		store.TransferOptions{Spender: carol}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	ops := []store.TransferOp{{To: carol, Amount: big.NewInt(25)}}
+	keyed := store.TransferOptions{IdempotencyKey: "k1"}
+	if _, err := s.Transfer(ctx, alice, ops, keyed); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, alice, []store.TransferOp{{To: carol, Amount: big.NewInt(1000)}},
+		store.TransferOptions{}); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	before := dump(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if _, err := s.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000004", big.NewInt(1)); err == nil {
+		t.Errorf("Expected writes to a closed store to fail")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "snapshot.json")); err != nil {
+		t.Errorf("Expected a snapshot to have been written: %v", err)
+	}
+
+	reopened := openDurable(t, dir, 4)
+	if after := dump(t, reopened); after != before {
+		t.Errorf("State changed across restart\nbefore: %s\nafter:  %s", before, after)
+	}
+
+	// The journal is restored with the balances it adds up to.
+	if unbalanced, err := reopened.CheckJournal(ctx); err != nil || len(unbalanced) != 0 {
+		t.Errorf("Expected a balanced journal after restart, got: %+v, %v", unbalanced, err)
+	}
+	if err := reopened.RebuildBalances(ctx); err != nil {
+		t.Fatalf("RebuildBalances error: %v", err)
+	}
+	if after := dump(t, reopened); after != before {
+		t.Errorf("Balances rebuilt after restart differ\nbefore: %s\nafter:  %s", before, after)
+	}
+
+	allowance, err := reopened.Allowance(ctx, "", alice, carol)
+	if err != nil || allowance.String() != "20" {
+		t.Errorf("Expected allowance 20 after restart, got: %v, %v", allowance, err)
+	}
+
+	// So does the record of the genesis.
+	if rec, applied, err := reopened.ApplyGenesis(ctx, &store.Genesis{Checksum: "sha256:other"}); err != nil || applied || rec.Checksum != genesis.Checksum {
+		t.Errorf("Expected the genesis to stay applied after restart, got: %+v, %v, %v", rec, applied, err)
+	}
+
+	// The key and nonce of a wallet survive the restart, so a signed
+	// transfer cannot be replayed after it.
+	if k, err := reopened.GetWalletKey(ctx, bob); err != nil || !k.PublicKey.Equal(bobKey) || k.Nonce != 1 {
+		t.Errorf("Expected bob's key with nonce 1 after restart, got: %+v, %v", k, err)
+	}
+	if _, err := reopened.Transfer(ctx, bob, []store.TransferOp{{To: carol, Amount: big.NewInt(7)}}, signed); !errors.Is(err, store.ErrInvalidNonce) {
+		t.Errorf("Expected ErrInvalidNonce for a replayed transfer, got: %v", err)
+	}
+
+	// Idempotency keys survive the restart too.
+	bal, err := reopened.Transfer(ctx, alice, ops, keyed)
+	if err != nil || bal.String() != "65" {
+		t.Errorf("Expected the keyed transfer to be replayed with balance 65, got: %v, %v", bal, err)
+	}
+	if _, err := reopened.Transfer(ctx, alice, []store.TransferOp{{To: carol, Amount: big.NewInt(1)}}, keyed); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("Expected ErrConflict for a reused key, got: %v", err)
+	}
+}
+
+// A transfer is logged before it is checked, so replaying a refused one after
+// restarting under another policy must still refuse it.
+func TestDurableInMemRecipientPolicyRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	alice, bob := "0x0000000000000000000000000000000000000001", "0x0000000000000000000000000000000000000002"
+
+	s := openDurable(t, dir, 100, store.WithRecipientPolicy(store.RecipientOptIn))
+	if _, err := s.CreateIfNotExists(ctx, alice, big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, alice, []store.TransferOp{{To: bob, Amount: big.NewInt(10)}},
+		store.TransferOptions{}); !errors.Is(err, store.ErrUnknownRecipient) {
+		t.Fatalf("Expected ErrUnknownRecipient, got: %v", err)
+	}
+	if _, err := s.CreateIfNotExists(ctx, bob, new(big.Int)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if err := s.SetAcceptsTransfers(ctx, bob, true); err != nil {
+		t.Fatalf("SetAcceptsTransfers error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, alice, []store.TransferOp{{To: bob, Amount: big.NewInt(10)}},
+		store.TransferOptions{}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	before := dump(t, s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	reopened := openDurable(t, dir, 100)
+	if after := dump(t, reopened); after != before {
+		t.Errorf("State changed across restart\nbefore: %s\nafter:  %s", before, after)
+	}
+	if accepts, err := reopened.AcceptsTransfers(ctx, bob); err != nil || !accepts {
+		t.Errorf("Expected bob to accept transfers after restart, got: %v, %v", accepts, err)
+	}
+}
+
+func TestDurableInMemTornWrite(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	s := openDurable(t, dir, 100)
+	if _, err := s.CreateIfNotExists(ctx, "0x0000000000000000000000000000000000000001", big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	before := dump(t, s)
+	s.Close()
+
+	// A crash in the middle of an append leaves half a record behind.
+	f, err := os.OpenFile(filepath.Join(dir, "wal.log"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	f.WriteString(`0badc0de {"seq":2,"op":"transfer","addr`)
+	f.Close()
+
+	reopened := openDurable(t, dir, 100)
+	if after := dump(t, reopened); after != before {
+		t.Errorf("Torn record changed the state\nbefore: %s\nafter:  %s", before, after)
+	}
+	if _, err := reopened.Transfer(ctx, "0x0000000000000000000000000000000000000001", []store.TransferOp{{To: "0x0000000000000000000000000000000000000002", Amount: big.NewInt(5)}}, store.TransferOptions{}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	want := dump(t, reopened)
+	reopened.Close()
+
+	if got := dump(t, openDurable(t, dir, 100)); got != want {
+		t.Errorf("Writes after a torn record were lost\nwant: %s\ngot:  %s", want, got)
+	}
+}
+
+func TestDurableInMemLock(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openDurable(t, dir, 100)
+	if _, err := store.OpenDurableInMemWalletStore(store.DurabilityConfig{Dir: dir}); !errors.Is(err, store.ErrDataDirLocked) {
+		t.Errorf("Opening a directory in use: Expected ErrDataDirLocked, got: %v", err)
+	}
+
+	// Closing the store releases the directory.
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	openDurable(t, dir, 100)
+}
+
+// An idempotency key is kept for the window in force when it was used, even
+// after restarting with another window, from the log and from a snapshot.
+func TestDurableInMemIdempotencyWindowRecovery(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := "0x0000000000000000000000000000000000000001", "0x0000000000000000000000000000000000000002"
+	ops := []store.TransferOp{{To: bob, Amount: big.NewInt(10)}}
+	long := store.TransferOptions{IdempotencyKey: "long"}
+	short := store.TransferOptions{IdempotencyKey: "short"}
+
+	for _, snapshotEvery := range []int{100, 1} {
+		dir := t.TempDir()
+
+		s := openDurable(t, dir, snapshotEvery, store.WithIdempotencyWindow(time.Hour))
+		if _, err := s.CreateIfNotExists(ctx, alice, big.NewInt(100)); err != nil {
+			t.Fatalf("CreateIfNotExists error: %v", err)
+		}
+		if _, err := s.Transfer(ctx, alice, ops, long); err != nil {
+			t.Fatalf("Transfer error: %v", err)
+		}
+		s.Close()
+
+		s = openDurable(t, dir, snapshotEvery, store.WithIdempotencyWindow(time.Nanosecond))
+		if _, err := s.Transfer(ctx, alice, ops, short); err != nil {
+			t.Fatalf("Transfer error: %v", err)
+		}
+		s.Close()
+
+		reopened := openDurable(t, dir, snapshotEvery, store.WithIdempotencyWindow(time.Hour))
+		if bal, err := reopened.Transfer(ctx, alice, ops, long); err != nil || bal.String() != "90" {
+			t.Errorf("snapshotEvery %d: Expected the key used under the longer window to be replayed with balance 90, got: %v, %v", snapshotEvery, bal, err)
+		}
+		if bal, err := reopened.Transfer(ctx, alice, ops, short); err != nil || bal.String() != "70" {
+			t.Errorf("snapshotEvery %d: Expected the key used under the shorter window to have expired, got: %v, %v", snapshotEvery, bal, err)
+		}
+	}
+}
+
+// Wallets logged before addresses were checked are moved to their lowercase
+// address when the store is opened, unless that would merge two wallets or
+// the address is not one.
+func TestDurableInMemCanonicalizesAddresses(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	mixed, lower := "0xAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAa", "0xaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	dupUpper, dupLower := "0xDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDDD", "0xdddddddddddddddddddddddddddddddddddddddd"
+	bob, carol := "0x0000000000000000000000000000000000000002", "0x0000000000000000000000000000000000000003"
+
+	at, err := time.Now().UTC().MarshalJSON()
+	if err != nil {
+		t.Fatalf("MarshalJSON error: %v", err)
+	}
+	var wal []byte
+	for i, rec := range []string{
+		`"op":"createWallet","address":"` + mixed + `","amount":100`,
+		`"op":"createWallet","address":"` + dupUpper + `","amount":5`,
+		`"op":"createWallet","address":"` + dupLower + `","amount":7`,
+		`"op":"createWallet","address":"alice","amount":3`,
+		`"op":"transfer","address":"` + mixed + `","legs":[{"To":"` + bob + `","Amount":10}],"options":{"IdempotencyKey":"k1"}`,
+		`"op":"approve","address":"` + mixed + `","spender":"` + carol + `","token":"` + store.DefaultToken + `","amount":20`,
+	} {
+		data := fmt.Sprintf(`{"seq":%d,"at":%s,%s}`, i+1, at, rec)
+		wal = fmt.Appendf(wal, "%08x %s\n", crc32.ChecksumIEEE([]byte(data)), data)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "wal.log"), wal, 0o644); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+
+	s := openDurable(t, dir, 100)
+
+	// The move is saved as a snapshot right away, so the old writes are not
+	// replayed again.
+	if info, err := os.Stat(filepath.Join(dir, "wal.log")); err != nil || info.Size() != 0 {
+		t.Errorf("Expected the write-ahead log to have been emptied, got: %v, %v", info, err)
+	}
+
+	if w, err := s.GetByAddress(ctx, lower); err != nil || w.Balance.String() != "90" {
+		t.Errorf("Expected the wallet moved to its lowercase address with balance 90, got: %+v, %v", w, err)
+	}
+	if allowance, err := s.Allowance(ctx, "", lower, carol); err != nil || allowance.String() != "20" {
+		t.Errorf("Expected the allowance to move with its owner, got: %v, %v", allowance, err)
+	}
+	if bal, err := s.Transfer(ctx, lower, []store.TransferOp{{To: bob, Amount: big.NewInt(10)}},
+		store.TransferOptions{IdempotencyKey: "k1"}); err != nil || bal.String() != "90" {
+		t.Errorf("Expected the idempotency key to move with its sender, got: %v, %v", bal, err)
+	}
+	transfers, err := s.ListTransfers(ctx, lower, 10, "")
+	if err != nil || len(transfers) != 1 || transfers[0].FromAddress != lower {
+		t.Errorf("Expected the transfer to be listed under the lowercase address, got: %+v, %v", transfers, err)
+	}
+	if unbalanced, err := s.CheckJournal(ctx); err != nil || len(unbalanced) != 0 {
+		t.Errorf("Expected a balanced journal, got: %+v, %v", unbalanced, err)
+	}
+
+	problems := s.AddressProblems()
+	want := []struct{ address, problem string }{
+		{dupUpper, store.AddressCaseDuplicate},
+		{dupLower, store.AddressCaseDuplicate},
+		{"alice", store.AddressMalformed},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("Expected %d address problems, got: %+v", len(want), problems)
+	}
+	for i, p := range problems {
+		if p.Address != want[i].address || p.Problem != want[i].problem {
+			t.Errorf("Problem %d: Expected %s %s, got: %+v", i, want[i].problem, want[i].address, p)
+		}
+	}
+
+	// The problems keep when they were found.
+	before := dump(t, s)
+	s.Close()
+	reopened := openDurable(t, dir, 100)
+	if after := dump(t, reopened); after != before {
+		t.Errorf("State changed across restart\nbefore: %s\nafter:  %s", before, after)
+	}
+	if again := reopened.AddressProblems(); len(again) != len(problems) || !again[0].DetectedAt.Equal(problems[0].DetectedAt) {
+		t.Errorf("Expected the address problems to survive the restart, got: %+v", again)
+	}
+}
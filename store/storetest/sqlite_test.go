@@ -0,0 +1,139 @@
+package storetest_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/store"
+	"github.com/zanpatryk/tokentransferapi/store/storetest"
+)
+
+func TestSQLiteConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, opts ...store.Option) store.WalletStore {
+		s, closeStore, err := store.Open(context.Background(), store.Config{
+			Backend:        store.BackendSQLite,
+			DatabaseURL:    filepath.Join(t.TempDir(), "wallets.db"),
+			MigrationsPath: "../../db/sqlite_migrations",
+			Options:        opts,
+		})
+		if err != nil {
+			t.Fatalf("Could not open SQLite store: %v", err)
+		}
+		t.Cleanup(closeStore)
+		return s
+	})
+}
+
+// An idempotency key is kept for the window in force when it was used, even
+// after reopening the database with another window.
+func TestSQLiteIdempotencyWindowRecovery(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "wallets.db")
+	open := func(window time.Duration) (store.WalletStore, func()) {
+		s, closeStore, err := store.Open(ctx, store.Config{
+			Backend:        store.BackendSQLite,
+			DatabaseURL:    path,
+			MigrationsPath: "../../db/sqlite_migrations",
+			Options:        []store.Option{store.WithIdempotencyWindow(window)},
+		})
+		if err != nil {
+			t.Fatalf("Could not open SQLite store: %v", err)
+		}
+		return s, closeStore
+	}
+
+	alice, bob := "0x0000000000000000000000000000000000000001", "0x0000000000000000000000000000000000000002"
+	ops := []store.TransferOp{{To: bob, Amount: big.NewInt(10)}}
+	long := store.TransferOptions{IdempotencyKey: "long"}
+	short := store.TransferOptions{IdempotencyKey: "short"}
+
+	s, closeStore := open(time.Hour)
+	if _, err := s.CreateIfNotExists(ctx, alice, big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, alice, ops, long); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	closeStore()
+
+	s, closeStore = open(time.Nanosecond)
+	if _, err := s.Transfer(ctx, alice, ops, short); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	closeStore()
+
+	s, closeStore = open(time.Hour)
+	t.Cleanup(closeStore)
+	if bal, err := s.Transfer(ctx, alice, ops, long); err != nil || bal.String() != "90" {
+		t.Errorf("Expected the key used under the longer window to be replayed with balance 90, got: %v, %v", bal, err)
+	}
+	if bal, err := s.Transfer(ctx, alice, ops, short); err != nil || bal.String() != "70" {
+		t.Errorf("Expected the key used under the shorter window to have expired, got: %v, %v", bal, err)
+	}
+}
+
+func TestSQLiteReconcileFindsDrift(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "wallets.db")
+
+	s, closeStore, err := store.Open(ctx, store.Config{
+		Backend:        store.BackendSQLite,
+		DatabaseURL:    path,
+		MigrationsPath: "../../db/sqlite_migrations",
+	})
+	if err != nil {
+		t.Fatalf("Could not open SQLite store: %v", err)
+	}
+	t.Cleanup(closeStore)
+
+	alice, bob := "0x0000000000000000000000000000000000000001", "0x0000000000000000000000000000000000000002"
+	if _, err := s.CreateIfNotExists(ctx, alice, big.NewInt(100)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if _, err := s.CreateIfNotExists(ctx, bob, big.NewInt(10)); err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+
+	// Change balances behind the store's back.
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("Open error: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`UPDATE balances SET balance = '-5' WHERE address = ?1`, bob); err != nil {
+		t.Fatalf("Update error: %v", err)
+	}
+
+	report, err := store.Reconcile(ctx, s)
+	if err != nil {
+		t.Fatalf("Reconcile error: %v", err)
+	}
+	if report.OK {
+		t.Fatalf("Expected drift to be reported")
+	}
+
+	var got []string
+	for _, d := range report.Discrepancies {
+		got = append(got, fmt.Sprintf("%s %s %s expected=%v actual=%v", d.Kind, d.Address, d.Token, d.Expected, d.Actual))
+	}
+	want := []string{
+		"SUPPLY_MISMATCH  BTP expected=95 actual=110",
+		"LEDGER_MISMATCH " + bob + " BTP expected=10 actual=-5",
+		"NEGATIVE_BALANCE " + bob + " BTP expected=0 actual=-5",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Unexpected discrepancies\nwant: %v\ngot:  %v", want, got)
+	}
+
+	if err := s.RebuildBalances(ctx); err != nil {
+		t.Fatalf("RebuildBalances error: %v", err)
+	}
+	if report, err := store.Reconcile(ctx, s); err != nil || !report.OK {
+		t.Errorf("Expected the rebuilt store to reconcile, got: %+v, %v", report, err)
+	}
+}
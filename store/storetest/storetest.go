@@ -0,0 +1,1590 @@
+// Package storetest is the behavioral contract every store.WalletStore must
+// satisfy. A backend proves it by running the suite from one of its tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.WalletStore {
+//			return newEmptyStore(t)
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+	"github.com/zanpatryk/tokentransferapi/store"
+)
+
+// Factory returns an empty store made with opts for a single test: no
+// wallets, no transfers and only the default token registered. Tests run one
+// after another, so a factory may hand out the same database after resetting
+// it.
+type Factory func(t *testing.T, opts ...store.Option) store.WalletStore
+
+// Run runs every test of the contract against stores made by newStore.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.WalletStore)
+	}{
+		{"CreateIfNotExists", testCreateIfNotExists},
+		{"Transfer", testTransfer},
+		{"InsufficientFunds", testInsufficientFunds},
+		{"NegativeAmounts", testNegativeAmounts},
+		{"UnknownWallets", testUnknownWallets},
+		{"MultipleRecipientsAllOrNothing", testMultipleRecipients},
+		{"IdempotencyKey", testIdempotencyKey},
+		{"Tokens", testTokens},
+		{"Allowances", testAllowances},
+		{"ListTransfers", testListTransfers},
+		{"ListWallets", testListWallets},
+		{"AsOf", testAsOf},
+		{"ConcurrentTransfers", testConcurrentTransfers},
+		{"Subscribe", testSubscribe},
+		{"Journal", testJournal},
+		{"Reconcile", testReconcile},
+		{"Genesis", testGenesis},
+		{"Bulk", testBulk},
+		{"APIKeys", testAPIKeys},
+		{"WalletKeys", testWalletKeys},
+		{"Addresses", testAddresses},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+	t.Run("RecipientPolicy", func(t *testing.T) {
+		testRecipientPolicy(t, newStore)
+	})
+}
+
+// addr returns the i-th test wallet address.
+func addr(i int) string {
+	return fmt.Sprintf("0x%040x", i)
+}
+
+func create(t *testing.T, s store.WalletStore, address string, balance int64) {
+	t.Helper()
+	if _, err := s.CreateIfNotExists(context.Background(), address, big.NewInt(balance)); err != nil {
+		t.Fatalf("CreateIfNotExists(%s) error: %v", address, err)
+	}
+}
+
+func transfer(s store.WalletStore, from string, to string, amount int64) (*big.Int, error) {
+	return s.Transfer(context.Background(), from, []store.TransferOp{{
+		To: to, Amount: big.NewInt(amount),
+	}}, store.TransferOptions{})
+}
+
+// expectBalance fails the test unless address holds want of the default
+// token.
+func expectBalance(t *testing.T, s store.WalletStore, address string, want int64) {
+	t.Helper()
+	w, err := s.GetByAddress(context.Background(), address)
+	if err != nil {
+		t.Fatalf("GetByAddress(%s) error: %v", address, err)
+	}
+	if w.Balance.Cmp(big.NewInt(want)) != 0 {
+		t.Errorf("Expected %s to hold %d, got: %v", address, want, w.Balance)
+	}
+}
+
+// expectSupplyMatches fails the test unless the total supply of every token
+// equals the sum of its balances and no balance is negative.
+func expectSupplyMatches(t *testing.T, s store.WalletStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	wallets, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatalf("ListAll error: %v", err)
+	}
+
+	sums := map[string]*big.Int{}
+	for _, w := range wallets {
+		for _, b := range w.Balances {
+			if b.Balance.Sign() < 0 {
+				t.Errorf("Negative %s balance on %s: %v", b.Token.Symbol, w.Address, b.Balance)
+			}
+			if sums[b.Token.Symbol] == nil {
+				sums[b.Token.Symbol] = new(big.Int)
+			}
+			sums[b.Token.Symbol].Add(sums[b.Token.Symbol], b.Balance)
+		}
+	}
+
+	tokens, err := s.ListTokens(ctx)
+	if err != nil {
+		t.Fatalf("ListTokens error: %v", err)
+	}
+	for _, tok := range tokens {
+		sum := sums[tok.Symbol]
+		if sum == nil {
+			sum = new(big.Int)
+		}
+		if tok.TotalSupply.Cmp(sum) != 0 {
+			t.Errorf("Total supply of %s is %v, but balances sum to %v", tok.Symbol, tok.TotalSupply, sum)
+		}
+	}
+}
+
+func testCreateIfNotExists(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	w, err := s.CreateIfNotExists(ctx, addr(1), big.NewInt(100))
+	if err != nil {
+		t.Fatalf("CreateIfNotExists error: %v", err)
+	}
+	if w.Address != addr(1) || w.Balance.String() != "100" {
+		t.Errorf("Unexpected wallet: %+v", w)
+	}
+
+	again, err := s.CreateIfNotExists(ctx, addr(1), big.NewInt(999))
+	if err != nil {
+		t.Fatalf("CreateIfNotExists, second call, error: %v", err)
+	}
+	if again.Balance.String() != "100" {
+		t.Errorf("Second CreateIfNotExists must not change the balance, got: %v", again.Balance)
+	}
+
+	w, err = s.GetByAddress(ctx, addr(1))
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+	if len(w.Balances) != 1 || w.Balances[0].Token.Symbol != store.DefaultToken || w.Balances[0].Balance.String() != "100" {
+		t.Errorf("Expected a single %s balance of 100, got: %+v", store.DefaultToken, w.Balances)
+	}
+
+	all, err := s.ListAll(ctx)
+	if err != nil {
+		t.Fatalf("ListAll error: %v", err)
+	}
+	if len(all) != 1 || all[0].Address != addr(1) {
+		t.Errorf("ListAll: Expected only %s, got: %v", addr(1), all)
+	}
+
+	expectSupplyMatches(t, s)
+}
+
+func testTransfer(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	create(t, s, addr(1), 100)
+
+	newBalance, err := transfer(s, addr(1), addr(2), 30)
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	if newBalance.String() != "70" {
+		t.Errorf("Transfer: Expected sender balance 70, got: %v", newBalance)
+	}
+
+	expectBalance(t, s, addr(1), 70)
+	expectBalance(t, s, addr(2), 30)
+
+	transfers, err := s.ListTransfers(ctx, addr(2), 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+	if len(transfers) != 1 {
+		t.Fatalf("Expected one recorded transfer, got: %d", len(transfers))
+	}
+	tr := transfers[0]
+	if tr.FromAddress != addr(1) || tr.ToAddress != addr(2) || tr.Amount.String() != "30" ||
+		tr.Token != store.DefaultToken || tr.Status != generated.TransferStatusSucceeded || tr.Error != nil {
+		t.Errorf("Unexpected recorded transfer: %+v", tr)
+	}
+
+	expectSupplyMatches(t, s)
+}
+
+func testInsufficientFunds(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	create(t, s, addr(1), 10)
+	create(t, s, addr(2), 0)
+
+	_, err := transfer(s, addr(1), addr(2), 11)
+	if !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	expectBalance(t, s, addr(1), 10)
+	expectBalance(t, s, addr(2), 0)
+
+	transfers, err := s.ListTransfers(ctx, addr(1), 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+	if len(transfers) != 1 || transfers[0].Status != generated.TransferStatusRejected || transfers[0].Error == nil {
+		t.Errorf("Expected the transfer to be recorded as rejected, got: %+v", transfers)
+	}
+}
+
+func testNegativeAmounts(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+	create(t, s, addr(1), 10)
+	create(t, s, addr(2), 50)
+
+	// A transfer only ever debits its sender, so a negative amount must not
+	// pull funds back from the recipient.
+	for _, amount := range []int64{-20, 0} {
+		if _, err := transfer(s, addr(1), addr(2), amount); !errors.Is(err, store.ErrInvalidAmount) {
+			t.Errorf("Amount %d: Expected ErrInvalidAmount, got: %v", amount, err)
+		}
+	}
+	if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{
+		{To: addr(2), Amount: big.NewInt(5)},
+		{To: addr(2), Amount: big.NewInt(-20)},
+	}, store.TransferOptions{}); !errors.Is(err, store.ErrInvalidAmount) {
+		t.Errorf("Negative leg among positive ones: Expected ErrInvalidAmount, got: %v", err)
+	}
+	expectBalance(t, s, addr(1), 10)
+	expectBalance(t, s, addr(2), 50)
+
+	page, err := s.ListTransfers(ctx, addr(1), 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+	if len(page) != 0 {
+		t.Errorf("Expected invalid transfers not to be recorded, got: %+v", page)
+	}
+
+	expectSupplyMatches(t, s)
+}
+
+func testUnknownWallets(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	if _, err := s.GetByAddress(ctx, addr(9)); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("GetByAddress: Expected ErrWalletNotFound, got: %v", err)
+	}
+
+	if _, err := transfer(s, addr(9), addr(1), 1); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Transfer from unknown wallet: Expected ErrWalletNotFound, got: %v", err)
+	}
+
+	// A failed transfer must not create either wallet.
+	for _, a := range []string{addr(1), addr(9)} {
+		if _, err := s.GetByAddress(ctx, a); !errors.Is(err, store.ErrWalletNotFound) {
+			t.Errorf("GetByAddress(%s): Expected ErrWalletNotFound, got: %v", a, err)
+		}
+	}
+
+	create(t, s, addr(1), 10)
+
+	if _, err := s.Transfer(ctx, addr(1), nil, store.TransferOptions{}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Transfer without legs: Expected ErrInvalidArgument, got: %v", err)
+	}
+
+	if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{{
+		To: addr(2), Amount: big.NewInt(1),
+	}}, store.TransferOptions{Token: "NOPE"}); !errors.Is(err, store.ErrTokenNotFound) {
+		t.Errorf("Transfer of unknown token: Expected ErrTokenNotFound, got: %v", err)
+	}
+}
+
+func testMultipleRecipients(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	create(t, s, addr(1), 100)
+
+	_, err := s.Transfer(ctx, addr(1), []store.TransferOp{
+		{To: addr(2), Amount: big.NewInt(40)},
+		{To: addr(3), Amount: big.NewInt(50)},
+		{To: addr(4), Amount: big.NewInt(20)},
+	}, store.TransferOptions{})
+	if !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	expectBalance(t, s, addr(1), 100)
+	for _, a := range []string{addr(2), addr(3), addr(4)} {
+		if _, err := s.GetByAddress(ctx, a); !errors.Is(err, store.ErrWalletNotFound) {
+			t.Errorf("Rejected transfer must not create %s, got: %v", a, err)
+		}
+	}
+
+	newBalance, err := s.Transfer(ctx, addr(1), []store.TransferOp{
+		{To: addr(2), Amount: big.NewInt(40)},
+		{To: addr(3), Amount: big.NewInt(50)},
+		{To: addr(2), Amount: big.NewInt(5)},
+	}, store.TransferOptions{})
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	if newBalance.String() != "5" {
+		t.Errorf("Transfer: Expected sender balance 5, got: %v", newBalance)
+	}
+	expectBalance(t, s, addr(2), 45)
+	expectBalance(t, s, addr(3), 50)
+
+	expectSupplyMatches(t, s)
+}
+
+func testIdempotencyKey(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	create(t, s, addr(1), 100)
+
+	ops := []store.TransferOp{{To: addr(2), Amount: big.NewInt(10)}}
+	opts := store.TransferOptions{IdempotencyKey: "retry-me"}
+
+	first, err := s.Transfer(ctx, addr(1), ops, opts)
+	if err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	replay, err := s.Transfer(ctx, addr(1), ops, opts)
+	if err != nil {
+		t.Fatalf("Replayed transfer error: %v", err)
+	}
+	if first.Cmp(replay) != 0 {
+		t.Errorf("Replay returned %v, the original transfer %v", replay, first)
+	}
+	expectBalance(t, s, addr(2), 10)
+
+	if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{{
+		To: addr(2), Amount: big.NewInt(11),
+	}}, opts); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("Reusing a key for other legs: Expected ErrConflict, got: %v", err)
+	}
+
+	tooMuch := []store.TransferOp{{To: addr(2), Amount: big.NewInt(1000)}}
+	rejected := store.TransferOptions{IdempotencyKey: "rejected"}
+	if _, err := s.Transfer(ctx, addr(1), tooMuch, rejected); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	// The rejection is replayed even once the sender could afford it.
+	if _, err := s.Mint(ctx, "", addr(1), big.NewInt(1000)); err != nil {
+		t.Fatalf("Mint error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, addr(1), tooMuch, rejected); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Errorf("Replayed rejection: Expected ErrInsufficientFunds, got: %v", err)
+	}
+	expectBalance(t, s, addr(2), 10)
+}
+
+func testTokens(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	tok, err := s.CreateToken(ctx, "USDX", "USD Example", 6)
+	if err != nil {
+		t.Fatalf("CreateToken error: %v", err)
+	}
+	if tok.Decimals != 6 || tok.TotalSupply.Sign() != 0 {
+		t.Errorf("Unexpected token: %+v", tok)
+	}
+
+	if _, err := s.CreateToken(ctx, "USDX", "Again", 6); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("Registering USDX twice: Expected ErrConflict, got: %v", err)
+	}
+	if _, err := s.CreateToken(ctx, "usdx", "Lowercase", 6); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Lowercase symbol: Expected ErrInvalidArgument, got: %v", err)
+	}
+	if _, err := s.GetToken(ctx, "NOPE"); !errors.Is(err, store.ErrTokenNotFound) {
+		t.Errorf("GetToken: Expected ErrTokenNotFound, got: %v", err)
+	}
+
+	minted, err := s.Mint(ctx, "USDX", addr(1), big.NewInt(500))
+	if err != nil {
+		t.Fatalf("Mint error: %v", err)
+	}
+	if minted.String() != "500" {
+		t.Errorf("Mint: Expected balance 500, got: %v", minted)
+	}
+
+	if _, err := s.Mint(ctx, "USDX", addr(1), big.NewInt(0)); !errors.Is(err, store.ErrInvalidAmount) {
+		t.Errorf("Minting zero: Expected ErrInvalidAmount, got: %v", err)
+	}
+
+	if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{{
+		To: addr(2), Amount: big.NewInt(200),
+	}}, store.TransferOptions{Token: "USDX"}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	burned, err := s.Burn(ctx, "USDX", addr(2), big.NewInt(50))
+	if err != nil {
+		t.Fatalf("Burn error: %v", err)
+	}
+	if burned.String() != "150" {
+		t.Errorf("Burn: Expected balance 150, got: %v", burned)
+	}
+
+	if _, err := s.Burn(ctx, "USDX", addr(2), big.NewInt(151)); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Errorf("Burning more than the balance: Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	tok, err = s.GetToken(ctx, "USDX")
+	if err != nil {
+		t.Fatalf("GetToken error: %v", err)
+	}
+	if tok.TotalSupply.String() != "450" {
+		t.Errorf("Expected USDX total supply 450, got: %v", tok.TotalSupply)
+	}
+
+	w, err := s.GetByAddress(ctx, addr(2))
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+	if w.Balance.Sign() != 0 || len(w.Balances) != 1 || w.Balances[0].Token.Symbol != "USDX" {
+		t.Errorf("Expected only a USDX balance, got: %+v", w.Balances)
+	}
+
+	expectSupplyMatches(t, s)
+}
+
+func testAllowances(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	owner, spender, merchant := addr(1), addr(2), addr(3)
+	create(t, s, owner, 100)
+
+	if _, err := s.Approve(ctx, "", addr(9), spender, big.NewInt(10), store.ApproveOptions{}); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Approve from unknown owner: Expected ErrWalletNotFound, got: %v", err)
+	}
+	if _, err := s.Approve(ctx, "", owner, spender, big.NewInt(-1), store.ApproveOptions{}); !errors.Is(err, store.ErrInvalidAmount) {
+		t.Errorf("Negative allowance: Expected ErrInvalidAmount, got: %v", err)
+	}
+	if _, err := s.Approve(ctx, "", owner, spender, big.NewInt(40), store.ApproveOptions{}); err != nil {
+		t.Fatalf("Approve error: %v", err)
+	}
+
+	byMerchant := store.TransferOptions{Spender: spender}
+	if _, err := s.Transfer(ctx, owner, []store.TransferOp{{
+		To: merchant, Amount: big.NewInt(30),
+	}}, byMerchant); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	expectBalance(t, s, owner, 70)
+
+	allowance, err := s.Allowance(ctx, "", owner, spender)
+	if err != nil {
+		t.Fatalf("Allowance error: %v", err)
+	}
+	if allowance.String() != "10" {
+		t.Errorf("Expected remaining allowance 10, got: %v", allowance)
+	}
+
+	if _, err := s.Transfer(ctx, owner, []store.TransferOp{{
+		To: merchant, Amount: big.NewInt(11),
+	}}, byMerchant); !errors.Is(err, store.ErrInsufficientAllowance) {
+		t.Errorf("Overspending: Expected ErrInsufficientAllowance, got: %v", err)
+	}
+	if _, err := s.Transfer(ctx, owner, []store.TransferOp{{
+		To: merchant, Amount: big.NewInt(-1),
+	}}, byMerchant); !errors.Is(err, store.ErrInvalidAmount) {
+		t.Errorf("Pulling as a spender: Expected ErrInvalidAmount, got: %v", err)
+	}
+
+	if _, err := s.Approve(ctx, "", owner, spender, big.NewInt(500), store.ApproveOptions{}); err != nil {
+		t.Fatalf("Approve error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, owner, []store.TransferOp{{
+		To: merchant, Amount: big.NewInt(71),
+	}}, byMerchant); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Errorf("Spending more than the owner holds: Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	allowance, err = s.Allowance(ctx, "", owner, spender)
+	if err != nil {
+		t.Fatalf("Allowance error: %v", err)
+	}
+	if allowance.String() != "500" {
+		t.Errorf("A rejected transfer must not use up the allowance, got: %v", allowance)
+	}
+
+	if a, err := s.Allowance(ctx, "", spender, owner); err != nil || a.Sign() != 0 {
+		t.Errorf("Expected no allowance the other way round, got: %v, %v", a, err)
+	}
+}
+
+func testListTransfers(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	create(t, s, addr(1), 100)
+	create(t, s, addr(2), 100)
+
+	for i := 1; i <= 5; i++ {
+		from, to := addr(1), addr(3)
+		if i%2 == 0 {
+			from = addr(2)
+		}
+		if _, err := transfer(s, from, to, int64(i)); err != nil {
+			t.Fatalf("Transfer error: %v", err)
+		}
+	}
+
+	var amounts []string
+	after := ""
+	for {
+		page, err := s.ListTransfers(ctx, "", 2, after)
+		if err != nil {
+			t.Fatalf("ListTransfers error: %v", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, tr := range page {
+			amounts = append(amounts, tr.Amount.String())
+		}
+		after = page[len(page)-1].ID
+	}
+	if fmt.Sprint(amounts) != "[5 4 3 2 1]" {
+		t.Errorf("Expected all transfers newest first, got: %v", amounts)
+	}
+
+	fromTwo, err := s.ListTransfers(ctx, addr(2), 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+	if len(fromTwo) != 2 {
+		t.Errorf("Expected 2 transfers involving %s, got: %d", addr(2), len(fromTwo))
+	}
+
+	if _, err := s.ListTransfers(ctx, "", 10, "not-a-cursor"); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Bad cursor: Expected ErrInvalidArgument, got: %v", err)
+	}
+}
+
+func testListWallets(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	for i, b := range []int64{30, 10, 50, 10, 40} {
+		create(t, s, addr(i), b)
+	}
+
+	collect := func(q store.WalletQuery, value func(*generated.Wallet) string) []string {
+		t.Helper()
+		var got []string
+		for {
+			page, err := s.ListWallets(ctx, q)
+			if err != nil {
+				t.Fatalf("ListWallets error: %v", err)
+			}
+			for _, e := range page.Edges {
+				got = append(got, value(e.Node))
+			}
+			if !page.PageInfo.HasNextPage {
+				return got
+			}
+			q.After = *page.PageInfo.EndCursor
+		}
+	}
+	balance := func(w *generated.Wallet) string { return w.Balance.String() }
+	address := func(w *generated.Wallet) string { return w.Address }
+
+	got := collect(store.WalletQuery{
+		First:   2,
+		OrderBy: generated.WalletOrder{Field: generated.WalletOrderFieldBalance, Direction: generated.OrderDirectionDesc},
+		Filter:  generated.WalletFilter{MinBalance: big.NewInt(20)},
+	}, balance)
+	if fmt.Sprint(got) != "[50 40 30]" {
+		t.Errorf("Expected balances [50 40 30], got: %v", got)
+	}
+
+	got = collect(store.WalletQuery{
+		First:   1,
+		OrderBy: generated.WalletOrder{Field: generated.WalletOrderFieldBalance, Direction: generated.OrderDirectionAsc},
+		Filter:  generated.WalletFilter{MaxBalance: big.NewInt(10)},
+	}, address)
+	if fmt.Sprint(got) != fmt.Sprint([]string{addr(1), addr(3)}) {
+		t.Errorf("Equal balances must be ordered by address, got: %v", got)
+	}
+
+	got = collect(store.WalletQuery{First: 3}, address)
+	if fmt.Sprint(got) != fmt.Sprint([]string{addr(0), addr(1), addr(2), addr(3), addr(4)}) {
+		t.Errorf("Expected every wallet by address, got: %v", got)
+	}
+
+	page, err := s.ListWallets(ctx, store.WalletQuery{
+		First:   1,
+		OrderBy: generated.WalletOrder{Field: generated.WalletOrderFieldBalance},
+	})
+	if err != nil {
+		t.Fatalf("ListWallets error: %v", err)
+	}
+	if _, err := s.ListWallets(ctx, store.WalletQuery{First: 1, After: *page.PageInfo.EndCursor}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Cursor used with another order: Expected ErrInvalidArgument, got: %v", err)
+	}
+
+	for _, first := range []int{-1, 0, store.MaxWalletsPageSize + 1} {
+		if _, err := s.ListWallets(ctx, store.WalletQuery{First: first}); !errors.Is(err, store.ErrInvalidArgument) {
+			t.Errorf("First %d: Expected ErrInvalidArgument, got: %v", first, err)
+		}
+	}
+	if _, err := s.ListWallets(ctx, store.WalletQuery{First: store.MaxWalletsPageSize}); err != nil {
+		t.Errorf("First %d: Expected no error, got: %v", store.MaxWalletsPageSize, err)
+	}
+}
+
+// instant returns the current time, a moment after anything done before it
+// and before anything done after it.
+func instant() time.Time {
+	time.Sleep(5 * time.Millisecond)
+	at := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	return at
+}
+
+func testAsOf(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	beforeAll := instant()
+	create(t, s, addr(1), 100)
+	create(t, s, addr(2), 0)
+
+	afterCreate := instant()
+	if _, err := transfer(s, addr(1), addr(2), 30); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	create(t, s, addr(3), 7)
+	if _, err := s.CreateToken(ctx, "USDX", "USD Example", 6); err != nil {
+		t.Fatalf("CreateToken error: %v", err)
+	}
+	if _, err := s.Mint(ctx, "USDX", addr(2), big.NewInt(50)); err != nil {
+		t.Fatalf("Mint error: %v", err)
+	}
+
+	afterMint := instant()
+	if _, err := transfer(s, addr(2), addr(1), 5); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	if _, err := transfer(s, addr(2), addr(1), 1000); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got: %v", err)
+	}
+
+	held := func(address string, asOf time.Time) string {
+		t.Helper()
+		w, err := s.GetByAddressAsOf(ctx, address, asOf)
+		if err != nil {
+			t.Fatalf("GetByAddressAsOf(%s) error: %v", address, err)
+		}
+		out := w.Balance.String()
+		for _, b := range w.Balances {
+			if b.Token.Symbol != store.DefaultToken {
+				out += fmt.Sprintf(" %s %v", b.Token.Symbol, b.Balance)
+			}
+		}
+		return out
+	}
+
+	for _, tt := range []struct {
+		address string
+		asOf    time.Time
+		want    string
+	}{
+		{addr(1), afterCreate, "100"},
+		{addr(2), afterCreate, "0"},
+		{addr(1), afterMint, "70"},
+		{addr(2), afterMint, "30 USDX 50"},
+		{addr(3), afterMint, "7"},
+		{addr(1), time.Now(), "75"},
+		{addr(2), time.Now(), "25 USDX 50"},
+	} {
+		if got := held(tt.address, tt.asOf); got != tt.want {
+			t.Errorf("%s as of %v: Expected %q, got: %q", tt.address, tt.asOf, tt.want, got)
+		}
+	}
+
+	if _, err := s.GetByAddressAsOf(ctx, addr(1), beforeAll); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Before the wallet was created: Expected ErrWalletNotFound, got: %v", err)
+	}
+	if _, err := s.GetByAddressAsOf(ctx, addr(3), afterCreate); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Before the wallet was created: Expected ErrWalletNotFound, got: %v", err)
+	}
+
+	w, err := s.GetByAddressAsOf(ctx, addr(2), afterCreate)
+	if err != nil {
+		t.Fatalf("GetByAddressAsOf error: %v", err)
+	}
+	if !w.UpdatedAt.Equal(w.CreatedAt) {
+		t.Errorf("Expected an untouched wallet to be updated when created, got: %v, created %v", w.UpdatedAt, w.CreatedAt)
+	}
+
+	// The seed is recorded at the moment the wallet was created.
+	seeded, err := s.GetByAddress(ctx, addr(3))
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+	if got := held(addr(3), seeded.CreatedAt); got != "7" {
+		t.Errorf("As of its creation: Expected the seeded balance 7, got: %q", got)
+	}
+
+	// Looking back leaves the present alone.
+	expectBalance(t, s, addr(1), 75)
+	expectBalance(t, s, addr(2), 25)
+
+	list := func(asOf time.Time, filter generated.WalletFilter) []string {
+		t.Helper()
+		conn, err := s.ListWallets(ctx, store.WalletQuery{
+			First:   10,
+			OrderBy: generated.WalletOrder{Field: generated.WalletOrderFieldBalance, Direction: generated.OrderDirectionDesc},
+			Filter:  filter,
+			AsOf:    &asOf,
+		})
+		if err != nil {
+			t.Fatalf("ListWallets error: %v", err)
+		}
+		var out []string
+		for _, e := range conn.Edges {
+			out = append(out, fmt.Sprintf("%s=%v", e.Node.Address, e.Node.Balance))
+		}
+		return out
+	}
+
+	for _, tt := range []struct {
+		asOf   time.Time
+		filter generated.WalletFilter
+		want   []string
+	}{
+		{beforeAll, generated.WalletFilter{}, nil},
+		{afterCreate, generated.WalletFilter{}, []string{addr(1) + "=100", addr(2) + "=0"}},
+		{afterMint, generated.WalletFilter{}, []string{addr(1) + "=70", addr(2) + "=30", addr(3) + "=7"}},
+		{afterMint, generated.WalletFilter{MinBalance: big.NewInt(10)}, []string{addr(1) + "=70", addr(2) + "=30"}},
+	} {
+		if got := list(tt.asOf, tt.filter); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("Wallets as of %v with %+v: Expected %v, got: %v", tt.asOf, tt.filter, tt.want, got)
+		}
+	}
+}
+
+func testConcurrentTransfers(t *testing.T, s store.WalletStore) {
+	const (
+		wallets   = 5
+		workers   = 10
+		transfers = 30
+	)
+
+	for i := 0; i < wallets; i++ {
+		create(t, s, addr(i), 1000)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*transfers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < transfers; i++ {
+				from := addr(rng.Intn(wallets))
+				ops := []store.TransferOp{
+					{To: addr(rng.Intn(wallets)), Amount: big.NewInt(1 + rng.Int63n(300))},
+					{To: addr(rng.Intn(wallets)), Amount: big.NewInt(1 + rng.Int63n(300))},
+				}
+				_, err := s.Transfer(context.Background(), from, ops, store.TransferOptions{})
+				if err != nil && !errors.Is(err, store.ErrInsufficientFunds) {
+					errs <- err
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("Unexpected transfer error: %v", err)
+	}
+
+	expectSupplyMatches(t, s)
+
+	tok, err := s.GetToken(context.Background(), store.DefaultToken)
+	if err != nil {
+		t.Fatalf("GetToken error: %v", err)
+	}
+	if tok.TotalSupply.Cmp(big.NewInt(wallets*1000)) != 0 {
+		t.Errorf("Transfers must not change the total supply, got: %v", tok.TotalSupply)
+	}
+}
+
+func testSubscribe(t *testing.T, s store.WalletStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	create(t, s, addr(1), 100)
+
+	events, err := s.Subscribe(ctx)
+	if err != nil {
+		t.Fatalf("Subscribe error: %v", err)
+	}
+
+	// Events committed after Subscribe returns are delivered.
+	if _, err := transfer(s, addr(1), addr(2), 1); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	var got store.Event
+	select {
+	case got = <-events:
+	case <-ctx.Done():
+		t.Fatalf("No event received: %v", ctx.Err())
+	}
+
+	if got.Transfer == nil || got.Transfer.ToAddress != addr(2) {
+		t.Fatalf("Expected a transfer event first, got: %+v", got)
+	}
+
+	// A transfer is followed by the new balances of both wallets.
+	balances := map[string]string{}
+	for len(balances) < 2 {
+		select {
+		case ev := <-events:
+			if ev.Balance != nil {
+				balances[ev.Balance.Address] = ev.Balance.Balance.String()
+			}
+		case <-ctx.Done():
+			t.Fatalf("Missing balance events, got: %v", balances)
+		}
+	}
+
+	sender, err := s.GetByAddress(ctx, addr(1))
+	if err != nil {
+		t.Fatalf("GetByAddress error: %v", err)
+	}
+	if balances[addr(1)] != sender.Balance.String() {
+		t.Errorf("Expected sender balance event %v, got: %v", sender.Balance, balances)
+	}
+}
+
+// balances returns every nonzero balance in s, keyed by address and token.
+func balances(t *testing.T, s store.WalletStore) map[string]string {
+	t.Helper()
+	wallets, err := s.ListAll(context.Background())
+	if err != nil {
+		t.Fatalf("ListAll error: %v", err)
+	}
+	out := map[string]string{}
+	for _, w := range wallets {
+		for _, b := range w.Balances {
+			if b.Balance.Sign() != 0 {
+				out[w.Address+"/"+b.Token.Symbol] = b.Balance.String()
+			}
+		}
+	}
+	return out
+}
+
+func testJournal(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	create(t, s, addr(1), 100)
+	create(t, s, addr(2), 0)
+	if _, err := transfer(s, addr(1), addr(2), 30); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	if _, err := transfer(s, addr(1), addr(2), 1000); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got: %v", err)
+	}
+	if _, err := s.CreateToken(ctx, "USDX", "USD Example", 6); err != nil {
+		t.Fatalf("CreateToken error: %v", err)
+	}
+	if _, err := s.Mint(ctx, "USDX", addr(3), big.NewInt(500)); err != nil {
+		t.Fatalf("Mint error: %v", err)
+	}
+	if _, err := s.Burn(ctx, "USDX", addr(3), big.NewInt(120)); err != nil {
+		t.Fatalf("Burn error: %v", err)
+	}
+	if _, err := s.Transfer(ctx, addr(3), []store.TransferOp{
+		{To: addr(1), Amount: big.NewInt(80)},
+		{To: addr(2), Amount: big.NewInt(10)},
+	}, store.TransferOptions{Token: "USDX"}); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+
+	unbalanced, err := s.CheckJournal(ctx)
+	if err != nil {
+		t.Fatalf("CheckJournal error: %v", err)
+	}
+	if len(unbalanced) != 0 {
+		t.Errorf("Expected a balanced journal, got: %+v", unbalanced)
+	}
+
+	before := balances(t, s)
+	if err := s.RebuildBalances(ctx); err != nil {
+		t.Fatalf("RebuildBalances error: %v", err)
+	}
+	after := balances(t, s)
+	if fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("Rebuilt balances differ\nbefore: %v\nafter:  %v", before, after)
+	}
+	expectSupplyMatches(t, s)
+}
+
+func testReconcile(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	create(t, s, addr(1), 100)
+	create(t, s, addr(2), 0)
+	if _, err := transfer(s, addr(1), addr(2), 40); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	if _, err := s.CreateToken(ctx, "USDX", "USD Example", 6); err != nil {
+		t.Fatalf("CreateToken error: %v", err)
+	}
+	if _, err := s.Mint(ctx, "USDX", addr(2), big.NewInt(500)); err != nil {
+		t.Fatalf("Mint error: %v", err)
+	}
+	if _, err := s.Burn(ctx, "USDX", addr(2), big.NewInt(200)); err != nil {
+		t.Fatalf("Burn error: %v", err)
+	}
+
+	report, err := store.Reconcile(ctx, s)
+	if err != nil {
+		t.Fatalf("Reconcile error: %v", err)
+	}
+	if !report.OK || len(report.Discrepancies) != 0 || len(report.UnbalancedEntries) != 0 {
+		t.Errorf("Expected a consistent store, got: %+v", report)
+	}
+
+	got := fmt.Sprint(report.Tokens)
+	want := fmt.Sprint([]store.TokenTotals{
+		{Token: "BTP", TotalSupply: big.NewInt(100), BalanceSum: big.NewInt(100), Issued: big.NewInt(100)},
+		{Token: "USDX", TotalSupply: big.NewInt(300), BalanceSum: big.NewInt(300), Issued: big.NewInt(300)},
+	})
+	if got != want {
+		t.Errorf("Expected token totals %s, got: %s", want, got)
+	}
+}
+
+// loadGenesis writes a genesis file named name and loads it.
+func loadGenesis(t *testing.T, name, content string) (*store.Genesis, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile error: %v", err)
+	}
+	return store.LoadGenesis(path)
+}
+
+func testGenesis(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	if _, err := loadGenesis(t, "negative.json", `{"wallets": [{"address": "0x0000000000000000000000000000000000000001", "balances": {"BTP": -1}}]}`); !errors.Is(err, store.ErrInvalidAmount) {
+		t.Errorf("Negative balance: Expected ErrInvalidAmount, got: %v", err)
+	}
+	if _, err := loadGenesis(t, "typo.yaml", "wallet: []\n"); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Unknown field: Expected ErrInvalidArgument, got: %v", err)
+	}
+
+	// A genesis that cannot be applied leaves no trace, and does not count
+	// as applied.
+	conflicting, err := loadGenesis(t, "conflicting.json", `{
+  "tokens": [{"symbol": "BTP", "name": "BTP Token", "decimals": 2}],
+  "wallets": [{"address": "`+addr(5)+`", "balances": {"BTP": 10}}]
+}`)
+	if err != nil {
+		t.Fatalf("LoadGenesis error: %v", err)
+	}
+	if _, _, err := s.ApplyGenesis(ctx, conflicting); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("Redefining BTP: Expected ErrConflict, got: %v", err)
+	}
+	if _, err := s.GetByAddress(ctx, addr(5)); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Expected no wallet from a rejected genesis, got: %v", err)
+	}
+
+	// Wallets that exist already are left alone.
+	create(t, s, addr(0), 5)
+
+	g, err := loadGenesis(t, "genesis.yaml", `
+tokens:
+  - symbol: BTP
+    name: BTP Token
+    decimals: 0
+  - symbol: USDX
+    name: USD Example
+    decimals: 6
+wallets:
+  - address: "`+addr(0)+`"
+    balances: {BTP: 1000}
+  - address: "`+addr(1)+`"
+    balances:
+      BTP: 1000
+      USDX: "123456789012345678901234567890"
+  - address: "`+addr(2)+`"
+`)
+	if err != nil {
+		t.Fatalf("LoadGenesis error: %v", err)
+	}
+	rec, applied, err := s.ApplyGenesis(ctx, g)
+	if err != nil {
+		t.Fatalf("ApplyGenesis error: %v", err)
+	}
+	if !applied || rec.Checksum != g.Checksum {
+		t.Errorf("Expected the genesis to be applied, got: %v %+v", applied, rec)
+	}
+
+	want := map[string]string{
+		addr(0) + "/BTP":  "5",
+		addr(1) + "/BTP":  "1000",
+		addr(1) + "/USDX": "123456789012345678901234567890",
+	}
+	if got := balances(t, s); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Unexpected balances after genesis\nwant: %v\ngot:  %v", want, got)
+	}
+	expectBalance(t, s, addr(2), 0)
+	expectSupplyMatches(t, s)
+	if report, err := store.Reconcile(ctx, s); err != nil || !report.OK {
+		t.Errorf("Expected a consistent store after genesis, got: %+v, %v", report, err)
+	}
+
+	// Once applied, a genesis is never applied again, whatever it says.
+	changed, err := loadGenesis(t, "changed.json", `{"wallets": [{"address": "`+addr(3)+`", "balances": {"BTP": "7"}}]}`)
+	if err != nil {
+		t.Fatalf("LoadGenesis error: %v", err)
+	}
+	if changed.Checksum == g.Checksum {
+		t.Fatalf("Expected different files to have different checksums")
+	}
+	again, applied, err := s.ApplyGenesis(ctx, changed)
+	if err != nil {
+		t.Fatalf("ApplyGenesis error: %v", err)
+	}
+	if applied || again.Checksum != g.Checksum {
+		t.Errorf("Expected the first genesis to stay in effect, got: %v %+v", applied, again)
+	}
+	if _, err := s.GetByAddress(ctx, addr(3)); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Expected no wallet from a second genesis, got: %v", err)
+	}
+}
+
+func testBulk(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	if _, err := s.CreateToken(ctx, "USDX", "USD Example", 6); err != nil {
+		t.Fatalf("CreateToken error: %v", err)
+	}
+	create(t, s, addr(1), 50)
+	create(t, s, addr(2), 0)
+
+	wallets := strings.Join([]string{
+		"address,token,balance",
+		addr(1) + ",BTP,10",
+		addr(1) + ",USDX,7",
+		addr(2) + ",,0",
+		addr(3) + ",BTP,100",
+		addr(3) + ",USDX,123456789012345678901234567890",
+		addr(3) + ",USDX,1",
+		addr(4) + ",BTP,-5",
+		addr(4) + ",NOPE,5",
+		addr(5) + ",USDX,0",
+		addr(5) + ",BTP,0",
+		"",
+	}, "\n")
+	wantProblems := []store.RowProblem{
+		{Line: 2, Status: store.RowSkipped},
+		{Line: 4, Status: store.RowSkipped},
+		{Line: 7, Status: store.RowFailed},
+		{Line: 8, Status: store.RowFailed},
+		{Line: 9, Status: store.RowFailed},
+	}
+	want := map[string]string{
+		addr(1) + "/BTP":  "50",
+		addr(1) + "/USDX": "7",
+		addr(3) + "/BTP":  "100",
+		addr(3) + "/USDX": "123456789012345678901234567890",
+	}
+
+	// A dry run reports what would happen, in batches small enough to split
+	// rows of one wallet, and changes nothing.
+	before := balances(t, s)
+	report, err := store.BulkImportWallets(ctx, s, strings.NewReader(wallets),
+		store.ImportOptions{Format: store.FormatCSV, DryRun: true, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("BulkImportWallets (dry run) error: %v", err)
+	}
+	expectImportReport(t, report, 10, 5, wantProblems)
+	if got := balances(t, s); fmt.Sprint(got) != fmt.Sprint(before) {
+		t.Errorf("Expected a dry run to change nothing\nbefore: %v\nafter:  %v", before, got)
+	}
+	if _, err := s.GetByAddress(ctx, addr(3)); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Expected no wallet from a dry run, got: %v", err)
+	}
+
+	report, err = store.BulkImportWallets(ctx, s, strings.NewReader(wallets),
+		store.ImportOptions{Format: store.FormatCSV, BatchSize: 2})
+	if err != nil {
+		t.Fatalf("BulkImportWallets error: %v", err)
+	}
+	expectImportReport(t, report, 10, 5, wantProblems)
+	if got := balances(t, s); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Unexpected balances after import\nwant: %v\ngot:  %v", want, got)
+	}
+	expectBalance(t, s, addr(5), 0)
+	expectSupplyMatches(t, s)
+	if report, err := store.Reconcile(ctx, s); err != nil || !report.OK {
+		t.Errorf("Expected a consistent store after import, got: %+v, %v", report, err)
+	}
+
+	// Importing the same file again only skips rows.
+	report, err = store.BulkImportWallets(ctx, s, strings.NewReader(wallets),
+		store.ImportOptions{Format: store.FormatCSV})
+	if err != nil {
+		t.Fatalf("BulkImportWallets (again) error: %v", err)
+	}
+	if report.Imported != 0 {
+		t.Errorf("Expected nothing imported twice, got: %+v", report)
+	}
+
+	if _, err := store.BulkImportWallets(ctx, s, strings.NewReader("address,amount\n"),
+		store.ImportOptions{Format: store.FormatCSV}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Unknown column: Expected ErrInvalidArgument, got: %v", err)
+	}
+
+	var out bytes.Buffer
+	n, err := store.BulkExportWallets(ctx, s, &out, store.FormatJSONL)
+	if err != nil {
+		t.Fatalf("BulkExportWallets error: %v", err)
+	}
+	wantJSONL := strings.Join([]string{
+		`{"address":"` + addr(1) + `","token":"BTP","balance":"50"}`,
+		`{"address":"` + addr(1) + `","token":"USDX","balance":"7"}`,
+		`{"address":"` + addr(2) + `","token":"BTP","balance":"0"}`,
+		`{"address":"` + addr(3) + `","token":"BTP","balance":"100"}`,
+		`{"address":"` + addr(3) + `","token":"USDX","balance":"123456789012345678901234567890"}`,
+		`{"address":"` + addr(5) + `","token":"BTP","balance":"0"}`,
+		"",
+	}, "\n")
+	if n != 6 || out.String() != wantJSONL {
+		t.Errorf("Unexpected export of %d rows\nwant:\n%s\ngot:\n%s", n, wantJSONL, out.String())
+	}
+
+	// Transfers are history: importing them moves no funds.
+	if _, err := transfer(s, addr(1), addr(2), 20); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	history := strings.Join([]string{
+		`{"from":"` + addr(3) + `","to":"` + addr(5) + `","token":"USDX","amount":5,"status":"SUCCEEDED","createdAt":"2025-01-02T03:04:05.123456Z"}`,
+		`{"from":"` + addr(3) + `","to":"` + addr(5) + `","amount":"9","status":"REJECTED","error":"insufficient funds","spender":"` + addr(1) + `","createdAt":"2025-01-03T00:00:00Z"}`,
+		`{"from":"` + addr(3) + `","to":"` + addr(5) + `","amount":"9","status":"PENDING","createdAt":"2025-01-03T00:00:00Z"}`,
+		`{"from":"` + addr(3) + `","to":"` + addr(5) + `","token":"NOPE","amount":"9","status":"SUCCEEDED","createdAt":"2025-01-03T00:00:00Z"}`,
+		`not json`,
+	}, "\n")
+	report, err = store.BulkImportTransfers(ctx, s, strings.NewReader(history), store.ImportOptions{Format: store.FormatJSONL})
+	if err != nil {
+		t.Fatalf("BulkImportTransfers error: %v", err)
+	}
+	expectImportReport(t, report, 5, 2, []store.RowProblem{
+		{Line: 3, Status: store.RowFailed},
+		{Line: 4, Status: store.RowFailed},
+		{Line: 5, Status: store.RowFailed},
+	})
+	expectBalance(t, s, addr(3), 100)
+
+	out.Reset()
+	if _, err := store.BulkExportTransfers(ctx, s, &out, store.FormatCSV); err != nil {
+		t.Fatalf("BulkExportTransfers error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a header and 3 transfers, got:\n%s", out.String())
+	}
+	wantLines := []string{
+		"id,from,to,spender,token,amount,status,error,createdAt",
+		",BTP,20,SUCCEEDED,,",
+		"," + addr(3) + "," + addr(5) + ",,USDX,5,SUCCEEDED,,2025-01-02T03:04:05.123456Z",
+		"," + addr(3) + "," + addr(5) + "," + addr(1) + ",BTP,9,REJECTED,insufficient funds,2025-01-03T00:00:00Z",
+	}
+	for i, want := range wantLines {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("Expected line %d of the export to contain %q, got: %s", i+1, want, lines[i])
+		}
+	}
+}
+
+// expectImportReport fails the test unless report counts rows rows, of
+// which imported were imported, and lists the problems in want. Reasons are
+// only checked for being there.
+func expectImportReport(t *testing.T, report *store.ImportReport, rows, imported int, want []store.RowProblem) {
+	t.Helper()
+	if report.Rows != rows || report.Imported != imported || report.Skipped+report.Failed != len(want) {
+		t.Errorf("Expected %d rows with %d imported, got: %+v", rows, imported, report)
+	}
+	if len(report.Problems) != len(want) {
+		t.Fatalf("Expected problems %+v, got: %+v", want, report.Problems)
+	}
+	for i, p := range report.Problems {
+		if p.Line != want[i].Line || p.Status != want[i].Status || p.Reason == "" {
+			t.Errorf("Expected problem %+v, got: %+v", want[i], p)
+		}
+	}
+}
+
+func testAPIKeys(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+	hash := strings.Repeat("ab", 32)
+
+	if err := s.CreateAPIKey(ctx, &store.APIKey{ID: "k1", Hash: "secret", Subject: "alice"}); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Unhashed secret: Expected ErrInvalidArgument, got: %v", err)
+	}
+	if _, err := s.GetAPIKey(ctx, "k1"); !errors.Is(err, store.ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound, got: %v", err)
+	}
+
+	k1 := &store.APIKey{ID: "k1", Hash: hash, Subject: "alice", Roles: []string{"issuer"}, Wallets: []string{addr(1), addr(2)}}
+	if err := s.CreateAPIKey(ctx, k1); err != nil {
+		t.Fatalf("CreateAPIKey error: %v", err)
+	}
+	if k1.CreatedAt.IsZero() {
+		t.Errorf("Expected CreatedAt to be set")
+	}
+	if err := s.CreateAPIKey(ctx, &store.APIKey{ID: "k1", Hash: hash, Subject: "mallory"}); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("Reused id: Expected ErrConflict, got: %v", err)
+	}
+	k2 := &store.APIKey{ID: "k2", Hash: hash, Subject: "bob"}
+	if err := s.CreateAPIKey(ctx, k2); err != nil {
+		t.Fatalf("CreateAPIKey error: %v", err)
+	}
+
+	got, err := s.GetAPIKey(ctx, "k1")
+	if err != nil {
+		t.Fatalf("GetAPIKey error: %v", err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(k1) {
+		t.Errorf("Expected %+v, got: %+v", k1, got)
+	}
+
+	revoked, err := s.RevokeAPIKey(ctx, "k1")
+	if err != nil {
+		t.Fatalf("RevokeAPIKey error: %v", err)
+	}
+	if !revoked.Revoked() {
+		t.Fatalf("Expected the key to be revoked, got: %+v", revoked)
+	}
+	again, err := s.RevokeAPIKey(ctx, "k1")
+	if err != nil || !again.RevokedAt.Equal(*revoked.RevokedAt) {
+		t.Errorf("Expected revoking again to keep %v, got: %+v, %v", revoked.RevokedAt, again, err)
+	}
+	if _, err := s.RevokeAPIKey(ctx, "k3"); !errors.Is(err, store.ErrAPIKeyNotFound) {
+		t.Errorf("Expected ErrAPIKeyNotFound, got: %v", err)
+	}
+
+	keys, err := s.ListAPIKeys(ctx)
+	if err != nil {
+		t.Fatalf("ListAPIKeys error: %v", err)
+	}
+	if len(keys) != 2 || keys[0].ID != "k1" || !keys[0].Revoked() || keys[1].ID != "k2" || keys[1].Revoked() {
+		t.Errorf("Expected k1 revoked then k2, got: %+v", keys)
+	}
+	if len(keys[1].Roles) != 0 || len(keys[1].Wallets) != 0 {
+		t.Errorf("Expected a key without roles or wallets, got: %+v", keys[1])
+	}
+}
+
+func testWalletKeys(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+	create(t, s, addr(1), 100)
+	create(t, s, addr(2), 0)
+
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("GenerateKey error: %v", err)
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+
+	if _, err := s.RegisterWalletKey(ctx, addr(1), pub[:16]); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Short key: Expected ErrInvalidArgument, got: %v", err)
+	}
+	if _, err := s.RegisterWalletKey(ctx, addr(9), pub); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Unknown wallet: Expected ErrWalletNotFound, got: %v", err)
+	}
+	if _, err := s.GetWalletKey(ctx, addr(9)); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Unknown wallet: Expected ErrWalletNotFound, got: %v", err)
+	}
+	k, err := s.GetWalletKey(ctx, addr(1))
+	if err != nil || k.PublicKey != nil || k.Nonce != 0 {
+		t.Fatalf("Expected no key and nonce 0, got: %+v, %v", k, err)
+	}
+
+	// A transfer may carry a nonce before the wallet has a key.
+	one := []store.TransferOp{{To: addr(2), Amount: big.NewInt(1)}}
+	nonce := func(n uint64) *uint64 { return &n }
+	if _, err := s.Transfer(ctx, addr(1), one, store.TransferOptions{Nonce: nonce(0)}); err != nil {
+		t.Fatalf("Transfer with nonce 0 error: %v", err)
+	}
+
+	if k, err = s.RegisterWalletKey(ctx, addr(1), pub); err != nil {
+		t.Fatalf("RegisterWalletKey error: %v", err)
+	}
+	if !k.PublicKey.Equal(pub) || k.Nonce != 1 {
+		t.Errorf("Expected the key with nonce 1, got: %+v", k)
+	}
+	if _, err := s.RegisterWalletKey(ctx, addr(1), pub); err != nil {
+		t.Errorf("Registering the same key again: Expected no error, got: %v", err)
+	}
+	if _, err := s.RegisterWalletKey(ctx, addr(1), other); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("Different key: Expected ErrConflict, got: %v", err)
+	}
+
+	refused := []struct {
+		name string
+		opts store.TransferOptions
+		want error
+	}{
+		{"unsigned", store.TransferOptions{}, store.ErrInvalidSignature},
+		{"unsigned with nonce", store.TransferOptions{Nonce: nonce(1)}, store.ErrInvalidSignature},
+		{"other key", store.TransferOptions{SignedWith: other, Nonce: nonce(1)}, store.ErrInvalidSignature},
+		{"no nonce", store.TransferOptions{SignedWith: pub}, store.ErrInvalidNonce},
+		{"replayed nonce", store.TransferOptions{SignedWith: pub, Nonce: nonce(0)}, store.ErrInvalidNonce},
+		{"skipped nonce", store.TransferOptions{SignedWith: pub, Nonce: nonce(2)}, store.ErrInvalidNonce},
+	}
+	for _, r := range refused {
+		if _, err := s.Transfer(ctx, addr(1), one, r.opts); !errors.Is(err, r.want) {
+			t.Errorf("%s: Expected %v, got: %v", r.name, r.want, err)
+		}
+	}
+	if _, err := s.Transfer(ctx, addr(2), one, store.TransferOptions{SignedWith: pub, Nonce: nonce(0)}); !errors.Is(err, store.ErrInvalidSignature) {
+		t.Errorf("Signed for a wallet without a key: Expected ErrInvalidSignature, got: %v", err)
+	}
+	expectBalance(t, s, addr(1), 99)
+
+	signed := func(n uint64) store.TransferOptions {
+		return store.TransferOptions{SignedWith: pub, Nonce: nonce(n)}
+	}
+	if _, err := s.Transfer(ctx, addr(1), one, signed(1)); err != nil {
+		t.Fatalf("Signed transfer error: %v", err)
+	}
+	// A rejected transfer uses up its nonce too, so it cannot be replayed
+	// later.
+	tooMuch := []store.TransferOp{{To: addr(2), Amount: big.NewInt(1000)}}
+	if _, err := s.Transfer(ctx, addr(1), tooMuch, signed(2)); !errors.Is(err, store.ErrInsufficientFunds) {
+		t.Fatalf("Expected ErrInsufficientFunds, got: %v", err)
+	}
+	if _, err := s.Transfer(ctx, addr(1), tooMuch, signed(2)); !errors.Is(err, store.ErrInvalidNonce) {
+		t.Errorf("Replayed rejected transfer: Expected ErrInvalidNonce, got: %v", err)
+	}
+	if k, err := s.GetWalletKey(ctx, addr(1)); err != nil || k.Nonce != 3 {
+		t.Errorf("Expected nonce 3, got: %+v, %v", k, err)
+	}
+	expectBalance(t, s, addr(1), 98)
+
+	// A spender moves funds without the wallet's key, so the allowance it
+	// draws on must be approved with it.
+	for _, r := range []struct {
+		name string
+		opts store.ApproveOptions
+		want error
+	}{
+		{"unsigned", store.ApproveOptions{}, store.ErrInvalidSignature},
+		{"other key", store.ApproveOptions{SignedWith: other, Nonce: nonce(3)}, store.ErrInvalidSignature},
+		{"replayed nonce", store.ApproveOptions{SignedWith: pub, Nonce: nonce(2)}, store.ErrInvalidNonce},
+	} {
+		if _, err := s.Approve(ctx, store.DefaultToken, addr(1), addr(2), big.NewInt(5), r.opts); !errors.Is(err, r.want) {
+			t.Errorf("Approval %s: Expected %v, got: %v", r.name, r.want, err)
+		}
+	}
+	if _, err := s.Approve(ctx, store.DefaultToken, addr(2), addr(3), big.NewInt(5), store.ApproveOptions{SignedWith: pub, Nonce: nonce(0)}); !errors.Is(err, store.ErrInvalidSignature) {
+		t.Errorf("Approval signed for a wallet without a key: Expected ErrInvalidSignature, got: %v", err)
+	}
+	if _, err := s.Approve(ctx, store.DefaultToken, addr(1), addr(2), big.NewInt(5), store.ApproveOptions{SignedWith: pub, Nonce: nonce(3)}); err != nil {
+		t.Fatalf("Signed approval error: %v", err)
+	}
+	if k, err := s.GetWalletKey(ctx, addr(1)); err != nil || k.Nonce != 4 {
+		t.Errorf("Expected the approval to use up nonce 3, got: %+v, %v", k, err)
+	}
+	if _, err := s.Transfer(ctx, addr(1), one, store.TransferOptions{Spender: addr(2)}); err != nil {
+		t.Errorf("Transfer by a spender error: %v", err)
+	}
+
+	// Of concurrent transfers signed with the same nonce, exactly one goes
+	// through.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Transfer(ctx, addr(1), one, signed(4))
+			if err != nil && !errors.Is(err, store.ErrInvalidNonce) {
+				t.Errorf("Unexpected transfer error: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				succeeded++
+			}
+		}()
+	}
+	wg.Wait()
+	if succeeded != 1 {
+		t.Errorf("Expected one transfer with nonce 4 to succeed, got: %d", succeeded)
+	}
+	expectBalance(t, s, addr(1), 96)
+}
+
+func testAddresses(t *testing.T, s store.WalletStore) {
+	ctx := context.Background()
+
+	// Test vectors of EIP-55.
+	for _, want := range []string{
+		"0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"0xfB6916095ca1df60bB79Ce92cE3Ea74c37c5d359",
+		"0xdbF03B407c01E7cD3CBea99509d93f8DDDC8C6FB",
+		"0xD1220A0cf47c7B9Be7A2E6BA89F429762e7b9aDb",
+	} {
+		a, err := store.ParseAddress(want)
+		if err != nil {
+			t.Fatalf("ParseAddress(%s) error: %v", want, err)
+		}
+		if a.String() != strings.ToLower(want) || a.Checksummed() != want {
+			t.Errorf("ParseAddress(%s): Expected it back in both forms, got: %s %s", want, a, a.Checksummed())
+		}
+	}
+
+	checksummed := "0x5aAeb6053F3E94C9b9A09f33669435E7Ef1BeAed"
+	lower, upper := strings.ToLower(checksummed), "0x"+strings.ToUpper(checksummed[2:])
+	for name, bad := range map[string]string{
+		"bad checksum": "0x5AAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+		"short":        "0x5aaeb6053f3e94c9b9a09f33669435e7ef1bea",
+		"no prefix":    lower[2:],
+		"not hex":      "0x5aaeb6053f3e94c9b9a09f33669435e7ef1beagg",
+		"0X, bad sum":  "0X5AAeb6053F3E94C9b9A09f33669435E7Ef1BeAed",
+	} {
+		if _, err := s.CreateIfNotExists(ctx, bad, new(big.Int)); !errors.Is(err, store.ErrInvalidAddress) {
+			t.Errorf("%s: Expected ErrInvalidAddress, got: %v", name, err)
+		}
+	}
+
+	// Every spelling of the address names the same wallet, kept in
+	// lowercase, including those with a 0X prefix.
+	create(t, s, checksummed, 100)
+	create(t, s, upper, 50)
+	for _, spelling := range []string{upper, "0X" + checksummed[2:], strings.ToUpper(lower)} {
+		w, err := s.GetByAddress(ctx, spelling)
+		if err != nil {
+			t.Fatalf("GetByAddress(%s) error: %v", spelling, err)
+		}
+		if w.Address != lower || w.Balance.Cmp(big.NewInt(100)) != 0 {
+			t.Errorf("GetByAddress(%s): Expected %s holding 100, got: %s holding %v", spelling, lower, w.Address, w.Balance)
+		}
+	}
+
+	create(t, s, addr(1), 0)
+	if _, err := transfer(s, upper, strings.ToUpper(addr(1)[2:]), 10); !errors.Is(err, store.ErrInvalidAddress) {
+		t.Errorf("Recipient without 0x: Expected ErrInvalidAddress, got: %v", err)
+	}
+	if _, err := transfer(s, checksummed, "0x"+strings.ToUpper(addr(1)[2:]), 10); err != nil {
+		t.Fatalf("Transfer error: %v", err)
+	}
+	expectBalance(t, s, lower, 90)
+	expectBalance(t, s, addr(1), 10)
+
+	page, err := s.ListTransfers(ctx, checksummed, 10, "")
+	if err != nil {
+		t.Fatalf("ListTransfers error: %v", err)
+	}
+	if len(page) != 1 || page[0].FromAddress != lower || page[0].ToAddress != addr(1) {
+		t.Errorf("Expected the transfer between lowercase addresses, got: %+v", page)
+	}
+}
+
+func testRecipientPolicy(t *testing.T, newStore Factory) {
+	ctx := context.Background()
+
+	s := newStore(t)
+	create(t, s, addr(1), 100)
+	if _, err := transfer(s, addr(1), addr(2), 10); err != nil {
+		t.Fatalf("Default policy: Transfer to a new wallet error: %v", err)
+	}
+	expectBalance(t, s, addr(2), 10)
+
+	for _, p := range []string{"must-exist", "opt-in"} {
+		if _, err := store.ParseRecipientPolicy(p); err != nil {
+			t.Errorf("ParseRecipientPolicy(%s) error: %v", p, err)
+		}
+	}
+	if _, err := store.ParseRecipientPolicy("anyone"); !errors.Is(err, store.ErrInvalidArgument) {
+		t.Errorf("Unknown policy: Expected ErrInvalidArgument, got: %v", err)
+	}
+
+	s = newStore(t, store.WithRecipientPolicy(store.RecipientMustExist))
+	create(t, s, addr(1), 100)
+	create(t, s, addr(2), 0)
+	nonce := func(n uint64) *uint64 { return &n }
+	if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{
+		{To: addr(2), Amount: big.NewInt(10)},
+		{To: addr(3), Amount: big.NewInt(10)},
+	}, store.TransferOptions{Nonce: nonce(0)}); !errors.Is(err, store.ErrUnknownRecipient) {
+		t.Errorf("Must exist: Expected ErrUnknownRecipient, got: %v", err)
+	}
+
+	// A refused transfer changes nothing, not even the sender's nonce.
+	expectBalance(t, s, addr(1), 100)
+	expectBalance(t, s, addr(2), 0)
+	if _, err := s.GetByAddress(ctx, addr(3)); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("Refused transfer must not create %s, got: %v", addr(3), err)
+	}
+	if k, err := s.GetWalletKey(ctx, addr(1)); err != nil || k.Nonce != 0 {
+		t.Errorf("Expected nonce 0, got: %+v, %v", k, err)
+	}
+	if _, err := s.Transfer(ctx, addr(1), []store.TransferOp{{
+		To: addr(2), Amount: big.NewInt(10),
+	}}, store.TransferOptions{Nonce: nonce(0)}); err != nil {
+		t.Fatalf("Must exist: Transfer to an existing wallet error: %v", err)
+	}
+	expectBalance(t, s, addr(2), 10)
+
+	// Mints are not held to the policy.
+	if _, err := s.Mint(ctx, "", addr(4), big.NewInt(5)); err != nil {
+		t.Errorf("Must exist: Mint to a new wallet error: %v", err)
+	}
+
+	s = newStore(t, store.WithRecipientPolicy(store.RecipientOptIn))
+	create(t, s, addr(1), 100)
+	create(t, s, addr(2), 50)
+	if _, err := transfer(s, addr(1), addr(3), 10); !errors.Is(err, store.ErrUnknownRecipient) {
+		t.Errorf("Opt in, unknown wallet: Expected ErrUnknownRecipient, got: %v", err)
+	}
+	if _, err := transfer(s, addr(1), addr(2), 10); !errors.Is(err, store.ErrRecipientNotOptedIn) {
+		t.Errorf("Opt in, before opting in: Expected ErrRecipientNotOptedIn, got: %v", err)
+	}
+	if accepts, err := s.AcceptsTransfers(ctx, addr(2)); err != nil || accepts {
+		t.Errorf("Expected a new wallet not to accept transfers, got: %v, %v", accepts, err)
+	}
+
+	if err := s.SetAcceptsTransfers(ctx, addr(2), true); err != nil {
+		t.Fatalf("SetAcceptsTransfers error: %v", err)
+	}
+	if accepts, err := s.AcceptsTransfers(ctx, addr(2)); err != nil || !accepts {
+		t.Errorf("Expected the wallet to accept transfers, got: %v, %v", accepts, err)
+	}
+	if _, err := transfer(s, addr(1), addr(2), 10); err != nil {
+		t.Fatalf("Opt in, after opting in error: %v", err)
+	}
+	expectBalance(t, s, addr(1), 90)
+	expectBalance(t, s, addr(2), 60)
+
+	if err := s.SetAcceptsTransfers(ctx, addr(2), false); err != nil {
+		t.Fatalf("SetAcceptsTransfers error: %v", err)
+	}
+	if _, err := transfer(s, addr(1), addr(2), 10); !errors.Is(err, store.ErrRecipientNotOptedIn) {
+		t.Errorf("Opt in, after opting out: Expected ErrRecipientNotOptedIn, got: %v", err)
+	}
+
+	if err := s.SetAcceptsTransfers(ctx, addr(9), true); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("SetAcceptsTransfers on unknown wallet: Expected ErrWalletNotFound, got: %v", err)
+	}
+	if _, err := s.AcceptsTransfers(ctx, addr(9)); !errors.Is(err, store.ErrWalletNotFound) {
+		t.Errorf("AcceptsTransfers on unknown wallet: Expected ErrWalletNotFound, got: %v", err)
+	}
+	if err := s.SetAcceptsTransfers(ctx, "0xnope", true); !errors.Is(err, store.ErrInvalidAddress) {
+		t.Errorf("SetAcceptsTransfers on bad address: Expected ErrInvalidAddress, got: %v", err)
+	}
+	expectSupplyMatches(t, s)
+}
@@ -0,0 +1,51 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DefaultToken is the symbol of the token every wallet is seeded with and
+// that transfers move unless another token is asked for.
+const (
+	DefaultToken         = "BTP"
+	defaultTokenName     = "BTP Token"
+	defaultTokenDecimals = 0
+)
+
+// maxTokenDecimals keeps one whole token representable in 256 bits, the same
+// bound ERC-20 contracts live with.
+const maxTokenDecimals = 77
+
+var tokenSymbolPattern = regexp.MustCompile(`^[A-Z0-9]{1,11}$`)
+
+func validateToken(symbol, name string, decimals int) error {
+	if !tokenSymbolPattern.MatchString(symbol) {
+		return fmt.Errorf("%w: token symbol %q must be 1-11 uppercase letters or digits", ErrInvalidArgument, symbol)
+	}
+	if name == "" {
+		return fmt.Errorf("%w: token name is required", ErrInvalidArgument)
+	}
+	if decimals < 0 || decimals > maxTokenDecimals {
+		return fmt.Errorf("%w: token decimals must be between 0 and %d", ErrInvalidArgument, maxTokenDecimals)
+	}
+	return nil
+}
+
+// tokenOrDefault resolves the token a request refers to.
+func tokenOrDefault(symbol string) string {
+	if symbol == "" {
+		return DefaultToken
+	}
+	return symbol
+}
+
+func errUnknownToken(symbol string) error {
+	return fmt.Errorf("%w: %q", ErrTokenNotFound, symbol)
+}
+
+func errTokenExists(symbol string) error {
+	return fmt.Errorf("%w: token %q already exists", ErrConflict, symbol)
+}
+
+var errNonPositiveAmount = fmt.Errorf("%w: amount must be positive", ErrInvalidAmount)
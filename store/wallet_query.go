@@ -0,0 +1,183 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/zanpatryk/tokentransferapi/graph/generated"
+)
+
+// MaxWalletsPageSize is the most wallets ListWallets returns at once.
+const MaxWalletsPageSize = 500
+
+// WalletQuery selects a page of wallets for ListWallets.
+type WalletQuery struct {
+	// First is the maximum number of wallets returned, from 1 to
+	// MaxWalletsPageSize.
+	First int
+
+	// After is the cursor of the last wallet of the previous page, empty for
+	// the first page.
+	After string
+
+	// OrderBy sorts wallets by the given field, ties broken by address.
+	// Defaults to ascending address.
+	OrderBy generated.WalletOrder
+
+	Filter generated.WalletFilter
+
+	// AsOf, if set, lists wallets as they were at that time: only those
+	// created by then, holding the balances they held then. Balance filters
+	// and ordering apply to those balances.
+	AsOf *time.Time
+}
+
+// validate checks the page size of q, so no store slices or limits its
+// results by a size it cannot use.
+func (q WalletQuery) validate() error {
+	if q.First < 1 || q.First > MaxWalletsPageSize {
+		return fmt.Errorf("%w: first must be between 1 and %d, got %d", ErrInvalidArgument, MaxWalletsPageSize, q.First)
+	}
+	return nil
+}
+
+func (q WalletQuery) orderField() generated.WalletOrderField {
+	if q.OrderBy.Field == "" {
+		return generated.WalletOrderFieldAddress
+	}
+	return q.OrderBy.Field
+}
+
+func (q WalletQuery) descending() bool {
+	return q.OrderBy.Direction == generated.OrderDirectionDesc
+}
+
+// walletKey is the position of a wallet in the listing order.
+type walletKey struct {
+	balance   *big.Int
+	createdAt time.Time
+	address   string
+}
+
+func keyOf(w *generated.Wallet) walletKey {
+	return walletKey{balance: w.Balance, createdAt: w.CreatedAt, address: w.Address}
+}
+
+// compare orders a and b by field, then by address.
+func (a walletKey) compare(b walletKey, field generated.WalletOrderField) int {
+	var c int
+	switch field {
+	case generated.WalletOrderFieldBalance:
+		c = a.balance.Cmp(b.balance)
+	case generated.WalletOrderFieldCreatedAt:
+		c = a.createdAt.Compare(b.createdAt)
+	}
+	if c != 0 {
+		return c
+	}
+	return strings.Compare(a.address, b.address)
+}
+
+// walletCursor is the JSON form of a wallet cursor. The order field is kept
+// so a cursor cannot silently be used with another order.
+type walletCursor struct {
+	Field   generated.WalletOrderField `json:"f"`
+	Value   string                     `json:"v,omitempty"`
+	Address string                     `json:"a"`
+}
+
+func encodeWalletCursor(w *generated.Wallet, field generated.WalletOrderField) string {
+	c := walletCursor{Field: field, Address: w.Address}
+	switch field {
+	case generated.WalletOrderFieldBalance:
+		c.Value = w.Balance.String()
+	case generated.WalletOrderFieldCreatedAt:
+		c.Value = w.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// decodeWalletCursor returns the key of the wallet cursor points at. A nil
+// key means cursor is empty and listing starts at the beginning.
+func decodeWalletCursor(cursor string, field generated.WalletOrderField) (*walletKey, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	invalid := fmt.Errorf("%w: invalid wallet cursor %q", ErrInvalidArgument, cursor)
+
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalid
+	}
+	var c walletCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, invalid
+	}
+	if c.Field != field {
+		return nil, fmt.Errorf("%w: wallet cursor is for ordering by %s, not %s", ErrInvalidArgument, c.Field, field)
+	}
+
+	k := &walletKey{address: c.Address}
+	switch field {
+	case generated.WalletOrderFieldBalance:
+		var ok bool
+		if k.balance, ok = new(big.Int).SetString(c.Value, 10); !ok {
+			return nil, invalid
+		}
+	case generated.WalletOrderFieldCreatedAt:
+		if k.createdAt, err = time.Parse(time.RFC3339Nano, c.Value); err != nil {
+			return nil, invalid
+		}
+	}
+	return k, nil
+}
+
+// matches reports whether w passes every bound of f.
+func matches(f generated.WalletFilter, w *generated.Wallet) bool {
+	if f.MinBalance != nil && w.Balance.Cmp(f.MinBalance) < 0 {
+		return false
+	}
+	if f.MaxBalance != nil && w.Balance.Cmp(f.MaxBalance) > 0 {
+		return false
+	}
+	if f.CreatedAfter != nil && !w.CreatedAt.After(*f.CreatedAfter) {
+		return false
+	}
+	if f.CreatedBefore != nil && !w.CreatedAt.Before(*f.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// walletConnection turns up to first+1 wallets, already in listing order,
+// into a page. The extra wallet only signals that there is a next page.
+func walletConnection(ws []*generated.Wallet, q WalletQuery) *generated.WalletConnection {
+	conn := &generated.WalletConnection{
+		Edges: []*generated.WalletEdge{},
+		PageInfo: &generated.PageInfo{
+			HasNextPage:     len(ws) > q.First,
+			HasPreviousPage: q.After != "",
+		},
+	}
+	if conn.PageInfo.HasNextPage {
+		ws = ws[:q.First]
+	}
+
+	for _, w := range ws {
+		conn.Edges = append(conn.Edges, &generated.WalletEdge{
+			Cursor: encodeWalletCursor(w, q.orderField()),
+			Node:   w,
+		})
+	}
+	if len(conn.Edges) > 0 {
+		conn.PageInfo.StartCursor = &conn.Edges[0].Cursor
+		conn.PageInfo.EndCursor = &conn.Edges[len(conn.Edges)-1].Cursor
+	}
+	return conn
+}
@@ -2,8 +2,11 @@ package store
 
 import (
 	"context"
-	"errors"
+	"crypto/ed25519"
 	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,45 +15,374 @@ import (
 
 type WalletStore interface {
 	GetByAddress(ctx context.Context, address string) (*generated.Wallet, error)
+
+	// GetByAddressAsOf returns the wallet with the balances it held at asOf,
+	// reconstructed from its history of balance changes. A wallet created
+	// after asOf is not found.
+	GetByAddressAsOf(ctx context.Context, address string, asOf time.Time) (*generated.Wallet, error)
+
 	ListAll(ctx context.Context) ([]*generated.Wallet, error)
 
-	CreateIfNotExists(ctx context.Context, address string, initialBalance int) (*generated.Wallet, error)
+	// ListWallets returns the page of wallets selected by q, in the order
+	// it asks for.
+	ListWallets(ctx context.Context, q WalletQuery) (*generated.WalletConnection, error)
+
+	// CreateIfNotExists creates the wallet holding initialBalance of the
+	// default token. An existing wallet is returned unchanged.
+	CreateIfNotExists(ctx context.Context, address string, initialBalance *big.Int) (*generated.Wallet, error)
+
+	// Transfer applies every op from the given wallet atomically: either all
+	// legs succeed or none of them do. It returns the sender's new balance of
+	// the transferred token.
+	// Retrying with the same opts.IdempotencyKey within the store's idempotency
+	// window returns the original outcome instead of moving funds again.
+	Transfer(ctx context.Context, from string, ops []TransferOp, opts TransferOptions) (*big.Int, error)
+
+	// ListTransfers returns up to first recorded transfers, newest first.
+	// An empty address lists transfers of every wallet, and after is the id
+	// of the last transfer of the previous page.
+	ListTransfers(ctx context.Context, address string, first int, after string) ([]*generated.Transfer, error)
+
+	GetToken(ctx context.Context, symbol string) (*generated.Token, error)
+	ListTokens(ctx context.Context) ([]*generated.Token, error)
+
+	// CreateToken registers a new token with a total supply of zero.
+	CreateToken(ctx context.Context, symbol, name string, decimals int) (*generated.Token, error)
+
+	// Mint creates amount of token in the wallet to, creating the wallet if
+	// needed, and grows the token's total supply by the same amount. It
+	// returns the wallet's new balance of the token.
+	Mint(ctx context.Context, token, to string, amount *big.Int) (*big.Int, error)
+
+	// Burn destroys amount of token held by the wallet from and shrinks the
+	// token's total supply by the same amount. It returns the wallet's new
+	// balance of the token.
+	Burn(ctx context.Context, token, from string, amount *big.Int) (*big.Int, error)
+
+	// Approve sets how much of token spender may move out of owner's wallet
+	// with transfers made on its behalf, replacing any previous allowance.
+	Approve(ctx context.Context, token, owner, spender string, amount *big.Int, opts ApproveOptions) (*big.Int, error)
+
+	// Allowance returns how much of token spender may still move out of
+	// owner's wallet, zero if nothing was approved.
+	Allowance(ctx context.Context, token, owner, spender string) (*big.Int, error)
+
+	// Subscribe streams the events of every change committed from now on,
+	// across all instances sharing the store, until ctx is done. A subscriber
+	// that falls too far behind misses events.
+	Subscribe(ctx context.Context) (<-chan Event, error)
+
+	// CheckJournal returns every journal entry whose postings of a token do
+	// not sum to zero. A healthy store returns none.
+	CheckJournal(ctx context.Context) ([]UnbalancedEntry, error)
+
+	// RebuildBalances recomputes every balance and total supply from the
+	// journal, replacing the cached values.
+	RebuildBalances(ctx context.Context) error
+
+	// LedgerState reads the balances, total supplies and journal totals
+	// Reconcile compares, all as of the same moment.
+	LedgerState(ctx context.Context) (*LedgerState, error)
 
-	Transfer(ctx context.Context, from string, transfer TransferOp) (int, error)
+	// ApplyGenesis registers the tokens and creates the wallets of g, and
+	// records that it did, in one transaction. Once a genesis has been
+	// applied, later calls change nothing. It returns the record of the
+	// genesis in effect and whether that is g, applied by this call.
+	ApplyGenesis(ctx context.Context, g *Genesis) (*GenesisRecord, bool, error)
+
+	// ImportWallets credits the balance of every row to its wallet, creating
+	// the wallet if needed, in one transaction, and returns what became of
+	// each row. A row is skipped if its wallet already holds some of its
+	// token, or already exists when the row has nothing to credit. Rows must
+	// not repeat an address and token. With dryRun nothing is written, but
+	// the results are those of a real import.
+	ImportWallets(ctx context.Context, rows []WalletRow, dryRun bool) ([]RowResult, error)
+
+	// ImportTransfers records rows as transfer history, with new ids, in one
+	// transaction. No funds move and no events are published.
+	ImportTransfers(ctx context.Context, rows []*generated.Transfer, dryRun bool) ([]RowResult, error)
+
+	// ExportWallets calls fn with every nonzero balance, ordered by address
+	// and token, and with a zero balance of the default token for each
+	// wallet holding nothing, all as of the same moment.
+	ExportWallets(ctx context.Context, fn func(WalletRow) error) error
+
+	// ExportTransfers calls fn with every recorded transfer, oldest first.
+	ExportTransfers(ctx context.Context, fn func(*generated.Transfer) error) error
+
+	// CreateAPIKey stores k, setting its CreatedAt. It returns ErrConflict
+	// if the id is taken.
+	CreateAPIKey(ctx context.Context, k *APIKey) error
+
+	// GetAPIKey returns the key with id, revoked or not, or
+	// ErrAPIKeyNotFound.
+	GetAPIKey(ctx context.Context, id string) (*APIKey, error)
+
+	// ListAPIKeys returns every key, oldest first.
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+
+	// RevokeAPIKey stops the key with id from being used and returns it.
+	// Revoking a key again keeps the time it was first revoked.
+	RevokeAPIKey(ctx context.Context, id string) (*APIKey, error)
+
+	// RegisterWalletKey sets the key the wallet at address signs its
+	// transfers with; from then on it only sends signed ones. Registering
+	// the key again changes nothing, while a different key is ErrConflict.
+	RegisterWalletKey(ctx context.Context, address string, key ed25519.PublicKey) (*WalletKey, error)
+
+	// GetWalletKey returns the key and next nonce of the wallet at address,
+	// with a nil PublicKey if it has no key.
+	GetWalletKey(ctx context.Context, address string) (*WalletKey, error)
+
+	// SetAcceptsTransfers opts the wallet at address in to receiving
+	// transfers, or back out of it, which RecipientOptIn requires of every
+	// recipient. Wallets start out not accepting transfers.
+	SetAcceptsTransfers(ctx context.Context, address string, accepts bool) error
+
+	// AcceptsTransfers reports whether the wallet at address opted in to
+	// receiving transfers.
+	AcceptsTransfers(ctx context.Context, address string) (bool, error)
 }
 
 type InMemWalletStore struct {
-	mu      sync.Mutex
-	wallets map[string]*generated.Wallet
+	mu          sync.Mutex
+	opts        options
+	wallets     map[string]*inMemWallet
+	tokens      map[string]*generated.Token
+	transfers   []*generated.Transfer
+	idempotency map[idempotencyKey]*inMemIdempotentResult
+	allowances  map[allowanceKey]*big.Int
+	events      *eventBus
+
+	// journal is the source of truth for balances, which are kept in
+	// wallets and tokens as a projection of it.
+	journal []*inMemEntry
+
+	// genesis is the genesis applied to the store, nil if none was.
+	genesis *GenesisRecord
+
+	apiKeys map[string]*APIKey
+
+	// addressProblems are the wallets restored at an address that could not
+	// be moved to its lowercase form.
+	addressProblems []AddressProblem
+
+	// wal is the write-ahead log of a durable store, nil otherwise.
+	wal *walLog
+}
+
+type inMemWallet struct {
+	address   string
+	balances  map[string]*big.Int
+	publicKey ed25519.PublicKey
+	nonce     uint64
+	accepts   bool
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+type inMemEntry struct {
+	kind      JournalEntryKind
+	createdAt time.Time
+	postings  []posting
 }
 
-func NewInMemWalletStore() *InMemWalletStore {
+type idempotencyKey struct {
+	from string
+	key  string
+}
+
+type inMemIdempotentResult struct {
+	idempotentResult
+	createdAt time.Time
+
+	// expiresAt is when the key stops being honoured, fixed by the window in
+	// force when it was first used.
+	expiresAt time.Time
+}
+
+func NewInMemWalletStore(opts ...Option) *InMemWalletStore {
 	return &InMemWalletStore{
-		wallets: make(map[string]*generated.Wallet),
+		opts:    newOptions(opts),
+		wallets: make(map[string]*inMemWallet),
+		tokens: map[string]*generated.Token{
+			DefaultToken: {
+				Symbol:      DefaultToken,
+				Name:        defaultTokenName,
+				Decimals:    defaultTokenDecimals,
+				TotalSupply: new(big.Int),
+				CreatedAt:   time.Now().UTC(),
+			},
+		},
+		idempotency: make(map[idempotencyKey]*inMemIdempotentResult),
+		allowances:  make(map[allowanceKey]*big.Int),
+		apiKeys:     make(map[string]*APIKey),
+		events:      newEventBus(),
 	}
 }
 
 type TransferOp struct {
-	To     string
-	Amount int
+	To string
+	// Amount is moved from the sender to To and must be positive.
+	Amount *big.Int
+}
+
+// TransferOptions holds the optional, per-request settings of a transfer.
+type TransferOptions struct {
+	// IdempotencyKey deduplicates retries of the same transfer from the same
+	// wallet. Empty means the transfer is not deduplicated.
+	IdempotencyKey string
+
+	// Token is the symbol of the token every leg moves, DefaultToken if empty.
+	Token string
+
+	// Spender, if set, makes the transfer on behalf of the sender, drawing on
+	// the allowance the sender approved for it. The total of the legs is
+	// deducted from the allowance.
+	Spender string
+
+	// Nonce, if set, must be the next nonce of the sender, which the transfer
+	// then uses up whether it succeeds or is rejected.
+	Nonce *uint64
+
+	// SignedWith is the key the transfer was signed with, which must be the
+	// one registered for the sender. A sender with a registered key only
+	// sends signed transfers, apart from those made by a spender.
+	SignedWith ed25519.PublicKey `json:",omitempty"`
+}
+
+// ApproveOptions holds the optional settings of an approval.
+type ApproveOptions struct {
+	// Nonce, if set, must be the next nonce of the owner, which the approval
+	// then uses up. Approvals and transfers share the owner's nonces.
+	Nonce *uint64
+
+	// SignedWith is the key the approval was signed with, which must be the
+	// one registered for the owner. An owner with a registered key only
+	// approves spenders with signed approvals.
+	SignedWith ed25519.PublicKey `json:",omitempty"`
+}
+
+var errNoTransfers = fmt.Errorf("%w: at least one transfer is required", ErrInvalidArgument)
+
+// lockOrder returns the distinct addresses touched by a transfer, sorted so
+// concurrent transfers always acquire their locks in the same order.
+func lockOrder(from string, ops []TransferOp) []string {
+	seen := map[string]bool{from: true}
+	addrs := []string{from}
+	for _, op := range ops {
+		if !seen[op.To] {
+			seen[op.To] = true
+			addrs = append(addrs, op.To)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// balance returns the wallet's balance of token, zero if it never held any.
+func (w *inMemWallet) balance(token string) *big.Int {
+	if b, ok := w.balances[token]; ok {
+		return b
+	}
+	return new(big.Int)
+}
+
+// toWallet returns a copy of w that shares no mutable state with the store;
+// callers must hold s.mu.
+func (s *InMemWalletStore) toWallet(w *inMemWallet) *generated.Wallet {
+	out := &generated.Wallet{
+		Address:   w.address,
+		Balance:   new(big.Int).Set(w.balance(DefaultToken)),
+		Balances:  []*generated.TokenBalance{},
+		CreatedAt: w.createdAt,
+		UpdatedAt: w.updatedAt,
+	}
+
+	symbols := make([]string, 0, len(w.balances))
+	for symbol := range w.balances {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+
+	for _, symbol := range symbols {
+		out.Balances = append(out.Balances, &generated.TokenBalance{
+			Token:   copyToken(s.tokens[symbol]),
+			Balance: new(big.Int).Set(w.balances[symbol]),
+		})
+	}
+	return out
+}
+
+func copyToken(t *generated.Token) *generated.Token {
+	cp := *t
+	cp.TotalSupply = new(big.Int).Set(t.TotalSupply)
+	return &cp
 }
 
 func (s *InMemWalletStore) GetByAddress(ctx context.Context, address string) (*generated.Wallet, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	w, exists := s.wallets[address]
 
 	if !exists {
-		return nil, errors.New("wallet not found")
+		return nil, ErrWalletNotFound
 	}
 
-	return &generated.Wallet{
-		Address:   w.Address,
-		Balance:   w.Balance,
-		CreatedAt: w.CreatedAt,
-		UpdatedAt: w.UpdatedAt,
-	}, nil
+	return s.toWallet(w), nil
+}
+
+func (s *InMemWalletStore) GetByAddressAsOf(ctx context.Context, address string, asOf time.Time) (*generated.Wallet, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, exists := s.walletsAsOf(asOf)[address]
+	if !exists {
+		return nil, ErrWalletNotFound
+	}
+	return s.toWallet(w), nil
+}
+
+// walletsAsOf returns every wallet created by asOf as it was then, rebuilt
+// by replaying the journal up to asOf; callers must hold s.mu.
+func (s *InMemWalletStore) walletsAsOf(asOf time.Time) map[string]*inMemWallet {
+	out := make(map[string]*inMemWallet)
+	for address, w := range s.wallets {
+		if !w.createdAt.After(asOf) {
+			out[address] = &inMemWallet{
+				address:   address,
+				balances:  make(map[string]*big.Int),
+				createdAt: w.createdAt,
+				updatedAt: w.createdAt,
+			}
+		}
+	}
+
+	for _, e := range s.journal {
+		if e.createdAt.After(asOf) {
+			continue
+		}
+		for _, p := range e.postings {
+			w, ok := out[p.address]
+			if !ok {
+				continue
+			}
+			w.balances[p.token] = new(big.Int).Add(w.balance(p.token), p.amount)
+			if e.createdAt.After(w.updatedAt) {
+				w.updatedAt = e.createdAt
+			}
+		}
+	}
+	return out
 }
 
 func (s *InMemWalletStore) ListAll(ctx context.Context) ([]*generated.Wallet, error) {
@@ -60,92 +392,1021 @@ func (s *InMemWalletStore) ListAll(ctx context.Context) ([]*generated.Wallet, er
 	var out []*generated.Wallet
 
 	for _, w := range s.wallets {
-		out = append(out, &generated.Wallet{
-			Address:   w.Address,
-			Balance:   w.Balance,
-			CreatedAt: w.CreatedAt,
-			UpdatedAt: w.UpdatedAt,
-		})
+		out = append(out, s.toWallet(w))
 	}
 	return out, nil
 }
 
-func (s *InMemWalletStore) CreateIfNotExists(ctx context.Context, address string, initialBalance int) (*generated.Wallet, error) {
+func (s *InMemWalletStore) ListWallets(ctx context.Context, q WalletQuery) (*generated.WalletConnection, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	field := q.orderField()
+	after, err := decodeWalletCursor(q.After, field)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wallets := s.wallets
+	if q.AsOf != nil {
+		wallets = s.walletsAsOf(*q.AsOf)
+	}
+
+	ws := []*generated.Wallet{}
+	for _, w := range wallets {
+		out := s.toWallet(w)
+		if matches(q.Filter, out) {
+			ws = append(ws, out)
+		}
+	}
+
+	sign := 1
+	if q.descending() {
+		sign = -1
+	}
+	sort.Slice(ws, func(i, j int) bool {
+		return sign*keyOf(ws[i]).compare(keyOf(ws[j]), field) < 0
+	})
+
+	if after != nil {
+		start := sort.Search(len(ws), func(i int) bool {
+			return sign*keyOf(ws[i]).compare(*after, field) > 0
+		})
+		ws = ws[start:]
+	}
+	if len(ws) > q.First+1 {
+		ws = ws[:q.First+1]
+	}
+
+	return walletConnection(ws, q), nil
+}
+
+func (s *InMemWalletStore) CreateIfNotExists(ctx context.Context, address string, initialBalance *big.Int) (*generated.Wallet, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if w, exists := s.wallets[address]; exists {
-		return &generated.Wallet{
-			Address:   w.Address,
-			Balance:   w.Balance,
-			CreatedAt: w.CreatedAt,
-			UpdatedAt: w.UpdatedAt,
-		}, nil
+		return s.toWallet(w), nil
 	}
 
 	now := time.Now().UTC()
-	w := &generated.Wallet{
-		Address:   address,
-		Balance:   initialBalance,
-		CreatedAt: now,
-		UpdatedAt: now,
+	if err := s.log(walRecord{Op: walCreateWallet, At: now, Address: address, Amount: initialBalance}); err != nil {
+		return nil, err
+	}
+	return s.toWallet(s.createWallet(address, initialBalance, now)), nil
+}
+
+// createWallet adds a wallet holding initialBalance of the default token;
+// callers must hold s.mu and have checked that address is not taken.
+func (s *InMemWalletStore) createWallet(address string, initialBalance *big.Int, now time.Time) *inMemWallet {
+	w := &inMemWallet{
+		address:   address,
+		balances:  make(map[string]*big.Int),
+		createdAt: now,
+		updatedAt: now,
+	}
+
+	if initialBalance.Sign() != 0 {
+		w.balances[DefaultToken] = new(big.Int).Set(initialBalance)
+		supply := s.tokens[DefaultToken].TotalSupply
+		supply.Add(supply, initialBalance)
+		s.post(EntrySeed, now, issuancePostings(address, DefaultToken, initialBalance))
 	}
 
 	s.wallets[address] = w
 
-	return &generated.Wallet{
-		Address:   w.Address,
-		Balance:   w.Balance,
-		CreatedAt: w.CreatedAt,
-		UpdatedAt: w.UpdatedAt,
-	}, nil
+	if initialBalance.Sign() != 0 {
+		s.events.publish(balanceChanged(address, DefaultToken, initialBalance))
+	}
+
+	return w
 }
 
-func (s *InMemWalletStore) Transfer(ctx context.Context, from string, op TransferOp) (int, error) {
+func (s *InMemWalletStore) Transfer(ctx context.Context, from string, ops []TransferOp, opts TransferOptions) (*big.Int, error) {
+	from, ops, opts, err := canonicalTransfer(from, ops, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := transferTotal(ops); err != nil {
+		return nil, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := time.Now().UTC()
+	policy, window := s.opts.recipientPolicy, s.opts.idempotencyWindow
+	if err := s.log(walRecord{Op: walTransfer, At: now, Address: from, Legs: ops, Options: opts, RecipientPolicy: policy, IdempotencyWindow: &window}); err != nil {
+		return nil, err
+	}
+	return s.transfer(from, ops, opts, policy, window, now)
+}
+
+// transfer applies a transfer whose legs have already been validated,
+// checking its recipients under policy and remembering its outcome for window
+// if it has an idempotency key; callers must hold s.mu.
+func (s *InMemWalletStore) transfer(from string, ops []TransferOp, opts TransferOptions, policy RecipientPolicy, window time.Duration, now time.Time) (*big.Int, error) {
+	token := tokenOrDefault(opts.Token)
+
+	var spent *big.Int
+	if opts.Spender != "" {
+		spent, _ = transferTotal(ops)
+	}
+
+	if _, ok := s.tokens[token]; !ok {
+		return nil, errUnknownToken(token)
+	}
+
+	if opts.IdempotencyKey != "" {
+		prev, ok := s.idempotency[idempotencyKey{from, opts.IdempotencyKey}]
+		if ok && now.Before(prev.expiresAt) {
+			return prev.replay(transferFingerprint(token, ops, opts))
+		}
+	}
+
 	senderW, ok := s.wallets[from]
 
 	if !ok {
-		return 0, errors.New("sender not found")
+		return nil, fmt.Errorf("sender %w", ErrWalletNotFound)
+	}
+	if err := checkTransferKey(senderW.publicKey, senderW.nonce, opts); err != nil {
+		return nil, err
+	}
+	err := checkRecipients(policy, ops, func(address string) (recipientState, error) {
+		w, exists := s.wallets[address]
+		return recipientState{exists: exists, accepts: exists && w.accepts}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.Nonce != nil {
+		senderW.nonce++
+	}
+
+	allowance := allowanceKey{from, opts.Spender, token}
+	if spent != nil {
+		if s.allowance(allowance).Cmp(spent) < 0 {
+			return s.rejectTransfer(from, token, ops, opts, senderW.balance(token), now, window, ErrInsufficientAllowance)
+		}
+	}
+
+	// Legs are applied to a scratch copy of the involved balances first, so a
+	// rejected leg leaves every wallet untouched.
+	balances := make(map[string]*big.Int)
+	for _, addr := range lockOrder(from, ops) {
+		if w, exists := s.wallets[addr]; exists {
+			balances[addr] = new(big.Int).Set(w.balance(token))
+		}
+	}
+
+	for _, op := range ops {
+		toAddr, rawAmt := op.To, op.Amount
+
+		// Transfers logged before amounts had to be positive may still
+		// pull funds back from a recipient with a negative leg.
+		if rawAmt.Sign() >= 0 {
+			if balances[from].Cmp(rawAmt) < 0 {
+				return s.rejectTransfer(from, token, ops, opts, senderW.balance(token), now, window, ErrInsufficientFunds)
+			}
+
+			if _, exists := balances[toAddr]; !exists {
+				balances[toAddr] = new(big.Int)
+			}
+			balances[from].Sub(balances[from], rawAmt)
+			balances[toAddr].Add(balances[toAddr], rawAmt)
+		} else {
+			absAmt := new(big.Int).Neg(rawAmt)
+
+			recBal, exists := balances[toAddr]
+
+			if !exists || recBal.Cmp(absAmt) < 0 {
+				return s.rejectTransfer(from, token, ops, opts, senderW.balance(token), now, window, errInsufficientFundsOnRecipient)
+			}
+
+			recBal.Sub(recBal, absAmt)
+			balances[from].Add(balances[from], absAmt)
+		}
+	}
+
+	for addr, bal := range balances {
+		w, exists := s.wallets[addr]
+		if !exists {
+			w = &inMemWallet{address: addr, balances: make(map[string]*big.Int), createdAt: now}
+			s.wallets[addr] = w
+		}
+		w.balances[token] = bal
+		w.updatedAt = now
+	}
+
+	if spent != nil {
+		s.allowances[allowance] = new(big.Int).Sub(s.allowance(allowance), spent)
+	}
+
+	var postings []posting
+	for _, op := range ops {
+		id := s.recordTransfer(from, token, op, opts, generated.TransferStatusSucceeded, nil, now)
+		postings = append(postings, transferPostings(from, token, op, id)...)
+	}
+	s.post(EntryTransfer, now, postings)
+	for _, addr := range lockOrder(from, ops) {
+		s.events.publish(balanceChanged(addr, token, balances[addr]))
+	}
+	s.rememberResult(from, token, ops, opts, senderW.balance(token), "", now, window)
+
+	return new(big.Int).Set(senderW.balance(token)), nil
+}
+
+func (s *InMemWalletStore) rejectTransfer(from, token string, ops []TransferOp, opts TransferOptions, balance *big.Int, now time.Time, window time.Duration, rejection error) (*big.Int, error) {
+	reason := rejection.Error()
+	for _, op := range ops {
+		s.recordTransfer(from, token, op, opts, generated.TransferStatusRejected, &reason, now)
+	}
+	s.rememberResult(from, token, ops, opts, balance, reason, now, window)
+	return new(big.Int).Set(balance), rejection
+}
+
+// rememberResult stores the outcome of a transfer under its idempotency key
+// for window; callers must hold s.mu.
+func (s *InMemWalletStore) rememberResult(from, token string, ops []TransferOp, opts TransferOptions, balance *big.Int, reason string, now time.Time, window time.Duration) {
+	if opts.IdempotencyKey == "" {
+		return
+	}
+	s.idempotency[idempotencyKey{from, opts.IdempotencyKey}] = &inMemIdempotentResult{
+		idempotentResult: idempotentResult{
+			fingerprint: transferFingerprint(token, ops, opts),
+			balance:     new(big.Int).Set(balance),
+			reason:      reason,
+		},
+		createdAt: now,
+		expiresAt: now.Add(window),
+	}
+}
+
+// recordTransfer appends op to the ledger, announces it and returns its id;
+// callers must hold s.mu.
+func (s *InMemWalletStore) recordTransfer(from, token string, op TransferOp, opts TransferOptions, status generated.TransferStatus, reason *string, now time.Time) string {
+	var spender *string
+	if opts.Spender != "" {
+		spender = &opts.Spender
+	}
+	s.transfers = append(s.transfers, &generated.Transfer{
+		ID:          strconv.Itoa(len(s.transfers) + 1),
+		FromAddress: from,
+		ToAddress:   op.To,
+		Spender:     spender,
+		Token:       token,
+		Amount:      new(big.Int).Set(op.Amount),
+		Status:      status,
+		Error:       reason,
+		CreatedAt:   now,
+	})
+	t := s.transfers[len(s.transfers)-1]
+	s.events.publish(transferCreated(t))
+	return t.ID
+}
+
+// post appends an entry of postings to the journal, leaving out postings of
+// zero; callers must hold s.mu.
+func (s *InMemWalletStore) post(kind JournalEntryKind, now time.Time, postings []posting) {
+	entry := &inMemEntry{kind: kind, createdAt: now}
+	for _, p := range postings {
+		if p.amount.Sign() != 0 {
+			entry.postings = append(entry.postings, p)
+		}
+	}
+	s.journal = append(s.journal, entry)
+}
+
+func (s *InMemWalletStore) ListTransfers(ctx context.Context, address string, first int, after string) ([]*generated.Transfer, error) {
+	if address != "" {
+		var err error
+		if address, err = canonicalAddress(address); err != nil {
+			return nil, err
+		}
+	}
+	cursor, err := parseTransferCursor(after)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []*generated.Transfer{}
+	for i := len(s.transfers) - 1; i >= 0 && len(out) < first; i-- {
+		t := s.transfers[i]
+		if cursor != 0 && int64(i+1) >= cursor {
+			continue
+		}
+		if address != "" && t.FromAddress != address && t.ToAddress != address {
+			continue
+		}
+		cp := *t
+		cp.Amount = new(big.Int).Set(t.Amount)
+		out = append(out, &cp)
+	}
+	return out, nil
+}
+
+// parseTransferCursor turns the after argument of ListTransfers into a
+// transfer id, where 0 means "start from the newest transfer".
+func parseTransferCursor(after string) (int64, error) {
+	if after == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(after, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w: invalid transfer cursor %q", ErrInvalidArgument, after)
+	}
+	return id, nil
+}
+
+func (s *InMemWalletStore) GetToken(ctx context.Context, symbol string) (*generated.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[symbol]
+	if !ok {
+		return nil, errUnknownToken(symbol)
+	}
+	return copyToken(t), nil
+}
+
+func (s *InMemWalletStore) ListTokens(ctx context.Context) ([]*generated.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make([]*generated.Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		out = append(out, copyToken(t))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Symbol < out[j].Symbol })
+	return out, nil
+}
+
+func (s *InMemWalletStore) CreateToken(ctx context.Context, symbol, name string, decimals int) (*generated.Token, error) {
+	if err := validateToken(symbol, name, decimals); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.tokens[symbol]; exists {
+		return nil, errTokenExists(symbol)
+	}
+
+	now := time.Now().UTC()
+	if err := s.log(walRecord{Op: walCreateToken, At: now, Token: symbol, Name: name, Decimals: decimals}); err != nil {
+		return nil, err
+	}
+	return copyToken(s.createToken(symbol, name, decimals, now)), nil
+}
+
+// createToken registers a validated token that does not exist yet; callers
+// must hold s.mu.
+func (s *InMemWalletStore) createToken(symbol, name string, decimals int, now time.Time) *generated.Token {
+	t := &generated.Token{
+		Symbol:      symbol,
+		Name:        name,
+		Decimals:    decimals,
+		TotalSupply: new(big.Int),
+		CreatedAt:   now,
+	}
+	s.tokens[symbol] = t
+	return t
+}
+
+func (s *InMemWalletStore) Mint(ctx context.Context, token, to string, amount *big.Int) (*big.Int, error) {
+	to, err := canonicalAddress(to)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Sign() <= 0 {
+		return nil, errNonPositiveAmount
+	}
+	token = tokenOrDefault(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	if err := s.log(walRecord{Op: walMint, At: now, Token: token, Address: to, Amount: amount}); err != nil {
+		return nil, err
+	}
+	return s.mint(token, to, amount, now)
+}
+
+// mint applies a mint of a positive amount; callers must hold s.mu.
+func (s *InMemWalletStore) mint(token, to string, amount *big.Int, now time.Time) (*big.Int, error) {
+	t, ok := s.tokens[token]
+	if !ok {
+		return nil, errUnknownToken(token)
+	}
+
+	w, exists := s.wallets[to]
+	if !exists {
+		w = &inMemWallet{address: to, balances: make(map[string]*big.Int), createdAt: now}
+		s.wallets[to] = w
+	}
+
+	bal := new(big.Int).Add(w.balance(token), amount)
+	w.balances[token] = bal
+	w.updatedAt = now
+	t.TotalSupply.Add(t.TotalSupply, amount)
+	s.post(EntryMint, now, issuancePostings(to, token, amount))
+	s.events.publish(balanceChanged(to, token, bal))
+
+	return new(big.Int).Set(bal), nil
+}
+
+func (s *InMemWalletStore) Burn(ctx context.Context, token, from string, amount *big.Int) (*big.Int, error) {
+	from, err := canonicalAddress(from)
+	if err != nil {
+		return nil, err
+	}
+	if amount.Sign() <= 0 {
+		return nil, errNonPositiveAmount
+	}
+	token = tokenOrDefault(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	if err := s.log(walRecord{Op: walBurn, At: now, Token: token, Address: from, Amount: amount}); err != nil {
+		return nil, err
+	}
+	return s.burn(token, from, amount, now)
+}
+
+// burn applies a burn of a positive amount; callers must hold s.mu.
+func (s *InMemWalletStore) burn(token, from string, amount *big.Int, now time.Time) (*big.Int, error) {
+	t, ok := s.tokens[token]
+	if !ok {
+		return nil, errUnknownToken(token)
+	}
+
+	w, exists := s.wallets[from]
+	if !exists || w.balance(token).Cmp(amount) < 0 {
+		return nil, ErrInsufficientFunds
+	}
+
+	bal := new(big.Int).Sub(w.balance(token), amount)
+	w.balances[token] = bal
+	w.updatedAt = now
+	t.TotalSupply.Sub(t.TotalSupply, amount)
+	s.post(EntryBurn, now, issuancePostings(from, token, new(big.Int).Neg(amount)))
+	s.events.publish(balanceChanged(from, token, bal))
+
+	return new(big.Int).Set(bal), nil
+}
+
+func (s *InMemWalletStore) Approve(ctx context.Context, token, owner, spender string, amount *big.Int, opts ApproveOptions) (*big.Int, error) {
+	if err := canonicalAddresses(&owner, &spender); err != nil {
+		return nil, err
+	}
+	if amount.Sign() < 0 {
+		return nil, errNegativeAllowance
+	}
+	token = tokenOrDefault(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.log(walRecord{Op: walApprove, At: time.Now().UTC(), Token: token, Address: owner, Spender: spender, Amount: amount, Approval: &opts}); err != nil {
+		return nil, err
+	}
+	return s.approve(token, owner, spender, amount, &opts)
+}
+
+// approve applies an approval of a non-negative amount, checked against the
+// owner's key and nonce unless opts is nil, as it is for approvals logged
+// before they could be signed; callers must hold s.mu.
+func (s *InMemWalletStore) approve(token, owner, spender string, amount *big.Int, opts *ApproveOptions) (*big.Int, error) {
+	if _, ok := s.tokens[token]; !ok {
+		return nil, errUnknownToken(token)
+	}
+	w, ok := s.wallets[owner]
+	if !ok {
+		return nil, fmt.Errorf("owner %w", ErrWalletNotFound)
+	}
+	if opts != nil {
+		if err := checkApproveKey(w.publicKey, w.nonce, *opts); err != nil {
+			return nil, err
+		}
+		if opts.Nonce != nil {
+			w.nonce++
+		}
+	}
+
+	s.allowances[allowanceKey{owner, spender, token}] = new(big.Int).Set(amount)
+	return new(big.Int).Set(amount), nil
+}
+
+func (s *InMemWalletStore) Allowance(ctx context.Context, token, owner, spender string) (*big.Int, error) {
+	if err := canonicalAddresses(&owner, &spender); err != nil {
+		return nil, err
+	}
+	token = tokenOrDefault(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tokens[token]; !ok {
+		return nil, errUnknownToken(token)
+	}
+	return new(big.Int).Set(s.allowance(allowanceKey{owner, spender, token})), nil
+}
+
+// allowance returns the allowance stored under k, zero if there is none;
+// callers must hold s.mu.
+func (s *InMemWalletStore) allowance(k allowanceKey) *big.Int {
+	if a, ok := s.allowances[k]; ok {
+		return a
+	}
+	return new(big.Int)
+}
+
+func (s *InMemWalletStore) Subscribe(ctx context.Context) (<-chan Event, error) {
+	return s.events.subscribe(ctx), nil
+}
+
+func (s *InMemWalletStore) CheckJournal(ctx context.Context) ([]UnbalancedEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := []UnbalancedEntry{}
+	for i, e := range s.journal {
+		sums := unbalancedTokens(e.postings)
+		tokens := make([]string, 0, len(sums))
+		for token := range sums {
+			tokens = append(tokens, token)
+		}
+		sort.Strings(tokens)
+
+		for _, token := range tokens {
+			out = append(out, UnbalancedEntry{
+				EntryID:   strconv.Itoa(i + 1),
+				Kind:      e.kind,
+				Token:     token,
+				Sum:       sums[token],
+				CreatedAt: e.createdAt,
+			})
+		}
+	}
+	return out, nil
+}
+
+func (s *InMemWalletStore) RebuildBalances(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.wallets {
+		for token := range w.balances {
+			w.balances[token] = new(big.Int)
+		}
+	}
+	for _, t := range s.tokens {
+		t.TotalSupply = new(big.Int)
+	}
+
+	for _, e := range s.journal {
+		for _, p := range e.postings {
+			if p.address == IssuanceAccount {
+				t := s.tokens[p.token]
+				t.TotalSupply.Sub(t.TotalSupply, p.amount)
+				continue
+			}
+			w := s.wallets[p.address]
+			w.balances[p.token] = new(big.Int).Add(w.balance(p.token), p.amount)
+		}
+	}
+	return nil
+}
+
+func (s *InMemWalletStore) LedgerState(ctx context.Context) (*LedgerState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state := &LedgerState{Supplies: make(map[string]*big.Int, len(s.tokens))}
+	for _, w := range s.wallets {
+		for token, bal := range w.balances {
+			state.Balances = append(state.Balances, AccountBalance{
+				Address: w.address, Token: token, Balance: new(big.Int).Set(bal),
+			})
+		}
+	}
+	for symbol, t := range s.tokens {
+		state.Supplies[symbol] = new(big.Int).Set(t.TotalSupply)
+	}
+
+	type account struct{ address, token string }
+	sums := make(map[account]*big.Int)
+	for _, e := range s.journal {
+		for _, p := range e.postings {
+			a := account{p.address, p.token}
+			if sums[a] == nil {
+				sums[a] = new(big.Int)
+			}
+			sums[a].Add(sums[a], p.amount)
+		}
+	}
+	for a, sum := range sums {
+		state.Journal = append(state.Journal, AccountBalance{Address: a.address, Token: a.token, Balance: sum})
+	}
+	return state, nil
+}
+
+func (s *InMemWalletStore) ApplyGenesis(ctx context.Context, g *Genesis) (*GenesisRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.genesis != nil {
+		rec := *s.genesis
+		return &rec, false, nil
+	}
+	if err := s.checkGenesis(g); err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now().UTC()
+	if err := s.log(walRecord{Op: walGenesis, At: now, Genesis: g}); err != nil {
+		return nil, false, err
+	}
+	rec := *s.applyGenesis(g, now)
+	return &rec, true, nil
+}
+
+// checkGenesis returns the error applying g would fail with; callers must
+// hold s.mu.
+func (s *InMemWalletStore) checkGenesis(g *Genesis) error {
+	listed := make(map[string]bool)
+	for _, t := range g.Tokens {
+		if existing, exists := s.tokens[t.Symbol]; exists {
+			if err := checkGenesisToken(t, existing); err != nil {
+				return err
+			}
+		}
+		listed[t.Symbol] = true
+	}
+	for _, w := range g.Wallets {
+		for _, b := range w.Balances {
+			if _, exists := s.tokens[b.Token]; !exists && !listed[b.Token] {
+				return errUnknownToken(b.Token)
+			}
+		}
+	}
+	return nil
+}
+
+// applyGenesis applies g, which checkGenesis accepted, and records it;
+// callers must hold s.mu.
+func (s *InMemWalletStore) applyGenesis(g *Genesis, now time.Time) *GenesisRecord {
+	for _, t := range g.Tokens {
+		if _, exists := s.tokens[t.Symbol]; !exists {
+			s.createToken(t.Symbol, t.Name, t.Decimals, now)
+		}
+	}
+
+	for _, gw := range g.Wallets {
+		if _, exists := s.wallets[gw.Address]; exists {
+			continue
+		}
+		w := &inMemWallet{
+			address:   gw.Address,
+			balances:  make(map[string]*big.Int),
+			createdAt: now,
+			updatedAt: now,
+		}
+		for _, b := range gw.Balances {
+			w.balances[b.Token] = new(big.Int).Set(b.Amount)
+			supply := s.tokens[b.Token].TotalSupply
+			supply.Add(supply, b.Amount)
+		}
+		s.wallets[gw.Address] = w
+
+		if len(gw.Balances) > 0 {
+			s.post(EntrySeed, now, gw.postings())
+		}
+		for _, b := range gw.Balances {
+			s.events.publish(balanceChanged(gw.Address, b.Token, b.Amount))
+		}
 	}
 
+	s.genesis = &GenesisRecord{Checksum: g.Checksum, AppliedAt: now}
+	return s.genesis
+}
+
+func (s *InMemWalletStore) ImportWallets(ctx context.Context, rows []WalletRow, dryRun bool) ([]RowResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	now := time.Now().UTC()
+	if !dryRun {
+		if err := s.log(walRecord{Op: walImportWallets, At: now, WalletRows: rows}); err != nil {
+			return nil, err
+		}
+	}
+	return s.importWallets(rows, now, dryRun), nil
+}
 
-	toAddr, rawAmt := op.To, op.Amount
+// importWallets imports rows, or with dryRun only works out what importing
+// them would do; callers must hold s.mu.
+func (s *InMemWalletStore) importWallets(rows []WalletRow, now time.Time, dryRun bool) []RowResult {
+	results := make([]RowResult, len(rows))
+	var postings []posting
+	created := make(map[string]bool)
+	for i, row := range rows {
+		t, known := s.tokens[row.Token]
+		w, exists := s.wallets[row.Address]
+		held := new(big.Int)
+		if exists {
+			held = w.balance(row.Token)
+		}
 
-	if rawAmt >= 0 {
+		// Rows are checked against the store as it was before the batch,
+		// whatever their order.
+		exists = exists && !created[row.Address]
+		results[i] = walletRowResult(row, known, exists, held)
+		if results[i].Status != RowImported {
+			continue
+		}
+		if !exists {
+			created[row.Address] = true
+		}
+		if dryRun {
+			continue
+		}
 
-		if senderW.Balance < rawAmt {
-			return 0, fmt.Errorf("insufficient funds")
+		if w == nil {
+			w = &inMemWallet{address: row.Address, balances: make(map[string]*big.Int), createdAt: now, updatedAt: now}
+			s.wallets[row.Address] = w
+		}
+		if row.Balance.Sign() != 0 {
+			w.balances[row.Token] = new(big.Int).Set(row.Balance)
+			w.updatedAt = now
+			t.TotalSupply.Add(t.TotalSupply, row.Balance)
+			postings = append(postings, issuancePostings(row.Address, row.Token, row.Balance)...)
+			s.events.publish(balanceChanged(row.Address, row.Token, row.Balance))
 		}
+	}
+
+	if len(postings) > 0 {
+		s.post(EntrySeed, now, postings)
+	}
+	return results
+}
+
+func (s *InMemWalletStore) ImportTransfers(ctx context.Context, rows []*generated.Transfer, dryRun bool) ([]RowResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !dryRun {
+		if err := s.log(walRecord{Op: walImportTransfers, At: time.Now().UTC(), Transfers: rows}); err != nil {
+			return nil, err
+		}
+	}
+	return s.importTransfers(rows, dryRun), nil
+}
+
+// importTransfers imports rows, or with dryRun only works out what
+// importing them would do; callers must hold s.mu.
+func (s *InMemWalletStore) importTransfers(rows []*generated.Transfer, dryRun bool) []RowResult {
+	results := make([]RowResult, len(rows))
+	for i, t := range rows {
+		if _, ok := s.tokens[t.Token]; !ok {
+			results[i] = rowFailed(errUnknownToken(t.Token))
+			continue
+		}
+
+		results[i] = RowResult{Status: RowImported}
+		if dryRun {
+			continue
+		}
+		cp := *t
+		cp.ID = strconv.Itoa(len(s.transfers) + 1)
+		cp.Amount = new(big.Int).Set(t.Amount)
+		s.transfers = append(s.transfers, &cp)
+	}
+	return results
+}
+
+func (s *InMemWalletStore) ExportWallets(ctx context.Context, fn func(WalletRow) error) error {
+	// Rows are copied out first, so fn can take its time without holding up
+	// writers.
+	s.mu.Lock()
+	var rows []WalletRow
+	for _, w := range s.wallets {
+		held := 0
+		for token, bal := range w.balances {
+			if bal.Sign() != 0 {
+				rows = append(rows, WalletRow{Address: w.address, Token: token, Balance: new(big.Int).Set(bal)})
+				held++
+			}
+		}
+		if held == 0 {
+			rows = append(rows, WalletRow{Address: w.address, Token: DefaultToken, Balance: new(big.Int)})
+		}
+	}
+	s.mu.Unlock()
+
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Address != rows[j].Address {
+			return rows[i].Address < rows[j].Address
+		}
+		return rows[i].Token < rows[j].Token
+	})
+	for _, row := range rows {
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *InMemWalletStore) ExportTransfers(ctx context.Context, fn func(*generated.Transfer) error) error {
+	s.mu.Lock()
+	transfers := make([]*generated.Transfer, len(s.transfers))
+	for i, t := range s.transfers {
+		cp := *t
+		cp.Amount = new(big.Int).Set(t.Amount)
+		transfers[i] = &cp
+	}
+	s.mu.Unlock()
+
+	for _, t := range transfers {
+		if err := fn(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *InMemWalletStore) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	if err := validateAPIKey(k); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.apiKeys[k.ID]; exists {
+		return errAPIKeyExists(k.ID)
+	}
 
-		senderW.Balance -= rawAmt
+	k.CreatedAt = time.Now().UTC()
+	k.RevokedAt = nil
+	if err := s.log(walRecord{Op: walCreateAPIKey, At: k.CreatedAt, APIKey: k}); err != nil {
+		return err
+	}
+	s.apiKeys[k.ID] = copyAPIKey(k)
+	return nil
+}
+
+func (s *InMemWalletStore) GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return nil, errUnknownAPIKey(id)
+	}
+	return copyAPIKey(k), nil
+}
+
+func (s *InMemWalletStore) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]*APIKey, 0, len(s.apiKeys))
+	for _, k := range s.apiKeys {
+		keys = append(keys, copyAPIKey(k))
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
 
-		recW, ok := s.wallets[toAddr]
-		if !ok {
-			senderW.Balance += rawAmt
+func (s *InMemWalletStore) RevokeAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.apiKeys[id]
+	if !ok {
+		return nil, errUnknownAPIKey(id)
+	}
+	if k.RevokedAt == nil {
+		now := time.Now().UTC()
+		if err := s.log(walRecord{Op: walRevokeAPIKey, At: now, KeyID: id}); err != nil {
+			return nil, err
+		}
+		k.RevokedAt = &now
+	}
+	return copyAPIKey(k), nil
+}
+
+// sortAPIKeys orders keys oldest first.
+func sortAPIKeys(keys []*APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
 		}
+		return keys[i].ID < keys[j].ID
+	})
+}
 
-		recW.Balance += rawAmt
-		recW.UpdatedAt = now
-	} else {
-		absAmt := -rawAmt
+func (s *InMemWalletStore) RegisterWalletKey(ctx context.Context, address string, key ed25519.PublicKey) (*WalletKey, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateWalletKey(key); err != nil {
+		return nil, err
+	}
 
-		recW, exists := s.wallets[toAddr]
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		if !exists || recW.Balance < absAmt {
-			return 0, fmt.Errorf("insufficient funds")
+	w, ok := s.wallets[address]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+	if w.publicKey != nil && !w.publicKey.Equal(key) {
+		return nil, errWalletKeyExists(address)
+	}
+	if w.publicKey == nil {
+		if err := s.log(walRecord{Op: walRegisterWalletKey, At: time.Now().UTC(), Address: address, PublicKey: key}); err != nil {
+			return nil, err
 		}
+		w.publicKey = append(ed25519.PublicKey{}, key...)
+	}
+	return w.key(), nil
+}
+
+func (s *InMemWalletStore) GetWalletKey(ctx context.Context, address string) (*WalletKey, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.wallets[address]
+	if !ok {
+		return nil, ErrWalletNotFound
+	}
+	return w.key(), nil
+}
+
+func (s *InMemWalletStore) SetAcceptsTransfers(ctx context.Context, address string, accepts bool) error {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-		recW.Balance -= absAmt
-		recW.UpdatedAt = now
+	w, ok := s.wallets[address]
+	if !ok {
+		return ErrWalletNotFound
+	}
+	if w.accepts == accepts {
+		return nil
+	}
+	if err := s.log(walRecord{Op: walSetAcceptsTransfers, At: time.Now().UTC(), Address: address, Accepts: accepts}); err != nil {
+		return err
+	}
+	w.accepts = accepts
+	return nil
+}
 
-		senderW.Balance += absAmt
+func (s *InMemWalletStore) AcceptsTransfers(ctx context.Context, address string) (bool, error) {
+	address, err := canonicalAddress(address)
+	if err != nil {
+		return false, err
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	senderW.UpdatedAt = now
+	w, ok := s.wallets[address]
+	if !ok {
+		return false, ErrWalletNotFound
+	}
+	return w.accepts, nil
+}
 
-	return senderW.Balance, nil
+// key returns a copy of the key and nonce of w; callers must hold s.mu.
+func (w *inMemWallet) key() *WalletKey {
+	k := &WalletKey{Address: w.address, Nonce: w.nonce}
+	if w.publicKey != nil {
+		k.PublicKey = append(ed25519.PublicKey{}, w.publicKey...)
+	}
+	return k
 }
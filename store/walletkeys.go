@@ -0,0 +1,65 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"fmt"
+)
+
+// WalletKey is the key a wallet signs its transfers with, and the nonce its
+// next transfer carrying one must use.
+type WalletKey struct {
+	Address string
+
+	// PublicKey is nil until a key is registered for the wallet.
+	PublicKey ed25519.PublicKey
+
+	// Nonce counts the transfers that carried a nonce, starting at zero.
+	Nonce uint64
+}
+
+func validateWalletKey(key ed25519.PublicKey) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: an Ed25519 public key is %d bytes, got %d", ErrInvalidArgument, ed25519.PublicKeySize, len(key))
+	}
+	return nil
+}
+
+func errWalletKeyExists(address string) error {
+	return fmt.Errorf("%w: wallet %q already has a different key", ErrConflict, address)
+}
+
+// checkTransferKey decides whether a transfer with opts may leave a wallet
+// holding key, whose next nonce is nonce. Every store calls it in the
+// transaction that moves the funds, so a nonce can only ever be used once.
+// A spender draws on an allowance the owner approved, signed if the owner
+// has a key, so its transfers need no signature of their own.
+func checkTransferKey(key ed25519.PublicKey, nonce uint64, opts TransferOptions) error {
+	return checkSigned(key, nonce, opts.SignedWith, opts.Nonce, opts.Spender == "", "sender", "transfer")
+}
+
+// checkApproveKey decides whether an approval with opts may be given for a
+// wallet holding key, whose next nonce is nonce. An owner with a key only
+// approves spenders with signed approvals, since an allowance lets the
+// spender move funds without a signature.
+func checkApproveKey(key ed25519.PublicKey, nonce uint64, opts ApproveOptions) error {
+	return checkSigned(key, nonce, opts.SignedWith, opts.Nonce, true, "owner", "approval")
+}
+
+// checkSigned checks an operation signed with signedWith and carrying nonce
+// against the key and next nonce of the wallet it acts for, the who of the
+// operation. mustSign is whether a wallet with a key requires it signed.
+func checkSigned(key ed25519.PublicKey, next uint64, signedWith ed25519.PublicKey, nonce *uint64, mustSign bool, who, what string) error {
+	switch {
+	case signedWith != nil && key == nil:
+		return fmt.Errorf("%w: the %s has no key registered", ErrInvalidSignature, who)
+	case signedWith != nil && !key.Equal(signedWith):
+		return fmt.Errorf("%w: signed with a key that is not the %s's", ErrInvalidSignature, who)
+	case signedWith == nil && key != nil && mustSign:
+		return fmt.Errorf("%w: the %s only allows signed %ss", ErrInvalidSignature, who, what)
+	case signedWith != nil && nonce == nil:
+		return fmt.Errorf("%w: a signed %s needs a nonce", ErrInvalidNonce, what)
+	case nonce != nil && *nonce != next:
+		return fmt.Errorf("%w: expected %d, got %d", ErrInvalidNonce, next, *nonce)
+	}
+	return nil
+}